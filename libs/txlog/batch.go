@@ -0,0 +1,62 @@
+package txlog
+
+import (
+	"errors"
+	"time"
+)
+
+var ErrEmptyBatch = errors.New("txlog: empty batch")
+
+// Batcher is implemented by logs that can append several events as one
+// atomic unit: after a crash either all of them are read back or none.
+type Batcher interface {
+	// AppendBatch writes events as a batch and returns the LSN of the last
+	// one. Events get consecutive LSNs.
+	AppendBatch(events []Event) (uint64, error)
+}
+
+// AppendBatch writes a begin marker, events and a commit marker with a single
+// write, so the batch is synced by one fsync and cannot be interleaved with
+// other appends.
+func (l *FileLog) AppendBatch(events []Event) (uint64, error) {
+	if len(events) == 0 {
+		return 0, ErrEmptyBatch
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	lsn := l.lsn
+
+	buf := appendMarker(nil, opcodeBegin, now)
+	for _, e := range events {
+		lsn++
+		e.LSN = lsn
+		if e.Time.IsZero() {
+			e.Time = now
+		}
+
+		var err error
+		buf, err = appendRecord(buf, e)
+		if err != nil {
+			return 0, err
+		}
+	}
+	buf = appendMarker(buf, opcodeCommit, now)
+
+	err := l.write(buf)
+	if err != nil {
+		return 0, err
+	}
+	l.lsn = lsn
+
+	return lsn, l.syncWritten()
+}
+
+// AppendBatch writes events as a batch into the current segment.
+func (l *SegmentedLog) AppendBatch(events []Event) (uint64, error) {
+	return l.appendCurrent(func(current *FileLog) (uint64, error) {
+		return current.AppendBatch(events)
+	})
+}
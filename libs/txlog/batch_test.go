@@ -0,0 +1,116 @@
+package txlog
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileLog_AppendBatch(t *testing.T) {
+	t.Helper()
+
+	logPath := t.TempDir() + "/test.log"
+
+	logFile, err := NewFileLog(logPath)
+	require.NoError(t, err)
+
+	appendEvent(t, logFile, Event{Key: "a", Value: "1", Op: OpSet})
+
+	lsn, err := logFile.AppendBatch([]Event{
+		{Key: "b", Value: "1", Op: OpSet},
+		{Key: "a", Op: OpDelete},
+		{Key: "c", Value: "1", Op: OpSet},
+	})
+	require.NoError(t, err, "AppendBatch should not return error")
+	require.Equal(t, uint64(4), lsn, "AppendBatch should return the LSN of the last event")
+
+	_, err = logFile.AppendBatch(nil)
+	require.ErrorIs(t, err, ErrEmptyBatch)
+
+	_, err = logFile.AppendBatch([]Event{{Key: "d", Value: "1", Op: OpSet}, {Key: "e", Op: "put"}})
+	require.ErrorIs(t, err, ErrUnknownOp, "an invalid event should reject the whole batch")
+
+	require.Equal(t, uint64(5), appendEvent(t, logFile, Event{Key: "d", Value: "1", Op: OpSet}))
+	require.NoError(t, logFile.Close())
+
+	var events []Event
+	_, err = ReadFile(logPath, func(e Event) error {
+		events = append(events, e)
+		return nil
+	})
+	require.NoError(t, err)
+
+	require.Equal(t, []Event{
+		{Key: "a", Value: "1", Op: OpSet},
+		{Key: "b", Value: "1", Op: OpSet},
+		{Key: "a", Op: OpDelete},
+		{Key: "c", Value: "1", Op: OpSet},
+		{Key: "d", Value: "1", Op: OpSet},
+	}, withoutMeta(events), "batch markers should not be returned")
+
+	for i, e := range events {
+		require.Equal(t, uint64(i+1), e.LSN)
+	}
+}
+
+func TestFileLog_UncommittedBatch(t *testing.T) {
+	t.Helper()
+
+	logPath := t.TempDir() + "/test.log"
+
+	logFile, err := NewFileLog(logPath)
+	require.NoError(t, err)
+	appendEvent(t, logFile, Event{Key: "a", Value: "1", Op: OpSet})
+	require.NoError(t, logFile.Close())
+
+	before := fileSize(t, logPath)
+
+	buf := appendMarker(nil, opcodeBegin, time.Now())
+	buf, err = appendRecord(buf, Event{Key: "b", Value: "1", Op: OpSet, LSN: 2})
+	require.NoError(t, err)
+
+	f, err := os.OpenFile(logPath, os.O_APPEND|os.O_WRONLY, 0o644)
+	require.NoError(t, err)
+	_, err = f.Write(buf)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	stats, err := ReadFile(logPath, func(e Event) error {
+		require.Equal(t, "a", e.Key, "events of an uncommitted batch should not be returned")
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, 1, stats.Events)
+	require.Equal(t, 1, stats.Skipped, "uncommitted batch should be reported as a truncated tail")
+
+	logFile, err = NewFileLog(logPath)
+	require.NoError(t, err)
+	defer logFile.Close()
+
+	require.Equal(t, int64(len(buf)), logFile.TruncatedBytes(), "the whole uncommitted batch should be truncated")
+	require.Equal(t, before, fileSize(t, logPath))
+	require.Equal(t, uint64(2), appendEvent(t, logFile, Event{Key: "c", Value: "1", Op: OpSet}))
+}
+
+func TestSegmentedLog_AppendBatch(t *testing.T) {
+	t.Helper()
+
+	dir := t.TempDir()
+
+	l, err := OpenSegmentedLog(dir, WithMaxSegmentSize(64))
+	require.NoError(t, err)
+
+	for i := 0; i < 3; i++ {
+		_, err = l.AppendBatch([]Event{
+			{Key: "x", Value: "1", Op: OpSet},
+			{Key: "y", Value: "1", Op: OpSet},
+		})
+		require.NoError(t, err)
+	}
+	require.Len(t, l.Segments(), 3, "a batch should never be split across segments")
+	require.NoError(t, l.Close())
+
+	require.Len(t, readAll(t, dir), 6)
+}
@@ -0,0 +1,305 @@
+package txlog
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+// TombstoneGrace is how long compaction keeps the latest delete of a key
+// that carries a stamp. Such a delete is what keeps a delayed older stamped
+// write from bringing the key back, on this log or a replica that missed
+// the delete.
+const TombstoneGrace = 24 * time.Hour
+
+// liveTombstone reports whether e is a stamped delete that compaction has to
+// keep at now.
+func liveTombstone(e Event, now time.Time) bool {
+	return e.Op == OpDelete && e.Stamp != 0 && now.Sub(e.Time) < TombstoneGrace
+}
+
+// Compactor is implemented by logs that can drop superseded records while
+// they are in use.
+type Compactor interface {
+	Compact() (CompactStats, error)
+}
+
+// CompactOrder defines the order of the surviving records in a compacted log.
+type CompactOrder int
+
+const (
+	// CompactLogOrder keeps surviving records in the order they were written.
+	CompactLogOrder CompactOrder = iota
+	// CompactKeyOrder sorts surviving records by key. The log is then no
+	// longer in LSN order: a Reader returns the compacted records in key
+	// order, then the ones appended since. Readers that need LSN order have
+	// to sort the records, and TruncateAfter cannot be used on such a log.
+	CompactKeyOrder
+)
+
+type CompactStats struct {
+	RecordsIn      int   `json:"records_in"`
+	RecordsOut     int   `json:"records_out"`
+	BytesIn        int64 `json:"bytes_in"`
+	BytesOut       int64 `json:"bytes_out"`
+	BytesReclaimed int64 `json:"bytes_reclaimed"`
+}
+
+func (s *CompactStats) add(other CompactStats) {
+	s.RecordsIn += other.RecordsIn
+	s.RecordsOut += other.RecordsOut
+	s.BytesIn += other.BytesIn
+	s.BytesOut += other.BytesOut
+	s.BytesReclaimed += other.BytesReclaimed
+}
+
+// WithCompactOrder sets the record order used by FileLog.Compact.
+func WithCompactOrder(order CompactOrder) Option {
+	return func(l *FileLog) {
+		l.compactOrder = order
+	}
+}
+
+// CompactLogFile rewrites a closed log keeping only the latest set of every
+// live key and the stamped deletes younger than TombstoneGrace. Surviving
+// records are copied byte for byte, so their metadata is preserved, and the
+// result is the same for the same input.
+func CompactLogFile(path string, order CompactOrder) (CompactStats, error) {
+	var stats CompactStats
+
+	r, err := OpenReader(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return stats, nil
+		}
+		return stats, fmt.Errorf("txlog: open for compaction: %w", err)
+	}
+	defer r.Close()
+
+	latest, err := collectLatest(r)
+	if err != nil {
+		return stats, err
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return stats, fmt.Errorf("txlog: stat for compaction: %w", err)
+	}
+
+	tmpPath := path + ".compact"
+	tmpLog, err := createFileLog(tmpPath)
+	if err != nil {
+		return stats, fmt.Errorf("txlog: open temp file for compaction: %w", err)
+	}
+
+	stats, err = writeLatest(tmpLog, latest, order)
+	if err != nil {
+		tmpLog.Close()
+		os.Remove(tmpPath)
+		return stats, err
+	}
+
+	err = tmpLog.Close()
+	if err != nil {
+		os.Remove(tmpPath)
+		return stats, fmt.Errorf("txlog: close temp log during compaction: %w", err)
+	}
+
+	err = os.Rename(tmpPath, path)
+	if err != nil {
+		return stats, fmt.Errorf("txlog: rename compacted log: %w", err)
+	}
+
+	err = syncDir(filepath.Dir(path))
+	if err != nil {
+		return stats, err
+	}
+
+	stats.BytesIn = info.Size()
+	stats.BytesReclaimed = stats.BytesIn - stats.BytesOut
+
+	return stats, nil
+}
+
+// Compact rewrites the log keeping only the latest set of every live key
+// and the stamped deletes younger than TombstoneGrace, without blocking
+// appenders for the bulk of the work. Records up to the current end of the
+// file are compacted into a temporary file; then, with appends paused, the
+// records written in the meantime are copied verbatim after them and the
+// temporary file atomically replaces the log.
+func (l *FileLog) Compact() (CompactStats, error) {
+	var stats CompactStats
+
+	l.mu.Lock()
+	snapshotSize := l.size
+	l.mu.Unlock()
+
+	src, err := os.Open(l.path)
+	if err != nil {
+		return stats, fmt.Errorf("txlog: open for compaction: %w", err)
+	}
+	defer src.Close()
+
+	latest, err := collectLatest(NewReader(io.NewSectionReader(src, 0, snapshotSize)))
+	if err != nil {
+		return stats, err
+	}
+
+	tmpPath := l.path + ".compact"
+	tmpLog, err := createFileLog(tmpPath)
+	if err != nil {
+		return stats, fmt.Errorf("txlog: open temp file for compaction: %w", err)
+	}
+
+	stats, err = writeLatest(tmpLog, latest, l.compactOrder)
+	if err != nil {
+		tmpLog.Close()
+		os.Remove(tmpPath)
+		return stats, err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	err = l.swapIn(tmpLog, src, snapshotSize)
+	if err != nil {
+		tmpLog.Close()
+		os.Remove(tmpPath)
+		return stats, err
+	}
+
+	stats.BytesIn = snapshotSize
+	stats.BytesReclaimed = stats.BytesIn - stats.BytesOut
+
+	return stats, nil
+}
+
+// swapIn appends the records written to src after offset to tmp and
+// replaces the log file with tmp. Must be called with l.mu held.
+func (l *FileLog) swapIn(tmp *FileLog, src *os.File, offset int64) error {
+	for l.syncing {
+		l.cond.Wait()
+	}
+
+	tail := io.NewSectionReader(src, offset, l.size-offset)
+
+	copied, err := io.Copy(tmp.file, tail)
+	if err != nil {
+		return fmt.Errorf("txlog: copy log tail: %w", err)
+	}
+
+	err = tmp.file.Sync()
+	if err != nil {
+		return fmt.Errorf("txlog: sync compacted log: %w", err)
+	}
+
+	file, err := os.OpenFile(tmp.path, os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return fmt.Errorf("txlog: reopen compacted log: %w", err)
+	}
+
+	err = os.Rename(tmp.path, l.path)
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("txlog: rename compacted log: %w", err)
+	}
+
+	err = syncDir(filepath.Dir(l.path))
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	tmp.file.Close()
+	l.file.Close()
+
+	l.file = file
+	l.size = tmp.size + copied
+	l.synced = l.written
+
+	return nil
+}
+
+type compactEntry struct {
+	index int
+	key   string
+	live  bool
+	raw   []byte
+}
+
+type latestRecords struct {
+	entries map[string]compactEntry
+	total   int
+}
+
+// collectLatest reads r to the end and keeps the last record of every key.
+// A truncated tail is ignored; corruption aborts the compaction.
+func collectLatest(r *Reader) (latestRecords, error) {
+	latest := latestRecords{
+		entries: make(map[string]compactEntry),
+	}
+	now := time.Now()
+
+	for r.Next() {
+		ev := r.Event()
+
+		raw, err := r.rawRecord()
+		if err != nil {
+			return latest, err
+		}
+
+		latest.entries[ev.Key] = compactEntry{
+			index: latest.total,
+			key:   ev.Key,
+			live:  ev.Op == OpSet || liveTombstone(ev, now),
+			raw:   raw,
+		}
+		latest.total++
+	}
+
+	err := r.Err()
+	if err != nil && !errors.Is(err, ErrTruncated) {
+		return latest, fmt.Errorf("txlog: read for compaction: %w", err)
+	}
+
+	return latest, nil
+}
+
+func writeLatest(w *FileLog, latest latestRecords, order CompactOrder) (CompactStats, error) {
+	stats := CompactStats{
+		RecordsIn: latest.total,
+	}
+
+	// The final record is kept even if it is a delete, so that the highest
+	// LSN survives and numbering continues from it after a restart.
+	survivors := make([]compactEntry, 0, len(latest.entries))
+	for _, entry := range latest.entries {
+		if entry.live || entry.index == latest.total-1 {
+			survivors = append(survivors, entry)
+		}
+	}
+
+	slices.SortFunc(survivors, func(a, b compactEntry) int {
+		if order == CompactKeyOrder {
+			return cmp.Compare(a.key, b.key)
+		}
+		return cmp.Compare(a.index, b.index)
+	})
+
+	for _, entry := range survivors {
+		err := w.appendRaw(entry.raw)
+		if err != nil {
+			return stats, fmt.Errorf("txlog: append during compaction: %w", err)
+		}
+	}
+
+	stats.RecordsOut = len(survivors)
+	stats.BytesOut = w.Size()
+
+	return stats, nil
+}
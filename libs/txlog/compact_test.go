@@ -0,0 +1,193 @@
+package txlog
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileLog_CompactOnline(t *testing.T) {
+	t.Helper()
+
+	logPath := t.TempDir() + "/test.log"
+
+	logFile, err := NewFileLog(logPath, WithDurability(DurabilityGroupCommit))
+	require.NoError(t, err)
+
+	for i := 0; i < 100; i++ {
+		appendEvent(t, logFile, Event{Key: fmt.Sprintf("key%d", i%10), Value: fmt.Sprint(i), Op: OpSet})
+	}
+	appendEvent(t, logFile, Event{Key: "key0", Op: OpDelete})
+
+	before, err := os.Stat(logPath)
+	require.NoError(t, err)
+
+	var appendErr error
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 200; i++ {
+			_, err := logFile.Append(Event{Key: fmt.Sprintf("live%d", i), Value: "v", Op: OpSet})
+			if err != nil {
+				appendErr = err
+				return
+			}
+		}
+	}()
+
+	stats, err := logFile.Compact()
+	wg.Wait()
+	require.NoError(t, err, "Compact should not return error")
+	require.NoError(t, appendErr, "Append during compaction should not return error")
+
+	require.GreaterOrEqual(t, stats.RecordsIn, 101, "all records written before compaction should be read")
+	require.Equal(t, stats.BytesIn-stats.BytesOut, stats.BytesReclaimed)
+	require.Positive(t, stats.BytesReclaimed)
+
+	appendEvent(t, logFile, Event{Key: "after", Value: "compact", Op: OpSet})
+	require.Equal(t, logFile.Size(), fileSize(t, logPath), "Size should match the swapped file")
+	require.NoError(t, logFile.Close())
+
+	state := make(map[string]string)
+	readStats, err := ReadFile(logPath, func(e Event) error {
+		switch e.Op {
+		case OpSet:
+			state[e.Key] = e.Value
+		case OpDelete:
+			delete(state, e.Key)
+		}
+		return nil
+	})
+	require.NoError(t, err)
+
+	require.Len(t, state, 9+200+1, "no write should be lost by online compaction")
+	require.Equal(t, "99", state["key9"])
+	require.NotContains(t, state, "key0")
+	require.Equal(t, "compact", state["after"])
+	require.LessOrEqual(t, readStats.Events, 9+200+1+1, "superseded records should be dropped, a trailing delete may be kept")
+	require.Less(t, fileSize(t, logPath), before.Size()+int64(201*20), "compacted log should be smaller")
+}
+
+func fileSize(t *testing.T, path string) int64 {
+	t.Helper()
+
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	return info.Size()
+}
+
+func writeEvents(t *testing.T, path string, events []Event) {
+	t.Helper()
+
+	logFile, err := NewFileLog(path)
+	require.NoError(t, err)
+	for i, ev := range events {
+		// A fixed timestamp keeps the written file reproducible.
+		ev.Time = time.Unix(int64(i), 0)
+		appendEvent(t, logFile, ev)
+	}
+	require.NoError(t, logFile.Close())
+}
+
+func TestCompactLogFile(t *testing.T) {
+	t.Helper()
+
+	dir := t.TempDir()
+
+	events := []Event{
+		{Key: "zeta", Value: "1", Op: OpSet},
+		{Key: "alpha", Value: "1", Op: OpSet},
+		{Key: "mid", Value: "1", Op: OpSet},
+		{Key: "zeta", Value: "2", Op: OpSet},
+		{Key: "gone", Value: "1", Op: OpSet},
+		{Key: "gone", Op: OpDelete},
+		{Key: "beta", Value: "1", Op: OpSet},
+	}
+
+	first, second := dir+"/first.log", dir+"/second.log"
+	writeEvents(t, first, events)
+	writeEvents(t, second, events)
+
+	stats, err := CompactLogFile(first, CompactLogOrder)
+	require.NoError(t, err, "CompactLogFile should not return error")
+	_, err = CompactLogFile(second, CompactLogOrder)
+	require.NoError(t, err)
+
+	require.Equal(t, 7, stats.RecordsIn)
+	require.Equal(t, 4, stats.RecordsOut)
+	require.Equal(t, fileSize(t, first), stats.BytesOut)
+	require.Equal(t, stats.BytesIn-stats.BytesOut, stats.BytesReclaimed)
+	require.Positive(t, stats.BytesReclaimed)
+
+	a, err := os.ReadFile(first)
+	require.NoError(t, err)
+	b, err := os.ReadFile(second)
+	require.NoError(t, err)
+	require.Equal(t, a, b, "compacting the same log should produce identical files")
+
+	require.Equal(t, []Event{
+		{Key: "alpha", Value: "1", Op: OpSet},
+		{Key: "mid", Value: "1", Op: OpSet},
+		{Key: "zeta", Value: "2", Op: OpSet},
+		{Key: "beta", Value: "1", Op: OpSet},
+	}, readAll(t, first), "surviving records should keep log order")
+
+	_, err = CompactLogFile(second, CompactKeyOrder)
+	require.NoError(t, err)
+
+	require.Equal(t, []Event{
+		{Key: "alpha", Value: "1", Op: OpSet},
+		{Key: "beta", Value: "1", Op: OpSet},
+		{Key: "mid", Value: "1", Op: OpSet},
+		{Key: "zeta", Value: "2", Op: OpSet},
+	}, readAll(t, second), "surviving records should be sorted by key")
+
+	_, err = os.Stat(first + ".compact")
+	require.ErrorIs(t, err, os.ErrNotExist, "temp file should not be left behind")
+}
+
+func TestFileLog_CompactKeepsTombstones(t *testing.T) {
+	t.Helper()
+
+	logPath := t.TempDir() + "/test.log"
+
+	logFile, err := NewFileLog(logPath)
+	require.NoError(t, err)
+
+	for _, key := range []string{"plain", "recent", "old"} {
+		appendEvent(t, logFile, Event{Key: key, Value: "v", Op: OpSet})
+	}
+	appendEvent(t, logFile, Event{Key: "plain", Op: OpDelete})
+	appendEvent(t, logFile, Event{Key: "recent", Op: OpDelete, Stamp: 7})
+
+	old := time.Now().Add(-TombstoneGrace - time.Minute)
+	_, err = logFile.AppendReplicated(Event{Key: "old", Op: OpDelete, Stamp: 8, LSN: 6, Time: old})
+	require.NoError(t, err)
+	appendEvent(t, logFile, Event{Key: "live", Value: "v", Op: OpSet})
+
+	_, err = logFile.Compact()
+	require.NoError(t, err)
+	require.NoError(t, logFile.Close())
+
+	var kept []string
+	_, err = ReadFile(logPath, func(e Event) error {
+		kept = append(kept, e.Op+" "+e.Key)
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, []string{"delete recent", "set live"}, kept,
+		"only stamped deletes younger than the grace period should survive")
+}
+
+func TestCompactLogFile_Missing(t *testing.T) {
+	t.Helper()
+
+	stats, err := CompactLogFile(t.TempDir()+"/missing.log", CompactLogOrder)
+	require.NoError(t, err)
+	require.Zero(t, stats.RecordsIn)
+}
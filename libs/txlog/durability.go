@@ -0,0 +1,126 @@
+package txlog
+
+import (
+	"fmt"
+	"time"
+)
+
+// Durability defines when FileLog.Append considers an event durable.
+type Durability int
+
+const (
+	// DurabilityNever leaves flushing to the OS; the file is synced on Close.
+	DurabilityNever Durability = iota
+	// DurabilityAlways fsyncs after every Append.
+	DurabilityAlways
+	// DurabilityGroupCommit fsyncs before Append returns, sharing one fsync
+	// between all appenders that are waiting at the same time.
+	DurabilityGroupCommit
+	// DurabilityInterval fsyncs in the background every sync interval.
+	DurabilityInterval
+)
+
+const DefaultSyncInterval = 100 * time.Millisecond
+
+func (d Durability) String() string {
+	switch d {
+	case DurabilityNever:
+		return "never"
+	case DurabilityAlways:
+		return "always"
+	case DurabilityGroupCommit:
+		return "group"
+	case DurabilityInterval:
+		return "interval"
+	}
+	return fmt.Sprintf("Durability(%d)", int(d))
+}
+
+func ParseDurability(s string) (Durability, error) {
+	for _, d := range []Durability{DurabilityNever, DurabilityAlways, DurabilityGroupCommit, DurabilityInterval} {
+		if d.String() == s {
+			return d, nil
+		}
+	}
+	return 0, fmt.Errorf("txlog: unknown durability mode %q", s)
+}
+
+type Option func(l *FileLog)
+
+func WithDurability(d Durability) Option {
+	return func(l *FileLog) {
+		l.durability = d
+	}
+}
+
+// WithSyncInterval sets the fsync period for DurabilityInterval.
+func WithSyncInterval(interval time.Duration) Option {
+	return func(l *FileLog) {
+		l.syncInterval = interval
+	}
+}
+
+// syncThrough blocks until every record up to seq is on disk. Only one fsync
+// runs at a time; appenders arriving meanwhile wait for the next one, which
+// then covers all of them. Must be called with l.mu held.
+func (l *FileLog) syncThrough(seq uint64) error {
+	for l.synced < seq {
+		if l.syncErr != nil {
+			return l.syncErr
+		}
+
+		if l.syncing {
+			l.cond.Wait()
+			continue
+		}
+
+		l.syncing = true
+		target := l.written
+		file := l.file
+
+		l.mu.Unlock()
+		err := file.Sync()
+		l.mu.Lock()
+
+		l.syncing = false
+		l.syncs++
+		if err != nil {
+			l.syncErr = fmt.Errorf("txlog: sync file: %w", err)
+		} else if target > l.synced {
+			l.synced = target
+		}
+		l.cond.Broadcast()
+	}
+
+	return l.syncErr
+}
+
+func (l *FileLog) runSyncLoop() {
+	defer close(l.loopDone)
+
+	ticker := time.NewTicker(l.syncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+			l.mu.Lock()
+			_ = l.syncThrough(l.written)
+			l.mu.Unlock()
+		}
+	}
+}
+
+func (l *FileLog) Durability() Durability {
+	return l.durability
+}
+
+// SyncCount returns how many fsyncs the log has issued.
+func (l *FileLog) SyncCount() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.syncs
+}
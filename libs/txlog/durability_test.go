@@ -0,0 +1,104 @@
+package txlog
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseDurability(t *testing.T) {
+	t.Helper()
+
+	for _, d := range []Durability{DurabilityNever, DurabilityAlways, DurabilityGroupCommit, DurabilityInterval} {
+		parsed, err := ParseDurability(d.String())
+		require.NoError(t, err)
+		require.Equal(t, d, parsed, "ParseDurability should invert String")
+	}
+
+	_, err := ParseDurability("sometimes")
+	require.Error(t, err, "unknown mode should be rejected")
+}
+
+func TestFileLog_DurabilityAlways(t *testing.T) {
+	t.Helper()
+
+	logFile, err := NewFileLog(t.TempDir()+"/test.log", WithDurability(DurabilityAlways))
+	require.NoError(t, err)
+	defer logFile.Close()
+
+	for i := 0; i < 5; i++ {
+		appendEvent(t, logFile, Event{Key: "key", Value: "v", Op: OpSet})
+	}
+
+	require.Equal(t, uint64(5), logFile.SyncCount(), "every append should be synced")
+}
+
+func TestFileLog_DurabilityGroupCommit(t *testing.T) {
+	t.Helper()
+
+	logPath := t.TempDir() + "/test.log"
+
+	logFile, err := NewFileLog(logPath, WithDurability(DurabilityGroupCommit))
+	require.NoError(t, err)
+
+	const writers, perWriter = 16, 50
+
+	errs := make(chan error, writers)
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < perWriter; i++ {
+				_, err := logFile.Append(Event{Key: fmt.Sprintf("k%d-%d", w, i), Value: "v", Op: OpSet})
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+
+	syncs := logFile.SyncCount()
+	require.Positive(t, syncs, "group commit should fsync")
+	require.LessOrEqual(t, syncs, uint64(writers*perWriter), "group commit should not fsync more than once per append")
+
+	logFile.mu.Lock()
+	require.Equal(t, logFile.written, logFile.synced, "all acknowledged appends should be synced")
+	logFile.mu.Unlock()
+
+	require.NoError(t, logFile.Close())
+
+	stats, err := ReadFile(logPath, func(e Event) error {
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, writers*perWriter, stats.Events)
+}
+
+func TestFileLog_DurabilityInterval(t *testing.T) {
+	t.Helper()
+
+	logFile, err := NewFileLog(t.TempDir()+"/test.log",
+		WithDurability(DurabilityInterval),
+		WithSyncInterval(10*time.Millisecond))
+	require.NoError(t, err)
+	defer logFile.Close()
+
+	appendEvent(t, logFile, Event{Key: "key", Value: "v", Op: OpSet})
+
+	require.Eventually(t, func() bool {
+		logFile.mu.Lock()
+		defer logFile.mu.Unlock()
+		return logFile.synced == logFile.written
+	}, time.Second, 5*time.Millisecond, "background loop should sync appended records")
+}
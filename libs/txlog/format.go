@@ -0,0 +1,269 @@
+package txlog
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"time"
+)
+
+// Log files start with an 8-byte header: the magic "TXLG", a format version
+// byte and three reserved bytes. Files without the header are v1 text logs.
+//
+// A v2 record is
+//
+//	uvarint(len(payload)) payload crc32c(payload, little endian)
+//
+// where payload is
+//
+//	opcode uvarint(len(key)) key uvarint(len(value)) value fields...
+//
+// and every optional metadata field is uvarint(tag) uvarint(len) data.
+// A batch is a begin marker, its records and a commit marker, all written
+// at once; markers are records with an empty key and value.
+// Readers skip fields with unknown tags. Known fields are the LSN (uvarint),
+// the append time and the expiry time (both varint Unix nanoseconds), the
+// consensus term and the client stamp (both uvarint).
+const (
+	headerSize = 8
+
+	FormatV1 = 1
+	FormatV2 = 2
+
+	maxFieldsSize  = 1024
+	maxPayloadSize = 1 + 2*binary.MaxVarintLen64 + MaxKeySize + MaxValueSize + maxFieldsSize
+	maxRecordSize  = binary.MaxVarintLen64 + maxPayloadSize + crcSize
+)
+
+const (
+	OpSet    = "set"
+	OpDelete = "delete"
+	// OpExpire removes a key whose expiry time has passed.
+	OpExpire = "expire"
+	// OpNoop changes no key. A consensus leader writes one when it is
+	// elected, to commit the records of earlier terms.
+	OpNoop = "noop"
+	// OpConfig changes no key either; its value holds the membership of a
+	// consensus group.
+	OpConfig = "config"
+)
+
+const (
+	opcodeSet    byte = 1
+	opcodeDelete byte = 2
+	opcodeBegin  byte = 3
+	opcodeCommit byte = 4
+	opcodeExpire byte = 5
+	opcodeNoop   byte = 6
+	opcodeConfig byte = 7
+)
+
+// Ops of batch markers. Reader consumes them and never returns them.
+const (
+	opBegin  = "begin"
+	opCommit = "commit"
+)
+
+const (
+	tagLSN     = 1
+	tagTime    = 2
+	tagExpires = 3
+	tagTerm    = 4
+	tagStamp   = 5
+)
+
+var (
+	ErrUnknownOp    = errors.New("txlog: unknown operation")
+	ErrLegacyFormat = errors.New("txlog: log uses v1 format, migrate it with MigrateFile")
+)
+
+var magic = [4]byte{'T', 'X', 'L', 'G'}
+
+func fileHeader() []byte {
+	header := make([]byte, headerSize)
+	copy(header, magic[:])
+	header[4] = FormatV2
+	return header
+}
+
+func opcodeOf(op string) (byte, error) {
+	switch op {
+	case OpSet:
+		return opcodeSet, nil
+	case OpDelete:
+		return opcodeDelete, nil
+	case OpExpire:
+		return opcodeExpire, nil
+	case OpNoop:
+		return opcodeNoop, nil
+	case OpConfig:
+		return opcodeConfig, nil
+	}
+	return 0, fmt.Errorf("%w %q", ErrUnknownOp, op)
+}
+
+func opOf(code byte) (string, error) {
+	switch code {
+	case opcodeSet:
+		return OpSet, nil
+	case opcodeDelete:
+		return OpDelete, nil
+	case opcodeBegin:
+		return opBegin, nil
+	case opcodeCommit:
+		return opCommit, nil
+	case opcodeExpire:
+		return OpExpire, nil
+	case opcodeNoop:
+		return OpNoop, nil
+	case opcodeConfig:
+		return OpConfig, nil
+	}
+	return "", fmt.Errorf("unknown opcode %d", code)
+}
+
+func appendRecord(buf []byte, e Event) ([]byte, error) {
+	if len(e.Key) > MaxKeySize {
+		return buf, ErrKeyTooLarge
+	}
+
+	if len(e.Value) > MaxValueSize {
+		return buf, ErrValueTooLarge
+	}
+
+	code, err := opcodeOf(e.Op)
+	if err != nil {
+		return buf, err
+	}
+
+	return encodeRecord(buf, code, e), nil
+}
+
+// appendMarker appends a batch marker record.
+func appendMarker(buf []byte, code byte, t time.Time) []byte {
+	return encodeRecord(buf, code, Event{Time: t})
+}
+
+func encodeRecord(buf []byte, code byte, e Event) []byte {
+	payload := make([]byte, 0, 1+2*binary.MaxVarintLen64+len(e.Key)+len(e.Value))
+	payload = append(payload, code)
+	payload = binary.AppendUvarint(payload, uint64(len(e.Key)))
+	payload = append(payload, e.Key...)
+	payload = binary.AppendUvarint(payload, uint64(len(e.Value)))
+	payload = append(payload, e.Value...)
+
+	if e.LSN != 0 {
+		payload = appendField(payload, tagLSN, binary.AppendUvarint(nil, e.LSN))
+	}
+	if !e.Time.IsZero() {
+		payload = appendField(payload, tagTime, binary.AppendVarint(nil, e.Time.UnixNano()))
+	}
+	if !e.ExpiresAt.IsZero() {
+		payload = appendField(payload, tagExpires, binary.AppendVarint(nil, e.ExpiresAt.UnixNano()))
+	}
+	if e.Term != 0 {
+		payload = appendField(payload, tagTerm, binary.AppendUvarint(nil, e.Term))
+	}
+	if e.Stamp != 0 {
+		payload = appendField(payload, tagStamp, binary.AppendUvarint(nil, e.Stamp))
+	}
+
+	buf = binary.AppendUvarint(buf, uint64(len(payload)))
+	buf = append(buf, payload...)
+	buf = binary.LittleEndian.AppendUint32(buf, crc32.Checksum(payload, crcTable))
+
+	return buf
+}
+
+func decodePayload(payload []byte) (Event, error) {
+	var ev Event
+
+	if len(payload) == 0 {
+		return ev, errors.New("empty payload")
+	}
+
+	op, err := opOf(payload[0])
+	if err != nil {
+		return ev, err
+	}
+	rest := payload[1:]
+
+	key, rest, err := readChunk(rest, MaxKeySize)
+	if err != nil {
+		return ev, fmt.Errorf("key: %w", err)
+	}
+
+	value, rest, err := readChunk(rest, MaxValueSize)
+	if err != nil {
+		return ev, fmt.Errorf("value: %w", err)
+	}
+
+	for len(rest) > 0 {
+		tag, n := binary.Uvarint(rest)
+		if n <= 0 {
+			return ev, errors.New("invalid field tag")
+		}
+
+		var data []byte
+		data, rest, err = readChunk(rest[n:], maxFieldsSize)
+		if err != nil {
+			return ev, fmt.Errorf("field: %w", err)
+		}
+
+		switch tag {
+		case tagLSN:
+			lsn, n := binary.Uvarint(data)
+			if n != len(data) {
+				return ev, errors.New("invalid lsn field")
+			}
+			ev.LSN = lsn
+		case tagTime:
+			nanos, n := binary.Varint(data)
+			if n != len(data) {
+				return ev, errors.New("invalid time field")
+			}
+			ev.Time = time.Unix(0, nanos)
+		case tagExpires:
+			nanos, n := binary.Varint(data)
+			if n != len(data) {
+				return ev, errors.New("invalid expiry field")
+			}
+			ev.ExpiresAt = time.Unix(0, nanos)
+		case tagTerm:
+			term, n := binary.Uvarint(data)
+			if n != len(data) {
+				return ev, errors.New("invalid term field")
+			}
+			ev.Term = term
+		case tagStamp:
+			stamp, n := binary.Uvarint(data)
+			if n != len(data) {
+				return ev, errors.New("invalid stamp field")
+			}
+			ev.Stamp = stamp
+		}
+	}
+
+	ev.Op = op
+	ev.Key = string(key)
+	ev.Value = string(value)
+
+	return ev, nil
+}
+
+func appendField(buf []byte, tag uint64, data []byte) []byte {
+	buf = binary.AppendUvarint(buf, tag)
+	buf = binary.AppendUvarint(buf, uint64(len(data)))
+	return append(buf, data...)
+}
+
+func readChunk(data []byte, limit int) ([]byte, []byte, error) {
+	size, n := binary.Uvarint(data)
+	if n <= 0 || size > uint64(limit) || size > uint64(len(data)-n) {
+		return nil, nil, errors.New("invalid length")
+	}
+
+	end := n + int(size)
+	return data[n:end], data[end:], nil
+}
@@ -0,0 +1,94 @@
+package txlog
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// MigrateFile rewrites a v1 text log at path into the v2 binary format. The
+// new file is fully written and synced before it atomically replaces the old
+// one. It reports whether a migration took place; missing, empty and v2 logs
+// are left untouched. A truncated v1 tail is dropped, mid-file corruption
+// aborts the migration. Migrated records are numbered from LSN 1 and have no
+// timestamp.
+func MigrateFile(path string) (bool, error) {
+	r, err := OpenReader(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return false, nil
+		}
+		return false, err
+	}
+	defer r.Close()
+
+	ok := r.Next()
+	if r.Version() != FormatV1 {
+		return false, nil
+	}
+
+	tmpPath := path + ".migrate"
+	tmpLog, err := createFileLog(tmpPath)
+	if err != nil {
+		return false, fmt.Errorf("txlog: open temp file for migration: %w", err)
+	}
+
+	var lsn uint64
+	for ; ok; ok = r.Next() {
+		ev := r.Event()
+		lsn++
+		ev.LSN = lsn
+
+		var buf []byte
+		buf, err = appendRecord(nil, ev)
+		if err == nil {
+			err = tmpLog.appendRaw(buf)
+		}
+		if err != nil {
+			break
+		}
+	}
+
+	if err == nil {
+		err = r.Err()
+	}
+
+	if err != nil && !errors.Is(err, ErrTruncated) {
+		tmpLog.Close()
+		os.Remove(tmpPath)
+		return false, fmt.Errorf("txlog: migrate record: %w", err)
+	}
+
+	err = tmpLog.Close()
+	if err != nil {
+		os.Remove(tmpPath)
+		return false, fmt.Errorf("txlog: close temp log during migration: %w", err)
+	}
+
+	err = os.Rename(tmpPath, path)
+	if err != nil {
+		return false, fmt.Errorf("txlog: rename migrated log: %w", err)
+	}
+
+	err = syncDir(filepath.Dir(path))
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("txlog: open dir %q: %w", dir, err)
+	}
+	defer d.Close()
+
+	err = d.Sync()
+	if err != nil {
+		return fmt.Errorf("txlog: sync dir %q: %w", dir, err)
+	}
+	return nil
+}
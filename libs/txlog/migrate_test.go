@@ -0,0 +1,91 @@
+package txlog
+
+import (
+	"fmt"
+	"hash/crc32"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func v1Line(op, key, value string) string {
+	payload := fmt.Sprintf("%s %d %d %s%s", op, len(key), len(value), key, value)
+	return fmt.Sprintf("%s %08x\n", payload, crc32.Checksum([]byte(payload), crcTable))
+}
+
+func TestMigrateFile(t *testing.T) {
+	t.Helper()
+
+	logPath := t.TempDir() + "/kv.log"
+
+	v1 := "set 5 5 user1Alice\n" +
+		v1Line("set", "multi", "a\nb") +
+		v1Line("delete", "user1", "") +
+		"set 5 3 us"
+	require.NoError(t, os.WriteFile(logPath, []byte(v1), 0o644))
+
+	_, err := NewFileLog(logPath)
+	require.ErrorIs(t, err, ErrLegacyFormat, "NewFileLog should refuse to append to a v1 log")
+
+	data, err := os.ReadFile(logPath)
+	require.NoError(t, err)
+	require.Equal(t, v1, string(data), "NewFileLog should leave a v1 log and its torn tail untouched")
+
+	migrated, err := MigrateFile(logPath)
+	require.NoError(t, err, "MigrateFile should not return error")
+	require.True(t, migrated, "v1 log should be migrated")
+
+	r, err := OpenReader(logPath)
+	require.NoError(t, err)
+
+	var events []Event
+	for r.Next() {
+		events = append(events, r.Event())
+	}
+	require.NoError(t, r.Err())
+	require.Equal(t, FormatV2, r.Version(), "migrated log should use v2 format")
+	require.NoError(t, r.Close())
+
+	require.Equal(t, []Event{
+		{Key: "user1", Value: "Alice", Op: OpSet},
+		{Key: "multi", Value: "a\nb", Op: OpSet},
+		{Key: "user1", Value: "", Op: OpDelete},
+	}, withoutMeta(events), "migrated log should contain the same events")
+	require.Equal(t, []uint64{1, 2, 3}, []uint64{events[0].LSN, events[1].LSN, events[2].LSN}, "migrated records should be numbered from 1")
+
+	migrated, err = MigrateFile(logPath)
+	require.NoError(t, err)
+	require.False(t, migrated, "v2 log should not be migrated again")
+
+	logFile, err := NewFileLog(logPath)
+	require.NoError(t, err, "NewFileLog should open the migrated log")
+	require.NoError(t, logFile.Close())
+
+	_, err = os.Stat(logPath + ".migrate")
+	require.ErrorIs(t, err, os.ErrNotExist, "temp file should not be left behind")
+}
+
+func TestMigrateFile_Missing(t *testing.T) {
+	t.Helper()
+
+	migrated, err := MigrateFile(t.TempDir() + "/missing.log")
+	require.NoError(t, err)
+	require.False(t, migrated)
+}
+
+func TestMigrateFile_Corrupt(t *testing.T) {
+	t.Helper()
+
+	logPath := t.TempDir() + "/kv.log"
+
+	v1 := "set x 5 user1Alice\n" + v1Line("set", "user2", "Bob")
+	require.NoError(t, os.WriteFile(logPath, []byte(v1), 0o644))
+
+	_, err := MigrateFile(logPath)
+	require.ErrorIs(t, err, ErrCorruptRecord, "corrupt v1 log should not be migrated")
+
+	data, err := os.ReadFile(logPath)
+	require.NoError(t, err)
+	require.Equal(t, v1, string(data), "original log should be left untouched")
+}
@@ -0,0 +1,106 @@
+package txlog
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"slices"
+)
+
+// Position locates a record of a SegmentedLog, so that it can be read back
+// with ReadRecordAt without scanning the segment.
+type Position struct {
+	Segment uint64
+	// Offset is where the record starts in the segment file and Size is
+	// its encoded length.
+	Offset int64
+	Size   int64
+}
+
+// AppendPosition is Append that also returns where the record was stored.
+func (l *SegmentedLog) AppendPosition(e Event) (uint64, Position, error) {
+	var pos Position
+
+	lsn, err := l.appendCurrent(func(current *FileLog) (uint64, error) {
+		lsn, p, err := current.append(e)
+		p.Segment = l.segments[len(l.segments)-1]
+		pos = p
+		return lsn, err
+	})
+
+	return lsn, pos, err
+}
+
+// SegmentPath returns the path of the file of segment id.
+func (l *SegmentedLog) SegmentPath(id uint64) string {
+	return segmentPath(l.dir, id)
+}
+
+// RewriteSegment atomically replaces the sealed segment id with the records
+// accepted by keep, keeping their order and encoding, and calls moved for
+// every kept record with its position before and after the rewrite. A
+// segment left without records is removed from the log.
+//
+// Readers holding the old segment file open keep seeing the old records at
+// the old positions until they reopen it.
+func (l *SegmentedLog) RewriteSegment(id uint64, keep func(e Event, pos Position) bool, moved func(e Event, from, to Position)) (CompactStats, error) {
+	l.compactMu.Lock()
+	defer l.compactMu.Unlock()
+
+	l.mu.RLock()
+	sealed := slices.Contains(l.segments[:len(l.segments)-1], id)
+	l.mu.RUnlock()
+
+	if !sealed {
+		return CompactStats{}, fmt.Errorf("txlog: segment %d is not a sealed segment of the log", id)
+	}
+
+	stats, err := rewriteSegment(l.dir, id, keep, moved)
+	if err != nil {
+		return stats, err
+	}
+
+	if stats.RecordsOut == 0 {
+		err = l.dropSegment(id)
+		if err != nil {
+			return stats, err
+		}
+		stats.BytesReclaimed += stats.BytesOut
+		stats.BytesOut = 0
+	}
+
+	return stats, nil
+}
+
+// ReadRecordAt reads the record at pos from r, the file of segment
+// pos.Segment.
+func ReadRecordAt(r io.ReaderAt, pos Position) (Event, error) {
+	if pos.Size <= crcSize || pos.Size > maxRecordSize {
+		return Event{}, &CorruptRecordError{Offset: pos.Offset, Reason: fmt.Sprintf("invalid record size %d", pos.Size)}
+	}
+
+	buf := make([]byte, pos.Size)
+
+	_, err := r.ReadAt(buf, pos.Offset)
+	if err != nil {
+		return Event{}, fmt.Errorf("txlog: read record at offset %d: %w", pos.Offset, err)
+	}
+
+	size, n := binary.Uvarint(buf)
+	if n <= 0 || size != uint64(len(buf)-n-crcSize) {
+		return Event{}, &CorruptRecordError{Offset: pos.Offset, Reason: "record length does not match its position"}
+	}
+
+	payload := buf[n : len(buf)-crcSize]
+	if binary.LittleEndian.Uint32(buf[len(buf)-crcSize:]) != crc32.Checksum(payload, crcTable) {
+		return Event{}, &CorruptRecordError{Offset: pos.Offset, Reason: "checksum mismatch"}
+	}
+
+	ev, err := decodePayload(payload)
+	if err != nil {
+		return Event{}, &CorruptRecordError{Offset: pos.Offset, Reason: err.Error()}
+	}
+
+	return ev, nil
+}
@@ -0,0 +1,102 @@
+package txlog
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func readAt(t *testing.T, l *SegmentedLog, pos Position) Event {
+	t.Helper()
+
+	file, err := os.Open(l.SegmentPath(pos.Segment))
+	require.NoError(t, err)
+	defer file.Close()
+
+	ev, err := ReadRecordAt(file, pos)
+	require.NoError(t, err, "ReadRecordAt should read the record at %+v", pos)
+
+	return ev
+}
+
+func TestSegmentedLog_AppendPosition(t *testing.T) {
+	t.Helper()
+
+	l, err := OpenSegmentedLog(t.TempDir(), WithMaxSegmentSize(128))
+	require.NoError(t, err)
+	defer l.Close()
+
+	positions := make(map[string]Position)
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("key%02d", i)
+
+		lsn, pos, err := l.AppendPosition(Event{Key: key, Value: "value", Op: OpSet})
+		require.NoError(t, err)
+		require.Equal(t, uint64(i+1), lsn)
+
+		positions[key] = pos
+	}
+
+	require.Greater(t, len(l.Segments()), 2, "log should roll to new segments")
+
+	for key, pos := range positions {
+		ev := readAt(t, l, pos)
+		require.Equal(t, key, ev.Key, "position should point at the record of its key")
+	}
+
+	file, err := os.Open(l.SegmentPath(positions["key00"].Segment))
+	require.NoError(t, err)
+	defer file.Close()
+
+	pos := positions["key00"]
+	pos.Size--
+	_, err = ReadRecordAt(file, pos)
+	require.ErrorIs(t, err, ErrCorruptRecord, "a wrong size should be detected")
+}
+
+func TestSegmentedLog_RewriteSegment(t *testing.T) {
+	t.Helper()
+
+	l, err := OpenSegmentedLog(t.TempDir(), WithMaxSegmentSize(128))
+	require.NoError(t, err)
+	defer l.Close()
+
+	positions := make(map[string]Position)
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("key%02d", i)
+
+		_, pos, err := l.AppendPosition(Event{Key: key, Value: "value", Op: OpSet})
+		require.NoError(t, err)
+		positions[key] = pos
+	}
+
+	segments := l.Segments()
+	first := segments[0]
+
+	_, err = l.RewriteSegment(segments[len(segments)-1], func(Event, Position) bool { return true }, nil)
+	require.Error(t, err, "the current segment should not be rewritten")
+
+	moved := make(map[string]Position)
+	stats, err := l.RewriteSegment(first, func(e Event, pos Position) bool {
+		require.Equal(t, positions[e.Key], pos, "keep should get the position of the record")
+		return e.Key != "key00"
+	}, func(e Event, from, to Position) {
+		require.Equal(t, positions[e.Key], from)
+		moved[e.Key] = to
+	})
+	require.NoError(t, err)
+	require.Equal(t, stats.RecordsIn-1, stats.RecordsOut, "one record should be dropped")
+	require.NotContains(t, moved, "key00")
+	require.NotEmpty(t, moved)
+
+	for key, pos := range moved {
+		ev := readAt(t, l, pos)
+		require.Equal(t, key, ev.Key, "moved position should point at the record in the new segment")
+	}
+
+	_, err = l.RewriteSegment(first, func(Event, Position) bool { return false }, nil)
+	require.NoError(t, err)
+	require.NotContains(t, l.Segments(), first, "an empty segment should be removed from the log")
+}
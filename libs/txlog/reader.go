@@ -0,0 +1,586 @@
+package txlog
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+)
+
+// ErrTruncated is reported by Reader when the log ends with an incomplete or
+// corrupt record that is not followed by any valid one, e.g. after a crash
+// during Append. Corruption followed by valid records is reported as
+// *CorruptRecordError instead.
+var ErrTruncated = errors.New("txlog: truncated record at end of log")
+
+const (
+	maxOpSize  = 16
+	crcHexSize = 8
+	crcSize    = 4
+)
+
+// Reader streams events from a transaction log in the order they were written.
+// Both v1 text logs and v2 binary logs are supported. Events of a batch are
+// returned only once its commit marker has been read; a batch cut off by the
+// end of the log is reported as ErrTruncated at the offset of its begin
+// marker.
+//
+//	r, err := txlog.OpenReader(path)
+//	...
+//	for r.Next() {
+//		ev := r.Event()
+//	}
+//	err = r.Err()
+type Reader struct {
+	file    *os.File
+	br      *bufio.Reader
+	paths   []string
+	index   int
+	version int
+	pos     int64
+	offset  int64
+	event   Event
+	err     error
+	rec     []byte
+	raw     []byte
+
+	inBatch     bool
+	batchOffset int64
+	batch       []batchRecord
+	ready       []batchRecord
+	continued   bool
+}
+
+type batchRecord struct {
+	event  Event
+	raw    []byte
+	offset int64
+}
+
+// OpenReader opens a log file, or a SegmentedLog directory whose segments are
+// then read in order as one log.
+func OpenReader(path string) (*Reader, error) {
+	paths := []string{path}
+
+	if isSegmentedDir(path) {
+		var err error
+		paths, err = segmentPaths(path, 0)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return openPaths(paths)
+}
+
+// OpenReaderFrom opens a SegmentedLog directory for reading from segment
+// from onwards. It fails with ErrLogTruncated if that segment has been
+// discarded by TruncateBefore.
+func OpenReaderFrom(dir string, from uint64) (*Reader, error) {
+	if !isSegmentedDir(dir) {
+		return nil, fmt.Errorf("txlog: %q is not a segmented log", dir)
+	}
+
+	m, err := readManifest(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	if from < m.Base {
+		return nil, fmt.Errorf("%w: segment %d, log starts at %d", ErrLogTruncated, from, m.Base)
+	}
+
+	paths, err := segmentPaths(dir, from)
+	if err != nil {
+		return nil, err
+	}
+
+	return openPaths(paths)
+}
+
+func openPaths(paths []string) (*Reader, error) {
+
+	r := &Reader{
+		paths: paths,
+		index: -1,
+	}
+
+	if len(paths) > 0 {
+		err := r.openNext()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return r, nil
+}
+
+func NewReader(rd io.Reader) *Reader {
+	return &Reader{
+		br: bufio.NewReaderSize(rd, 64*1024),
+	}
+}
+
+func (r *Reader) openNext() error {
+	if r.file != nil {
+		r.file.Close()
+		r.file = nil
+	}
+
+	r.index++
+	path := r.paths[r.index]
+
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("txlog: open reader %q: %w", path, err)
+	}
+
+	r.file = file
+	r.br = bufio.NewReaderSize(file, 64*1024)
+	r.version = 0
+	r.pos = 0
+	r.offset = 0
+
+	return nil
+}
+
+func (r *Reader) hasNextFile() bool {
+	return r.index+1 < len(r.paths)
+}
+
+// Next advances to the next event. It returns false on clean EOF or on error;
+// Err distinguishes the two.
+func (r *Reader) Next() bool {
+	for r.err == nil {
+		if len(r.ready) > 0 {
+			rec := r.ready[0]
+			r.ready = r.ready[1:]
+			r.event, r.raw, r.offset = rec.event, rec.raw, rec.offset
+			r.continued = len(r.ready) > 0
+			return true
+		}
+
+		if r.br == nil {
+			return false
+		}
+
+		ev, err := r.next()
+		if err == nil {
+			if r.collect(ev) {
+				continue
+			}
+			r.event, r.raw = ev, r.rec
+			r.continued = false
+			return true
+		}
+
+		if r.inBatch && (err == io.EOF || errors.Is(err, ErrTruncated)) {
+			r.offset = r.batchOffset
+			r.inBatch, r.batch = false, nil
+			err = fmt.Errorf("%w (offset %d): batch without commit", ErrTruncated, r.offset)
+		}
+
+		if err == io.EOF && r.hasNextFile() {
+			r.err = r.openNext()
+			continue
+		}
+
+		if errors.Is(err, ErrTruncated) && r.hasNextFile() {
+			err = &CorruptRecordError{Offset: r.offset, Reason: "truncated record in sealed segment " + r.Path()}
+		}
+
+		if err != io.EOF {
+			r.err = err
+		}
+		return false
+	}
+	return false
+}
+
+// collect handles batch markers and the records between them. It reports
+// whether ev was consumed; false means ev is a plain record to return.
+func (r *Reader) collect(ev Event) bool {
+	switch {
+	case ev.Op == opBegin:
+		if r.inBatch {
+			r.err = &CorruptRecordError{Offset: r.offset, Reason: "nested batch"}
+			return true
+		}
+		r.inBatch = true
+		r.batchOffset = r.offset
+		return true
+	case ev.Op == opCommit:
+		if !r.inBatch {
+			r.err = &CorruptRecordError{Offset: r.offset, Reason: "commit without batch"}
+			return true
+		}
+		r.ready = append(r.ready, r.batch...)
+		r.inBatch, r.batch = false, nil
+		return true
+	case r.inBatch:
+		r.batch = append(r.batch, batchRecord{event: ev, raw: slices.Clone(r.rec), offset: r.offset})
+		return true
+	}
+	return false
+}
+
+func (r *Reader) next() (Event, error) {
+	if r.version == 0 {
+		err := r.readHeader()
+		if err != nil {
+			return Event{}, err
+		}
+	}
+
+	r.offset = r.pos
+
+	return r.readRecord()
+}
+
+func (r *Reader) Event() Event {
+	return r.event
+}
+
+// Continued reports whether the current event is followed by more events
+// of the same batch.
+func (r *Reader) Continued() bool {
+	return r.continued
+}
+
+// Offset returns the byte offset of the current record within Path, or of
+// the position where reading stopped once Next has returned false.
+func (r *Reader) Offset() int64 {
+	return r.offset
+}
+
+// RecordSize returns the encoded size of the current record.
+func (r *Reader) RecordSize() int64 {
+	return int64(len(r.raw))
+}
+
+// Path returns the file the current record was read from.
+func (r *Reader) Path() string {
+	if r.index < 0 || r.index >= len(r.paths) {
+		return ""
+	}
+	return r.paths[r.index]
+}
+
+// Version returns the format of the log (FormatV1 or FormatV2), or 0 if
+// nothing has been read yet or the log is empty.
+func (r *Reader) Version() int {
+	return r.version
+}
+
+// rawRecord returns a copy of the encoded current record. v1 records are
+// re-encoded in the v2 format.
+func (r *Reader) rawRecord() ([]byte, error) {
+	if r.version == FormatV1 {
+		return appendRecord(nil, r.event)
+	}
+	return slices.Clone(r.raw), nil
+}
+
+func (r *Reader) Err() error {
+	return r.err
+}
+
+func (r *Reader) Close() error {
+	if r.file == nil {
+		return nil
+	}
+
+	err := r.file.Close()
+	if err != nil {
+		return fmt.Errorf("txlog: close reader: %w", err)
+	}
+	return nil
+}
+
+func (r *Reader) readHeader() error {
+	peek, err := r.br.Peek(len(magic))
+	if len(peek) == 0 && err == io.EOF {
+		return io.EOF
+	}
+
+	if !bytes.HasPrefix(magic[:], peek) {
+		r.version = FormatV1
+		return nil
+	}
+
+	header := make([]byte, headerSize)
+	n, err := io.ReadFull(r.br, header)
+	r.pos += int64(n)
+	if err != nil {
+		return fmt.Errorf("%w (offset 0): incomplete header", ErrTruncated)
+	}
+
+	if header[4] != FormatV2 {
+		return fmt.Errorf("txlog: unsupported log format version %d", header[4])
+	}
+
+	r.version = FormatV2
+	return nil
+}
+
+func (r *Reader) readRecord() (Event, error) {
+	ev, err := r.decodeRecord()
+	if err == nil || err == io.EOF {
+		return ev, err
+	}
+
+	if err == io.ErrUnexpectedEOF {
+		return ev, fmt.Errorf("%w (offset %d)", ErrTruncated, r.offset)
+	}
+
+	// A record that follows the invalid one ends within two records of its
+	// offset, so there is no need to look further.
+	rest, readErr := io.ReadAll(io.LimitReader(r.br, int64(max(2*maxRecordSize-len(r.rec), 0))))
+	if readErr != nil {
+		return ev, fmt.Errorf("txlog: read after corrupt record: %w", readErr)
+	}
+	r.pos += int64(len(rest))
+
+	if !containsRecord(r.version, append(r.rec, rest...)) {
+		return ev, fmt.Errorf("%w (offset %d): %v", ErrTruncated, r.offset, err)
+	}
+
+	return ev, &CorruptRecordError{Offset: r.offset, Reason: err.Error()}
+}
+
+// decodeRecord parses one record. io.EOF means a clean end of log,
+// io.ErrUnexpectedEOF an incomplete record; any other error describes why
+// the record is invalid.
+func (r *Reader) decodeRecord() (Event, error) {
+	r.rec = r.rec[:0]
+
+	if r.version == FormatV1 {
+		return r.decodeV1Record()
+	}
+	return r.decodeV2Record()
+}
+
+func (r *Reader) decodeV2Record() (Event, error) {
+	size, err := r.readUvarint()
+	if err != nil {
+		return Event{}, err
+	}
+
+	if size == 0 || size > maxPayloadSize {
+		return Event{}, fmt.Errorf("invalid record size %d", size)
+	}
+
+	data, err := r.readBytes(int(size) + crcSize)
+	if err != nil {
+		return Event{}, err
+	}
+
+	payload := data[:size]
+	if binary.LittleEndian.Uint32(data[size:]) != crc32.Checksum(payload, crcTable) {
+		return Event{}, errors.New("checksum mismatch")
+	}
+
+	return decodePayload(payload)
+}
+
+// decodeV1Record parses one text record, with or without a checksum suffix.
+func (r *Reader) decodeV1Record() (Event, error) {
+	var ev Event
+
+	op, err := r.readField(maxOpSize)
+	if err != nil {
+		return ev, err
+	}
+
+	lenK, err := r.readLength(MaxKeySize)
+	if err != nil {
+		return ev, err
+	}
+
+	lenV, err := r.readLength(MaxValueSize)
+	if err != nil {
+		return ev, err
+	}
+
+	data, err := r.readBytes(lenK + lenV + 1)
+	if err != nil {
+		return ev, err
+	}
+
+	ev.Op = op
+	ev.Key = string(data[:lenK])
+	ev.Value = string(data[lenK : lenK+lenV])
+
+	switch data[lenK+lenV] {
+	case '\n':
+		return ev, nil
+	case ' ':
+	default:
+		return ev, errors.New("missing record terminator")
+	}
+
+	payloadLen := len(r.rec) - 1
+
+	trailer, err := r.readBytes(crcHexSize + 1)
+	if err != nil {
+		return ev, err
+	}
+
+	if trailer[crcHexSize] != '\n' {
+		return ev, errors.New("missing record terminator")
+	}
+
+	sum, err := strconv.ParseUint(string(trailer[:crcHexSize]), 16, 32)
+	if err != nil {
+		return ev, fmt.Errorf("invalid checksum %q", trailer[:crcHexSize])
+	}
+
+	if uint32(sum) != crc32.Checksum(r.rec[:payloadLen], crcTable) {
+		return ev, errors.New("checksum mismatch")
+	}
+
+	return ev, nil
+}
+
+func (r *Reader) readUvarint() (uint64, error) {
+	for i := 0; i < binary.MaxVarintLen64; i++ {
+		b, err := r.readByte()
+		if err != nil {
+			return 0, err
+		}
+
+		if b < 0x80 {
+			v, n := binary.Uvarint(r.rec)
+			if n <= 0 {
+				return 0, errors.New("invalid varint")
+			}
+			return v, nil
+		}
+	}
+	return 0, errors.New("invalid varint")
+}
+
+func (r *Reader) readField(maxSize int) (string, error) {
+	start := len(r.rec)
+
+	for {
+		b, err := r.readByte()
+		if err != nil {
+			return "", err
+		}
+
+		field := r.rec[start : len(r.rec)-1]
+
+		if b == ' ' {
+			if len(field) == 0 {
+				return "", errors.New("empty field")
+			}
+			return string(field), nil
+		}
+
+		if b == '\n' || len(field) == maxSize {
+			return "", fmt.Errorf("invalid field %q", r.rec[start:])
+		}
+	}
+}
+
+func (r *Reader) readLength(limit int) (int, error) {
+	field, err := r.readField(len(strconv.Itoa(limit)))
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := strconv.Atoi(field)
+	if err != nil || n < 0 || n > limit {
+		return 0, fmt.Errorf("invalid length %q", field)
+	}
+
+	return n, nil
+}
+
+func (r *Reader) readByte() (byte, error) {
+	b, err := r.br.ReadByte()
+	if err != nil {
+		if err == io.EOF && len(r.rec) > 0 {
+			return 0, io.ErrUnexpectedEOF
+		}
+		return 0, err
+	}
+
+	r.pos++
+	r.rec = append(r.rec, b)
+
+	return b, nil
+}
+
+func (r *Reader) readBytes(n int) ([]byte, error) {
+	start := len(r.rec)
+	r.rec = append(r.rec, make([]byte, n)...)
+
+	read, err := io.ReadFull(r.br, r.rec[start:])
+	r.pos += int64(read)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return r.rec[start:], nil
+}
+
+// containsRecord reports whether a valid record starts anywhere after the
+// beginning of data (only right after a newline for v1 logs). It tells a
+// torn tail apart from mid-log corruption.
+func containsRecord(version int, data []byte) bool {
+	if version == FormatV2 {
+		for i := 1; i < len(data); i++ {
+			if validV2Record(data[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+
+	// v1 candidates are lines, decoded by one reader reset to each of them.
+	src := bytes.NewReader(nil)
+	r := &Reader{br: bufio.NewReaderSize(src, 16), version: version}
+
+	for i := 1; i < len(data); i++ {
+		if data[i-1] != '\n' {
+			continue
+		}
+
+		src.Reset(data[i:])
+		r.br.Reset(src)
+
+		_, err := r.decodeRecord()
+		if err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// validV2Record reports whether data starts with a complete, valid v2
+// record.
+func validV2Record(data []byte) bool {
+	size, n := binary.Uvarint(data)
+	if n <= 0 || size == 0 || size > maxPayloadSize || uint64(len(data)-n) < size+crcSize {
+		return false
+	}
+
+	payload := data[n : n+int(size)]
+	if binary.LittleEndian.Uint32(data[n+int(size):]) != crc32.Checksum(payload, crcTable) {
+		return false
+	}
+
+	_, err := decodePayload(payload)
+	return err == nil
+}
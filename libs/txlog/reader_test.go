@@ -0,0 +1,138 @@
+package txlog
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReader_Next(t *testing.T) {
+	t.Helper()
+
+	logPath := t.TempDir() + "/test.log"
+
+	logFile, err := NewFileLog(logPath)
+	require.NoError(t, err)
+
+	events := []Event{
+		{Key: "user1", Value: "Alice", Op: "set"},
+		{Key: "multi", Value: "line1\nline2", Op: "set"},
+		{Key: "user1", Value: "", Op: "delete"},
+	}
+	for _, ev := range events {
+		appendEvent(t, logFile, ev)
+	}
+	require.NoError(t, logFile.Close())
+
+	r, err := OpenReader(logPath)
+	require.NoError(t, err, "OpenReader should not return error")
+	defer r.Close()
+
+	var got []Event
+	var offsets []int64
+	for r.Next() {
+		got = append(got, r.Event())
+		offsets = append(offsets, r.Offset())
+	}
+	require.NoError(t, r.Err(), "clean EOF should not be reported as error")
+	require.Equal(t, events, withoutMeta(got), "Reader should return events in log order")
+	require.Equal(t, []int64{8, 40, 78}, offsets, "Reader should report record offsets")
+}
+
+func TestReader_TruncatedTail(t *testing.T) {
+	t.Helper()
+
+	r := NewReader(strings.NewReader("set 5 5 user1Alice\nset 5 5 user2Al"))
+
+	require.True(t, r.Next(), "first record should be read")
+	require.Equal(t, "user1", r.Event().Key)
+
+	require.False(t, r.Next(), "truncated record should not be returned")
+	require.ErrorIs(t, r.Err(), ErrTruncated, "truncated tail should be reported")
+	require.Equal(t, int64(19), r.Offset(), "Offset should point to the truncated record")
+}
+
+func TestReader_CorruptRecord(t *testing.T) {
+	t.Helper()
+
+	r := NewReader(strings.NewReader("set x 5 user1Alice\nset 5 3 user2Bob\n"))
+
+	require.False(t, r.Next(), "corrupt record should not be returned")
+	require.ErrorIs(t, r.Err(), ErrCorruptRecord, "mid-log corruption should be reported")
+	require.NotErrorIs(t, r.Err(), ErrTruncated, "mid-log corruption is not a truncated tail")
+
+	var corruptErr *CorruptRecordError
+	require.ErrorAs(t, r.Err(), &corruptErr)
+	require.Equal(t, int64(0), corruptErr.Offset, "error should carry the record offset")
+}
+
+func TestReader_ChecksumMismatch(t *testing.T) {
+	t.Helper()
+
+	logPath := t.TempDir() + "/test.log"
+
+	logFile, err := NewFileLog(logPath)
+	require.NoError(t, err)
+	appendEvent(t, logFile, Event{Key: "user1", Value: "Alice", Op: "set"})
+	appendEvent(t, logFile, Event{Key: "user2", Value: "Bob", Op: "set"})
+	require.NoError(t, logFile.Close())
+
+	data, err := os.ReadFile(logPath)
+	require.NoError(t, err)
+	data = []byte(strings.Replace(string(data), "Alice", "Alica", 1))
+
+	r := NewReader(strings.NewReader(string(data)))
+	require.False(t, r.Next(), "record with bad checksum should not be returned")
+	require.ErrorIs(t, r.Err(), ErrCorruptRecord, "checksum mismatch should be reported")
+}
+
+func TestReader_CorruptRecordInLargeLog(t *testing.T) {
+	t.Helper()
+
+	logPath := t.TempDir() + "/test.log"
+
+	logFile, err := NewFileLog(logPath)
+	require.NoError(t, err)
+	value := strings.Repeat("v", MaxValueSize)
+	for i := 0; i < 20; i++ {
+		appendEvent(t, logFile, Event{Key: "user1", Value: value, Op: "set"})
+	}
+	require.NoError(t, logFile.Close())
+
+	data, err := os.ReadFile(logPath)
+	require.NoError(t, err)
+	torn := string(data[:len(data)-10])
+	data[headerSize+100]++
+
+	r := NewReader(strings.NewReader(string(data)))
+	require.False(t, r.Next(), "record with bad checksum should not be returned")
+
+	var corruptErr *CorruptRecordError
+	require.ErrorAs(t, r.Err(), &corruptErr, "records after the corrupt one should be found")
+	require.Equal(t, int64(headerSize), corruptErr.Offset)
+
+	r = NewReader(strings.NewReader(torn))
+	for r.Next() {
+	}
+	require.ErrorIs(t, r.Err(), ErrTruncated, "torn last record should be reported as truncated")
+}
+
+func TestReader_LegacyRecord(t *testing.T) {
+	t.Helper()
+
+	r := NewReader(strings.NewReader("set 5 5 user1Alice\n"))
+
+	require.True(t, r.Next(), "record without checksum should still be readable")
+	require.Equal(t, Event{Key: "user1", Value: "Alice", Op: "set"}, r.Event())
+	require.False(t, r.Next())
+	require.NoError(t, r.Err())
+}
+
+func TestOpenReader_Missing(t *testing.T) {
+	t.Helper()
+
+	_, err := OpenReader(t.TempDir() + "/missing.log")
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
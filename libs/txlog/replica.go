@@ -0,0 +1,101 @@
+package txlog
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrLSNOutOfOrder is returned by AppendReplicated for a record whose LSN is
+// not greater than the last LSN of the log.
+var ErrLSNOutOfOrder = errors.New("txlog: replicated record out of LSN order")
+
+// Replica is implemented by logs that can store records copied from another
+// log, so that a follower's log keeps the LSNs of its leader's.
+type Replica interface {
+	// AppendReplicated writes e with its own LSN, and its own time unless
+	// it is zero. As with Append, the LSN is returned together with the
+	// error if the record was written but could not be synced.
+	AppendReplicated(e Event) (uint64, error)
+	// AppendReplicatedBatch writes events, the records of one batch of the
+	// other log, as a batch with their own LSNs. It returns the LSN of the
+	// last one like AppendReplicated.
+	AppendReplicatedBatch(events []Event) (uint64, error)
+}
+
+func (l *FileLog) AppendReplicated(e Event) (uint64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if e.LSN <= l.lsn {
+		return 0, fmt.Errorf("%w: %d after %d", ErrLSNOutOfOrder, e.LSN, l.lsn)
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	buf, err := appendRecord(nil, e)
+	if err != nil {
+		return 0, err
+	}
+
+	err = l.write(buf)
+	if err != nil {
+		return 0, err
+	}
+	l.lsn = e.LSN
+
+	return e.LSN, l.syncWritten()
+}
+
+func (l *FileLog) AppendReplicatedBatch(events []Event) (uint64, error) {
+	if len(events) == 0 {
+		return 0, ErrEmptyBatch
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	lsn := l.lsn
+
+	buf := appendMarker(nil, opcodeBegin, now)
+	for _, e := range events {
+		if e.LSN <= lsn {
+			return 0, fmt.Errorf("%w: %d after %d", ErrLSNOutOfOrder, e.LSN, lsn)
+		}
+		lsn = e.LSN
+		if e.Time.IsZero() {
+			e.Time = now
+		}
+
+		var err error
+		buf, err = appendRecord(buf, e)
+		if err != nil {
+			return 0, err
+		}
+	}
+	buf = appendMarker(buf, opcodeCommit, now)
+
+	err := l.write(buf)
+	if err != nil {
+		return 0, err
+	}
+	l.lsn = lsn
+
+	return lsn, l.syncWritten()
+}
+
+// AppendReplicated writes e into the current segment.
+func (l *SegmentedLog) AppendReplicated(e Event) (uint64, error) {
+	return l.appendCurrent(func(current *FileLog) (uint64, error) {
+		return current.AppendReplicated(e)
+	})
+}
+
+// AppendReplicatedBatch writes events as a batch into the current segment.
+func (l *SegmentedLog) AppendReplicatedBatch(events []Event) (uint64, error) {
+	return l.appendCurrent(func(current *FileLog) (uint64, error) {
+		return current.AppendReplicatedBatch(events)
+	})
+}
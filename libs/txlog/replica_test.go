@@ -0,0 +1,113 @@
+package txlog
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileLog_AppendReplicated(t *testing.T) {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "replica.log")
+
+	l, err := NewFileLog(path)
+	require.NoError(t, err)
+
+	at := time.Unix(1700000000, 0)
+
+	lsn, err := l.AppendReplicated(Event{Key: "a", Value: "1", Op: OpSet, LSN: 5, Time: at})
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), lsn, "the record should keep its LSN")
+
+	_, err = l.AppendReplicated(Event{Key: "b", Value: "2", Op: OpSet, LSN: 5})
+	require.ErrorIs(t, err, ErrLSNOutOfOrder, "a repeated LSN should be rejected")
+
+	lsn, err = l.Append(Event{Key: "c", Value: "3", Op: OpSet})
+	require.NoError(t, err)
+	require.Equal(t, uint64(6), lsn, "Append should continue after the replicated LSN")
+	require.NoError(t, l.Close())
+
+	var events []Event
+	_, err = ReadFile(path, func(e Event) error {
+		events = append(events, e)
+		return nil
+	})
+	require.NoError(t, err)
+	require.Len(t, events, 2)
+	require.Equal(t, uint64(5), events[0].LSN)
+	require.True(t, at.Equal(events[0].Time), "the record should keep its time")
+
+	l, err = NewFileLog(path)
+	require.NoError(t, err)
+	defer l.Close()
+
+	require.Equal(t, uint64(6), l.LastLSN(), "the LSN should survive a reopen")
+}
+
+func TestFileLog_AppendReplicatedBatch(t *testing.T) {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "replica.log")
+
+	l, err := NewFileLog(path)
+	require.NoError(t, err)
+
+	_, err = l.AppendReplicatedBatch([]Event{
+		{Key: "a", Value: "1", Op: OpSet, LSN: 5},
+		{Key: "b", Value: "2", Op: OpSet, LSN: 5},
+	})
+	require.ErrorIs(t, err, ErrLSNOutOfOrder, "a repeated LSN should be rejected")
+
+	lsn, err := l.AppendReplicatedBatch([]Event{
+		{Key: "a", Value: "1", Op: OpSet, LSN: 5},
+		{Key: "b", Value: "2", Op: OpSet, LSN: 6},
+	})
+	require.NoError(t, err)
+	require.Equal(t, uint64(6), lsn, "the records should keep their LSNs")
+	require.NoError(t, l.Close())
+
+	r, err := OpenReader(path)
+	require.NoError(t, err)
+	defer r.Close()
+
+	var lsns []uint64
+	var continued []bool
+	for r.Next() {
+		lsns = append(lsns, r.Event().LSN)
+		continued = append(continued, r.Continued())
+	}
+	require.NoError(t, r.Err())
+	require.Equal(t, []uint64{5, 6}, lsns, "only the second batch should be written")
+	require.Equal(t, []bool{true, false}, continued, "the records should be read back as a batch")
+}
+
+func TestSegmentedLog_AppendReplicated(t *testing.T) {
+	t.Helper()
+
+	dir := t.TempDir()
+
+	l, err := OpenSegmentedLog(dir, WithMaxSegmentSize(128))
+	require.NoError(t, err)
+
+	for lsn := uint64(10); lsn < 30; lsn += 2 {
+		got, err := l.AppendReplicated(Event{Key: "key", Value: "value", Op: OpSet, LSN: lsn})
+		require.NoError(t, err)
+		require.Equal(t, lsn, got)
+	}
+
+	require.Greater(t, len(l.Segments()), 1, "the log should roll to new segments")
+	require.Equal(t, uint64(28), l.LastLSN())
+	require.NoError(t, l.Close())
+
+	l, err = OpenSegmentedLog(dir, WithMaxSegmentSize(128))
+	require.NoError(t, err)
+	defer l.Close()
+
+	require.Equal(t, uint64(28), l.LastLSN(), "the LSN should survive a reopen")
+
+	_, err = l.AppendReplicated(Event{Key: "key", Op: OpDelete, LSN: 28})
+	require.ErrorIs(t, err, ErrLSNOutOfOrder)
+}
@@ -0,0 +1,596 @@
+package txlog
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	manifestName  = "MANIFEST"
+	segmentSuffix = ".seg"
+
+	DefaultMaxSegmentSize = 64 << 20
+)
+
+// SegmentedLog is a Log stored as a sequence of numbered segment files in a
+// directory. Appends go to the newest segment, which is sealed and replaced
+// by a new one once it reaches the size or age threshold. The MANIFEST file
+// lists the active segments in order.
+type SegmentedLog struct {
+	mu       sync.RWMutex
+	dir      string
+	segments []uint64
+	current  *FileLog
+	openedAt time.Time
+
+	maxSize     int64
+	maxAge      time.Duration
+	fileOptions []Option
+	closedSyncs uint64
+
+	base       uint64
+	checkpoint uint64
+	// startLSN is the last LSN written before the current segment.
+	startLSN uint64
+
+	compactMu sync.Mutex
+}
+
+type SegmentOption func(l *SegmentedLog)
+
+// WithMaxSegmentSize sets the size after which the current segment is sealed.
+func WithMaxSegmentSize(size int64) SegmentOption {
+	return func(l *SegmentedLog) {
+		l.maxSize = size
+	}
+}
+
+// WithMaxSegmentAge seals the current segment once it has been open for the
+// given duration. Zero disables age-based rotation.
+func WithMaxSegmentAge(age time.Duration) SegmentOption {
+	return func(l *SegmentedLog) {
+		l.maxAge = age
+	}
+}
+
+// WithFileOptions sets the options used to open every segment file.
+func WithFileOptions(opts ...Option) SegmentOption {
+	return func(l *SegmentedLog) {
+		l.fileOptions = opts
+	}
+}
+
+// Checkpointer is implemented by logs whose history can be discarded once it
+// is covered by a snapshot of the state built from it.
+type Checkpointer interface {
+	// Checkpoint starts a new segment and returns its id. Every record
+	// appended after Checkpoint returns is stored in that segment or a later
+	// one.
+	Checkpoint() (uint64, error)
+	// TruncateBefore discards all segments older than id.
+	TruncateBefore(id uint64) error
+}
+
+// ErrLogTruncated is returned when reading a log from a segment that has
+// already been discarded by TruncateBefore.
+var ErrLogTruncated = errors.New("txlog: log truncated past the requested segment")
+
+type manifest struct {
+	Segments []uint64 `json:"segments"`
+	// Base is the id of the oldest segment kept by TruncateBefore; records
+	// before it are gone.
+	Base uint64 `json:"base,omitempty"`
+	// Checkpoint is the id returned by the latest Checkpoint.
+	Checkpoint uint64 `json:"checkpoint,omitempty"`
+	// LSN is the last LSN written before the newest segment was created, so
+	// numbering continues even if that segment is empty.
+	LSN uint64 `json:"lsn,omitempty"`
+}
+
+func OpenSegmentedLog(dir string, opts ...SegmentOption) (*SegmentedLog, error) {
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return nil, fmt.Errorf("txlog: create log dir %q: %w", dir, err)
+	}
+
+	m, err := readManifest(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &SegmentedLog{
+		dir:        dir,
+		segments:   m.Segments,
+		maxSize:    DefaultMaxSegmentSize,
+		base:       m.Base,
+		checkpoint: m.Checkpoint,
+		startLSN:   m.LSN,
+	}
+
+	for _, opt := range opts {
+		opt(l)
+	}
+
+	if len(l.segments) == 0 {
+		l.segments = []uint64{1}
+
+		err = writeManifest(dir, l.manifest(l.segments))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	last := l.segments[len(l.segments)-1]
+	l.current, err = NewFileLog(segmentPath(dir, last), l.fileOptions...)
+	if err != nil {
+		return nil, err
+	}
+	l.current.continueLSN(l.startLSN)
+	l.openedAt = time.Now()
+
+	return l, nil
+}
+
+func (l *SegmentedLog) Dir() string {
+	return l.dir
+}
+
+// Segments returns the ids of the active segments, oldest first. The last
+// one is the segment currently appended to.
+func (l *SegmentedLog) Segments() []uint64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	return append([]uint64(nil), l.segments...)
+}
+
+func (l *SegmentedLog) Append(e Event) (uint64, error) {
+	return l.appendCurrent(func(current *FileLog) (uint64, error) {
+		return current.Append(e)
+	})
+}
+
+// appendCurrent runs appendFn on the current segment, rolling the log first
+// if the segment is full.
+func (l *SegmentedLog) appendCurrent(appendFn func(current *FileLog) (uint64, error)) (uint64, error) {
+	for {
+		l.mu.RLock()
+		if !l.needsRoll() {
+			lsn, err := appendFn(l.current)
+			l.mu.RUnlock()
+			return lsn, err
+		}
+		l.mu.RUnlock()
+
+		l.mu.Lock()
+		var err error
+		if l.needsRoll() {
+			err = l.roll()
+		}
+		l.mu.Unlock()
+
+		if err != nil {
+			return 0, err
+		}
+	}
+}
+
+// LastLSN returns the LSN of the last record appended to the log.
+func (l *SegmentedLog) LastLSN() uint64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	return l.current.LastLSN()
+}
+
+func (l *SegmentedLog) needsRoll() bool {
+	if l.current.Size() >= l.maxSize {
+		return true
+	}
+	return l.maxAge > 0 && time.Since(l.openedAt) >= l.maxAge && l.current.Size() > headerSize
+}
+
+// Roll seals the current segment and starts a new one, returning its id.
+func (l *SegmentedLog) Roll() (uint64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	err := l.roll()
+	if err != nil {
+		return 0, err
+	}
+	return l.segments[len(l.segments)-1], nil
+}
+
+// Checkpoint rolls the log like Roll and records the new segment as a
+// checkpoint. From then on Compact keeps the latest delete of every key, as
+// a snapshot taken before it may still hold the deleted value.
+func (l *SegmentedLog) Checkpoint() (uint64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	next := l.segments[len(l.segments)-1] + 1
+
+	prev := l.checkpoint
+	l.checkpoint = next
+
+	err := l.roll()
+	if err != nil {
+		l.checkpoint = prev
+		return 0, err
+	}
+	return next, nil
+}
+
+// TruncateBefore removes every segment older than id from the log. The
+// current segment is always kept.
+func (l *SegmentedLog) TruncateBefore(id uint64) error {
+	l.compactMu.Lock()
+	defer l.compactMu.Unlock()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if id <= l.base {
+		return nil
+	}
+
+	last := l.segments[len(l.segments)-1]
+	if id > last {
+		id = last
+	}
+
+	var removed, segments []uint64
+	for _, s := range l.segments {
+		if s < id {
+			removed = append(removed, s)
+		} else {
+			segments = append(segments, s)
+		}
+	}
+
+	prev := l.base
+	l.base = id
+
+	err := writeManifest(l.dir, l.manifest(segments))
+	if err != nil {
+		l.base = prev
+		return err
+	}
+	l.segments = segments
+
+	for _, s := range removed {
+		err = os.Remove(segmentPath(l.dir, s))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("txlog: remove segment %d: %w", s, err)
+		}
+	}
+	return nil
+}
+
+func (l *SegmentedLog) roll() error {
+	next := l.segments[len(l.segments)-1] + 1
+
+	file, err := NewFileLog(segmentPath(l.dir, next), l.fileOptions...)
+	if err != nil {
+		return err
+	}
+
+	prevLSN := l.startLSN
+	l.startLSN = l.current.LastLSN()
+	file.continueLSN(l.startLSN)
+
+	segments := append(append([]uint64(nil), l.segments...), next)
+
+	err = writeManifest(l.dir, l.manifest(segments))
+	if err != nil {
+		l.startLSN = prevLSN
+		file.Close()
+		return err
+	}
+
+	prev := l.current
+	l.current = file
+	l.segments = segments
+	l.openedAt = time.Now()
+	l.closedSyncs += prev.SyncCount()
+
+	err = prev.Close()
+	if err != nil {
+		return fmt.Errorf("txlog: seal segment: %w", err)
+	}
+	return nil
+}
+
+func (l *SegmentedLog) Sync() error {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	return l.current.Sync()
+}
+
+func (l *SegmentedLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.current.Close()
+}
+
+func (l *SegmentedLog) Durability() Durability {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	return l.current.Durability()
+}
+
+func (l *SegmentedLog) SyncCount() uint64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	return l.closedSyncs + l.current.SyncCount()
+}
+
+// Compact rewrites every sealed segment, oldest first, keeping only records
+// that are still the latest for their key and are not deletes, except for
+// stamped deletes younger than TombstoneGrace. Records keep
+// their original order and encoding. Segments that become empty are removed
+// from the manifest. The current segment is never touched, so Compact can
+// run while the log is being appended to.
+func (l *SegmentedLog) Compact() (CompactStats, error) {
+	var stats CompactStats
+
+	l.compactMu.Lock()
+	defer l.compactMu.Unlock()
+
+	l.mu.RLock()
+	segments := append([]uint64(nil), l.segments...)
+	keepDeletes := l.checkpoint > 0
+	l.mu.RUnlock()
+	now := time.Now()
+	sealed := segments[:len(segments)-1]
+	if len(sealed) == 0 {
+		return stats, nil
+	}
+
+	type position struct {
+		segment uint64
+		index   int
+	}
+	latest := make(map[string]position)
+
+	for _, id := range segments {
+		index := 0
+		_, err := ReadFile(segmentPath(l.dir, id), func(e Event) error {
+			latest[e.Key] = position{segment: id, index: index}
+			index++
+			return nil
+		})
+		if err != nil {
+			return stats, fmt.Errorf("txlog: read segment %d for compaction: %w", id, err)
+		}
+	}
+
+	for _, id := range sealed {
+		index := 0
+		segmentStats, err := rewriteSegment(l.dir, id, func(e Event, _ Position) bool {
+			keep := (e.Op == OpSet || keepDeletes || liveTombstone(e, now)) && latest[e.Key] == position{segment: id, index: index}
+			index++
+			return keep
+		}, nil)
+		if err != nil {
+			return stats, err
+		}
+		stats.add(segmentStats)
+
+		if segmentStats.RecordsOut == 0 {
+			err = l.dropSegment(id)
+			if err != nil {
+				return stats, err
+			}
+			stats.BytesReclaimed += segmentStats.BytesOut
+			stats.BytesOut -= segmentStats.BytesOut
+		}
+	}
+
+	return stats, nil
+}
+
+func (l *SegmentedLog) dropSegment(id uint64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	segments := make([]uint64, 0, len(l.segments))
+	for _, s := range l.segments {
+		if s != id {
+			segments = append(segments, s)
+		}
+	}
+
+	err := writeManifest(l.dir, l.manifest(segments))
+	if err != nil {
+		return err
+	}
+	l.segments = segments
+
+	err = os.Remove(segmentPath(l.dir, id))
+	if err != nil {
+		return fmt.Errorf("txlog: remove segment %d: %w", id, err)
+	}
+	return nil
+}
+
+// rewriteSegment atomically replaces segment id of the log in dir with the
+// records accepted by keep. moved, if not nil, is called for every kept
+// record with its position before and after the rewrite.
+func rewriteSegment(dir string, id uint64, keep func(e Event, pos Position) bool, moved func(e Event, from, to Position)) (CompactStats, error) {
+	var stats CompactStats
+
+	path := segmentPath(dir, id)
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return stats, fmt.Errorf("txlog: stat segment: %w", err)
+	}
+
+	r, err := OpenReader(path)
+	if err != nil {
+		return stats, err
+	}
+	defer r.Close()
+
+	tmpPath := path + ".compact"
+	tmpLog, err := createFileLog(tmpPath)
+	if err != nil {
+		return stats, fmt.Errorf("txlog: open temp segment: %w", err)
+	}
+
+	for err == nil && r.Next() {
+		stats.RecordsIn++
+
+		from := Position{Segment: id, Offset: r.Offset(), Size: r.RecordSize()}
+		if !keep(r.Event(), from) {
+			continue
+		}
+
+		var raw []byte
+		raw, err = r.rawRecord()
+		if err != nil {
+			break
+		}
+
+		to := Position{Segment: id, Offset: tmpLog.Size(), Size: int64(len(raw))}
+
+		err = tmpLog.appendRaw(raw)
+		if err == nil && moved != nil {
+			moved(r.Event(), from, to)
+		}
+		stats.RecordsOut++
+	}
+
+	if err == nil {
+		err = r.Err()
+	}
+
+	if err != nil {
+		tmpLog.Close()
+		os.Remove(tmpPath)
+		return stats, fmt.Errorf("txlog: rewrite segment: %w", err)
+	}
+
+	stats.BytesIn = info.Size()
+	stats.BytesOut = tmpLog.Size()
+	stats.BytesReclaimed = stats.BytesIn - stats.BytesOut
+
+	err = tmpLog.Close()
+	if err != nil {
+		os.Remove(tmpPath)
+		return stats, fmt.Errorf("txlog: close temp segment: %w", err)
+	}
+
+	err = os.Rename(tmpPath, path)
+	if err != nil {
+		return stats, fmt.Errorf("txlog: rename compacted segment: %w", err)
+	}
+
+	err = syncDir(filepath.Dir(path))
+	if err != nil {
+		return stats, err
+	}
+
+	return stats, nil
+}
+
+func segmentPath(dir string, id uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("%020d%s", id, segmentSuffix))
+}
+
+func isSegmentedDir(path string) bool {
+	_, err := os.Stat(filepath.Join(path, manifestName))
+	return err == nil
+}
+
+// segmentPaths returns the paths of the segments with id from or later.
+func segmentPaths(dir string, from uint64) ([]string, error) {
+	m, err := readManifest(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	paths := make([]string, 0, len(m.Segments))
+	for _, id := range m.Segments {
+		if id >= from {
+			paths = append(paths, segmentPath(dir, id))
+		}
+	}
+	return paths, nil
+}
+
+// manifest returns the manifest of the log with the given segments. Must be
+// called with l.mu held.
+func (l *SegmentedLog) manifest(segments []uint64) manifest {
+	return manifest{
+		Segments:   segments,
+		Base:       l.base,
+		Checkpoint: l.checkpoint,
+		LSN:        l.startLSN,
+	}
+}
+
+func readManifest(dir string) (manifest, error) {
+	var m manifest
+
+	data, err := os.ReadFile(filepath.Join(dir, manifestName))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return m, nil
+		}
+		return m, fmt.Errorf("txlog: read manifest: %w", err)
+	}
+
+	err = json.Unmarshal(data, &m)
+	if err != nil {
+		return m, fmt.Errorf("txlog: decode manifest: %w", err)
+	}
+
+	return m, nil
+}
+
+func writeManifest(dir string, m manifest) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return fmt.Errorf("txlog: encode manifest: %w", err)
+	}
+
+	path := filepath.Join(dir, manifestName)
+	tmpPath := path + ".tmp"
+
+	f, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o644)
+	if err != nil {
+		return fmt.Errorf("txlog: create manifest: %w", err)
+	}
+
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("txlog: write manifest: %w", err)
+	}
+
+	err = os.Rename(tmpPath, path)
+	if err != nil {
+		return fmt.Errorf("txlog: rename manifest: %w", err)
+	}
+
+	return syncDir(dir)
+}
@@ -0,0 +1,223 @@
+package txlog
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func readAll(t *testing.T, path string) []Event {
+	t.Helper()
+
+	var events []Event
+	_, err := ReadFile(path, func(e Event) error {
+		events = append(events, e)
+		return nil
+	})
+	require.NoError(t, err)
+
+	return withoutMeta(events)
+}
+
+func TestSegmentedLog_Rotation(t *testing.T) {
+	t.Helper()
+
+	dir := t.TempDir()
+
+	l, err := OpenSegmentedLog(dir, WithMaxSegmentSize(64))
+	require.NoError(t, err, "OpenSegmentedLog should not return error")
+
+	var want []Event
+	for i := 0; i < 20; i++ {
+		ev := Event{Key: fmt.Sprintf("key%d", i), Value: "value", Op: OpSet}
+		appendEvent(t, l, ev)
+		want = append(want, ev)
+	}
+
+	segments := l.Segments()
+	require.Greater(t, len(segments), 1, "log should roll to new segments")
+	require.Equal(t, uint64(1), segments[0], "segments should be numbered from 1")
+	require.NoError(t, l.Close())
+
+	for _, id := range segments {
+		_, err := os.Stat(segmentPath(dir, id))
+		require.NoError(t, err, "every manifest segment should exist")
+	}
+
+	require.Equal(t, want, readAll(t, dir), "reader should iterate segments in order")
+
+	l, err = OpenSegmentedLog(dir, WithMaxSegmentSize(64))
+	require.NoError(t, err)
+	require.Equal(t, segments, l.Segments(), "reopened log should keep its segments")
+
+	ev := Event{Key: "after", Value: "reopen", Op: OpSet}
+	appendEvent(t, l, ev)
+	require.NoError(t, l.Close())
+
+	require.Equal(t, append(want, ev), readAll(t, dir))
+}
+
+func TestSegmentedLog_Roll(t *testing.T) {
+	t.Helper()
+
+	dir := t.TempDir()
+
+	l, err := OpenSegmentedLog(dir)
+	require.NoError(t, err)
+	defer l.Close()
+
+	appendEvent(t, l, Event{Key: "a", Value: "1", Op: OpSet})
+
+	id, err := l.Roll()
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), id)
+	require.Equal(t, []uint64{1, 2}, l.Segments())
+
+	appendEvent(t, l, Event{Key: "b", Value: "2", Op: OpSet})
+	require.Len(t, readAll(t, dir), 2)
+}
+
+func TestSegmentedLog_Compact(t *testing.T) {
+	t.Helper()
+
+	dir := t.TempDir()
+
+	l, err := OpenSegmentedLog(dir)
+	require.NoError(t, err)
+	defer l.Close()
+
+	appendEvent(t, l, Event{Key: "a", Value: "1", Op: OpSet})
+	appendEvent(t, l, Event{Key: "b", Value: "1", Op: OpSet})
+	_, err = l.Roll()
+	require.NoError(t, err)
+
+	appendEvent(t, l, Event{Key: "a", Value: "2", Op: OpSet})
+	appendEvent(t, l, Event{Key: "c", Value: "1", Op: OpSet})
+	appendEvent(t, l, Event{Key: "c", Op: OpDelete})
+	_, err = l.Roll()
+	require.NoError(t, err)
+
+	appendEvent(t, l, Event{Key: "a", Value: "3", Op: OpSet})
+
+	stats, err := l.Compact()
+	require.NoError(t, err, "Compact should not return error")
+	require.Equal(t, 5, stats.RecordsIn, "only sealed segments should be compacted")
+	require.Equal(t, 1, stats.RecordsOut)
+	require.Positive(t, stats.BytesReclaimed)
+
+	require.Equal(t, []uint64{1, 3}, l.Segments(), "fully compacted segments should be dropped")
+	_, err = os.Stat(segmentPath(dir, 2))
+	require.ErrorIs(t, err, os.ErrNotExist)
+
+	require.Equal(t, []Event{
+		{Key: "b", Value: "1", Op: OpSet},
+		{Key: "a", Value: "3", Op: OpSet},
+	}, readAll(t, dir), "only live records should remain")
+
+	appendEvent(t, l, Event{Key: "d", Value: "1", Op: OpSet})
+	require.Len(t, readAll(t, dir), 3, "log should stay appendable after compaction")
+}
+
+func TestReader_TruncatedSealedSegment(t *testing.T) {
+	t.Helper()
+
+	dir := t.TempDir()
+
+	l, err := OpenSegmentedLog(dir)
+	require.NoError(t, err)
+	appendEvent(t, l, Event{Key: "a", Value: "1", Op: OpSet})
+	_, err = l.Roll()
+	require.NoError(t, err)
+	appendEvent(t, l, Event{Key: "b", Value: "1", Op: OpSet})
+	require.NoError(t, l.Close())
+
+	path := segmentPath(dir, 1)
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	require.NoError(t, os.Truncate(path, info.Size()-2))
+
+	_, err = ReadFile(dir, func(e Event) error {
+		return nil
+	})
+	require.ErrorIs(t, err, ErrCorruptRecord, "truncated sealed segment should not be treated as end of log")
+}
+
+func TestSegmentedLog_CheckpointAndTruncate(t *testing.T) {
+	t.Helper()
+
+	dir := t.TempDir()
+
+	l, err := OpenSegmentedLog(dir)
+	require.NoError(t, err)
+
+	appendEvent(t, l, Event{Key: "a", Value: "1", Op: OpSet})
+	appendEvent(t, l, Event{Key: "b", Value: "1", Op: OpSet})
+
+	id, err := l.Checkpoint()
+	require.NoError(t, err, "Checkpoint should not return error")
+	require.Equal(t, uint64(2), id)
+
+	appendEvent(t, l, Event{Key: "a", Op: OpDelete})
+	_, err = l.Roll()
+	require.NoError(t, err)
+	appendEvent(t, l, Event{Key: "c", Value: "1", Op: OpSet})
+
+	_, err = l.Compact()
+	require.NoError(t, err)
+
+	var tail []Event
+	_, err = ReadFileFrom(dir, id, func(e Event) error {
+		tail = append(tail, e)
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, []Event{
+		{Key: "a", Op: OpDelete},
+		{Key: "c", Value: "1", Op: OpSet},
+	}, withoutMeta(tail), "compaction after a checkpoint should keep deletes")
+
+	require.NoError(t, l.TruncateBefore(id), "TruncateBefore should not return error")
+	require.Equal(t, []uint64{2, 3}, l.Segments())
+	_, err = os.Stat(segmentPath(dir, 1))
+	require.ErrorIs(t, err, os.ErrNotExist, "truncated segment should be removed")
+	require.NoError(t, l.Close())
+
+	_, err = OpenReaderFrom(dir, 1)
+	require.ErrorIs(t, err, ErrLogTruncated, "reading before the truncation point should fail")
+
+	l, err = OpenSegmentedLog(dir)
+	require.NoError(t, err)
+	defer l.Close()
+
+	require.NoError(t, l.TruncateBefore(1), "truncating an already truncated range should be a no-op")
+	require.Equal(t, []uint64{2, 3}, l.Segments())
+	require.Len(t, readAll(t, dir), 2)
+}
+
+func TestSegmentedLog_LSN(t *testing.T) {
+	t.Helper()
+
+	dir := t.TempDir()
+
+	l, err := OpenSegmentedLog(dir)
+	require.NoError(t, err)
+
+	require.Equal(t, uint64(1), appendEvent(t, l, Event{Key: "a", Value: "1", Op: OpSet}))
+	require.Equal(t, uint64(2), appendEvent(t, l, Event{Key: "a", Op: OpDelete}))
+
+	_, err = l.Roll()
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), l.LastLSN(), "rolling should not change the last LSN")
+
+	_, err = l.Compact()
+	require.NoError(t, err)
+	require.NoError(t, l.Close())
+
+	l, err = OpenSegmentedLog(dir)
+	require.NoError(t, err)
+	defer l.Close()
+
+	require.Equal(t, uint64(3), appendEvent(t, l, Event{Key: "b", Value: "1", Op: OpSet}), "LSNs should continue in an empty segment after reopening")
+}
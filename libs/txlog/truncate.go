@@ -0,0 +1,193 @@
+package txlog
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+)
+
+// ErrInsideBatch is returned when a log would be cut between the records of
+// a batch.
+var ErrInsideBatch = errors.New("txlog: cut inside a batch")
+
+// TruncateAfter removes the records with an LSN greater than lsn from the end
+// of the log, as a consensus follower does with records its leader never
+// committed. Afterwards the next record appended gets LSN lsn+1, even if the
+// log ended before lsn. A batch is removed as a whole, so lsn must not fall
+// inside one. The log must be in LSN order, so not compacted with
+// CompactKeyOrder.
+func (l *FileLog) TruncateAfter(lsn uint64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for l.syncing {
+		l.cond.Wait()
+	}
+
+	if lsn >= l.lsn {
+		l.lsn = lsn
+		return nil
+	}
+
+	cut, err := l.offsetAfter(lsn)
+	if err != nil {
+		return err
+	}
+
+	err = l.file.Truncate(cut)
+	if err != nil {
+		return fmt.Errorf("txlog: truncate log: %w", err)
+	}
+
+	err = l.file.Sync()
+	if err != nil {
+		return fmt.Errorf("txlog: sync truncated log: %w", err)
+	}
+
+	l.size = cut
+	l.lsn = lsn
+	l.synced = l.written
+
+	return nil
+}
+
+// offsetAfter returns the offset of the first record with an LSN greater
+// than lsn, or of the begin marker of its batch. Must be called with l.mu
+// held.
+func (l *FileLog) offsetAfter(lsn uint64) (int64, error) {
+	src, err := os.Open(l.path)
+	if err != nil {
+		return 0, fmt.Errorf("txlog: open for truncation: %w", err)
+	}
+	defer src.Close()
+
+	r := NewReader(io.NewSectionReader(src, 0, l.size))
+
+	var (
+		batchOffset int64
+		inBatch     bool
+		batchFirst  uint64
+	)
+
+	for {
+		ev, err := r.next()
+		if err == io.EOF {
+			return l.size, nil
+		}
+		if err != nil {
+			return 0, fmt.Errorf("txlog: read for truncation: %w", err)
+		}
+
+		switch ev.Op {
+		case opBegin:
+			inBatch, batchOffset, batchFirst = true, r.offset, 0
+			continue
+		case opCommit:
+			inBatch = false
+			continue
+		}
+
+		if inBatch && batchFirst == 0 {
+			batchFirst = ev.LSN
+		}
+
+		if ev.LSN <= lsn {
+			continue
+		}
+
+		if !inBatch {
+			return r.offset, nil
+		}
+		if batchFirst <= lsn {
+			return 0, fmt.Errorf("%w: LSN %d", ErrInsideBatch, lsn)
+		}
+		return batchOffset, nil
+	}
+}
+
+// DiscardBefore removes the records with an LSN less than lsn from the start
+// of the log, once a snapshot covers them. A batch is kept if any of its
+// records is kept. The log is rewritten to a temporary file that replaces it;
+// appends wait until it is done.
+func (l *FileLog) DiscardBefore(lsn uint64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	src, err := os.Open(l.path)
+	if err != nil {
+		return fmt.Errorf("txlog: open for discard: %w", err)
+	}
+	defer src.Close()
+
+	kept, dropped, err := recordsFrom(NewReader(io.NewSectionReader(src, 0, l.size)), lsn)
+	if err != nil {
+		return err
+	}
+	if !dropped {
+		return nil
+	}
+
+	tmpPath := l.path + ".discard"
+	tmpLog, err := createFileLog(tmpPath)
+	if err != nil {
+		return fmt.Errorf("txlog: open temp file for discard: %w", err)
+	}
+
+	err = tmpLog.write(kept)
+	if err == nil {
+		err = l.swapIn(tmpLog, src, l.size)
+	}
+	if err != nil {
+		tmpLog.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+
+	return nil
+}
+
+// recordsFrom returns the encoded records of r, batch markers included,
+// starting with the first batch or record that has an LSN of at least lsn,
+// and whether any record came before it.
+func recordsFrom(r *Reader, lsn uint64) ([]byte, bool, error) {
+	var (
+		kept    bytes.Buffer
+		batch   []byte
+		inBatch bool
+		keep    bool
+		dropped bool
+	)
+
+	for {
+		ev, err := r.next()
+		if err == io.EOF {
+			return kept.Bytes(), dropped, nil
+		}
+		if err != nil {
+			return nil, false, fmt.Errorf("txlog: read for discard: %w", err)
+		}
+
+		switch {
+		case ev.Op == opBegin:
+			inBatch, batch, keep = true, slices.Clone(r.rec), false
+		case ev.Op == opCommit:
+			batch = append(batch, r.rec...)
+			if keep {
+				kept.Write(batch)
+			} else {
+				dropped = true
+			}
+			inBatch, batch = false, nil
+		case inBatch:
+			batch = append(batch, r.rec...)
+			keep = keep || ev.LSN >= lsn
+		case ev.LSN >= lsn:
+			kept.Write(r.rec)
+		default:
+			dropped = true
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package txlog
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func readRecords(t *testing.T, path string) ([]Event, []bool) {
+	t.Helper()
+
+	r, err := OpenReader(path)
+	require.NoError(t, err)
+	defer r.Close()
+
+	var (
+		events    []Event
+		continued []bool
+	)
+	for r.Next() {
+		events = append(events, r.Event())
+		continued = append(continued, r.Continued())
+	}
+	require.NoError(t, r.Err())
+
+	return events, continued
+}
+
+func lsnsOf(events []Event) []uint64 {
+	lsns := make([]uint64, len(events))
+	for i, e := range events {
+		lsns[i] = e.LSN
+	}
+	return lsns
+}
+
+func TestFileLog_TruncateAfter(t *testing.T) {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "raft.log")
+
+	l, err := NewFileLog(path)
+	require.NoError(t, err)
+
+	appendEvent(t, l, Event{Key: "a", Value: "1", Op: OpSet, Term: 1})
+	_, err = l.AppendBatch([]Event{
+		{Key: "b", Value: "1", Op: OpSet, Term: 1},
+		{Key: "c", Value: "1", Op: OpSet, Term: 1},
+	})
+	require.NoError(t, err)
+	appendEvent(t, l, Event{Key: "d", Value: "1", Op: OpSet, Term: 2, Stamp: 7})
+	_, err = l.AppendBatch([]Event{
+		{Key: "e", Value: "1", Op: OpSet, Term: 2},
+		{Key: "f", Value: "1", Op: OpSet, Term: 2},
+	})
+	require.NoError(t, err)
+
+	events, continued := readRecords(t, path)
+	require.Equal(t, []uint64{1, 2, 3, 4, 5, 6}, lsnsOf(events))
+	require.Equal(t, []bool{false, true, false, false, true, false}, continued, "Continued should mark all but the last record of a batch")
+	require.Equal(t, uint64(2), events[3].Term, "the term should survive a round trip")
+	require.Equal(t, uint64(7), events[3].Stamp, "the stamp should survive a round trip")
+
+	require.ErrorIs(t, l.TruncateAfter(2), ErrInsideBatch)
+
+	require.NoError(t, l.TruncateAfter(4))
+	require.Equal(t, uint64(4), l.LastLSN())
+	require.Equal(t, uint64(5), appendEvent(t, l, Event{Key: "g", Value: "1", Op: OpSet, Term: 3}))
+
+	require.NoError(t, l.TruncateAfter(3))
+	require.NoError(t, l.Close())
+
+	events, _ = readRecords(t, path)
+	require.Equal(t, []uint64{1, 2, 3}, lsnsOf(events), "records after the cut should be removed")
+
+	l, err = NewFileLog(path)
+	require.NoError(t, err)
+	defer l.Close()
+	require.Equal(t, uint64(3), l.LastLSN())
+
+	// Cutting past the end only moves the next LSN, as after a snapshot
+	// that covers more than the log.
+	require.NoError(t, l.TruncateAfter(10))
+	require.Equal(t, uint64(11), appendEvent(t, l, Event{Key: "h", Value: "1", Op: OpSet}))
+}
+
+func TestFileLog_DiscardBefore(t *testing.T) {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "raft.log")
+
+	l, err := NewFileLog(path)
+	require.NoError(t, err)
+
+	appendEvent(t, l, Event{Key: "a", Value: "1", Op: OpSet})
+	_, err = l.AppendBatch([]Event{
+		{Key: "b", Value: "1", Op: OpSet},
+		{Key: "c", Value: "1", Op: OpSet},
+	})
+	require.NoError(t, err)
+	appendEvent(t, l, Event{Key: "d", Value: "1", Op: OpSet})
+
+	require.NoError(t, l.DiscardBefore(3))
+
+	events, continued := readRecords(t, path)
+	require.Equal(t, []uint64{2, 3, 4}, lsnsOf(events), "a batch with a kept record should be kept whole")
+	require.Equal(t, []bool{true, false, false}, continued)
+
+	require.NoError(t, l.DiscardBefore(4))
+	require.Equal(t, uint64(5), appendEvent(t, l, Event{Key: "e", Value: "1", Op: OpSet}))
+
+	events, _ = readRecords(t, path)
+	require.Equal(t, []uint64{4, 5}, lsnsOf(events))
+
+	require.NoError(t, l.DiscardBefore(6))
+	require.Equal(t, uint64(5), l.LastLSN(), "an emptied log should keep its LSN")
+	require.NoError(t, l.Close())
+
+	events, _ = readRecords(t, path)
+	require.Empty(t, events)
+}
@@ -1,11 +1,13 @@
 package txlog
 
 import (
-	"bufio"
-	"bytes"
 	"errors"
 	"fmt"
+	"hash/crc32"
+	"io"
 	"os"
+	"sync"
+	"time"
 )
 
 const (
@@ -16,211 +18,423 @@ const (
 var (
     ErrKeyTooLarge = errors.New("txlog: key size exceeds MaxKeySize")
     ErrValueTooLarge = errors.New("txlog: value size exceeds MaxValueSize")
+    ErrCorruptRecord = errors.New("txlog: corrupt record")
+    // ErrLogFailed is returned by the writes to a log whose last write
+    // failed partway and could not be cut off again.
+    ErrLogFailed = errors.New("txlog: log failed after a partial write")
 )
 
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+type CorruptRecordError struct {
+    Offset int64
+    Reason string
+}
+
+func (e *CorruptRecordError) Error() string {
+    return fmt.Sprintf("txlog: corrupt record at offset %d: %s", e.Offset, e.Reason)
+}
+
+func (e *CorruptRecordError) Is(target error) bool {
+    return target == ErrCorruptRecord
+}
+
 type Event struct {
     Key   string
     Value string
     Op    string
+
+    // LSN is the log sequence number assigned by Append: 1 for the first
+    // record of a log, then increasing by one. Records written before LSNs
+    // were introduced read back with LSN 0.
+    LSN  uint64
+    // Time is when the event was appended, zero if unknown.
+    Time time.Time
+    // ExpiresAt is when the key written by a set event expires, zero if
+    // it never does.
+    ExpiresAt time.Time
+    // Term is the consensus term in which the record was proposed, zero in
+    // logs that are not replicated by consensus.
+    Term uint64
+    // Stamp orders the writes of a key made by a client across replicas,
+    // zero for writes without one.
+    Stamp uint64
 }
 
 
 type Log interface {
-    Append(e Event) error
+    // Append writes e to the log and returns the LSN assigned to it. If the
+    // record was written but could not be synced, the LSN is returned
+    // together with the error.
+    Append(e Event) (uint64, error)
     Sync() error
     Close() error
 }
 
 type FileLog struct {
+    mu sync.Mutex
+    cond *sync.Cond
+    path string
     file *os.File
+    size int64
+    truncated int64
+    lsn uint64
+
+    durability Durability
+    syncInterval time.Duration
+    compactOrder CompactOrder
+    written uint64
+    synced uint64
+    syncs uint64
+    syncing bool
+    syncErr error
+    failed error
+    stop chan struct{}
+    loopDone chan struct{}
 }
 
-func NewFileLog(path string) (*FileLog, error) {
-    file, err := os.OpenFile(path, os.O_APPEND | os.O_CREATE | os.O_WRONLY, 0o644)
-    if err != nil {
-        return nil, fmt.Errorf("txlog: open file %q: %w", path, err)
-    }
-
-    log :=  &FileLog {
+func newFileLog(file *os.File, opts ...Option) *FileLog {
+    log := &FileLog{
         file: file,
+        syncInterval: DefaultSyncInterval,
     }
+    log.cond = sync.NewCond(&log.mu)
 
-    return log, nil
-}
-
-func (l *FileLog) Append(e Event) error {
-    keyBytes := []byte(e.Key)
-    valBytes := []byte(e.Value)
-
-    if len(keyBytes) > MaxKeySize {
-        return ErrKeyTooLarge
+    for _, opt := range opts {
+        opt(log)
     }
 
-    if len(valBytes) > MaxValueSize {
-        return ErrValueTooLarge
+    if log.durability == DurabilityInterval {
+        log.stop = make(chan struct{})
+        log.loopDone = make(chan struct{})
+        go log.runSyncLoop()
     }
 
-    prefix := fmt.Sprintf("%s %d %d ", e.Op, len(keyBytes), len(valBytes))
+    return log
+}
 
-    var buf bytes.Buffer
+func NewFileLog(path string, opts ...Option) (*FileLog, error) {
+    tail, err := recoverTail(path)
+    if err != nil {
+        return nil, err
+    }
 
-    _, err := buf.WriteString(prefix)
+    file, err := os.OpenFile(path, os.O_APPEND | os.O_CREATE | os.O_WRONLY, 0o644)
     if err != nil {
-        return fmt.Errorf("txlog: write prefix: %w", err)
+        return nil, fmt.Errorf("txlog: open file %q: %w", path, err)
     }
 
-    _, err = buf.Write(keyBytes)
+    err = writeHeaderIfEmpty(file)
     if err != nil {
-        return fmt.Errorf("txlog: write key: %w", err)
+        file.Close()
+        return nil, err
     }
 
-    _, err = buf.Write(valBytes)
+    info, err := file.Stat()
     if err != nil {
-        return fmt.Errorf("txlog: write value: %w", err)
+        file.Close()
+        return nil, fmt.Errorf("txlog: stat file: %w", err)
     }
 
-    err = buf.WriteByte('\n')
+    log := newFileLog(file, opts...)
+    log.path = path
+    log.truncated = tail.truncated
+    log.lsn = tail.lsn
+    log.size = info.Size()
+
+    return log, nil
+}
+
+func createFileLog(path string) (*FileLog, error) {
+    file, err := os.OpenFile(path, os.O_CREATE | os.O_TRUNC | os.O_WRONLY, 0o644)
     if err != nil {
-        return fmt.Errorf("txlog: write newline: %w", err)
+        return nil, fmt.Errorf("txlog: create file %q: %w", path, err)
     }
 
-    _, err = l.file.Write(buf.Bytes())
+    err = writeHeaderIfEmpty(file)
     if err != nil {
-        return fmt.Errorf("txlog: append event: %w", err)
+        file.Close()
+        return nil, err
     }
 
-    return nil
+    log := newFileLog(file)
+    log.path = path
+    log.size = headerSize
+
+    return log, nil
 }
 
-func (l *FileLog) Sync() error {
-    err := l.file.Sync()
+func writeHeaderIfEmpty(file *os.File) error {
+    info, err := file.Stat()
     if err != nil {
-        return fmt.Errorf("txlog: sync file: %w", err)
+        return fmt.Errorf("txlog: stat file: %w", err)
     }
-    return nil
-}
 
-func (l *FileLog) Close() error {
-    err := l.Sync()
-    if err != nil {
-        return err
+    if info.Size() > 0 {
+        return nil
     }
 
-    err = l.file.Close()
+    _, err = file.Write(fileHeader())
     if err != nil {
-        return fmt.Errorf("txlog: close file: %w", err)
+        return fmt.Errorf("txlog: write header: %w", err)
     }
     return nil
 }
 
-func CompactLogFile(path string) error {
-    f, err := os.Open(path)
+func (l *FileLog) TruncatedBytes() int64 {
+    return l.truncated
+}
+
+func (l *FileLog) Size() int64 {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+
+    return l.size
+}
+
+// LastLSN returns the LSN of the last record in the log, 0 if it is empty.
+func (l *FileLog) LastLSN() uint64 {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+
+    return l.lsn
+}
+
+// continueLSN makes the log assign LSNs after lsn if it has not gone past
+// it already.
+func (l *FileLog) continueLSN(lsn uint64) {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+
+    l.lsn = max(l.lsn, lsn)
+}
+
+type tailInfo struct {
+    truncated int64
+    version int
+    lsn uint64
+}
+
+// recoverTail scans the log at path, truncates a torn tail and reports the
+// highest LSN found. A v1 log is rejected before anything is changed, so
+// that MigrateFile gets all of it.
+func recoverTail(path string) (tailInfo, error) {
+    var tail tailInfo
+
+    r, err := OpenReader(path)
     if err != nil {
         if errors.Is(err, os.ErrNotExist) {
-            return nil
+            return tail, nil
         }
-        return fmt.Errorf("txlog: open for compaction: %w", err)
+        return tail, err
     }
-    defer f.Close()
-
-    scanner := bufio.NewScanner(f)
-    buf := make([]byte, 0, 64*1024)
-    scanner.Buffer(buf, MaxKeySize+MaxValueSize+256)
+    defer r.Close()
 
-    lastEvents := make(map[string]Event)
+    ok := r.Next()
+    tail.version = r.Version()
+    if tail.version == FormatV1 {
+        return tail, fmt.Errorf("%w: %q", ErrLegacyFormat, path)
+    }
 
-    for scanner.Scan() {
-        line := scanner.Bytes()
+    for ; ok; ok = r.Next() {
+        tail.lsn = max(tail.lsn, r.Event().LSN)
+    }
 
-        ev, err := parseLineToEvent(line)
-        if err != nil {
-            continue
-        }
+    err = r.Err()
+    if !errors.Is(err, ErrTruncated) {
+        return tail, err
+    }
 
-         lastEvents[ev.Key] = ev
+    info, err := os.Stat(path)
+    if err != nil {
+        return tail, fmt.Errorf("txlog: stat for recovery: %w", err)
     }
 
-    err = scanner.Err()
+    err = os.Truncate(path, r.Offset())
     if err != nil {
-        return fmt.Errorf("txlog: scan for compaction: %w", err)
+        return tail, fmt.Errorf("txlog: truncate torn tail: %w", err)
     }
 
-    tmpPath := path + ".compact"
-    tmpFile, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o644)
+    tail.truncated = info.Size() - r.Offset()
+    return tail, nil
+}
+
+// Append assigns e the next LSN and, unless e.Time is already set, the
+// current time, then writes it to the log.
+func (l *FileLog) Append(e Event) (uint64, error) {
+    lsn, _, err := l.append(e)
+    return lsn, err
+}
+
+// append is Append that also returns the offset and size of the record.
+func (l *FileLog) append(e Event) (uint64, Position, error) {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+
+    e.LSN = l.lsn + 1
+    if e.Time.IsZero() {
+        e.Time = time.Now()
+    }
+
+    buf, err := appendRecord(nil, e)
     if err != nil {
-        return fmt.Errorf("txlog: open temp file for compaction: %w", err)
+        return 0, Position{}, err
     }
 
-    tmpLog := &FileLog{file: tmpFile}
+    pos := Position{
+        Offset: l.size,
+        Size: int64(len(buf)),
+    }
 
-    for _, ev := range lastEvents {
-        if ev.Op != "set" {
-            continue
-        }
-        err = tmpLog.Append(ev)
-        if err != nil {
-            tmpLog.Close()
-            return fmt.Errorf("txlog: append during compaction: %w", err)
-        }
+    err = l.write(buf)
+    if err != nil {
+        return 0, Position{}, err
     }
+    l.lsn = e.LSN
+
+    return e.LSN, pos, l.syncWritten()
+}
 
-    err = tmpLog.Close()
+// appendRaw writes an already encoded record.
+func (l *FileLog) appendRaw(buf []byte) error {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+
+    err := l.write(buf)
     if err != nil {
-        return fmt.Errorf("txlog: close temp log during compaction: %w", err)
+        return err
+    }
+
+    return l.syncWritten()
+}
+
+// write writes buf at the end of the log. The bytes of a write that fails
+// partway are cut off again, so that the records written later do not
+// follow a corrupt one; if that fails too, the log refuses further writes.
+// Must be called with l.mu held.
+func (l *FileLog) write(buf []byte) error {
+    if l.failed != nil {
+        return l.failed
     }
 
-    err = os.Rename(tmpPath,path )
+    _, err := l.file.Write(buf)
     if err != nil {
-        return fmt.Errorf("txlog: rename compacted log: %w", err)
+        l.discardPartial()
+        return fmt.Errorf("txlog: append event: %w", err)
     }
+    l.size += int64(len(buf))
+    l.written++
+
     return nil
 }
 
-func parseLineToEvent(line []byte)(Event ,error) {
-    var ev Event
-
-    var firstSpace, secondSpace, thirdSpace int = -1, -1, -1
+// discardPartial truncates the file back to the end of the last record
+// written. Must be called with l.mu held.
+func (l *FileLog) discardPartial() {
+    err := l.file.Truncate(l.size)
+    if err == nil {
+        _, err = l.file.Seek(l.size, io.SeekStart)
+    }
+    if err != nil {
+        l.failed = fmt.Errorf("%w: %w", ErrLogFailed, err)
+    }
+}
 
-    for i, b := range line {
-    	if b == ' ' {
-    		if firstSpace == -1 {
-    			firstSpace = i
-    		} else if secondSpace == -1 {
-    			secondSpace = i
-    		} else {
-    			thirdSpace = i
-    			break
-    		}
+// syncWritten syncs the records written so far as required by the
+// durability mode. Must be called with l.mu held.
+func (l *FileLog) syncWritten() error {
+    switch l.durability {
+    case DurabilityAlways:
+        l.syncs++
+        err := l.file.Sync()
+        if err != nil {
+            return fmt.Errorf("txlog: sync file: %w", err)
         }
+        l.synced = l.written
+    case DurabilityGroupCommit:
+        return l.syncThrough(l.written)
     }
 
-    if firstSpace == -1 || secondSpace == -1 || thirdSpace == -1 {
-    	return ev, fmt.Errorf("txlog: invalid line format (spaces)")
+    return nil
+}
+
+func (l *FileLog) Sync() error {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+
+    l.syncs++
+    err := l.file.Sync()
+    if err != nil {
+        return fmt.Errorf("txlog: sync file: %w", err)
     }
+    l.synced = l.written
+    return nil
+}
 
-    op := string(line[:firstSpace])
+func (l *FileLog) Close() error {
+    if l.stop != nil {
+        close(l.stop)
+        <-l.loopDone
+    }
 
-    var lenK, lenV int
-    _, err := fmt.Sscanf(string(line[firstSpace+1:secondSpace]), "%d", &lenK)
+    err := l.Sync()
     if err != nil {
-    	return ev, fmt.Errorf("txlog: parse lenK: %w", err)
+        return err
     }
-    _, err = fmt.Sscanf(string(line[secondSpace+1:thirdSpace]), "%d", &lenV)
+
+    err = l.file.Close()
     if err != nil {
-    	return ev, fmt.Errorf("txlog: parse lenV: %w", err)
+        return fmt.Errorf("txlog: close file: %w", err)
     }
+    return nil
+}
+
+type ReadStats struct {
+    Events  int
+    Skipped int
+}
 
-    data := line[thirdSpace+1:]
-    if len(data) < lenK+lenV {
-    	return ev, fmt.Errorf("txlog: data too short")
+func ReadFile(path string, fn func(e Event) error) (ReadStats, error) {
+    r, err := OpenReader(path)
+    if err != nil {
+        if errors.Is(err, os.ErrNotExist) {
+            return ReadStats{}, nil
+        }
+        return ReadStats{}, err
+    }
+    defer r.Close()
+
+    return readEvents(r, fn)
+}
+
+// ReadFileFrom is like ReadFile but reads a SegmentedLog directory starting
+// at segment from, see OpenReaderFrom.
+func ReadFileFrom(dir string, from uint64, fn func(e Event) error) (ReadStats, error) {
+    r, err := OpenReaderFrom(dir, from)
+    if err != nil {
+        return ReadStats{}, err
     }
+    defer r.Close()
 
-    keyBytes := data[:lenK]
-    valBytes := data[lenK : lenK+lenV]
+    return readEvents(r, fn)
+}
 
-    ev.Op = op
-    ev.Key = string(keyBytes)
-    ev.Value = string(valBytes)
+func readEvents(r *Reader, fn func(e Event) error) (ReadStats, error) {
+    var stats ReadStats
 
-    return ev, nil
-}
\ No newline at end of file
+    for r.Next() {
+        err := fn(r.Event())
+        if err != nil {
+            return stats, err
+        }
+        stats.Events++
+    }
+
+    err := r.Err()
+    if errors.Is(err, ErrTruncated) {
+        stats.Skipped++
+        return stats, nil
+    }
+
+    return stats, err
+}
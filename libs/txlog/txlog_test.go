@@ -4,6 +4,7 @@ import (
 	"os"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
@@ -28,7 +29,7 @@ func TestFileLog_Append(t *testing.T) {
         Op: "set",
     }
 
-    err = logFile.Append(event1)
+    _, err = logFile.Append(event1)
     require.NoError(t, err, "Append for event1 should not return error")
 
     event2 := Event {
@@ -37,16 +38,25 @@ func TestFileLog_Append(t *testing.T) {
         Op: "delete",
     }
 
-    err = logFile.Append(event2)
+    _, err = logFile.Append(event2)
     require.NoError(t, err, "Append for event2 should not return error")
 
     data, err := os.ReadFile(logPath)
     require.NoError(t, err, "ReadFile should not return error")
 
-    content := string(data)
+    require.Equal(t, "TXLG\x02", string(data[:5]), "log should start with v2 header")
 
-    require.Contains(t, content, "set 5 5 user1Alice", "log should contain encoded first event")
-    require.Contains(t, content, "delete 5 0 user2", "log should contain encoded second event")
+    r, err := OpenReader(logPath)
+    require.NoError(t, err)
+    defer r.Close()
+
+    require.True(t, r.Next(), "log should contain encoded first event")
+    require.Equal(t, []Event{event1}, withoutMeta([]Event{r.Event()}))
+    require.True(t, r.Next(), "log should contain encoded second event")
+    require.Equal(t, []Event{event2}, withoutMeta([]Event{r.Event()}))
+    require.False(t, r.Next())
+    require.NoError(t, r.Err())
+    require.Equal(t, FormatV2, r.Version())
 }
 
 func TestFileLog_AppendTooLarge(t *testing.T) {
@@ -64,7 +74,7 @@ func TestFileLog_AppendTooLarge(t *testing.T) {
 
     tooLongKey := strings.Repeat("a", MaxKeySize+1)
 
-    err = logFile.Append(Event{
+    _, err = logFile.Append(Event{
         Key: tooLongKey,
         Value: "x",
         Op: "set",
@@ -73,10 +83,297 @@ func TestFileLog_AppendTooLarge(t *testing.T) {
 
     tooLongValue := strings.Repeat("b", MaxValueSize+1)
 
-    err = logFile.Append(Event{
+    _, err = logFile.Append(Event{
         Key: "key",
         Value: tooLongValue,
         Op: "set",
     })
     require.ErrorIs(t, err, ErrValueTooLarge)
-}
\ No newline at end of file
+}
+
+func TestReadFile(t *testing.T) {
+    t.Helper()
+
+    tempDir := t.TempDir()
+    logPath := tempDir + "/test.log"
+
+    logFile, err := NewFileLog(logPath)
+    require.NoError(t, err)
+
+    _, err = logFile.Append(Event{Key: "user1", Value: "Alice", Op: "set"})
+    require.NoError(t, err)
+    _, err = logFile.Append(Event{Key: "user1", Op: "delete"})
+    require.NoError(t, err)
+    require.NoError(t, logFile.Close())
+
+    f, err := os.OpenFile(logPath, os.O_APPEND|os.O_WRONLY, 0o644)
+    require.NoError(t, err)
+    _, err = f.WriteString("set 5 5 us")
+    require.NoError(t, err)
+    require.NoError(t, f.Close())
+
+    var events []Event
+    stats, err := ReadFile(logPath, func(e Event) error {
+        events = append(events, e)
+        return nil
+    })
+    require.NoError(t, err, "ReadFile should not return error")
+    require.Equal(t, 2, stats.Events, "ReadFile should report two events")
+    require.Equal(t, 1, stats.Skipped, "ReadFile should report the truncated tail as skipped")
+    require.Equal(t, []Event{
+        {Key: "user1", Value: "Alice", Op: "set"},
+        {Key: "user1", Value: "", Op: "delete"},
+    }, withoutMeta(events), "ReadFile should return events in log order")
+
+    stats, err = ReadFile(tempDir+"/missing.log", func(e Event) error {
+        return nil
+    })
+    require.NoError(t, err, "ReadFile of missing file should not return error")
+    require.Zero(t, stats.Events)
+}
+
+
+func TestNewFileLog_TruncatesTornTail(t *testing.T) {
+    t.Helper()
+
+    logPath := t.TempDir() + "/test.log"
+
+    logFile, err := NewFileLog(logPath)
+    require.NoError(t, err)
+    appendEvent(t, logFile, Event{Key: "user1", Value: "Alice", Op: "set"})
+    require.NoError(t, logFile.Close())
+
+    info, err := os.Stat(logPath)
+    require.NoError(t, err)
+    validSize := info.Size()
+
+    f, err := os.OpenFile(logPath, os.O_APPEND|os.O_WRONLY, 0o644)
+    require.NoError(t, err)
+    _, err = f.Write([]byte("set 5 3 user2B\x00\x00\x00\x00"))
+    require.NoError(t, err)
+    require.NoError(t, f.Close())
+
+    logFile, err = NewFileLog(logPath)
+    require.NoError(t, err, "NewFileLog should recover from a torn tail")
+    require.Equal(t, int64(18), logFile.TruncatedBytes(), "torn tail should be truncated")
+
+    appendEvent(t, logFile, Event{Key: "user2", Value: "Bob", Op: "set"})
+    require.NoError(t, logFile.Close())
+
+    info, err = os.Stat(logPath)
+    require.NoError(t, err)
+    require.Greater(t, info.Size(), validSize)
+
+    var keys []string
+    _, err = ReadFile(logPath, func(e Event) error {
+        keys = append(keys, e.Key)
+        return nil
+    })
+    require.NoError(t, err)
+    require.Equal(t, []string{"user1", "user2"}, keys, "log should contain only valid records")
+}
+
+func TestNewFileLog_MidFileCorruption(t *testing.T) {
+    t.Helper()
+
+    logPath := t.TempDir() + "/test.log"
+
+    logFile, err := NewFileLog(logPath)
+    require.NoError(t, err)
+    appendEvent(t, logFile, Event{Key: "user1", Value: "Alice", Op: "set"})
+    appendEvent(t, logFile, Event{Key: "user2", Value: "Bob", Op: "set"})
+    require.NoError(t, logFile.Close())
+
+    data, err := os.ReadFile(logPath)
+    require.NoError(t, err)
+    data[10] ^= 0xff
+    require.NoError(t, os.WriteFile(logPath, data, 0o644))
+
+    _, err = NewFileLog(logPath)
+    require.ErrorIs(t, err, ErrCorruptRecord, "mid-file corruption should be reported")
+
+    var corruptErr *CorruptRecordError
+    require.ErrorAs(t, err, &corruptErr)
+    require.Equal(t, int64(headerSize), corruptErr.Offset)
+
+    _, err = ReadFile(logPath, func(e Event) error {
+        return nil
+    })
+    require.ErrorIs(t, err, ErrCorruptRecord, "ReadFile should not skip corrupt records")
+}
+
+func TestFileLog_FailedWrite(t *testing.T) {
+    t.Helper()
+
+    logPath := t.TempDir() + "/test.log"
+
+    logFile, err := NewFileLog(logPath)
+    require.NoError(t, err)
+    appendEvent(t, logFile, Event{Key: "user1", Value: "Alice", Op: "set"})
+
+    // A read-only file fails both the write and cutting it off again.
+    readOnly, err := os.Open(logPath)
+    require.NoError(t, err)
+    file := logFile.file
+    logFile.file = readOnly
+
+    _, err = logFile.Append(Event{Key: "user2", Value: "Bob", Op: "set"})
+    require.Error(t, err)
+    require.NotErrorIs(t, err, ErrLogFailed)
+
+    logFile.file = file
+    require.NoError(t, readOnly.Close())
+
+    _, err = logFile.Append(Event{Key: "user3", Value: "Carol", Op: "set"})
+    require.ErrorIs(t, err, ErrLogFailed, "a log that could not undo a failed write should refuse appends")
+    require.NoError(t, logFile.Close())
+
+    logFile, err = NewFileLog(logPath)
+    require.NoError(t, err, "the log should open after a failed write")
+    require.Equal(t, uint64(1), logFile.LastLSN())
+    require.NoError(t, logFile.Close())
+}
+
+
+func TestFileLog_AppendUnknownOp(t *testing.T) {
+    t.Helper()
+
+    logFile, err := NewFileLog(t.TempDir() + "/test.log")
+    require.NoError(t, err)
+    defer logFile.Close()
+
+    _, err = logFile.Append(Event{Key: "key", Value: "x", Op: "put"})
+    require.ErrorIs(t, err, ErrUnknownOp)
+}
+
+func TestFileLog_LargeMultilineValue(t *testing.T) {
+    t.Helper()
+
+    logPath := t.TempDir() + "/test.log"
+
+    logFile, err := NewFileLog(logPath)
+    require.NoError(t, err)
+
+    value := strings.Repeat("line\n", MaxValueSize/5)
+    appendEvent(t, logFile, Event{Key: "big", Value: value, Op: OpSet})
+    appendEvent(t, logFile, Event{Key: "small", Value: "x", Op: OpSet})
+    require.NoError(t, logFile.Close())
+
+    var events []Event
+    _, err = ReadFile(logPath, func(e Event) error {
+        events = append(events, e)
+        return nil
+    })
+    require.NoError(t, err)
+    require.Len(t, events, 2)
+    require.Equal(t, value, events[0].Value, "value with newlines should survive a round trip")
+}
+
+func TestFileLog_LSN(t *testing.T) {
+    t.Helper()
+
+    logPath := t.TempDir() + "/test.log"
+
+    logFile, err := NewFileLog(logPath)
+    require.NoError(t, err)
+
+    require.Equal(t, uint64(1), appendEvent(t, logFile, Event{Key: "a", Value: "1", Op: OpSet}), "first record should get LSN 1")
+    require.Equal(t, uint64(2), appendEvent(t, logFile, Event{Key: "b", Value: "1", Op: OpSet}))
+    require.Equal(t, uint64(2), logFile.LastLSN())
+    require.NoError(t, logFile.Close())
+
+    at := time.Unix(1700000000, 0)
+
+    logFile, err = NewFileLog(logPath)
+    require.NoError(t, err)
+    require.Equal(t, uint64(3), appendEvent(t, logFile, Event{Key: "c", Value: "1", Op: OpSet, Time: at}), "LSNs should continue after reopening")
+    require.Equal(t, uint64(4), appendEvent(t, logFile, Event{Key: "b", Op: OpDelete}))
+
+    stats, err := logFile.Compact()
+    require.NoError(t, err)
+    require.Equal(t, 3, stats.RecordsOut, "compaction should keep the live keys and the final delete")
+    require.NoError(t, logFile.Close())
+
+    var events []Event
+    _, err = ReadFile(logPath, func(e Event) error {
+        events = append(events, e)
+        return nil
+    })
+    require.NoError(t, err)
+    require.Len(t, events, 3)
+    require.Equal(t, []uint64{1, 3, 4}, []uint64{events[0].LSN, events[1].LSN, events[2].LSN})
+    require.False(t, events[0].Time.IsZero(), "Append should set the time")
+    require.True(t, at.Equal(events[1].Time), "Append should keep a time that is already set")
+
+    logFile, err = NewFileLog(logPath)
+    require.NoError(t, err)
+    defer logFile.Close()
+
+    require.Equal(t, uint64(5), appendEvent(t, logFile, Event{Key: "d", Value: "1", Op: OpSet}), "LSNs should not be reused after compaction")
+}
+
+func TestFileLog_Expiry(t *testing.T) {
+    t.Helper()
+
+    logPath := t.TempDir() + "/test.log"
+
+    logFile, err := NewFileLog(logPath)
+    require.NoError(t, err)
+
+    expiresAt := time.Unix(1700000060, 0)
+
+    appendEvent(t, logFile, Event{Key: "session", Value: "token", Op: OpSet, ExpiresAt: expiresAt})
+    appendEvent(t, logFile, Event{Key: "other", Value: "1", Op: OpSet})
+    appendEvent(t, logFile, Event{Key: "session", Op: OpExpire})
+
+    stats, err := logFile.Compact()
+    require.NoError(t, err)
+    require.Equal(t, 2, stats.RecordsOut, "an expired key should be compacted away like a deleted one")
+    require.NoError(t, logFile.Close())
+
+    var events []Event
+    _, err = ReadFile(logPath, func(e Event) error {
+        events = append(events, e)
+        return nil
+    })
+    require.NoError(t, err)
+    require.Equal(t, []Event{
+        {Key: "other", Value: "1", Op: OpSet},
+        {Key: "session", Op: OpExpire},
+    }, withoutMeta(events))
+
+    logFile, err = NewFileLog(logPath)
+    require.NoError(t, err)
+    defer logFile.Close()
+
+    appendEvent(t, logFile, Event{Key: "session", Value: "token2", Op: OpSet, ExpiresAt: expiresAt})
+
+    events = events[:0]
+    _, err = ReadFile(logPath, func(e Event) error {
+        events = append(events, e)
+        return nil
+    })
+    require.NoError(t, err)
+    require.True(t, expiresAt.Equal(events[2].ExpiresAt), "expiry time should survive a round trip")
+}
+
+func appendEvent(t *testing.T, l Log, e Event) uint64 {
+    t.Helper()
+
+    lsn, err := l.Append(e)
+    require.NoError(t, err, "Append should not return error")
+
+    return lsn
+}
+
+// withoutMeta clears the fields assigned by Append, so events read back can
+// be compared with the ones that were written.
+func withoutMeta(events []Event) []Event {
+    out := make([]Event, len(events))
+    for i, e := range events {
+        e.LSN = 0
+        e.Time = time.Time{}
+        out[i] = e
+    }
+    return out
+}
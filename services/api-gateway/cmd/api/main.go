@@ -9,6 +9,7 @@ import (
 	"time"
 
 	"github.com/alexey-y-a/go-txlog-microservices/libs/logger"
+	"github.com/alexey-y-a/go-txlog-microservices/services/api-gateway/internal/config"
 	"github.com/alexey-y-a/go-txlog-microservices/services/api-gateway/internal/server"
 )
 
@@ -16,9 +17,30 @@ func main() {
 	logger.Init()
 	log := logger.L().With().Str("service", "api-gateway").Logger()
 
-	kvBaseURL := "http://kv-service:8081"
+	cfg, err := config.Load()
+	if err != nil {
+		log.Fatal().Err(err).Msg("invalid api-gateway configuration")
+	}
+
+	srv, router, err := server.NewServer(cfg)
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to create api-gateway server")
+	}
 
-	srv := server.NewServer(kvBaseURL)
+	// SIGHUP reloads the shards from the shards file.
+	hupChan := make(chan os.Signal, 1)
+	signal.Notify(hupChan, syscall.SIGHUP)
+
+	go func() {
+		for range hupChan {
+			err := router.Reload()
+			if err != nil {
+				log.Error().Err(err).Msg("failed to reload shards")
+				continue
+			}
+			log.Info().Any("shards", router.Shards()).Msg("shards reloaded")
+		}
+	}()
 
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
@@ -36,7 +58,7 @@ func main() {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	err := srv.Shutdown(ctx)
+	err = srv.Shutdown(ctx)
 	if err != nil {
 		log.Error().Err(err).Msg("api-gateway graceful shutdown failed")
 	} else {
@@ -0,0 +1,154 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// changesPath is the replication stream of kv-service; see its replication
+// package.
+const changesPath = "/replication/stream?from=latest"
+
+// maxChangeSize bounds one line of the stream, as in kv-service.
+const maxChangeSize = 1 << 20
+
+// Change is a record kv-service applied to its default namespace. Op is
+// "set", "delete" or "expire"; other records carry no key.
+type Change struct {
+	LSN       uint64    `json:"lsn"`
+	Op        string    `json:"op"`
+	Key       string    `json:"key"`
+	Value     string    `json:"value,omitempty"`
+	ExpiresAt time.Time `json:"expires_at,omitzero"`
+}
+
+type changeMessage struct {
+	LeaderLSN uint64  `json:"leader_lsn"`
+	Event     *Change `json:"event,omitempty"`
+	Error     string  `json:"error,omitempty"`
+}
+
+// ChangeStream reads the records kv-service applies from the moment the
+// stream was opened, in LSN order.
+type ChangeStream struct {
+	body    io.ReadCloser
+	scanner *bufio.Scanner
+	start   uint64
+}
+
+// Changes opens a stream of the changes to the default namespace. The
+// stream ends when ctx is done. kv-service serves it only with the txlog
+// engine and outside of a Raft cluster.
+func (c *KVClient) Changes(ctx context.Context) (*ChangeStream, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.baseURL+changesPath, nil)
+	if err != nil {
+		return nil, fmt.Errorf("kvclient: new GET request: %w", err)
+	}
+
+	// The stream outlives the timeout of the other requests.
+	streamClient := &http.Client{Transport: c.client.Transport}
+
+	resp, err := streamClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("kvclient: do GET request: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("kvclient: change stream failed with status %d", resp.StatusCode)
+	}
+
+	s := &ChangeStream{
+		body:    resp.Body,
+		scanner: bufio.NewScanner(resp.Body),
+	}
+	s.scanner.Buffer(make([]byte, 64*1024), maxChangeSize)
+
+	// The stream starts with a heartbeat at the position it was opened at.
+	m, err := s.read()
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	s.start = m.LeaderLSN
+
+	return s, nil
+}
+
+// Start returns the LSN of the last record applied before the stream was
+// opened.
+func (s *ChangeStream) Start() uint64 {
+	return s.start
+}
+
+// Next blocks until the next change arrives.
+func (s *ChangeStream) Next() (Change, error) {
+	for {
+		m, err := s.read()
+		if err != nil {
+			return Change{}, err
+		}
+		if m.Event != nil {
+			return *m.Event, nil
+		}
+	}
+}
+
+func (s *ChangeStream) read() (changeMessage, error) {
+	var m changeMessage
+
+	if !s.scanner.Scan() {
+		err := s.scanner.Err()
+		if err == nil {
+			err = io.ErrUnexpectedEOF
+		}
+		return m, fmt.Errorf("kvclient: read change stream: %w", err)
+	}
+
+	err := json.Unmarshal(s.scanner.Bytes(), &m)
+	if err != nil {
+		return m, fmt.Errorf("kvclient: decode change: %w", err)
+	}
+
+	if m.Error != "" {
+		return m, errors.New("kvclient: change stream ended: " + m.Error)
+	}
+
+	return m, nil
+}
+
+func (s *ChangeStream) Close() error {
+	return s.body.Close()
+}
+
+type namespacesResponse struct {
+	Namespaces []string `json:"namespaces"`
+}
+
+// Namespaces returns the names of the namespaces of kv-service, the
+// default one included.
+func (c *KVClient) Namespaces() ([]string, error) {
+	resp, err := c.client.Get(c.baseURL + "/admin/namespaces")
+	if err != nil {
+		return nil, fmt.Errorf("kvclient: do GET request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("kvclient: list namespaces failed with status %d", resp.StatusCode)
+	}
+
+	var response namespacesResponse
+	err = json.NewDecoder(resp.Body).Decode(&response)
+	if err != nil {
+		return nil, fmt.Errorf("kvclient: decode namespaces response: %w", err)
+	}
+
+	return response.Namespaces, nil
+}
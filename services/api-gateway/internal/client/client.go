@@ -3,123 +3,447 @@ package client
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
 	"time"
 )
 
 
 type KVClient struct {
     baseURL string
+    // prefix is the path of the namespace the client talks to.
+    prefix string
     client *http.Client
 }
 
 func NewKVClient(baseURL string, timeout time.Duration) *KVClient {
     return &KVClient{
         baseURL: baseURL,
+        prefix: "/kv",
         client: &http.Client {
             Timeout: timeout,
         },
     }
 }
 
+// SetTransport makes c, and the namespace clients made from it, send their
+// requests through rt.
+func (c *KVClient) SetTransport(rt http.RoundTripper) {
+    c.client.Transport = rt
+}
+
+// ErrNamespaceNotFound is returned when the namespace of the client does not
+// exist in kv-service.
+var ErrNamespaceNotFound = errors.New("kvclient: namespace not found")
+
+// Namespace returns a client for the namespace name that shares the
+// connection pool of c.
+func (c *KVClient) Namespace(name string) *KVClient {
+    ns := *c
+    ns.prefix = "/kv/" + url.PathEscape(name)
+    return &ns
+}
+
+// namespaceMissing reports whether resp is kv-service's answer for an
+// unknown namespace, which unlike a missing key carries an error body.
+func namespaceMissing(resp *http.Response) bool {
+    if resp.StatusCode != http.StatusNotFound {
+        return false
+    }
+
+    var response commonResponse
+    err := json.NewDecoder(resp.Body).Decode(&response)
+    return err == nil && response.Status == "error"
+}
+
 type setRequest struct {
     Key   string `json:"key"`
     Value string `json:"value"`
+    TTL   int64  `json:"ttl,omitempty"`
+    Stamp uint64 `json:"stamp,omitempty"`
 }
 
 type commonResponse struct {
     Status  string `json:"status"`
     Message string `json:"message,omitempty"`
+    LSN     uint64 `json:"lsn,omitempty"`
+}
+
+// ErrPreconditionFailed is returned when kv-service rejects a conditional
+// write because the key's version did not match.
+var ErrPreconditionFailed = errors.New("kvclient: precondition failed")
+
+// ErrStale is returned when kv-service rejects a stamped write because the
+// key already holds a write with the same or a later stamp.
+var ErrStale = errors.New("kvclient: stale write")
+
+// Precondition holds raw If-Match and If-None-Match header values for a
+// conditional write. Empty fields are not sent.
+type Precondition struct {
+    IfMatch     string
+    IfNoneMatch string
+}
+
+func (p Precondition) apply(req *http.Request) {
+    if p.IfMatch != "" {
+        req.Header.Set("If-Match", p.IfMatch)
+    }
+    if p.IfNoneMatch != "" {
+        req.Header.Set("If-None-Match", p.IfNoneMatch)
+    }
+}
+
+// ETag formats a key version as the entity tag used by kv-service.
+func ETag(version uint64) string {
+    return `"` + strconv.FormatUint(version, 10) + `"`
+}
+
+func parseETag(tag string) uint64 {
+    version, _ := strconv.ParseUint(strings.Trim(strings.TrimPrefix(tag, "W/"), `"`), 10, 64)
+    return version
 }
 
 func (c *KVClient) Set(key, value string) error {
-    requestBody := setRequest {
-        Key: key,
-        Value: value,
+    _, err := c.SetIf(key, value, Precondition{})
+    return err
+}
+
+// CompareAndSet sets key only if its current version is version and returns
+// the new version. Version 0 means the key must not exist yet.
+func (c *KVClient) CompareAndSet(key, value string, version uint64) (uint64, error) {
+    pre := Precondition{IfMatch: ETag(version)}
+    if version == 0 {
+        pre = Precondition{IfNoneMatch: "*"}
     }
 
+    return c.SetIf(key, value, pre)
+}
+
+// SetIf sets key guarded by pre and returns the new version of the key.
+func (c *KVClient) SetIf(key, value string, pre Precondition) (uint64, error) {
+    return c.SetWithTTL(key, value, 0, pre)
+}
+
+// SetWithTTL is SetIf for a key that expires after ttl, rounded down to
+// whole seconds. A ttl of zero means no expiry.
+func (c *KVClient) SetWithTTL(key, value string, ttl time.Duration, pre Precondition) (uint64, error) {
+    return c.set(setRequest{
+        Key:   key,
+        Value: value,
+        TTL:   int64(ttl / time.Second),
+    }, pre)
+}
+
+// SetStamped is SetWithTTL for a write that kv-service orders by stamp: it
+// fails with ErrStale if the key holds a write stamped stamp or later.
+func (c *KVClient) SetStamped(key, value string, ttl time.Duration, stamp uint64) (uint64, error) {
+    return c.set(setRequest{
+        Key:   key,
+        Value: value,
+        TTL:   int64(ttl / time.Second),
+        Stamp: stamp,
+    }, Precondition{})
+}
+
+func (c *KVClient) set(requestBody setRequest, pre Precondition) (uint64, error) {
     bodyBytes, err := json.Marshal(requestBody)
     if err != nil {
-        return fmt.Errorf("kvclient: marshal set request: %w", err)
+        return 0, fmt.Errorf("kvclient: marshal set request: %w", err)
     }
 
-    url := c.baseURL + "/kv/set"
+    url := c.baseURL + c.prefix + "/set"
 
     req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(bodyBytes))
     if err != nil {
-        return fmt.Errorf("kvclient: new POST request: %w", err)
+        return 0, fmt.Errorf("kvclient: new POST request: %w", err)
     }
 
     req.Header.Set("Content-Type", "application/json")
+    pre.apply(req)
 
     resp, err := c.client.Do(req)
     if err != nil {
-        return fmt.Errorf("kvclient: do POST request: %w", err)
+        return 0, fmt.Errorf("kvclient: do POST request: %w", err)
     }
     defer resp.Body.Close()
 
+    if namespaceMissing(resp) {
+        return 0, ErrNamespaceNotFound
+    }
+
+    if resp.StatusCode == http.StatusPreconditionFailed {
+        return 0, ErrPreconditionFailed
+    }
+
+    if resp.StatusCode == http.StatusConflict {
+        return 0, ErrStale
+    }
+
     if resp.StatusCode != http.StatusOK {
-        return fmt.Errorf("kvclient: set failed with status %d", resp.StatusCode)
+        return 0, fmt.Errorf("kvclient: set failed with status %d", resp.StatusCode)
     }
 
-    return nil
+    var response commonResponse
+    err = json.NewDecoder(resp.Body).Decode(&response)
+    if err != nil {
+        return 0, fmt.Errorf("kvclient: decode set response: %w", err)
+    }
+
+    return response.LSN, nil
 }
 
 type getResponse struct {
     Status string `json:"status"`
     Value string `json:"value,omitempty"`
+    Stamp uint64 `json:"stamp,omitempty"`
+}
+
+// Entry is a key as kv-service stores it.
+type Entry struct {
+    Value   string
+    Version uint64
+    // Stamp is zero for keys not written by SetStamped.
+    Stamp uint64
 }
 
 func (c *KVClient) Get(key string) (string, bool, error) {
-    url := c.baseURL + "/kv/get?key=" + key
+    value, _, ok, err := c.GetVersioned(key)
+    return value, ok, err
+}
+
+// GetVersioned is Get that also returns the version of the key, taken from
+// the ETag of the response.
+func (c *KVClient) GetVersioned(key string) (string, uint64, bool, error) {
+    entry, ok, err := c.GetEntry(key)
+    return entry.Value, entry.Version, ok, err
+}
+
+// GetEntry is Get that returns the whole entry of the key. A missing key
+// that a stamped delete removed comes with the stamp of the delete.
+func (c *KVClient) GetEntry(key string) (Entry, bool, error) {
+    url := c.baseURL + c.prefix + "/get?key=" + key
 
     req, err := http.NewRequest(http.MethodGet, url, nil)
     if err != nil {
-        return "", false, fmt.Errorf("kvclient: new GET request: %w", err)
+        return Entry{}, false, fmt.Errorf("kvclient: new GET request: %w", err)
     }
 
     resp, err := c.client.Do(req)
     if err != nil {
-        return "", false, fmt.Errorf("kvclient: do GET request: %w", err)
+        return Entry{}, false, fmt.Errorf("kvclient: do GET request: %w", err)
     }
     defer resp.Body.Close()
 
     if resp.StatusCode == http.StatusNotFound {
-        return "", false, nil
+        var response getResponse
+        err = json.NewDecoder(resp.Body).Decode(&response)
+        if err == nil && response.Status == "error" {
+            return Entry{}, false, ErrNamespaceNotFound
+        }
+        return Entry{Stamp: response.Stamp}, false, nil
     }
 
     if resp.StatusCode != http.StatusOK {
-        return "", false, fmt.Errorf("kvclient: get failed with status %d", resp.StatusCode)
+        return Entry{}, false, fmt.Errorf("kvclient: get failed with status %d", resp.StatusCode)
     }
 
     var response getResponse
     decoder := json.NewDecoder(resp.Body)
     err = decoder.Decode(&response)
     if err != nil {
-        return "", false, fmt.Errorf("kvclient: decode get response: %w", err)
+        return Entry{}, false, fmt.Errorf("kvclient: decode get response: %w", err)
     }
 
-    return response.Value, true, nil
+    entry := Entry{
+        Value:   response.Value,
+        Version: parseETag(resp.Header.Get("ETag")),
+        Stamp:   response.Stamp,
+    }
+    return entry, true, nil
 }
 
 func (c *KVClient) Delete(key string) error {
-    url := c.baseURL + "/kv/delete?key=" + key
+    _, err := c.DeleteIf(key, Precondition{})
+    return err
+}
+
+// DeleteIf deletes key guarded by pre and returns the LSN of the delete.
+func (c *KVClient) DeleteIf(key string, pre Precondition) (uint64, error) {
+    return c.delete(c.baseURL + c.prefix + "/delete?key=" + key, pre)
+}
+
+// DeleteStamped deletes key unless it holds a write stamped stamp or
+// later, in which case it fails with ErrStale.
+func (c *KVClient) DeleteStamped(key string, stamp uint64) (uint64, error) {
+    return c.delete(c.baseURL + c.prefix + "/delete?key=" + key + "&stamp=" + strconv.FormatUint(stamp, 10), Precondition{})
+}
 
+func (c *KVClient) delete(url string, pre Precondition) (uint64, error) {
     req, err := http.NewRequest(http.MethodDelete, url, nil)
     if err != nil {
-        return fmt.Errorf("kvclient: new DELETE request: %w", err)
+        return 0, fmt.Errorf("kvclient: new DELETE request: %w", err)
+    }
+
+    pre.apply(req)
+
+    resp, err := c.client.Do(req)
+    if err != nil {
+        return 0, fmt.Errorf("kvclient: do DELETE request: %w", err)
+    }
+    defer resp.Body.Close()
+
+    if namespaceMissing(resp) {
+        return 0, ErrNamespaceNotFound
+    }
+
+    if resp.StatusCode == http.StatusPreconditionFailed {
+        return 0, ErrPreconditionFailed
+    }
+
+    if resp.StatusCode == http.StatusConflict {
+        return 0, ErrStale
+    }
+
+    if resp.StatusCode != http.StatusOK {
+        return 0, fmt.Errorf("kvclient: delete failed with status %d", resp.StatusCode)
+    }
+
+    var response commonResponse
+    err = json.NewDecoder(resp.Body).Decode(&response)
+    if err != nil {
+        return 0, fmt.Errorf("kvclient: decode delete response: %w", err)
+    }
+
+    return response.LSN, nil
+}
+
+// TxnOp is one operation of a transaction: Op is "set" or "delete".
+type TxnOp struct {
+    Op    string `json:"op"`
+    Key   string `json:"key"`
+    Value string `json:"value,omitempty"`
+}
+
+type txnRequest struct {
+    Ops []TxnOp `json:"ops"`
+}
+
+// Txn applies ops atomically in kv-service and returns the LSN of the last
+// operation.
+func (c *KVClient) Txn(ops []TxnOp) (uint64, error) {
+    bodyBytes, err := json.Marshal(txnRequest{Ops: ops})
+    if err != nil {
+        return 0, fmt.Errorf("kvclient: marshal txn request: %w", err)
+    }
+
+    url := c.baseURL + c.prefix + "/txn"
+
+    req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(bodyBytes))
+    if err != nil {
+        return 0, fmt.Errorf("kvclient: new POST request: %w", err)
+    }
+
+    req.Header.Set("Content-Type", "application/json")
+
+    resp, err := c.client.Do(req)
+    if err != nil {
+        return 0, fmt.Errorf("kvclient: do POST request: %w", err)
+    }
+    defer resp.Body.Close()
+
+    if namespaceMissing(resp) {
+        return 0, ErrNamespaceNotFound
+    }
+
+    if resp.StatusCode != http.StatusOK {
+        return 0, fmt.Errorf("kvclient: txn failed with status %d", resp.StatusCode)
+    }
+
+    var response commonResponse
+    err = json.NewDecoder(resp.Body).Decode(&response)
+    if err != nil {
+        return 0, fmt.Errorf("kvclient: decode txn response: %w", err)
+    }
+
+    return response.LSN, nil
+}
+
+// ScanRequest selects a page of keys; see kv-service /kv/scan. Empty fields
+// and a zero Limit are not sent.
+type ScanRequest struct {
+    Prefix string
+    Start  string
+    End    string
+    Cursor string
+    Limit  int
+}
+
+type ScanItem struct {
+    Key     string `json:"key"`
+    Value   string `json:"value"`
+    Version uint64 `json:"version"`
+    // ExpiresAt is zero for keys without a TTL.
+    ExpiresAt time.Time `json:"expires_at,omitzero"`
+}
+
+// ScanPage is one page of a scan. NextCursor is empty on the last page.
+type ScanPage struct {
+    Items      []ScanItem `json:"items"`
+    NextCursor string     `json:"next_cursor,omitempty"`
+}
+
+// ErrInvalidScan is returned when kv-service rejects the scan parameters.
+var ErrInvalidScan = errors.New("kvclient: invalid scan request")
+
+func (c *KVClient) Scan(scan ScanRequest) (ScanPage, error) {
+    var page ScanPage
+
+    query := url.Values{}
+    for name, value := range map[string]string{
+        "prefix": scan.Prefix,
+        "start":  scan.Start,
+        "end":    scan.End,
+        "cursor": scan.Cursor,
+    } {
+        if value != "" {
+            query.Set(name, value)
+        }
+    }
+    if scan.Limit > 0 {
+        query.Set("limit", strconv.Itoa(scan.Limit))
+    }
+
+    req, err := http.NewRequest(http.MethodGet, c.baseURL + c.prefix + "/scan?"+query.Encode(), nil)
+    if err != nil {
+        return page, fmt.Errorf("kvclient: new GET request: %w", err)
     }
 
     resp, err := c.client.Do(req)
     if err != nil {
-        return fmt.Errorf("kvclient: do DELETE request: %w", err)
+        return page, fmt.Errorf("kvclient: do GET request: %w", err)
     }
     defer resp.Body.Close()
 
+    if namespaceMissing(resp) {
+        return page, ErrNamespaceNotFound
+    }
+
+    if resp.StatusCode == http.StatusBadRequest {
+        return page, ErrInvalidScan
+    }
+
     if resp.StatusCode != http.StatusOK {
-        return fmt.Errorf("kvclient: delete failed with status %d", resp.StatusCode)
+        return page, fmt.Errorf("kvclient: scan failed with status %d", resp.StatusCode)
     }
 
-    return nil
-}
\ No newline at end of file
+    err = json.NewDecoder(resp.Body).Decode(&page)
+    if err != nil {
+        return page, fmt.Errorf("kvclient: decode scan response: %w", err)
+    }
+
+    return page, nil
+}
@@ -0,0 +1,103 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/alexey-y-a/go-txlog-microservices/services/api-gateway/internal/shard"
+)
+
+type Config struct {
+	Addr      string
+	KVTimeout time.Duration
+
+	// Shards are the kv-service instances the keys are spread over.
+	Shards shard.Config
+	// ShardsFile, if set, holds the shards instead, as JSON; it is read
+	// again on SIGHUP and on POST /admin/shards/reload.
+	ShardsFile string
+
+	// Quorum is the N/R/W of every namespace; requests can override it.
+	Quorum shard.QuorumConfig
+}
+
+func Default() Config {
+	return Config{
+		Addr:      ":8080",
+		KVTimeout: 3 * time.Second,
+
+		Shards: shard.Config{
+			Shards: []shard.Shard{{Name: "kv-service", URL: "http://kv-service:8081"}},
+		},
+
+		Quorum: shard.QuorumConfig{Default: shard.DefaultQuorum},
+	}
+}
+
+// Load reads the api-gateway configuration from GATEWAY_* environment
+// variables, falling back to Default for unset ones.
+func Load() (Config, error) {
+	cfg := Default()
+
+	if v := os.Getenv("GATEWAY_ADDR"); v != "" {
+		cfg.Addr = v
+	}
+
+	if v := os.Getenv("GATEWAY_KV_TIMEOUT"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return cfg, fmt.Errorf("config: GATEWAY_KV_TIMEOUT: invalid duration %q", v)
+		}
+		cfg.KVTimeout = d
+	}
+
+	if v := os.Getenv("GATEWAY_KV_SHARDS"); v != "" {
+		shards, err := shard.ParseList(v)
+		if err != nil {
+			return cfg, fmt.Errorf("config: GATEWAY_KV_SHARDS: %w", err)
+		}
+		cfg.Shards.Shards = shards
+	}
+
+	if v := os.Getenv("GATEWAY_VIRTUAL_NODES"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return cfg, fmt.Errorf("config: GATEWAY_VIRTUAL_NODES: invalid number %q", v)
+		}
+		cfg.Shards.VirtualNodes = n
+	}
+
+	if v := os.Getenv("GATEWAY_SHARDS_FILE"); v != "" {
+		shards, err := shard.LoadFile(v)
+		if err != nil {
+			return cfg, fmt.Errorf("config: GATEWAY_SHARDS_FILE: %w", err)
+		}
+		cfg.ShardsFile = v
+		cfg.Shards = shards
+	}
+
+	err := cfg.Shards.Validate()
+	if err != nil {
+		return cfg, fmt.Errorf("config: GATEWAY_KV_SHARDS: %w", err)
+	}
+
+	if v := os.Getenv("GATEWAY_QUORUM"); v != "" {
+		q, err := shard.ParseQuorum(v)
+		if err != nil {
+			return cfg, fmt.Errorf("config: GATEWAY_QUORUM: %w", err)
+		}
+		cfg.Quorum.Default = q
+	}
+
+	if v := os.Getenv("GATEWAY_NAMESPACE_QUORUMS"); v != "" {
+		quorums, err := shard.ParseNamespaceQuorums(v)
+		if err != nil {
+			return cfg, fmt.Errorf("config: GATEWAY_NAMESPACE_QUORUMS: %w", err)
+		}
+		cfg.Quorum.Namespaces = quorums
+	}
+
+	return cfg, nil
+}
@@ -2,21 +2,24 @@ package http
 
 import (
 	"encoding/json"
+	"errors"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/alexey-y-a/go-txlog-microservices/libs/logger"
 	"github.com/alexey-y-a/go-txlog-microservices/libs/txlog"
 	"github.com/alexey-y-a/go-txlog-microservices/services/api-gateway/internal/client"
+	"github.com/alexey-y-a/go-txlog-microservices/services/api-gateway/internal/shard"
 )
 
 type Handler struct {
-	kvClient *client.KVClient
+	router *shard.Router
 }
 
-func NewHandler(kvClient *client.KVClient) *Handler {
+func NewHandler(router *shard.Router) *Handler {
 	return &Handler{
-		kvClient: kvClient,
+		router: router,
 	}
 }
 
@@ -27,9 +30,14 @@ type healthResponse struct {
 
 func (h *Handler) RegisterRoutes(mux *http.ServeMux) {
 	mux.HandleFunc("/health", h.HealthHandler)
-	mux.HandleFunc("/api/set", h.SetHandler)
-	mux.HandleFunc("/api/get", h.GetHandler)
-	mux.HandleFunc("/api/delete", h.DeleteHandler)
+
+	for _, prefix := range []string{"/api", "/api/{ns}"} {
+		mux.HandleFunc(prefix+"/set", h.SetHandler)
+		mux.HandleFunc(prefix+"/get", h.GetHandler)
+		mux.HandleFunc(prefix+"/delete", h.DeleteHandler)
+		mux.HandleFunc(prefix+"/txn", h.TxnHandler)
+		mux.HandleFunc(prefix+"/scan", h.ScanHandler)
+	}
 }
 
 func (h *Handler) HealthHandler(w http.ResponseWriter, r *http.Request) {
@@ -52,6 +60,8 @@ func (h *Handler) HealthHandler(w http.ResponseWriter, r *http.Request) {
 type setRequest struct {
 	Key   string `json:"key"`
 	Value string `json:"value"`
+	// TTL is the lifetime of the key in seconds; zero means no expiry.
+	TTL int64 `json:"ttl,omitempty"`
 }
 
 type commonResponse struct {
@@ -86,7 +96,42 @@ func (h *Handler) SetHandler(w http.ResponseWriter, r *http.Request) {
         return
     }
 
-	err = h.kvClient.Set(req.Key, req.Value)
+	if req.TTL < 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	q, err := h.quorum(r)
+	if writeQuorumError(w, err) {
+		return
+	}
+
+	pre := precondition(r)
+	if pre != (client.Precondition{}) && rejectReplicated(w, q, "preconditions") {
+		return
+	}
+
+	ns := r.PathValue("ns")
+	ttl := time.Duration(req.TTL) * time.Second
+
+	var version uint64
+	if q.N > 1 {
+		err = h.router.QuorumSet(ns, req.Key, req.Value, ttl, q)
+	} else {
+		version, err = h.router.Set(ns, req.Key, req.Value, ttl, pre)
+	}
+	if errors.Is(err, client.ErrPreconditionFailed) {
+		w.WriteHeader(http.StatusPreconditionFailed)
+		return
+	}
+	if errors.Is(err, client.ErrNamespaceNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if writeQuorumError(w, err) {
+		log.Warn().Err(err).Str("key", req.Key).Stringer("quorum", q).Msg("set quorum not reached")
+		return
+	}
 	if err != nil {
 		log.Error().Err(err).Str("key", req.Key).Msg("kv-client set failed")
 		w.WriteHeader(http.StatusBadGateway)
@@ -98,7 +143,12 @@ func (h *Handler) SetHandler(w http.ResponseWriter, r *http.Request) {
 		Message: "value set via api-gateway",
 	}
 
+	// Replicas store a key under versions of their own, so a replicated
+	// write has none to report.
 	w.Header().Set("Content-Type", "application/json")
+	if version != 0 {
+		w.Header().Set("ETag", client.ETag(version))
+	}
 	w.WriteHeader(http.StatusOK)
 
 	err = json.NewEncoder(w).Encode(resp)
@@ -126,7 +176,29 @@ func (h *Handler) GetHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	value, ok, err := h.kvClient.Get(key)
+	q, err := h.quorum(r)
+	if writeQuorumError(w, err) {
+		return
+	}
+
+	var (
+		value   string
+		version uint64
+		ok      bool
+	)
+	if q.N > 1 {
+		value, ok, err = h.router.QuorumGet(r.PathValue("ns"), key, q)
+	} else {
+		value, version, ok, err = h.router.Get(r.PathValue("ns"), key)
+	}
+	if errors.Is(err, client.ErrNamespaceNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if writeQuorumError(w, err) {
+		log.Warn().Err(err).Str("key", key).Stringer("quorum", q).Msg("get quorum not reached")
+		return
+	}
 	if err != nil {
 		log.Error().Err(err).Str("key", key).Msg("kv-client get failed")
 		w.WriteHeader(http.StatusBadGateway)
@@ -144,6 +216,9 @@ func (h *Handler) GetHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	w.Header().Set("Content-Type", "application/json")
+	if version != 0 {
+		w.Header().Set("ETag", client.ETag(version))
+	}
 	w.WriteHeader(http.StatusOK)
 
 	err = json.NewEncoder(w).Encode(resp)
@@ -166,7 +241,33 @@ func (h *Handler) DeleteHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err := h.kvClient.Delete(key)
+	q, err := h.quorum(r)
+	if writeQuorumError(w, err) {
+		return
+	}
+
+	pre := precondition(r)
+	if pre != (client.Precondition{}) && rejectReplicated(w, q, "preconditions") {
+		return
+	}
+
+	if q.N > 1 {
+		err = h.router.QuorumDelete(r.PathValue("ns"), key, q)
+	} else {
+		err = h.router.Delete(r.PathValue("ns"), key, pre)
+	}
+	if errors.Is(err, client.ErrPreconditionFailed) {
+		w.WriteHeader(http.StatusPreconditionFailed)
+		return
+	}
+	if errors.Is(err, client.ErrNamespaceNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if writeQuorumError(w, err) {
+		log.Warn().Err(err).Str("key", key).Stringer("quorum", q).Msg("delete quorum not reached")
+		return
+	}
 	if err != nil {
 		log.Error().Err(err).Str("key", key).Msg("kv-client delete failed")
 		w.WriteHeader(http.StatusBadGateway)
@@ -186,3 +287,154 @@ func (h *Handler) DeleteHandler(w http.ResponseWriter, r *http.Request) {
 		log.Error().Err(err).Msg("failed to write delete response")
 	}
 }
+
+type txnRequest struct {
+	Ops []client.TxnOp `json:"ops"`
+}
+
+func (h *Handler) TxnHandler(w http.ResponseWriter, r *http.Request) {
+	log := logger.L().With().Str("handler", "api_txn").Logger()
+
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req txnRequest
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&req)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to decode txn request")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if len(req.Ops) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	for _, op := range req.Ops {
+		if op.Op != txlog.OpSet && op.Op != txlog.OpDelete {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		if op.Key == "" || len(op.Key) > txlog.MaxKeySize || len(op.Value) > txlog.MaxValueSize {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	q, err := h.quorum(r)
+	if writeQuorumError(w, err) {
+		return
+	}
+	if rejectReplicated(w, q, "transactions") {
+		return
+	}
+
+	err = h.router.Txn(r.PathValue("ns"), req.Ops)
+	if errors.Is(err, shard.ErrCrossShardTxn) {
+		writeJSON(w, http.StatusBadRequest, commonResponse{
+			Status:  "error",
+			Message: err.Error(),
+		})
+		return
+	}
+	if errors.Is(err, client.ErrNamespaceNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Error().Err(err).Int("ops", len(req.Ops)).Msg("kv-client txn failed")
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+
+	resp := commonResponse{
+		Status:  "ok",
+		Message: "transaction committed via api-gateway",
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	err = json.NewEncoder(w).Encode(resp)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to write txn response")
+	}
+}
+
+// precondition forwards the conditional headers of r to kv-service.
+func precondition(r *http.Request) client.Precondition {
+	return client.Precondition{
+		IfMatch:     r.Header.Get("If-Match"),
+		IfNoneMatch: r.Header.Get("If-None-Match"),
+	}
+}
+
+type scanResponse struct {
+	Status     string            `json:"status"`
+	Items      []client.ScanItem `json:"items"`
+	NextCursor string            `json:"next_cursor,omitempty"`
+}
+
+func (h *Handler) ScanHandler(w http.ResponseWriter, r *http.Request) {
+	log := logger.L().With().Str("handler", "api_scan").Logger()
+
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+
+	scan := client.ScanRequest{
+		Prefix: query.Get("prefix"),
+		Start:  query.Get("start"),
+		End:    query.Get("end"),
+		Cursor: query.Get("cursor"),
+	}
+
+	if v := query.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit <= 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		scan.Limit = limit
+	}
+
+	page, err := h.router.Scan(r.PathValue("ns"), scan)
+	if errors.Is(err, client.ErrInvalidScan) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if errors.Is(err, client.ErrNamespaceNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("kv-client scan failed")
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+
+	resp := scanResponse{
+		Status:     "ok",
+		Items:      page.Items,
+		NextCursor: page.NextCursor,
+	}
+	if resp.Items == nil {
+		resp.Items = []client.ScanItem{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	err = json.NewEncoder(w).Encode(resp)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to write scan response")
+	}
+}
@@ -0,0 +1,73 @@
+package http
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/alexey-y-a/go-txlog-microservices/services/api-gateway/internal/shard"
+)
+
+// quorum returns the quorum of a request: the one of its namespace with
+// the n, r and w given in the query in place of its own. An n below the
+// namespace's own is rejected: its other replicas would miss the write,
+// and a write to a single replica would not be stamped.
+func (h *Handler) quorum(r *http.Request) (shard.Quorum, error) {
+	configured := h.router.Quorum(r.PathValue("ns"))
+	q := configured
+
+	query := r.URL.Query()
+	for name, dst := range map[string]*int{"n": &q.N, "r": &q.R, "w": &q.W} {
+		v := query.Get(name)
+		if v == "" {
+			continue
+		}
+
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return q, fmt.Errorf("%w: invalid %s %q", shard.ErrInvalidQuorum, name, v)
+		}
+		*dst = n
+	}
+
+	if q.N < configured.N {
+		return q, fmt.Errorf("%w: n=%d is below the namespace quorum %s", shard.ErrInvalidQuorum, q.N, configured)
+	}
+
+	return q, q.Validate()
+}
+
+// writeQuorumError answers 400 itself for a quorum the shards cannot serve
+// and 503 for one that was not reached.
+func writeQuorumError(w http.ResponseWriter, err error) bool {
+	status := 0
+	switch {
+	case errors.Is(err, shard.ErrInvalidQuorum):
+		status = http.StatusBadRequest
+	case errors.Is(err, shard.ErrQuorumNotReached), errors.Is(err, shard.ErrRebalancing):
+		status = http.StatusServiceUnavailable
+	default:
+		return false
+	}
+
+	writeJSON(w, status, commonResponse{
+		Status:  "error",
+		Message: err.Error(),
+	})
+	return true
+}
+
+// rejectReplicated answers 400 itself for a request that cannot be served
+// with more than one replica, for the reason given.
+func rejectReplicated(w http.ResponseWriter, q shard.Quorum, reason string) bool {
+	if q.N == 1 {
+		return false
+	}
+
+	writeJSON(w, http.StatusBadRequest, commonResponse{
+		Status:  "error",
+		Message: fmt.Sprintf("%s need n=1, the quorum is %s", reason, q),
+	})
+	return true
+}
@@ -0,0 +1,153 @@
+package http
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/alexey-y-a/go-txlog-microservices/libs/logger"
+	"github.com/alexey-y-a/go-txlog-microservices/services/api-gateway/internal/shard"
+)
+
+type shardsResponse struct {
+	Status string        `json:"status"`
+	Shards []shard.Shard `json:"shards"`
+	// Owner is the shard of the key given in the query, if any.
+	Owner *shard.Shard `json:"owner,omitempty"`
+}
+
+// ShardsHandler lists the kv-service shards of the gateway. With a key in
+// the query it also names the shard that owns the key.
+func (h *Handler) ShardsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	resp := shardsResponse{
+		Status: "ok",
+		Shards: h.router.Shards(),
+	}
+	if key := r.URL.Query().Get("key"); key != "" {
+		owner := h.router.Lookup(key)
+		resp.Owner = &owner
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// ReloadShardsHandler reads the shard configuration again and applies it.
+func (h *Handler) ReloadShardsHandler(w http.ResponseWriter, r *http.Request) {
+	log := logger.L().With().Str("handler", "admin_shards_reload").Logger()
+
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	err := h.router.Reload()
+	if errors.Is(err, shard.ErrRebalancing) {
+		writeJSON(w, http.StatusConflict, commonResponse{
+			Status:  "error",
+			Message: err.Error(),
+		})
+		return
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("failed to reload shards")
+
+		writeJSON(w, http.StatusBadRequest, commonResponse{
+			Status:  "error",
+			Message: err.Error(),
+		})
+		return
+	}
+
+	log.Info().Any("shards", h.router.Shards()).Msg("shards reloaded")
+
+	writeJSON(w, http.StatusOK, shardsResponse{
+		Status: "ok",
+		Shards: h.router.Shards(),
+	})
+}
+
+type rebalanceResponse struct {
+	Status    string          `json:"status"`
+	Rebalance *shard.Progress `json:"rebalance"`
+}
+
+// RebalanceHandler starts moving the keys to new shards on POST, given in
+// the body or, without a body, read from the shards file. GET reports the
+// progress of the current or the last rebalancing.
+func (h *Handler) RebalanceHandler(w http.ResponseWriter, r *http.Request) {
+	log := logger.L().With().Str("handler", "admin_shards_rebalance").Logger()
+
+	switch r.Method {
+	case http.MethodGet:
+		resp := rebalanceResponse{Status: "ok"}
+		if progress, ok := h.router.Rebalancing(); ok {
+			resp.Rebalance = &progress
+		}
+		writeJSON(w, http.StatusOK, resp)
+	case http.MethodPost:
+		cfg, err := rebalanceConfig(h.router, r)
+		if err == nil {
+			err = h.router.Rebalance(cfg)
+		}
+		if errors.Is(err, shard.ErrRebalancing) {
+			writeJSON(w, http.StatusConflict, commonResponse{
+				Status:  "error",
+				Message: err.Error(),
+			})
+			return
+		}
+		if err != nil {
+			log.Error().Err(err).Msg("failed to start rebalancing")
+
+			writeJSON(w, http.StatusBadRequest, commonResponse{
+				Status:  "error",
+				Message: err.Error(),
+			})
+			return
+		}
+
+		progress, _ := h.router.Rebalancing()
+		log.Info().Any("to", progress.To).Int("moves", len(progress.Moves)).Msg("rebalancing started")
+
+		writeJSON(w, http.StatusAccepted, rebalanceResponse{
+			Status:    "ok",
+			Rebalance: &progress,
+		})
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// rebalanceConfig returns the shards given in the body of r, or read from
+// the source of router if the body is empty.
+func rebalanceConfig(router *shard.Router, r *http.Request) (shard.Config, error) {
+	var cfg shard.Config
+
+	err := json.NewDecoder(r.Body).Decode(&cfg)
+	if errors.Is(err, io.EOF) {
+		return router.ReadSource()
+	}
+	if err != nil {
+		return cfg, fmt.Errorf("invalid shards: %w", err)
+	}
+	return cfg, nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	log := logger.L()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to write response")
+	}
+}
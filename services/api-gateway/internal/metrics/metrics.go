@@ -2,6 +2,7 @@ package metrics
 
 import (
 	"net/http"
+	"path"
 	"strconv"
 	"time"
 
@@ -17,6 +18,51 @@ var httpRequestsTotal = promauto.NewCounterVec(
 	},
 	[]string{"handler", "method", "status"},
 )
+
+var shardRequestsTotal = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "kv_shard_requests_total",
+		Help: "Total number of requests sent to each kv-service shard.",
+	},
+	[]string{"shard", "op", "status"},
+)
+
+var shardRequestDuration = promauto.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Name:    "kv_shard_request_duration_seconds",
+		Help:    "Duration of requests sent to each kv-service shard.",
+		Buckets: prometheus.DefBuckets,
+	},
+	[]string{"shard", "op"},
+)
+
+// InstrumentTransport counts the requests that go through next to the
+// shard named shard. The operation is the last element of the request path,
+// such as set or scan; the status is "error" when no response was received.
+func InstrumentTransport(shard string, next http.RoundTripper) http.RoundTripper {
+	return roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		op := path.Base(r.URL.Path)
+		start := time.Now()
+
+		resp, err := next.RoundTrip(r)
+
+		status := "error"
+		if err == nil {
+			status = strconv.Itoa(resp.StatusCode)
+		}
+		shardRequestsTotal.WithLabelValues(shard, op, status).Inc()
+		shardRequestDuration.WithLabelValues(shard, op).Observe(time.Since(start).Seconds())
+
+		return resp, err
+	})
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
 func InstrumentHandler(handlerName string, next http.Handler) http.Handler {
     return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
         ww := &responseWriterWrapper{
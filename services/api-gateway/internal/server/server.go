@@ -2,41 +2,65 @@ package server
 
 import (
 	"net/http"
-	"time"
 
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 
 	"github.com/alexey-y-a/go-txlog-microservices/libs/logger"
-	"github.com/alexey-y-a/go-txlog-microservices/services/api-gateway/internal/client"
+	"github.com/alexey-y-a/go-txlog-microservices/services/api-gateway/internal/config"
 	apihttp "github.com/alexey-y-a/go-txlog-microservices/services/api-gateway/internal/http"
 	apimetrics "github.com/alexey-y-a/go-txlog-microservices/services/api-gateway/internal/metrics"
+	"github.com/alexey-y-a/go-txlog-microservices/services/api-gateway/internal/shard"
 )
 
-func NewServer(kvBaseURL string) *http.Server {
+// NewServer returns the api-gateway server over the kv-service shards of
+// cfg. The returned router can reload the shards from cfg.ShardsFile.
+func NewServer(cfg config.Config) (*http.Server, *shard.Router, error) {
 	logger.Init()
 	log := logger.L().With().Str("service", "api-gateway").Logger()
 
-	kvTimeout := 3 * time.Second
-	kvClient := client.NewKVClient(kvBaseURL, kvTimeout)
+	router, err := shard.NewRouter(cfg.Shards, cfg.KVTimeout)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	router.SetQuorum(cfg.Quorum)
+
+	if cfg.ShardsFile != "" {
+		router.SetSource(func() (shard.Config, error) {
+			return shard.LoadFile(cfg.ShardsFile)
+		})
+	}
 
 	mux := http.NewServeMux()
 
-	handler := apihttp.NewHandler(kvClient)
+	handler := apihttp.NewHandler(router)
 
 	mux.Handle("/health", apimetrics.InstrumentHandler("health", http.HandlerFunc(handler.HealthHandler)))
-	mux.Handle("/api/set", apimetrics.InstrumentHandler("api_set", http.HandlerFunc(handler.SetHandler)))
-	mux.Handle("/api/get", apimetrics.InstrumentHandler("api_get", http.HandlerFunc(handler.GetHandler)))
-	mux.Handle("/api/delete", apimetrics.InstrumentHandler("api_delete", http.HandlerFunc(handler.DeleteHandler)))
+	for _, prefix := range []string{"/api", "/api/{ns}"} {
+		mux.Handle(prefix+"/set", apimetrics.InstrumentHandler("api_set", http.HandlerFunc(handler.SetHandler)))
+		mux.Handle(prefix+"/get", apimetrics.InstrumentHandler("api_get", http.HandlerFunc(handler.GetHandler)))
+		mux.Handle(prefix+"/delete", apimetrics.InstrumentHandler("api_delete", http.HandlerFunc(handler.DeleteHandler)))
+		mux.Handle(prefix+"/txn", apimetrics.InstrumentHandler("api_txn", http.HandlerFunc(handler.TxnHandler)))
+		mux.Handle(prefix+"/scan", apimetrics.InstrumentHandler("api_scan", http.HandlerFunc(handler.ScanHandler)))
+	}
+
+	mux.Handle("/admin/shards", apimetrics.InstrumentHandler("admin_shards", http.HandlerFunc(handler.ShardsHandler)))
+	mux.Handle("/admin/shards/reload", apimetrics.InstrumentHandler("admin_shards_reload", http.HandlerFunc(handler.ReloadShardsHandler)))
+	mux.Handle("/admin/shards/rebalance", apimetrics.InstrumentHandler("admin_shards_rebalance", http.HandlerFunc(handler.RebalanceHandler)))
 
 	mux.Handle("/metrics", promhttp.Handler())
 
-	addr := ":8080"
+	addr := cfg.Addr
 	server := &http.Server{
 		Addr:    addr,
 		Handler: mux,
 	}
 
-	log.Info().Str("addr", addr).Msg("api-gateway http server created")
+	log.Info().
+		Str("addr", addr).
+		Any("shards", router.Shards()).
+		Stringer("quorum", cfg.Quorum.For("")).
+		Msg("api-gateway http server created")
 
-	return server
+	return server, router, nil
 }
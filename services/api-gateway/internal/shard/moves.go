@@ -0,0 +1,76 @@
+package shard
+
+import (
+	"slices"
+	"strings"
+)
+
+// HashRange is the range of key hashes h with Start < h <= End. The range
+// that wraps around the ring has Start >= End.
+type HashRange struct {
+	Start uint64 `json:"start"`
+	End   uint64 `json:"end"`
+}
+
+// Move is the part of the ring whose keys go from one shard to another.
+type Move struct {
+	Source string      `json:"source"`
+	Dest   string      `json:"dest"`
+	Ranges []HashRange `json:"ranges"`
+}
+
+// Moves returns the ranges of hashes whose keys belong to another shard in
+// to than in from, grouped by source and destination.
+func Moves(from, to *Ring) []Move {
+	bounds := make([]uint64, 0, len(from.points)+len(to.points))
+	for _, p := range from.points {
+		bounds = append(bounds, p.hash)
+	}
+	for _, p := range to.points {
+		bounds = append(bounds, p.hash)
+	}
+	slices.Sort(bounds)
+	bounds = slices.Compact(bounds)
+
+	var moves []Move
+	index := make(map[[2]string]int)
+
+	// No point of either ring lies inside a range between two bounds, so
+	// every hash of the range belongs to the owner of its end. The first
+	// range wraps around.
+	prev := bounds[len(bounds)-1]
+	for _, end := range bounds {
+		start := prev
+		prev = end
+
+		source := from.shards[from.points[from.search(end)].shard].Name
+		dest := to.shards[to.points[to.search(end)].shard].Name
+		if source == dest {
+			continue
+		}
+
+		key := [2]string{source, dest}
+		i, ok := index[key]
+		if !ok {
+			i = len(moves)
+			index[key] = i
+			moves = append(moves, Move{Source: source, Dest: dest})
+		}
+
+		ranges := moves[i].Ranges
+		if n := len(ranges); n > 0 && ranges[n-1].End == start {
+			ranges[n-1].End = end
+			continue
+		}
+		moves[i].Ranges = append(ranges, HashRange{Start: start, End: end})
+	}
+
+	slices.SortFunc(moves, func(a, b Move) int {
+		if c := strings.Compare(a.Source, b.Source); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Dest, b.Dest)
+	})
+
+	return moves
+}
@@ -0,0 +1,345 @@
+package shard
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/alexey-y-a/go-txlog-microservices/services/api-gateway/internal/client"
+)
+
+var (
+	// ErrInvalidQuorum is returned for a quorum that the shards cannot
+	// serve, such as more replicas than shards.
+	ErrInvalidQuorum = errors.New("shard: invalid quorum")
+	// ErrQuorumNotReached is matched by the QuorumError of an operation
+	// that too few replicas acknowledged.
+	ErrQuorumNotReached = errors.New("shard: quorum not reached")
+	// ErrReplicated is returned by Rebalance when the default namespace
+	// keeps more than one replica of a key, which rebalancing cannot move.
+	ErrReplicated = errors.New("shard: keys with several replicas cannot be rebalanced")
+)
+
+// Quorum is how many shards hold a key (N), and how many of them must
+// answer a read (R) or acknowledge a write (W) for it to succeed. With
+// R+W > N every read reaches a replica that acknowledged the last write.
+type Quorum struct {
+	N int `json:"n"`
+	R int `json:"r"`
+	W int `json:"w"`
+}
+
+// DefaultQuorum keeps a single replica of every key.
+var DefaultQuorum = Quorum{N: 1, R: 1, W: 1}
+
+// Validate checks that R and W are between 1 and N.
+func (q Quorum) Validate() error {
+	if q.N < 1 || q.R < 1 || q.R > q.N || q.W < 1 || q.W > q.N {
+		return fmt.Errorf("%w %s: need 1 <= r, w <= n", ErrInvalidQuorum, q)
+	}
+	return nil
+}
+
+func (q Quorum) String() string {
+	return fmt.Sprintf("%d/%d/%d", q.N, q.R, q.W)
+}
+
+// ParseQuorum parses a quorum written as N/R/W, such as "3/2/2".
+func ParseQuorum(v string) (Quorum, error) {
+	var q Quorum
+
+	parts := strings.Split(v, "/")
+	if len(parts) != 3 {
+		return q, fmt.Errorf("%w %q: want n/r/w", ErrInvalidQuorum, v)
+	}
+
+	for i, dst := range []*int{&q.N, &q.R, &q.W} {
+		n, err := strconv.Atoi(strings.TrimSpace(parts[i]))
+		if err != nil {
+			return q, fmt.Errorf("%w %q: want n/r/w", ErrInvalidQuorum, v)
+		}
+		*dst = n
+	}
+
+	return q, q.Validate()
+}
+
+// QuorumConfig is the quorum of every namespace.
+type QuorumConfig struct {
+	// Default applies to the default namespace and to the namespaces
+	// missing from Namespaces.
+	Default    Quorum
+	Namespaces map[string]Quorum
+}
+
+// For returns the quorum of the namespace ns, the default one if empty.
+func (c QuorumConfig) For(ns string) Quorum {
+	if q, ok := c.Namespaces[ns]; ok {
+		return q
+	}
+	if c.Default == (Quorum{}) {
+		return DefaultQuorum
+	}
+	return c.Default
+}
+
+// ParseNamespaceQuorums parses a comma separated list of ns=N/R/W, such as
+// "orders=3/2/2,cache=2/1/1".
+func ParseNamespaceQuorums(v string) (map[string]Quorum, error) {
+	quorums := make(map[string]Quorum)
+
+	for _, item := range strings.Split(v, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		ns, spec, ok := strings.Cut(item, "=")
+		if !ok || ns == "" {
+			return nil, fmt.Errorf("%w %q: want ns=n/r/w", ErrInvalidQuorum, item)
+		}
+
+		q, err := ParseQuorum(spec)
+		if err != nil {
+			return nil, err
+		}
+		quorums[ns] = q
+	}
+
+	return quorums, nil
+}
+
+// QuorumError reports an operation that fewer than Needed of Replicas
+// acknowledged. Errs are the failures of the other replicas. A write that
+// failed may still have been stored by the replicas that acknowledged it.
+type QuorumError struct {
+	Op       string
+	Replicas int
+	Needed   int
+	Acked    int
+	Errs     []error
+}
+
+func (e *QuorumError) Error() string {
+	msgs := make([]string, len(e.Errs))
+	for i, err := range e.Errs {
+		msgs[i] = err.Error()
+	}
+
+	return fmt.Sprintf("shard: %s quorum not reached: %d of %d replicas answered, %d needed: %s",
+		e.Op, e.Acked, e.Replicas, e.Needed, strings.Join(msgs, "; "))
+}
+
+func (e *QuorumError) Is(target error) bool {
+	return target == ErrQuorumNotReached
+}
+
+func (e *QuorumError) Unwrap() []error {
+	return e.Errs
+}
+
+// LookupN returns the first n distinct shards at or after the hash of key,
+// the owner of the key first. It returns fewer if the ring has fewer.
+func (r *Ring) LookupN(key string, n int) []Shard {
+	shards := make([]Shard, 0, min(n, len(r.shards)))
+	seen := make([]bool, len(r.shards))
+
+	start := r.search(hash(key))
+	for i := 0; i < len(r.points) && len(shards) < n; i++ {
+		p := r.points[(start+i)%len(r.points)]
+		if seen[p.shard] {
+			continue
+		}
+		seen[p.shard] = true
+		shards = append(shards, r.shards[p.shard])
+	}
+
+	return shards
+}
+
+// stampClock issues the stamps of quorum writes: the wall clock in Unix
+// nanoseconds, made strictly increasing within the gateway. Writes from
+// different gateways are ordered by their clocks.
+type stampClock struct {
+	last atomic.Uint64
+}
+
+func (c *stampClock) next() uint64 {
+	for {
+		last := c.last.Load()
+		stamp := max(uint64(time.Now().UnixNano()), last+1)
+		if c.last.CompareAndSwap(last, stamp) {
+			return stamp
+		}
+	}
+}
+
+// SetQuorum makes cfg the quorum of the namespaces.
+func (r *Router) SetQuorum(cfg QuorumConfig) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.quorum = cfg
+}
+
+// Quorum returns the quorum of the namespace ns.
+func (r *Router) Quorum(ns string) Quorum {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.quorum.For(ns)
+}
+
+// replica is the client of a namespace on one of the shards that hold a
+// key.
+type replica struct {
+	name   string
+	client *client.KVClient
+}
+
+// replicas returns the clients of the namespace ns on the q.N shards that
+// hold key. Replicated keys are not followed by a rebalancing, so they
+// cannot be used during one.
+func (r *Router) replicas(ns, key string, q Quorum) ([]replica, error) {
+	err := q.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if r.migration != nil {
+		return nil, ErrRebalancing
+	}
+
+	shards := r.ring.LookupN(key, q.N)
+	if len(shards) < q.N {
+		return nil, fmt.Errorf("%w %s: only %d shards", ErrInvalidQuorum, q, len(shards))
+	}
+
+	replicas := make([]replica, len(shards))
+	for i, s := range shards {
+		replicas[i] = replica{name: s.Name, client: namespace(r.clients[s.Name], ns)}
+	}
+	return replicas, nil
+}
+
+// QuorumSet writes key to the q.N shards that hold it and returns once q.W
+// of them have stored it. The write carries a stamp newer than the writes
+// before it, so a replica that has seen a later write keeps that one; such
+// a replica counts as an acknowledgement.
+func (r *Router) QuorumSet(ns, key, value string, ttl time.Duration, q Quorum) error {
+	r.writes.RLock()
+	defer r.writes.RUnlock()
+
+	replicas, err := r.replicas(ns, key, q)
+	if err != nil {
+		return err
+	}
+
+	stamp := r.stamps.next()
+	_, err = gather(replicas, q.W, "set", func(c *client.KVClient) (struct{}, error) {
+		_, err := c.SetStamped(key, value, ttl, stamp)
+		if errors.Is(err, client.ErrStale) {
+			err = nil
+		}
+		return struct{}{}, err
+	})
+	return err
+}
+
+// QuorumDelete deletes key from the q.N shards that hold it like QuorumSet.
+func (r *Router) QuorumDelete(ns, key string, q Quorum) error {
+	r.writes.RLock()
+	defer r.writes.RUnlock()
+
+	replicas, err := r.replicas(ns, key, q)
+	if err != nil {
+		return err
+	}
+
+	stamp := r.stamps.next()
+	_, err = gather(replicas, q.W, "delete", func(c *client.KVClient) (struct{}, error) {
+		_, err := c.DeleteStamped(key, stamp)
+		if errors.Is(err, client.ErrStale) {
+			err = nil
+		}
+		return struct{}{}, err
+	})
+	return err
+}
+
+// QuorumGet reads key from the q.N shards that hold it and returns the
+// answer with the newest stamp among the first q.R answers. A replica that
+// lost the key to a stamped delete answers with the stamp of the delete, so
+// the key is missing if that delete is newer than any value.
+func (r *Router) QuorumGet(ns, key string, q Quorum) (string, bool, error) {
+	replicas, err := r.replicas(ns, key, q)
+	if err != nil {
+		return "", false, err
+	}
+
+	type answer struct {
+		entry client.Entry
+		ok    bool
+	}
+
+	answers, err := gather(replicas, q.R, "get", func(c *client.KVClient) (answer, error) {
+		entry, ok, err := c.GetEntry(key)
+		return answer{entry: entry, ok: ok}, err
+	})
+	if err != nil {
+		return "", false, err
+	}
+
+	var newest answer
+	for _, a := range answers {
+		if a.entry.Stamp > newest.entry.Stamp || a.entry.Stamp == newest.entry.Stamp && a.ok && !newest.ok {
+			newest = a
+		}
+	}
+	return newest.entry.Value, newest.ok, nil
+}
+
+// gather calls op on every replica concurrently and returns the results of
+// the first needed calls that succeed, without waiting for the others. If
+// too many calls fail, it waits for all of them and fails with a
+// QuorumError.
+func gather[T any](replicas []replica, needed int, name string, op func(*client.KVClient) (T, error)) ([]T, error) {
+	type result struct {
+		value T
+		err   error
+	}
+
+	results := make(chan result, len(replicas))
+	for _, rep := range replicas {
+		go func() {
+			value, err := op(rep.client)
+			if err != nil {
+				err = fmt.Errorf("shard %s: %w", rep.name, err)
+			}
+			results <- result{value: value, err: err}
+		}()
+	}
+
+	var values []T
+	var errs []error
+	for range replicas {
+		res := <-results
+		if res.err != nil {
+			errs = append(errs, res.err)
+			continue
+		}
+
+		values = append(values, res.value)
+		if len(values) == needed {
+			return values, nil
+		}
+	}
+
+	return nil, &QuorumError{Op: name, Replicas: len(replicas), Needed: needed, Acked: len(values), Errs: errs}
+}
@@ -0,0 +1,176 @@
+package shard
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseQuorum(t *testing.T) {
+	t.Helper()
+
+	q, err := ParseQuorum("3/2/2")
+	require.NoError(t, err)
+	require.Equal(t, Quorum{N: 3, R: 2, W: 2}, q)
+
+	for _, v := range []string{"", "3/2", "3/2/x", "2/3/1", "2/1/3", "0/0/0", "3/0/2"} {
+		_, err := ParseQuorum(v)
+		require.ErrorIs(t, err, ErrInvalidQuorum, "%q should be rejected", v)
+	}
+
+	quorums, err := ParseNamespaceQuorums("orders=3/2/2, cache=2/1/1")
+	require.NoError(t, err)
+
+	cfg := QuorumConfig{Namespaces: quorums}
+	require.Equal(t, Quorum{N: 3, R: 2, W: 2}, cfg.For("orders"))
+	require.Equal(t, DefaultQuorum, cfg.For("users"), "other namespaces should get the default quorum")
+
+	_, err = ParseNamespaceQuorums("orders")
+	require.ErrorIs(t, err, ErrInvalidQuorum)
+}
+
+func TestRing_LookupN(t *testing.T) {
+	t.Helper()
+
+	ring := NewRing(Config{Shards: testShards("kv1", "kv2", "kv3", "kv4")})
+
+	for i := 0; i < 1000; i++ {
+		key := "user" + strconv.Itoa(i)
+
+		shards := ring.LookupN(key, 3)
+		require.Len(t, shards, 3)
+		require.Equal(t, ring.Lookup(key), shards[0], "the owner should come first")
+		require.NotEqual(t, shards[0].Name, shards[1].Name)
+		require.NotEqual(t, shards[1].Name, shards[2].Name)
+		require.NotEqual(t, shards[0].Name, shards[2].Name)
+	}
+
+	require.Len(t, ring.LookupN("user1", 5), 4, "there should be no more replicas than shards")
+}
+
+func TestRouter_Quorum(t *testing.T) {
+	t.Helper()
+
+	router, kvs := newTestRouter(t, "kv1", "kv2", "kv3")
+	q := Quorum{N: 3, R: 2, W: 2}
+
+	require.NoError(t, router.QuorumSet("", "user1", "Alice", 0, q))
+	for name, kv := range kvs {
+		require.Equal(t, []string{"user1"}, kv.keys(), "shard %s should hold a replica", name)
+	}
+
+	replicas := router.ring.LookupN("user1", 3)
+	down := kvs[replicas[0].Name]
+
+	down.mu.Lock()
+	down.down = true
+	down.mu.Unlock()
+
+	require.NoError(t, router.QuorumSet("", "user1", "Bob", 0, q), "two replicas should be enough to write")
+
+	value, ok, err := router.QuorumGet("", "user1", q)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, "Bob", value)
+
+	down.mu.Lock()
+	down.down = false
+	down.mu.Unlock()
+
+	// The replica that missed the write still holds Alice, so a read of all
+	// replicas has to pick the newest value.
+	value, ok, err = router.QuorumGet("", "user1", Quorum{N: 3, R: 3, W: 1})
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, "Bob", value, "the value with the newest stamp should win")
+
+	for _, s := range replicas[1:] {
+		kv := kvs[s.Name]
+		kv.mu.Lock()
+		kv.down = true
+		kv.mu.Unlock()
+	}
+
+	err = router.QuorumSet("", "user1", "Carol", 0, q)
+	require.ErrorIs(t, err, ErrQuorumNotReached)
+
+	var quorumErr *QuorumError
+	require.True(t, errors.As(err, &quorumErr))
+	require.Equal(t, 2, quorumErr.Needed)
+	require.Len(t, quorumErr.Errs, 2)
+	require.Equal(t, 1, quorumErr.Acked, "the replica that is up should be counted")
+
+	_, _, err = router.QuorumGet("", "user1", q)
+	require.ErrorIs(t, err, ErrQuorumNotReached)
+
+	_, _, err = router.QuorumGet("", "user1", Quorum{N: 4, R: 1, W: 1})
+	require.ErrorIs(t, err, ErrInvalidQuorum, "there should be no more replicas than shards")
+}
+
+func TestRouter_QuorumDelete(t *testing.T) {
+	t.Helper()
+
+	router, kvs := newTestRouter(t, "kv1", "kv2", "kv3")
+	q := Quorum{N: 2, R: 1, W: 2}
+
+	require.NoError(t, router.QuorumSet("", "user1", "Alice", 0, q))
+	require.NoError(t, router.QuorumDelete("", "user1", q))
+
+	for name, kv := range kvs {
+		require.Empty(t, kv.keys(), "shard %s should not hold the key", name)
+	}
+
+	_, ok, err := router.QuorumGet("", "user1", q)
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	router.SetQuorum(QuorumConfig{Default: q})
+	require.ErrorIs(t, router.Rebalance(Config{Shards: router.Shards()}), ErrReplicated,
+		"replicated keys should not be rebalanced")
+}
+
+func TestRouter_QuorumDeleteMissedByReplica(t *testing.T) {
+	t.Helper()
+
+	router, kvs := newTestRouter(t, "kv1", "kv2", "kv3")
+	q := Quorum{N: 3, R: 2, W: 2}
+
+	require.NoError(t, router.QuorumSet("", "user1", "Alice", 0, q))
+
+	replicas := router.ring.LookupN("user1", 3)
+	setDown := func(name string, down bool) {
+		kv := kvs[name]
+		kv.mu.Lock()
+		kv.down = down
+		kv.mu.Unlock()
+	}
+
+	setDown(replicas[2].Name, true)
+	require.NoError(t, router.QuorumDelete("", "user1", q))
+	setDown(replicas[2].Name, false)
+
+	require.Equal(t, []string{"user1"}, kvs[replicas[2].Name].keys(), "the replica should have missed the delete")
+
+	// With one of the replicas that saw the delete down, a read of two
+	// replicas has to tell the delete from the older value.
+	setDown(replicas[0].Name, true)
+
+	_, ok, err := router.QuorumGet("", "user1", q)
+	require.NoError(t, err)
+	require.False(t, ok, "the newer delete should win over the missed one")
+
+	setDown(replicas[0].Name, false)
+
+	_, ok, err = router.QuorumGet("", "user1", Quorum{N: 3, R: 3, W: 1})
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	require.NoError(t, router.QuorumSet("", "user1", "Bob", 0, q))
+
+	value, ok, err := router.QuorumGet("", "user1", q)
+	require.NoError(t, err)
+	require.True(t, ok, "a write after the delete should bring the key back")
+	require.Equal(t, "Bob", value)
+}
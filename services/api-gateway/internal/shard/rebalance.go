@@ -0,0 +1,708 @@
+package shard
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/alexey-y-a/go-txlog-microservices/libs/logger"
+	"github.com/alexey-y-a/go-txlog-microservices/services/api-gateway/internal/client"
+)
+
+// States of a rebalancing, in order; it ends in StateDone or StateFailed.
+const (
+	StatePreparing  = "preparing"
+	StateCopying    = "copying"
+	StateCatchingUp = "catching_up"
+	StateSwitching  = "switching"
+	StateCleaning   = "cleaning"
+	StateDone       = "done"
+	StateFailed     = "failed"
+)
+
+var (
+	// ErrRebalancing is returned when the membership is changed while keys
+	// are being moved.
+	ErrRebalancing = errors.New("shard: a rebalancing is in progress")
+	// ErrNamedNamespaces is returned when a shard involved in a rebalancing
+	// has namespaces besides the default one, whose writes cannot be
+	// followed.
+	ErrNamedNamespaces = errors.New("shard: only the default namespace can be rebalanced")
+)
+
+const (
+	// copyPageSize is the scan page of the copy, the largest kv-service
+	// allows.
+	copyPageSize = 1000
+
+	// switchBacklog is how many changes may be left to replay before the
+	// writes are stopped to switch to the new shards.
+	switchBacklog = 100
+
+	// switchTimeout bounds how long the writes stay stopped while the last
+	// changes are replayed.
+	switchTimeout = 10 * time.Second
+
+	pollInterval = 10 * time.Millisecond
+)
+
+// Progress reports a rebalancing.
+type Progress struct {
+	State string  `json:"state"`
+	From  []Shard `json:"from"`
+	To    []Shard `json:"to"`
+
+	Moves []MoveProgress `json:"moves"`
+	// MovedKeys is the number of keys copied to their new shard.
+	MovedKeys uint64 `json:"moved_keys"`
+
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at,omitzero"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// MoveProgress reports the keys going from one shard to another.
+type MoveProgress struct {
+	Source string `json:"source"`
+	Dest   string `json:"dest"`
+	// Ranges is the number of hash ranges of the ring that move.
+	Ranges int `json:"ranges"`
+	// Copied is the number of keys copied by the scan of the source.
+	Copied uint64 `json:"copied"`
+	// Replayed is the number of writes to moving keys replayed from the log
+	// of the source while they were copied.
+	Replayed uint64 `json:"replayed"`
+	// Removed is the number of moved keys deleted from the source once
+	// they belonged to the destination.
+	Removed uint64 `json:"removed"`
+}
+
+// migration moves the keys of the default namespace from the ring from to
+// the ring to.
+//
+// The source of a key stays its owner until the switch: the copy scans the
+// sources while a stream of their log, opened before the scan, is replayed
+// on the destinations afterwards. To switch, the router stops the writes,
+// waits until every write to a moving key has been replayed and swaps the
+// rings.
+type migration struct {
+	from, to *Ring
+	cfg      Config
+	moves    []Move
+	// clients are the clients of the shards of both rings.
+	clients map[string]*client.KVClient
+
+	mu       sync.Mutex
+	progress Progress
+	// fences are the LSNs of the last write to a moving key on every
+	// source; the switch waits until they are replayed.
+	fences map[string]uint64
+}
+
+// Rebalance moves the keys to the shards of cfg in the background and makes
+// cfg the membership of the router once they are moved. Until then the
+// keys stay with their current shards. Rebalancing covers the default
+// namespace of kv-service only and follows the writes made through this
+// gateway; writes made directly to a shard may be lost.
+func (r *Router) Rebalance(cfg Config) error {
+	cfg.trimURLs()
+
+	err := cfg.Validate()
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.migration != nil {
+		return ErrRebalancing
+	}
+
+	if r.quorum.For("").N > 1 {
+		return ErrReplicated
+	}
+
+	m := &migration{
+		from:    r.ring,
+		to:      NewRing(cfg),
+		cfg:     cfg,
+		clients: make(map[string]*client.KVClient),
+		fences:  make(map[string]uint64),
+	}
+
+	for name, c := range r.clients {
+		m.clients[name] = c
+	}
+	for _, s := range cfg.Shards {
+		if r.ring.url(s.Name) != s.URL {
+			m.clients[s.Name] = r.newClient(s)
+		}
+	}
+
+	m.progress = Progress{
+		State:     StatePreparing,
+		From:      m.from.Shards(),
+		To:        m.to.Shards(),
+		StartedAt: time.Now().UTC(),
+	}
+	m.moves = Moves(m.from, m.to)
+	for _, move := range m.moves {
+		m.progress.Moves = append(m.progress.Moves, MoveProgress{
+			Source: move.Source,
+			Dest:   move.Dest,
+			Ranges: len(move.Ranges),
+		})
+	}
+
+	r.migration = m
+	r.rebalanced = m
+
+	go r.migrate(m)
+	return nil
+}
+
+// Rebalancing returns the progress of the current or the last rebalancing,
+// and false if there was none.
+func (r *Router) Rebalancing() (Progress, bool) {
+	r.mu.RLock()
+	m := r.rebalanced
+	r.mu.RUnlock()
+
+	if m == nil {
+		return Progress{}, false
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	progress := m.progress
+	progress.Moves = slices.Clone(m.progress.Moves)
+	return progress, true
+}
+
+func (r *Router) migrate(m *migration) {
+	log := logger.L().With().Str("component", "rebalance").Logger()
+	log.Info().Any("from", m.from.Shards()).Any("to", m.to.Shards()).Msg("rebalancing started")
+
+	err := r.move(m)
+	if err != nil {
+		log.Error().Err(err).Msg("rebalancing failed")
+
+		r.mu.Lock()
+		r.migration = nil
+		r.mu.Unlock()
+
+		// Keys copied so far are removed, or a later rebalancing would
+		// bring back the ones deleted in between.
+		cleanErr := m.clean(m.dests(), m.to, m.from)
+		if cleanErr != nil {
+			log.Error().Err(cleanErr).Msg("failed to remove copied keys")
+		}
+
+		m.finish(StateFailed, err)
+		return
+	}
+
+	m.setState(StateCleaning)
+
+	err = m.clean(m.sources(), m.from, m.to)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to remove moved keys from their old shards")
+		m.finish(StateFailed, err)
+		return
+	}
+
+	m.finish(StateDone, nil)
+
+	progress, _ := r.Rebalancing()
+	log.Info().Uint64("moved_keys", progress.MovedKeys).Any("shards", r.Shards()).Msg("rebalancing finished")
+}
+
+// move copies the keys and switches the router to the new ring.
+func (r *Router) move(m *migration) error {
+	err := m.checkNamespaces()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	// The streams are opened before the copy, so that every write the scan
+	// misses is replayed.
+	var replays []*replay
+	defer func() {
+		cancel()
+		for _, rp := range replays {
+			<-rp.done
+			rp.stream.Close()
+		}
+	}()
+
+	for _, source := range m.sources() {
+		stream, err := m.clients[source].Changes(ctx)
+		if err != nil {
+			return fmt.Errorf("shard %s: %w", source, err)
+		}
+
+		rp := newReplay(source, stream)
+		go rp.read()
+		go rp.run(ctx, m)
+		replays = append(replays, rp)
+	}
+
+	m.setState(StateCopying)
+
+	for _, source := range m.sources() {
+		err = m.copy(source)
+		if err != nil {
+			return err
+		}
+	}
+
+	m.setState(StateCatchingUp)
+
+	for _, rp := range replays {
+		close(rp.start)
+	}
+
+	err = waitFor(replays, func(rp *replay) bool { return rp.backlog() <= switchBacklog }, 0)
+	if err != nil {
+		return err
+	}
+
+	m.setState(StateSwitching)
+
+	return r.switchTo(m, replays, cancel)
+}
+
+// switchTo stops the writes, waits until the writes to moving keys are
+// replayed and makes the ring of m the ring of the router. The replays are
+// stopped before the writes resume, as the destinations own the keys from
+// then on.
+func (r *Router) switchTo(m *migration, replays []*replay, stop context.CancelFunc) error {
+	r.writes.Lock()
+	defer r.writes.Unlock()
+
+	defer func() {
+		stop()
+		for _, rp := range replays {
+			<-rp.done
+		}
+	}()
+
+	m.mu.Lock()
+	fences := make(map[string]uint64, len(m.fences))
+	for source, lsn := range m.fences {
+		fences[source] = lsn
+	}
+	m.mu.Unlock()
+
+	err := waitFor(replays, func(rp *replay) bool { return rp.position() >= fences[rp.source] }, switchTimeout)
+	if err != nil {
+		return err
+	}
+
+	clients := make(map[string]*client.KVClient, len(m.cfg.Shards))
+	for _, s := range m.cfg.Shards {
+		clients[s.Name] = m.clients[s.Name]
+	}
+
+	r.mu.Lock()
+	r.ring = m.to
+	r.clients = clients
+	r.migration = nil
+	r.mu.Unlock()
+
+	return nil
+}
+
+// waitFor polls until done holds for every replay, one of them fails or
+// timeout, if positive, passes.
+func waitFor(replays []*replay, done func(rp *replay) bool, timeout time.Duration) error {
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+
+	for {
+		all := true
+		for _, rp := range replays {
+			err := rp.failed()
+			if err != nil {
+				return err
+			}
+			all = all && done(rp)
+		}
+		if all {
+			return nil
+		}
+
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			return errors.New("shard: timed out replaying the writes to moving keys")
+		}
+		time.Sleep(pollInterval)
+	}
+}
+
+// checkNamespaces fails if a shard keys move from or to has a namespace
+// other than the default one.
+func (m *migration) checkNamespaces() error {
+	for _, name := range append(m.sources(), m.dests()...) {
+		names, err := m.clients[name].Namespaces()
+		if err != nil {
+			return fmt.Errorf("shard %s: %w", name, err)
+		}
+		for _, ns := range names {
+			if ns != "default" {
+				return fmt.Errorf("%w: shard %s has namespace %q", ErrNamedNamespaces, name, ns)
+			}
+		}
+	}
+	return nil
+}
+
+// sources returns the shards keys move from, dests the shards they move to.
+func (m *migration) sources() []string {
+	var names []string
+	for _, move := range m.moves {
+		if !slices.Contains(names, move.Source) {
+			names = append(names, move.Source)
+		}
+	}
+	return names
+}
+
+func (m *migration) dests() []string {
+	var names []string
+	for _, move := range m.moves {
+		if !slices.Contains(names, move.Dest) {
+			names = append(names, move.Dest)
+		}
+	}
+	return names
+}
+
+// dest returns the shard key moves to from source, and false if it does
+// not move or source does not own it.
+func (m *migration) dest(source, key string) (string, bool) {
+	if m.from.Lookup(key).Name != source {
+		return "", false
+	}
+
+	dest := m.to.Lookup(key).Name
+	return dest, dest != source
+}
+
+// written records the LSN of a write to key on its current shard.
+func (m *migration) written(key string, lsn uint64) {
+	source := m.from.Lookup(key).Name
+	if _, ok := m.dest(source, key); !ok {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.fences[source] = max(m.fences[source], lsn)
+}
+
+// copy writes the keys of source that move to their destinations.
+func (m *migration) copy(source string) error {
+	scan := client.ScanRequest{Limit: copyPageSize}
+	for {
+		page, err := m.clients[source].Scan(scan)
+		if err != nil {
+			return fmt.Errorf("shard %s: %w", source, err)
+		}
+
+		sets := make(map[string][]client.TxnOp)
+		for _, item := range page.Items {
+			dest, ok := m.dest(source, item.Key)
+			if !ok {
+				continue
+			}
+
+			// Transactions cannot set a TTL.
+			if !item.ExpiresAt.IsZero() {
+				err = m.set(dest, item.Key, item.Value, item.ExpiresAt)
+				if err != nil {
+					return err
+				}
+				m.count(source, dest, func(p *MoveProgress) { p.Copied++ })
+				continue
+			}
+
+			sets[dest] = append(sets[dest], client.TxnOp{Op: "set", Key: item.Key, Value: item.Value})
+		}
+
+		for dest, ops := range sets {
+			_, err = m.clients[dest].Txn(ops)
+			if err != nil {
+				return fmt.Errorf("shard %s: %w", dest, err)
+			}
+			m.count(source, dest, func(p *MoveProgress) { p.Copied += uint64(len(ops)) })
+		}
+
+		if page.NextCursor == "" {
+			return nil
+		}
+		scan.Cursor = page.NextCursor
+	}
+}
+
+// set writes key to dest with the expiry expiresAt, or deletes it if it
+// has expired already.
+func (m *migration) set(dest, key, value string, expiresAt time.Time) error {
+	var ttl time.Duration
+	if !expiresAt.IsZero() {
+		ttl = time.Until(expiresAt)
+		if ttl <= 0 {
+			_, err := m.clients[dest].DeleteIf(key, client.Precondition{})
+			if err != nil {
+				return fmt.Errorf("shard %s: %w", dest, err)
+			}
+			return nil
+		}
+		// kv-service takes whole seconds; a key may live a little longer
+		// on its new shard, never shorter.
+		ttl = (ttl + time.Second - 1).Truncate(time.Second)
+	}
+
+	_, err := m.clients[dest].SetWithTTL(key, value, ttl, client.Precondition{})
+	if err != nil {
+		return fmt.Errorf("shard %s: %w", dest, err)
+	}
+	return nil
+}
+
+// replayChange applies a change of source to the destination of its key.
+func (m *migration) replayChange(source string, c client.Change) error {
+	dest, ok := m.dest(source, c.Key)
+	if c.Key == "" || !ok {
+		return nil
+	}
+
+	var err error
+	switch c.Op {
+	case "set":
+		err = m.set(dest, c.Key, c.Value, c.ExpiresAt)
+	case "delete", "expire":
+		_, err = m.clients[dest].DeleteIf(c.Key, client.Precondition{})
+		if err != nil {
+			err = fmt.Errorf("shard %s: %w", dest, err)
+		}
+	default:
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	m.count(source, dest, func(p *MoveProgress) { p.Replayed++ })
+	return nil
+}
+
+// clean deletes from the shards names the keys that before owns and after
+// gives to another shard.
+func (m *migration) clean(names []string, before, after *Ring) error {
+	for _, name := range names {
+		scan := client.ScanRequest{Limit: copyPageSize}
+		for {
+			page, err := m.clients[name].Scan(scan)
+			if err != nil {
+				return fmt.Errorf("shard %s: %w", name, err)
+			}
+
+			var ops []client.TxnOp
+			removed := make(map[string]uint64)
+			for _, item := range page.Items {
+				if before.Lookup(item.Key).Name != name {
+					continue
+				}
+				if owner := after.Lookup(item.Key).Name; owner != name {
+					ops = append(ops, client.TxnOp{Op: "delete", Key: item.Key})
+					removed[owner]++
+				}
+			}
+
+			if len(ops) > 0 {
+				_, err = m.clients[name].Txn(ops)
+				if err != nil {
+					return fmt.Errorf("shard %s: %w", name, err)
+				}
+			}
+
+			// Only the removal from the sources after the switch counts.
+			if before == m.from {
+				for dest, n := range removed {
+					m.count(name, dest, func(p *MoveProgress) { p.Removed += n })
+				}
+			}
+
+			if page.NextCursor == "" {
+				break
+			}
+			scan.Cursor = page.NextCursor
+		}
+	}
+	return nil
+}
+
+func (m *migration) count(source, dest string, update func(p *MoveProgress)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i := range m.progress.Moves {
+		p := &m.progress.Moves[i]
+		if p.Source == source && p.Dest == dest {
+			before := p.Copied
+			update(p)
+			m.progress.MovedKeys += p.Copied - before
+			return
+		}
+	}
+}
+
+func (m *migration) setState(state string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.progress.State = state
+}
+
+func (m *migration) finish(state string, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.progress.State = state
+	m.progress.FinishedAt = time.Now().UTC()
+	if err != nil {
+		m.progress.Error = err.Error()
+	}
+}
+
+// replay buffers the change stream of a source while the keys are copied
+// and replays it on the destinations afterwards.
+type replay struct {
+	source string
+	stream *client.ChangeStream
+
+	mu      sync.Mutex
+	changes []client.Change
+	// applied is the LSN of the last change replayed or skipped.
+	applied uint64
+	err     error
+	wake    chan struct{}
+	// start is closed once the keys are copied; done when run returns.
+	start chan struct{}
+	done  chan struct{}
+}
+
+func newReplay(source string, stream *client.ChangeStream) *replay {
+	return &replay{
+		source:  source,
+		stream:  stream,
+		applied: stream.Start(),
+		wake:    make(chan struct{}, 1),
+		start:   make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+}
+
+// read buffers the changes until the stream ends.
+func (rp *replay) read() {
+	for {
+		c, err := rp.stream.Next()
+
+		rp.mu.Lock()
+		if err != nil {
+			if rp.err == nil {
+				rp.err = fmt.Errorf("shard %s: %w", rp.source, err)
+			}
+		} else {
+			rp.changes = append(rp.changes, c)
+		}
+		rp.mu.Unlock()
+
+		select {
+		case rp.wake <- struct{}{}:
+		default:
+		}
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+// run replays the buffered changes, from when start is closed until ctx is
+// done.
+func (rp *replay) run(ctx context.Context, m *migration) {
+	defer close(rp.done)
+
+	select {
+	case <-ctx.Done():
+		return
+	case <-rp.start:
+	}
+
+	for {
+		rp.mu.Lock()
+		changes := rp.changes
+		rp.changes = nil
+		rp.mu.Unlock()
+
+		for _, c := range changes {
+			if ctx.Err() != nil {
+				return
+			}
+
+			err := m.replayChange(rp.source, c)
+
+			rp.mu.Lock()
+			if err != nil {
+				if rp.err == nil {
+					rp.err = err
+				}
+			} else {
+				rp.applied = c.LSN
+			}
+			rp.mu.Unlock()
+
+			if err != nil {
+				return
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-rp.wake:
+		}
+	}
+}
+
+func (rp *replay) backlog() int {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+
+	return len(rp.changes)
+}
+
+func (rp *replay) position() uint64 {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+
+	return rp.applied
+}
+
+func (rp *replay) failed() error {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+
+	return rp.err
+}
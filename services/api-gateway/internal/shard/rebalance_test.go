@@ -0,0 +1,138 @@
+package shard
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/alexey-y-a/go-txlog-microservices/services/api-gateway/internal/client"
+)
+
+func waitRebalanced(t *testing.T, router *Router) Progress {
+	t.Helper()
+
+	var progress Progress
+	require.Eventually(t, func() bool {
+		progress, _ = router.Rebalancing()
+		return progress.State == StateDone || progress.State == StateFailed
+	}, 10*time.Second, 10*time.Millisecond, "the rebalancing should finish")
+
+	return progress
+}
+
+func TestRouter_Rebalance(t *testing.T) {
+	t.Helper()
+
+	router, kvs := newTestRouter(t, "kv1", "kv2")
+
+	_, ok := router.Rebalancing()
+	require.False(t, ok, "there should be no rebalancing yet")
+
+	want := make(map[string]string)
+	for i := 0; i < 300; i++ {
+		key := "user" + strconv.Itoa(i)
+		_, err := router.Set("", key, "v", 0, client.Precondition{})
+		require.NoError(t, err)
+		want[key] = "v"
+	}
+
+	// Writes go on while the keys move.
+	var mu sync.Mutex
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+
+			key := "user" + strconv.Itoa(i%300)
+			value := "w" + strconv.Itoa(i)
+
+			mu.Lock()
+			if i%7 == 0 {
+				err := router.Delete("", key, client.Precondition{})
+				if err == nil {
+					delete(want, key)
+				}
+			} else {
+				_, err := router.Set("", key, value, 0, client.Precondition{})
+				if err == nil {
+					want[key] = value
+				}
+			}
+			mu.Unlock()
+		}
+	}()
+
+	cfg := Config{Shards: router.Shards()}
+	cfg.Shards = append(cfg.Shards, startShards(t, kvs, "kv3").Shards...)
+
+	require.NoError(t, router.Rebalance(cfg))
+
+	progress := waitRebalanced(t, router)
+	close(stop)
+	<-done
+
+	require.Equal(t, StateDone, progress.State, progress.Error)
+	require.Len(t, router.Shards(), 3, "the router should switch to the new shards")
+	require.NotZero(t, progress.MovedKeys)
+	for _, move := range progress.Moves {
+		require.Equal(t, "kv3", move.Dest, "keys should only move to the new shard")
+		require.NotZero(t, move.Ranges)
+		require.NotZero(t, move.Removed, "the copied keys should leave their old shard")
+		require.LessOrEqual(t, move.Removed, move.Copied)
+	}
+
+	for name, kv := range kvs {
+		for _, key := range kv.keys() {
+			require.Equal(t, name, router.Lookup(key).Name, "key %s should only be stored on its shard", key)
+		}
+	}
+
+	for i := 0; i < 300; i++ {
+		key := "user" + strconv.Itoa(i)
+
+		value, _, ok, err := router.Get("", key)
+		require.NoError(t, err)
+		require.Equal(t, want[key] != "", ok, "key %s", key)
+		require.Equal(t, want[key], value, "key %s should keep its last write", key)
+	}
+
+	require.Error(t, router.Rebalance(Config{}), "an empty membership should be rejected")
+}
+
+func TestRouter_RebalanceFails(t *testing.T) {
+	t.Helper()
+
+	router, kvs := newTestRouter(t, "kv1")
+
+	for i := 0; i < 50; i++ {
+		key := "user" + strconv.Itoa(i)
+		_, err := router.Set("", key, "v", 0, client.Precondition{})
+		require.NoError(t, err)
+	}
+
+	cfg := startShards(t, kvs, "kv2")
+	kvs["kv2"].namespaces = append(kvs["kv2"].namespaces, "team-a")
+	cfg.Shards = append(cfg.Shards, router.Shards()...)
+
+	require.NoError(t, router.Rebalance(cfg))
+
+	progress := waitRebalanced(t, router)
+	require.Equal(t, StateFailed, progress.State)
+	require.Contains(t, progress.Error, ErrNamedNamespaces.Error())
+
+	require.Len(t, router.Shards(), 1, "a failed rebalancing should keep the shards")
+	require.Len(t, kvs["kv1"].keys(), 50)
+	require.Empty(t, kvs["kv2"].keys(), "nothing should be left on the new shard")
+
+	require.NoError(t, router.Update(cfg), "the membership can change once the rebalancing ended")
+}
@@ -0,0 +1,184 @@
+// Package shard spreads the keys of api-gateway over several kv-service
+// instances with a consistent-hash ring.
+package shard
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// DefaultVirtualNodes is how many points each shard has on the ring.
+const DefaultVirtualNodes = 128
+
+// Shard is a kv-service instance that owns part of the keys.
+type Shard struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+}
+
+// Config is the shard membership of the gateway.
+type Config struct {
+	// VirtualNodes is the number of ring points per shard; more points
+	// spread the keys more evenly. Zero means DefaultVirtualNodes.
+	VirtualNodes int     `json:"virtual_nodes,omitempty"`
+	Shards       []Shard `json:"shards"`
+}
+
+// Validate checks that there is at least one shard and that every shard has
+// a unique name and an http(s) URL.
+func (c Config) Validate() error {
+	if len(c.Shards) == 0 {
+		return errors.New("shard: no shards configured")
+	}
+	if c.VirtualNodes < 0 {
+		return fmt.Errorf("shard: invalid number of virtual nodes %d", c.VirtualNodes)
+	}
+
+	names := make(map[string]bool, len(c.Shards))
+	for _, s := range c.Shards {
+		if s.Name == "" {
+			return fmt.Errorf("shard: shard %q has no name", s.URL)
+		}
+		if names[s.Name] {
+			return fmt.Errorf("shard: duplicate shard %q", s.Name)
+		}
+		names[s.Name] = true
+
+		u, err := url.Parse(s.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("shard: invalid URL of shard %q", s.Name)
+		}
+	}
+
+	return nil
+}
+
+// trimURLs removes a trailing slash from the URLs of the shards.
+func (c *Config) trimURLs() {
+	c.Shards = slices.Clone(c.Shards)
+	for i := range c.Shards {
+		c.Shards[i].URL = strings.TrimSuffix(c.Shards[i].URL, "/")
+	}
+}
+
+// ParseList parses a comma separated list of shards, each either name=url
+// or a bare URL named after its host, such as
+// "kv1=http://kv1:8081,http://kv2:8081".
+func ParseList(v string) ([]Shard, error) {
+	var shards []Shard
+
+	for _, item := range strings.Split(v, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		name, addr, ok := strings.Cut(item, "=")
+		if !ok {
+			addr = item
+			u, err := url.Parse(addr)
+			if err != nil {
+				return nil, fmt.Errorf("shard: invalid URL %q", addr)
+			}
+			name = u.Host
+		}
+
+		shards = append(shards, Shard{Name: name, URL: strings.TrimSuffix(addr, "/")})
+	}
+
+	return shards, nil
+}
+
+type point struct {
+	hash  uint64
+	shard int
+}
+
+// Ring maps keys to shards. Every shard has a number of virtual nodes on
+// the ring and a key belongs to the shard of the first point at or after
+// its hash, so adding or removing a shard only moves the keys between it
+// and its neighbours. A Ring is immutable.
+type Ring struct {
+	shards []Shard
+	points []point
+}
+
+// NewRing builds the ring of cfg, which must be valid.
+func NewRing(cfg Config) *Ring {
+	vnodes := cfg.VirtualNodes
+	if vnodes == 0 {
+		vnodes = DefaultVirtualNodes
+	}
+
+	r := &Ring{
+		shards: slices.Clone(cfg.Shards),
+		points: make([]point, 0, len(cfg.Shards)*vnodes),
+	}
+
+	for i, s := range r.shards {
+		for v := 0; v < vnodes; v++ {
+			r.points = append(r.points, point{hash: hash(fmt.Sprintf("%s#%d", s.Name, v)), shard: i})
+		}
+	}
+
+	// Points that collide are ordered by shard name, so that every gateway
+	// builds the same ring whatever the order of the configuration.
+	slices.SortFunc(r.points, func(a, b point) int {
+		if a.hash != b.hash {
+			if a.hash < b.hash {
+				return -1
+			}
+			return 1
+		}
+		return strings.Compare(r.shards[a.shard].Name, r.shards[b.shard].Name)
+	})
+
+	return r
+}
+
+// Lookup returns the shard that owns key.
+func (r *Ring) Lookup(key string) Shard {
+	return r.shards[r.points[r.search(hash(key))].shard]
+}
+
+// search returns the position of the first point at or after h, wrapping
+// around to the first point.
+func (r *Ring) search(h uint64) int {
+	i, _ := slices.BinarySearchFunc(r.points, h, func(p point, h uint64) int {
+		switch {
+		case p.hash < h:
+			return -1
+		case p.hash > h:
+			return 1
+		}
+		return 0
+	})
+	if i == len(r.points) {
+		return 0
+	}
+	return i
+}
+
+// Shards returns the shards of the ring.
+func (r *Ring) Shards() []Shard {
+	return slices.Clone(r.shards)
+}
+
+// hash is FNV-1a with a final mix, as FNV alone spreads similar strings
+// such as the virtual nodes of a shard poorly.
+func hash(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
@@ -0,0 +1,123 @@
+package shard
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func testShards(names ...string) []Shard {
+	shards := make([]Shard, len(names))
+	for i, name := range names {
+		shards[i] = Shard{Name: name, URL: "http://" + name + ":8081"}
+	}
+	return shards
+}
+
+func TestRing_SpreadsKeys(t *testing.T) {
+	t.Helper()
+
+	ring := NewRing(Config{Shards: testShards("kv1", "kv2", "kv3")})
+
+	counts := make(map[string]int)
+	for i := 0; i < 30000; i++ {
+		counts[ring.Lookup("user"+strconv.Itoa(i)).Name]++
+	}
+
+	require.Len(t, counts, 3)
+	for name, n := range counts {
+		require.InDelta(t, 10000, n, 2500, "shard %s should own about a third of the keys", name)
+	}
+}
+
+func TestRing_IndependentOfOrder(t *testing.T) {
+	t.Helper()
+
+	a := NewRing(Config{Shards: testShards("kv1", "kv2", "kv3")})
+	b := NewRing(Config{Shards: testShards("kv3", "kv1", "kv2")})
+
+	for i := 0; i < 1000; i++ {
+		key := "key" + strconv.Itoa(i)
+		require.Equal(t, a.Lookup(key), b.Lookup(key), "key %s", key)
+	}
+}
+
+func TestRing_AddShardMovesFewKeys(t *testing.T) {
+	t.Helper()
+
+	before := NewRing(Config{Shards: testShards("kv1", "kv2", "kv3")})
+	after := NewRing(Config{Shards: testShards("kv1", "kv2", "kv3", "kv4")})
+
+	moved := 0
+	for i := 0; i < 10000; i++ {
+		key := "key" + strconv.Itoa(i)
+
+		from, to := before.Lookup(key), after.Lookup(key)
+		if from != to {
+			require.Equal(t, "kv4", to.Name, "key %s should only move to the new shard", key)
+			moved++
+		}
+	}
+
+	require.InDelta(t, 2500, moved, 800, "about a quarter of the keys should move")
+}
+
+func TestConfig_Validate(t *testing.T) {
+	t.Helper()
+
+	require.NoError(t, Config{Shards: testShards("kv1")}.Validate())
+
+	require.Error(t, Config{}.Validate(), "a config without shards should be invalid")
+	require.Error(t, Config{Shards: testShards("kv1", "kv1")}.Validate(), "shard names should be unique")
+	require.Error(t, Config{Shards: []Shard{{Name: "kv1", URL: "kv1:8081"}}}.Validate(), "a shard needs an http URL")
+
+	shards, err := ParseList("kv1=http://kv1:8081/, http://kv2:8081")
+	require.NoError(t, err)
+	require.Equal(t, []Shard{
+		{Name: "kv1", URL: "http://kv1:8081"},
+		{Name: "kv2:8081", URL: "http://kv2:8081"},
+	}, shards)
+}
+
+func TestMoves(t *testing.T) {
+	t.Helper()
+
+	before := NewRing(Config{Shards: testShards("kv1", "kv2", "kv3")})
+	after := NewRing(Config{Shards: testShards("kv1", "kv3", "kv4")})
+
+	moves := Moves(before, after)
+	require.NotEmpty(t, moves)
+	require.Empty(t, Moves(before, before), "an unchanged ring should move nothing")
+
+	inRanges := func(move Move, h uint64) bool {
+		for _, r := range move.Ranges {
+			if r.Start < r.End && r.Start < h && h <= r.End {
+				return true
+			}
+			if r.Start >= r.End && (h > r.Start || h <= r.End) {
+				return true
+			}
+		}
+		return false
+	}
+
+	for i := 0; i < 10000; i++ {
+		key := "key" + strconv.Itoa(i)
+		from, to := before.Lookup(key).Name, after.Lookup(key).Name
+
+		found := ""
+		for _, move := range moves {
+			if inRanges(move, hash(key)) {
+				require.Empty(t, found, "key %s should be in a single range", key)
+				found = move.Source + ">" + move.Dest
+			}
+		}
+
+		if from == to {
+			require.Empty(t, found, "key %s does not move", key)
+		} else {
+			require.Equal(t, from+">"+to, found, "key %s should be in the range of its move", key)
+		}
+	}
+}
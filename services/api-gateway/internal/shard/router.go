@@ -0,0 +1,410 @@
+package shard
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alexey-y-a/go-txlog-microservices/services/api-gateway/internal/client"
+	apimetrics "github.com/alexey-y-a/go-txlog-microservices/services/api-gateway/internal/metrics"
+)
+
+// DefaultScanLimit is the page size of a scan without a limit, the same as
+// kv-service's.
+const DefaultScanLimit = 100
+
+// Router sends each key to the kv-service shard that owns it. Its
+// membership can be replaced at runtime with Update or Reload, or changed
+// with Rebalance, which moves the keys first.
+type Router struct {
+	timeout time.Duration
+
+	// writes is held for reading by every write and for writing while a
+	// rebalancing switches to its new shards.
+	writes sync.RWMutex
+
+	mu      sync.RWMutex
+	ring    *Ring
+	clients map[string]*client.KVClient
+	// source, if set, is what Reload reads the membership from.
+	source func() (Config, error)
+	// migration is the rebalancing in progress, rebalanced the last one.
+	migration  *migration
+	rebalanced *migration
+
+	quorum QuorumConfig
+	stamps stampClock
+}
+
+// NewRouter returns a router over the shards of cfg. Requests to a shard
+// time out after timeout.
+func NewRouter(cfg Config, timeout time.Duration) (*Router, error) {
+	r := &Router{timeout: timeout}
+
+	err := r.Update(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Update replaces the membership of the router with cfg, without moving
+// any keys. Clients of shards that keep their URL are kept, with their
+// connections. It fails with ErrRebalancing during a rebalancing.
+func (r *Router) Update(cfg Config) error {
+	err := cfg.Validate()
+	if err != nil {
+		return err
+	}
+
+	ring := NewRing(cfg)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.migration != nil {
+		return ErrRebalancing
+	}
+
+	clients := make(map[string]*client.KVClient, len(cfg.Shards))
+	for _, s := range cfg.Shards {
+		if c, ok := r.clients[s.Name]; ok && r.ring.url(s.Name) == s.URL {
+			clients[s.Name] = c
+			continue
+		}
+		clients[s.Name] = r.newClient(s)
+	}
+
+	r.ring = ring
+	r.clients = clients
+	return nil
+}
+
+func (r *Router) newClient(s Shard) *client.KVClient {
+	c := client.NewKVClient(s.URL, r.timeout)
+	c.SetTransport(apimetrics.InstrumentTransport(s.Name, http.DefaultTransport))
+	return c
+}
+
+// SetSource makes Reload read the membership from source.
+func (r *Router) SetSource(source func() (Config, error)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.source = source
+}
+
+// Reload reads the membership from the source of the router and applies
+// it. The current membership stays if it cannot be read.
+func (r *Router) Reload() error {
+	cfg, err := r.ReadSource()
+	if err != nil {
+		return err
+	}
+	return r.Update(cfg)
+}
+
+// ReadSource reads the membership from the source of the router.
+func (r *Router) ReadSource() (Config, error) {
+	r.mu.RLock()
+	source := r.source
+	r.mu.RUnlock()
+
+	if source == nil {
+		return Config{}, errors.New("shard: no configuration source to reload from")
+	}
+	return source()
+}
+
+// LoadFile reads a Config in JSON from path.
+func LoadFile(path string) (Config, error) {
+	var cfg Config
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return cfg, fmt.Errorf("shard: read %q: %w", path, err)
+	}
+
+	err = json.Unmarshal(data, &cfg)
+	if err != nil {
+		return cfg, fmt.Errorf("shard: parse %q: %w", path, err)
+	}
+	cfg.trimURLs()
+
+	return cfg, cfg.Validate()
+}
+
+// Shards returns the current shards.
+func (r *Router) Shards() []Shard {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.ring.Shards()
+}
+
+// Lookup returns the shard that owns key.
+func (r *Router) Lookup(key string) Shard {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.ring.Lookup(key)
+}
+
+// Client returns the client of the namespace ns, the default one if empty,
+// on the shard that owns key.
+func (r *Router) Client(ns, key string) *client.KVClient {
+	r.mu.RLock()
+	c := r.clients[r.ring.Lookup(key).Name]
+	r.mu.RUnlock()
+
+	return namespace(c, ns)
+}
+
+// Get reads key from the shard that owns it. While the key moves to another
+// shard, it is read from both and the new shard answers if the current one
+// fails.
+func (r *Router) Get(ns, key string) (string, uint64, bool, error) {
+	r.mu.RLock()
+	c := namespace(r.clients[r.ring.Lookup(key).Name], ns)
+	var next *client.KVClient
+	if m := r.migration; m != nil && ns == "" {
+		if dest, ok := m.dest(r.ring.Lookup(key).Name, key); ok {
+			next = m.clients[dest]
+		}
+	}
+	r.mu.RUnlock()
+
+	if next == nil {
+		return c.GetVersioned(key)
+	}
+
+	type result struct {
+		value   string
+		version uint64
+		ok      bool
+		err     error
+	}
+
+	nextResult := make(chan result, 1)
+	go func() {
+		var res result
+		res.value, res.version, res.ok, res.err = next.GetVersioned(key)
+		nextResult <- res
+	}()
+
+	value, version, ok, err := c.GetVersioned(key)
+	if err == nil {
+		return value, version, ok, nil
+	}
+
+	res := <-nextResult
+	if res.err != nil {
+		return "", 0, false, err
+	}
+	return res.value, res.version, res.ok, nil
+}
+
+// Set writes key to the shard that owns it and returns its new version.
+func (r *Router) Set(ns, key, value string, ttl time.Duration, pre client.Precondition) (uint64, error) {
+	r.writes.RLock()
+	defer r.writes.RUnlock()
+
+	version, err := r.Client(ns, key).SetWithTTL(key, value, ttl, pre)
+	if err == nil && ns == "" {
+		r.written(key, version)
+	}
+	return version, err
+}
+
+// Delete deletes key from the shard that owns it.
+func (r *Router) Delete(ns, key string, pre client.Precondition) error {
+	r.writes.RLock()
+	defer r.writes.RUnlock()
+
+	lsn, err := r.Client(ns, key).DeleteIf(key, pre)
+	if err == nil && ns == "" {
+		r.written(key, lsn)
+	}
+	return err
+}
+
+// written tells the rebalancing in progress, if any, about a write with
+// the LSN lsn to key. Must be called with r.writes held for reading.
+func (r *Router) written(key string, lsn uint64) {
+	r.mu.RLock()
+	m := r.migration
+	r.mu.RUnlock()
+
+	if m != nil {
+		m.written(key, lsn)
+	}
+}
+
+// all returns the ring and the clients of the namespace ns on every shard.
+func (r *Router) all(ns string) (*Ring, map[string]*client.KVClient) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	clients := make(map[string]*client.KVClient, len(r.clients))
+	for name, c := range r.clients {
+		clients[name] = namespace(c, ns)
+	}
+	return r.ring, clients
+}
+
+func namespace(c *client.KVClient, ns string) *client.KVClient {
+	if ns == "" {
+		return c
+	}
+	return c.Namespace(ns)
+}
+
+// ErrCrossShardTxn is returned by Txn for operations on keys that different
+// shards own, which could not be applied atomically.
+var ErrCrossShardTxn = errors.New("shard: transaction spans several shards")
+
+// Txn applies ops atomically on the shard that owns their keys. Operations
+// on keys of different shards are rejected with ErrCrossShardTxn, and none
+// of them is applied.
+func (r *Router) Txn(ns string, ops []client.TxnOp) error {
+	r.writes.RLock()
+	defer r.writes.RUnlock()
+
+	var owner string
+	r.mu.RLock()
+	for _, op := range ops {
+		name := r.ring.Lookup(op.Key).Name
+		if owner != "" && name != owner {
+			r.mu.RUnlock()
+			return fmt.Errorf("%w: %q is on %s, %q on %s", ErrCrossShardTxn, ops[0].Key, owner, op.Key, name)
+		}
+		owner = name
+	}
+	c := namespace(r.clients[owner], ns)
+	r.mu.RUnlock()
+
+	lsn, err := c.Txn(ops)
+	if err != nil {
+		return fmt.Errorf("shard %s: %w", owner, err)
+	}
+
+	if ns == "" {
+		for _, op := range ops {
+			r.written(op.Key, lsn)
+		}
+	}
+	return nil
+}
+
+// Scan returns a page of the keys of all shards in order. Every shard is
+// asked for a full page and the pages are merged; the cursor of the result
+// is the smallest key after the last one returned, which kv-service
+// accepts as is. Keys a shard holds but does not own, such as copies made
+// by a rebalancing, are left out, so a page may be short of the limit
+// while more keys follow.
+func (r *Router) Scan(ns string, scan client.ScanRequest) (client.ScanPage, error) {
+	if scan.Limit == 0 {
+		scan.Limit = DefaultScanLimit
+	}
+
+	type result struct {
+		name string
+		page client.ScanPage
+		err  error
+	}
+
+	ring, clients := r.all(ns)
+	results := make(chan result, len(clients))
+	for name, c := range clients {
+		go func() {
+			page, err := c.Scan(scan)
+			if err != nil {
+				err = fmt.Errorf("shard %s: %w", name, err)
+			}
+			results <- result{name: name, page: page, err: err}
+		}()
+	}
+
+	var items []client.ScanItem
+	var errs []error
+	// Past the last key of a shard with more keys, the shard may hold keys
+	// that the merged page would skip.
+	var bound string
+	more := false
+	for range clients {
+		res := <-results
+		if res.err != nil {
+			errs = append(errs, res.err)
+			continue
+		}
+
+		for _, item := range res.page.Items {
+			if ring.Lookup(item.Key).Name == res.name {
+				items = append(items, item)
+			}
+		}
+
+		if n := len(res.page.Items); res.page.NextCursor != "" && n > 0 {
+			last := res.page.Items[n-1].Key
+			if !more || last < bound {
+				bound = last
+			}
+			more = true
+		}
+	}
+	if len(errs) > 0 {
+		return client.ScanPage{}, errors.Join(errs...)
+	}
+
+	slices.SortFunc(items, func(a, b client.ScanItem) int {
+		return strings.Compare(a.Key, b.Key)
+	})
+
+	if more {
+		n, _ := slices.BinarySearchFunc(items, bound, func(item client.ScanItem, key string) int {
+			return strings.Compare(item.Key, key)
+		})
+		if n < len(items) && items[n].Key == bound {
+			n++
+		}
+		items = items[:n]
+	}
+
+	last := bound
+	if len(items) > scan.Limit {
+		items = items[:scan.Limit]
+		last = items[len(items)-1].Key
+		more = true
+	}
+
+	var page client.ScanPage
+	page.Items = items
+
+	if more {
+		next := last + "\x00"
+		page.NextCursor = base64.RawURLEncoding.EncodeToString([]byte(next))
+	}
+
+	return page, nil
+}
+
+// url returns the URL of the shard name, empty if the ring has no such
+// shard.
+func (r *Ring) url(name string) string {
+	if r == nil {
+		return ""
+	}
+
+	i := slices.IndexFunc(r.shards, func(s Shard) bool { return s.Name == name })
+	if i < 0 {
+		return ""
+	}
+	return r.shards[i].URL
+}
@@ -0,0 +1,383 @@
+package shard
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/alexey-y-a/go-txlog-microservices/services/api-gateway/internal/client"
+)
+
+// fakeKV serves the part of the kv-service API the router uses from a map.
+type fakeKV struct {
+	mu   sync.Mutex
+	data map[string]string
+	lsn  uint64
+	// stamps are the stamps of the keys written or deleted with one.
+	stamps map[string]uint64
+	// down makes every request fail, as if the shard were unreachable.
+	down bool
+	// streams receive the changes, as the replication stream does.
+	streams    map[chan client.Change]struct{}
+	namespaces []string
+}
+
+func newFakeKV(t *testing.T) (*fakeKV, *httptest.Server) {
+	t.Helper()
+
+	kv := &fakeKV{
+		data:       make(map[string]string),
+		stamps:     make(map[string]uint64),
+		streams:    make(map[chan client.Change]struct{}),
+		namespaces: []string{"default"},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /kv/set", kv.set)
+	mux.HandleFunc("GET /kv/get", kv.get)
+	mux.HandleFunc("DELETE /kv/delete", kv.delete)
+	mux.HandleFunc("POST /kv/txn", kv.txn)
+	mux.HandleFunc("GET /kv/scan", kv.scan)
+	mux.HandleFunc("GET /replication/stream", kv.stream)
+	mux.HandleFunc("GET /admin/namespaces", func(w http.ResponseWriter, r *http.Request) {
+		kv.mu.Lock()
+		defer kv.mu.Unlock()
+
+		json.NewEncoder(w).Encode(map[string]any{"status": "ok", "namespaces": kv.namespaces})
+	})
+	mux.HandleFunc("/kv/{ns}/", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"status":"error","message":"namespace not found"}`))
+	})
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		kv.mu.Lock()
+		down := kv.down
+		kv.mu.Unlock()
+
+		if down {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+
+	return kv, srv
+}
+
+// applyLocked writes a change and hands it to the streams. Must be called
+// with kv.mu held.
+func (kv *fakeKV) applyLocked(op, key, value string) uint64 {
+	kv.lsn++
+	delete(kv.stamps, key)
+	if op == "delete" {
+		delete(kv.data, key)
+	} else {
+		kv.data[key] = value
+	}
+
+	for stream := range kv.streams {
+		stream <- client.Change{LSN: kv.lsn, Op: op, Key: key, Value: value}
+	}
+	return kv.lsn
+}
+
+func (kv *fakeKV) set(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Key, Value string
+		Stamp      uint64
+	}
+	json.NewDecoder(r.Body).Decode(&req)
+
+	kv.mu.Lock()
+	if kv.stale(req.Key, req.Stamp) {
+		kv.mu.Unlock()
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+	lsn := kv.applyLocked("set", req.Key, req.Value)
+	if req.Stamp != 0 {
+		kv.stamps[req.Key] = req.Stamp
+	}
+	kv.mu.Unlock()
+
+	json.NewEncoder(w).Encode(map[string]any{"status": "ok", "lsn": lsn})
+}
+
+func (kv *fakeKV) delete(w http.ResponseWriter, r *http.Request) {
+	key := r.URL.Query().Get("key")
+	stamp, _ := strconv.ParseUint(r.URL.Query().Get("stamp"), 10, 64)
+
+	kv.mu.Lock()
+	if kv.stale(key, stamp) {
+		kv.mu.Unlock()
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+	lsn := kv.applyLocked("delete", key, "")
+	if stamp != 0 {
+		kv.stamps[key] = stamp
+	}
+	kv.mu.Unlock()
+
+	json.NewEncoder(w).Encode(map[string]any{"status": "ok", "lsn": lsn})
+}
+
+// stale reports whether a write stamped stamp to key is older than the
+// last one, a delete included, as kv-service does. Must be called with
+// kv.mu held.
+func (kv *fakeKV) stale(key string, stamp uint64) bool {
+	return stamp != 0 && kv.stamps[key] >= stamp
+}
+
+func (kv *fakeKV) stream(w http.ResponseWriter, r *http.Request) {
+	changes := make(chan client.Change, 1<<16)
+
+	kv.mu.Lock()
+	kv.streams[changes] = struct{}{}
+	start := kv.lsn
+	kv.mu.Unlock()
+
+	defer func() {
+		kv.mu.Lock()
+		delete(kv.streams, changes)
+		kv.mu.Unlock()
+	}()
+
+	rc := http.NewResponseController(w)
+	enc := json.NewEncoder(w)
+
+	enc.Encode(map[string]any{"leader_lsn": start})
+	rc.Flush()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case c := <-changes:
+			enc.Encode(map[string]any{"leader_lsn": c.LSN, "event": c})
+			rc.Flush()
+		}
+	}
+}
+
+func (kv *fakeKV) get(w http.ResponseWriter, r *http.Request) {
+	key := r.URL.Query().Get("key")
+
+	kv.mu.Lock()
+	value, ok := kv.data[key]
+	stamp := kv.stamps[key]
+	kv.mu.Unlock()
+
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		if stamp != 0 {
+			json.NewEncoder(w).Encode(map[string]any{"status": "not found", "stamp": stamp})
+		}
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]any{"status": "ok", "value": value, "stamp": stamp})
+}
+
+func (kv *fakeKV) txn(w http.ResponseWriter, r *http.Request) {
+	var req struct{ Ops []client.TxnOp }
+	json.NewDecoder(r.Body).Decode(&req)
+
+	kv.mu.Lock()
+	var lsn uint64
+	for _, op := range req.Ops {
+		lsn = kv.applyLocked(op.Op, op.Key, op.Value)
+	}
+	kv.mu.Unlock()
+
+	json.NewEncoder(w).Encode(map[string]any{"status": "ok", "lsn": lsn})
+}
+
+func (kv *fakeKV) scan(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	limit, _ := strconv.Atoi(query.Get("limit"))
+	after, _ := base64.RawURLEncoding.DecodeString(query.Get("cursor"))
+
+	kv.mu.Lock()
+	var keys []string
+	for key := range kv.data {
+		if key >= string(after) {
+			keys = append(keys, key)
+		}
+	}
+	slices.Sort(keys)
+
+	page := client.ScanPage{Items: []client.ScanItem{}}
+	for _, key := range keys {
+		if len(page.Items) == limit {
+			next := page.Items[len(page.Items)-1].Key + "\x00"
+			page.NextCursor = base64.RawURLEncoding.EncodeToString([]byte(next))
+			break
+		}
+		page.Items = append(page.Items, client.ScanItem{Key: key, Value: kv.data[key]})
+	}
+	kv.mu.Unlock()
+
+	json.NewEncoder(w).Encode(page)
+}
+
+func (kv *fakeKV) keys() []string {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	var keys []string
+	for key := range kv.data {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// newTestRouter starts a fake kv-service for every name and returns a
+// router over them.
+func newTestRouter(t *testing.T, names ...string) (*Router, map[string]*fakeKV) {
+	t.Helper()
+
+	kvs := make(map[string]*fakeKV)
+	cfg := startShards(t, kvs, names...)
+
+	router, err := NewRouter(cfg, time.Second)
+	require.NoError(t, err, "NewRouter should not return error")
+
+	return router, kvs
+}
+
+// startShards starts a fake kv-service for every name, adds it to kvs and
+// returns the shards.
+func startShards(t *testing.T, kvs map[string]*fakeKV, names ...string) Config {
+	t.Helper()
+
+	var cfg Config
+	for _, name := range names {
+		kv, srv := newFakeKV(t)
+		kvs[name] = kv
+		cfg.Shards = append(cfg.Shards, Shard{Name: name, URL: srv.URL})
+	}
+	return cfg
+}
+
+func TestRouter_RoutesKeys(t *testing.T) {
+	t.Helper()
+
+	router, kvs := newTestRouter(t, "kv1", "kv2", "kv3")
+
+	for i := 0; i < 60; i++ {
+		key := "user" + strconv.Itoa(i)
+		require.NoError(t, router.Client("", key).Set(key, "v"))
+	}
+
+	for name, kv := range kvs {
+		keys := kv.keys()
+		require.NotEmpty(t, keys, "shard %s should own some keys", name)
+
+		for _, key := range keys {
+			require.Equal(t, name, router.Lookup(key).Name, "key %s should only be stored on its shard", key)
+		}
+	}
+
+	value, ok, err := router.Client("", "user7").Get("user7")
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, "v", value)
+}
+
+func TestRouter_TxnAndScanFanOut(t *testing.T) {
+	t.Helper()
+
+	router, kvs := newTestRouter(t, "kv1", "kv2", "kv3")
+
+	var ops []client.TxnOp
+	var want []string
+	for i := 0; i < 25; i++ {
+		key := "key" + strconv.Itoa(100+i)
+		ops = append(ops, client.TxnOp{Op: "set", Key: key, Value: strconv.Itoa(i)})
+		want = append(want, key)
+	}
+
+	err := router.Txn("", ops)
+	require.ErrorIs(t, err, ErrCrossShardTxn, "a transaction over several shards should be rejected")
+	for name, kv := range kvs {
+		require.Empty(t, kv.keys(), "shard %s should not apply part of the transaction", name)
+	}
+
+	// The keys of one shard are applied together.
+	groups := make(map[string][]client.TxnOp)
+	for _, op := range ops {
+		name := router.Lookup(op.Key).Name
+		groups[name] = append(groups[name], op)
+	}
+	for name, group := range groups {
+		require.NoError(t, router.Txn("", group))
+		require.Len(t, kvs[name].keys(), len(group))
+	}
+
+	// A copy left on a shard that does not own the key is not listed.
+	for name, kv := range kvs {
+		if name != router.Lookup("key110").Name {
+			kv.mu.Lock()
+			kv.data["key110"] = "stale"
+			kv.mu.Unlock()
+			break
+		}
+	}
+
+	var got []string
+	scan := client.ScanRequest{Limit: 7}
+	for {
+		page, err := router.Scan("", scan)
+		require.NoError(t, err)
+		require.LessOrEqual(t, len(page.Items), 7)
+
+		for _, item := range page.Items {
+			got = append(got, item.Key)
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		scan.Cursor = page.NextCursor
+	}
+	require.Equal(t, want, got, "pages should merge the shards in key order")
+
+	_, err = router.Scan("team-a", client.ScanRequest{})
+	require.ErrorIs(t, err, client.ErrNamespaceNotFound)
+}
+
+func TestRouter_Reload(t *testing.T) {
+	t.Helper()
+
+	router, _ := newTestRouter(t, "kv1")
+	require.Error(t, router.Reload(), "a router without a source should not reload")
+
+	_, srv := newFakeKV(t)
+	path := filepath.Join(t.TempDir(), "shards.json")
+
+	shards := append(router.Shards(), Shard{Name: "kv2", URL: srv.URL + "/"})
+	data, err := json.Marshal(Config{VirtualNodes: 16, Shards: shards})
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(path, data, 0o644))
+
+	router.SetSource(func() (Config, error) { return LoadFile(path) })
+	require.NoError(t, router.Reload())
+	require.Len(t, router.Shards(), 2)
+	require.Equal(t, srv.URL, router.Shards()[1].URL)
+
+	require.NoError(t, os.WriteFile(path, []byte(`{"shards":[]}`), 0o644))
+	require.Error(t, router.Reload(), "an empty membership should be rejected")
+	require.Len(t, router.Shards(), 2, "a failed reload should keep the shards")
+}
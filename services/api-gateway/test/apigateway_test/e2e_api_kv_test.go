@@ -13,7 +13,9 @@ import (
 	"github.com/stretchr/testify/require"
 
 	"github.com/alexey-y-a/go-txlog-microservices/libs/logger"
+	apiconfig "github.com/alexey-y-a/go-txlog-microservices/services/api-gateway/internal/config"
 	apiserver "github.com/alexey-y-a/go-txlog-microservices/services/api-gateway/internal/server"
+	"github.com/alexey-y-a/go-txlog-microservices/services/api-gateway/internal/shard"
 )
 
 type apiSetResponse struct {
@@ -49,7 +51,11 @@ func TestE2E_ApiGatewayAndKVService(t *testing.T) {
 
 	time.Sleep(1 * time.Second)
 
-	apiSrv := apiserver.NewServer("http://localhost:8081")
+	cfg := apiconfig.Default()
+	cfg.Shards.Shards = []shard.Shard{{Name: "kv", URL: "http://localhost:8081"}}
+
+	apiSrv, _, err := apiserver.NewServer(cfg)
+	require.NoError(t, err, "api-gateway server should be created")
 
 	go func() {
 		err = apiSrv.ListenAndServe()
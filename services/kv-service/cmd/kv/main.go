@@ -9,6 +9,7 @@ import (
 	"time"
 
 	"github.com/alexey-y-a/go-txlog-microservices/libs/logger"
+	"github.com/alexey-y-a/go-txlog-microservices/services/kv-service/internal/config"
 	"github.com/alexey-y-a/go-txlog-microservices/services/kv-service/internal/server"
 )
 
@@ -16,11 +17,13 @@ func main() {
 	logger.Init()
 	log := logger.L().With().Str("service", "kv-service").Logger()
 
-	srv, logFile, err := server.NewServer()
+	cfg, err := config.Load()
 	if err != nil {
-		log.Fatal().Err(err).Msg("failed to create kv-service")
+		log.Fatal().Err(err).Msg("failed to load kv-service config")
 	}
 
+	srv, namespaces, open := server.NewServer(cfg)
+
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
 
@@ -31,6 +34,17 @@ func main() {
 		}
 	}()
 
+	// The logs are replayed while the server already answers /ready.
+	opened := make(chan struct{})
+	go func() {
+		defer close(opened)
+
+		err := open()
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed to open kv-service namespaces")
+		}
+	}()
+
 	sig := <-sigChan
 	log.Info().Str("signal", sig.String()).Msg("shutting down kv-service")
 
@@ -44,15 +58,17 @@ func main() {
 		log.Info().Msg("kv-service stopped gracefully")
 	}
 
-    err = logFile.Sync()
+	<-opened
+
+    err = namespaces.Sync()
     if err != nil {
-        log.Error().Err(err).Msg("failed to sync transaction log")
+        log.Error().Err(err).Msg("failed to sync transaction logs")
     }
 
-	err = logFile.Close()
+	err = namespaces.Close()
     if err != nil {
-         log.Error().Err(err).Msg("failed to close transaction log")
+         log.Error().Err(err).Msg("failed to close transaction logs")
     } else {
-        log.Info().Msg("transaction log closed")
+        log.Info().Msg("transaction logs closed")
     }
 }
@@ -0,0 +1,314 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alexey-y-a/go-txlog-microservices/libs/txlog"
+	"github.com/alexey-y-a/go-txlog-microservices/services/kv-service/internal/engine"
+	"github.com/alexey-y-a/go-txlog-microservices/services/kv-service/internal/raft"
+)
+
+type Config struct {
+	Addr         string
+	Engine       engine.Kind
+	LogPath      string
+	Durability   txlog.Durability
+	SyncInterval time.Duration
+
+	// LogDir switches kv-service to a SegmentedLog stored in this directory
+	// instead of the single LogPath file.
+	LogDir        string
+	SegmentSize   int64
+	SegmentMaxAge time.Duration
+
+	// CompactRatio triggers automatic compaction once the share of dead log
+	// records exceeds it; zero disables automatic compaction.
+	CompactRatio      float64
+	CompactMinRecords int64
+	CompactOrder      txlog.CompactOrder
+
+	// SnapshotDir and SnapshotInterval control periodic snapshots, which are
+	// only taken with a segmented log. An empty SnapshotDir means
+	// LogDir/snapshots; a zero interval disables periodic snapshots.
+	SnapshotDir      string
+	SnapshotInterval time.Duration
+
+	// ExpiryInterval is how often expired keys are swept; zero disables the
+	// sweeper and keys then expire only when they are read.
+	ExpiryInterval time.Duration
+
+	// MemtableSize is the size in bytes at which the lsm engine flushes its
+	// memtable to a table on disk.
+	MemtableSize int
+
+	// NamespaceDir holds one subdirectory per namespace other than the
+	// default one, with the namespace's log and snapshots.
+	NamespaceDir string
+
+	// ReplicateFrom is the base URL of a leader kv-service. When set, the
+	// default namespace is a read-only follower that streams the leader's
+	// log.
+	ReplicateFrom string
+
+	// RaftID makes the node a member of a Raft cluster that replicates the
+	// default namespace; its log and snapshots are kept in RaftDir.
+	// RaftPeers, the members of a new cluster, bootstraps a node that has
+	// no state yet; a node added to a running cluster is started without.
+	RaftID                string
+	RaftDir               string
+	RaftPeers             []raft.Member
+	RaftElectionTimeout   time.Duration
+	RaftHeartbeatInterval time.Duration
+	RaftSnapshotThreshold uint64
+}
+
+func Default() Config {
+	return Config{
+		Addr:         ":8081",
+		LogPath:      "kv.log",
+		Durability:   txlog.DurabilityGroupCommit,
+		SyncInterval: txlog.DefaultSyncInterval,
+		SegmentSize:  txlog.DefaultMaxSegmentSize,
+
+		CompactRatio:      0.5,
+		CompactMinRecords: 10000,
+
+		SnapshotInterval: 5 * time.Minute,
+
+		ExpiryInterval: time.Second,
+
+		MemtableSize: engine.DefaultLSMOptions().MemtableSize,
+
+		NamespaceDir: "namespaces",
+
+		RaftDir:               "raft",
+		RaftElectionTimeout:   raft.DefaultElectionTimeout,
+		RaftHeartbeatInterval: raft.DefaultHeartbeatInterval,
+		RaftSnapshotThreshold: raft.DefaultSnapshotThreshold,
+	}
+}
+
+// Load reads the kv-service configuration from KV_* environment variables,
+// falling back to Default for unset ones.
+func Load() (Config, error) {
+	cfg := Default()
+
+	if v := os.Getenv("KV_ADDR"); v != "" {
+		cfg.Addr = v
+	}
+
+	if v := os.Getenv("KV_ENGINE"); v != "" {
+		k, err := engine.ParseKind(v)
+		if err != nil {
+			return cfg, fmt.Errorf("config: KV_ENGINE: %w", err)
+		}
+		cfg.Engine = k
+	}
+
+	if v := os.Getenv("KV_LOG_PATH"); v != "" {
+		cfg.LogPath = v
+	}
+
+	if v := os.Getenv("KV_DURABILITY"); v != "" {
+		d, err := txlog.ParseDurability(v)
+		if err != nil {
+			return cfg, fmt.Errorf("config: KV_DURABILITY: %w", err)
+		}
+		cfg.Durability = d
+	}
+
+	if v := os.Getenv("KV_SYNC_INTERVAL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return cfg, fmt.Errorf("config: KV_SYNC_INTERVAL: invalid duration %q", v)
+		}
+		cfg.SyncInterval = d
+	}
+
+	if v := os.Getenv("KV_LOG_DIR"); v != "" {
+		cfg.LogDir = v
+	}
+
+	if v := os.Getenv("KV_SEGMENT_SIZE"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n <= 0 {
+			return cfg, fmt.Errorf("config: KV_SEGMENT_SIZE: invalid size %q", v)
+		}
+		cfg.SegmentSize = n
+	}
+
+	if v := os.Getenv("KV_SEGMENT_MAX_AGE"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return cfg, fmt.Errorf("config: KV_SEGMENT_MAX_AGE: invalid duration %q", v)
+		}
+		cfg.SegmentMaxAge = d
+	}
+
+	if v := os.Getenv("KV_COMPACT_RATIO"); v != "" {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil || f < 0 || f >= 1 {
+			return cfg, fmt.Errorf("config: KV_COMPACT_RATIO: invalid ratio %q", v)
+		}
+		cfg.CompactRatio = f
+	}
+
+	if v := os.Getenv("KV_COMPACT_MIN_RECORDS"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			return cfg, fmt.Errorf("config: KV_COMPACT_MIN_RECORDS: invalid number %q", v)
+		}
+		cfg.CompactMinRecords = n
+	}
+
+	if v := os.Getenv("KV_COMPACT_ORDER"); v != "" {
+		switch v {
+		case "log":
+			cfg.CompactOrder = txlog.CompactLogOrder
+		case "key":
+			cfg.CompactOrder = txlog.CompactKeyOrder
+		default:
+			return cfg, fmt.Errorf("config: KV_COMPACT_ORDER: unknown order %q", v)
+		}
+	}
+
+	if v := os.Getenv("KV_SNAPSHOT_DIR"); v != "" {
+		cfg.SnapshotDir = v
+	}
+
+	if v := os.Getenv("KV_SNAPSHOT_INTERVAL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return cfg, fmt.Errorf("config: KV_SNAPSHOT_INTERVAL: invalid duration %q", v)
+		}
+		cfg.SnapshotInterval = d
+	}
+
+	if v := os.Getenv("KV_EXPIRY_INTERVAL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return cfg, fmt.Errorf("config: KV_EXPIRY_INTERVAL: invalid duration %q", v)
+		}
+		cfg.ExpiryInterval = d
+	}
+
+	if v := os.Getenv("KV_MEMTABLE_SIZE"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return cfg, fmt.Errorf("config: KV_MEMTABLE_SIZE: invalid size %q", v)
+		}
+		cfg.MemtableSize = n
+	}
+
+	if v := os.Getenv("KV_NAMESPACE_DIR"); v != "" {
+		cfg.NamespaceDir = v
+	}
+
+	if v := os.Getenv("KV_REPLICATE_FROM"); v != "" {
+		u, err := url.Parse(v)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return cfg, fmt.Errorf("config: KV_REPLICATE_FROM: invalid leader URL %q", v)
+		}
+		cfg.ReplicateFrom = v
+	}
+
+	if v := os.Getenv("KV_RAFT_ID"); v != "" {
+		cfg.RaftID = v
+	}
+
+	if v := os.Getenv("KV_RAFT_DIR"); v != "" {
+		cfg.RaftDir = v
+	}
+
+	if v := os.Getenv("KV_RAFT_PEERS"); v != "" {
+		peers, err := parsePeers(v)
+		if err != nil {
+			return cfg, fmt.Errorf("config: KV_RAFT_PEERS: %w", err)
+		}
+		cfg.RaftPeers = peers
+	}
+
+	if v := os.Getenv("KV_RAFT_ELECTION_TIMEOUT"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return cfg, fmt.Errorf("config: KV_RAFT_ELECTION_TIMEOUT: invalid duration %q", v)
+		}
+		cfg.RaftElectionTimeout = d
+	}
+
+	if v := os.Getenv("KV_RAFT_HEARTBEAT_INTERVAL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return cfg, fmt.Errorf("config: KV_RAFT_HEARTBEAT_INTERVAL: invalid duration %q", v)
+		}
+		cfg.RaftHeartbeatInterval = d
+	}
+
+	if v := os.Getenv("KV_RAFT_SNAPSHOT_THRESHOLD"); v != "" {
+		n, err := strconv.ParseUint(v, 10, 64)
+		if err != nil || n == 0 {
+			return cfg, fmt.Errorf("config: KV_RAFT_SNAPSHOT_THRESHOLD: invalid number %q", v)
+		}
+		cfg.RaftSnapshotThreshold = n
+	}
+
+	if (cfg.Engine == engine.KindBitcask || cfg.Engine == engine.KindLSM) && cfg.LogDir == "" {
+		return cfg, fmt.Errorf("config: KV_ENGINE: the %s engine requires KV_LOG_DIR", cfg.Engine)
+	}
+
+	if cfg.ReplicateFrom != "" && cfg.Engine != engine.KindTxlog {
+		return cfg, fmt.Errorf("config: KV_REPLICATE_FROM: replication requires the %s engine", engine.KindTxlog)
+	}
+
+	if cfg.RaftID != "" {
+		if cfg.Engine != engine.KindTxlog {
+			return cfg, fmt.Errorf("config: KV_RAFT_ID: raft requires the %s engine", engine.KindTxlog)
+		}
+		if cfg.ReplicateFrom != "" {
+			return cfg, errors.New("config: KV_RAFT_ID: raft cannot be combined with KV_REPLICATE_FROM")
+		}
+		if cfg.CompactOrder == txlog.CompactKeyOrder {
+			return cfg, errors.New("config: KV_COMPACT_ORDER: raft requires a log in LSN order")
+		}
+		if cfg.RaftHeartbeatInterval >= cfg.RaftElectionTimeout {
+			return cfg, errors.New("config: KV_RAFT_HEARTBEAT_INTERVAL: must be shorter than the election timeout")
+		}
+		if len(cfg.RaftPeers) > 0 && !slices.ContainsFunc(cfg.RaftPeers, func(m raft.Member) bool { return m.ID == cfg.RaftID }) {
+			return cfg, fmt.Errorf("config: KV_RAFT_PEERS: node %q is not one of the peers", cfg.RaftID)
+		}
+	}
+
+	return cfg, nil
+}
+
+// parsePeers parses a comma separated list of id=url members, such as
+// "kv1=http://kv1:8081,kv2=http://kv2:8081".
+func parsePeers(v string) ([]raft.Member, error) {
+	var peers []raft.Member
+
+	for _, peer := range strings.Split(v, ",") {
+		id, addr, ok := strings.Cut(strings.TrimSpace(peer), "=")
+		if !ok || id == "" {
+			return nil, fmt.Errorf("invalid peer %q", peer)
+		}
+
+		u, err := url.Parse(addr)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("invalid URL of peer %q", id)
+		}
+
+		if slices.ContainsFunc(peers, func(m raft.Member) bool { return m.ID == id }) {
+			return nil, fmt.Errorf("duplicate peer %q", id)
+		}
+		peers = append(peers, raft.Member{ID: id, Addr: strings.TrimSuffix(addr, "/")})
+	}
+
+	return peers, nil
+}
@@ -0,0 +1,384 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/alexey-y-a/go-txlog-microservices/libs/logger"
+	"github.com/alexey-y-a/go-txlog-microservices/libs/txlog"
+	"github.com/alexey-y-a/go-txlog-microservices/services/kv-service/internal/index"
+	"github.com/alexey-y-a/go-txlog-microservices/services/kv-service/internal/store"
+)
+
+// BitcaskEngine is the KindBitcask engine. Values stay in the segments of a
+// txlog.SegmentedLog; memory holds only the keydir, which maps every live
+// key to the position of its latest record, and Get reads the value from
+// the segment file with a single pread.
+//
+// Compact merges the sealed segments, dropping records that no longer back
+// a key, and writes a hint file next to every merged segment. On open the
+// keydir is loaded from the hint files where they exist and by scanning
+// the remaining segments otherwise.
+type BitcaskEngine struct {
+	log *txlog.SegmentedLog
+
+	// writeMu serializes writes, so that they become visible in the order
+	// of the log.
+	writeMu sync.Mutex
+
+	// mu guards keydir, index and files. Readers hold it while they read a
+	// value, so that a merge cannot swap a file under them.
+	mu     sync.RWMutex
+	keydir map[string]keydirEntry
+	index  *index.Skiplist
+	files  map[uint64]*os.File
+
+	now         func() time.Time
+	records     atomic.Int64
+	expiredKeys atomic.Uint64
+	compacting  atomic.Bool
+
+	compactRatio      float64
+	compactMinRecords int64
+
+	sweeper *store.Sweeper
+}
+
+type keydirEntry struct {
+	pos       txlog.Position
+	version   uint64
+	expiresAt time.Time
+}
+
+func (e keydirEntry) expired(now time.Time) bool {
+	return store.Expired(e.expiresAt, now)
+}
+
+// LoadStats describe how OpenBitcask rebuilt the keydir.
+type LoadStats struct {
+	Keys            int
+	HintSegments    int
+	ScannedSegments int
+	Duration        time.Duration
+}
+
+// OpenBitcask opens the segmented log in dir and rebuilds the keydir from
+// it.
+func OpenBitcask(dir string, opts ...txlog.SegmentOption) (*BitcaskEngine, LoadStats, error) {
+	var stats LoadStats
+	start := time.Now()
+
+	log, err := txlog.OpenSegmentedLog(dir, opts...)
+	if err != nil {
+		return nil, stats, err
+	}
+
+	e := &BitcaskEngine{
+		log:    log,
+		keydir: make(map[string]keydirEntry),
+		index:  index.NewSkiplist(),
+		files:  make(map[uint64]*os.File),
+		now:    time.Now,
+	}
+
+	for _, id := range log.Segments() {
+		hinted, err := e.loadSegment(id)
+		if err != nil {
+			e.Close()
+			return nil, stats, err
+		}
+
+		if hinted {
+			stats.HintSegments++
+		} else {
+			stats.ScannedSegments++
+		}
+	}
+
+	stats.Keys = len(e.keydir)
+	stats.Duration = time.Since(start)
+
+	return e, stats, nil
+}
+
+// loadSegment opens segment id and applies its records to the keydir, from
+// its hint file if it has a valid one. It reports whether the hint was used.
+func (e *BitcaskEngine) loadSegment(id uint64) (bool, error) {
+	path := e.log.SegmentPath(id)
+
+	file, err := os.Open(path)
+	if err != nil {
+		return false, fmt.Errorf("engine: open segment %d: %w", id, err)
+	}
+	e.files[id] = file
+
+	info, err := file.Stat()
+	if err != nil {
+		return false, fmt.Errorf("engine: stat segment %d: %w", id, err)
+	}
+
+	entries, err := readHint(hintPath(path), id, info.Size())
+	if err == nil {
+		for _, entry := range entries {
+			e.applyLocked(txlog.Event{
+				Key:       entry.key,
+				Op:        txlog.OpSet,
+				LSN:       entry.version,
+				ExpiresAt: entry.expiresAt,
+			}, entry.pos)
+		}
+		e.records.Add(int64(len(entries)))
+		return true, nil
+	}
+
+	if !errors.Is(err, os.ErrNotExist) {
+		log := logger.L().With().Str("component", "bitcask").Logger()
+		log.Warn().Err(err).Uint64("segment", id).Msg("ignoring hint file")
+	}
+
+	r, err := txlog.OpenReader(path)
+	if err != nil {
+		return false, err
+	}
+	defer r.Close()
+
+	for r.Next() {
+		e.applyLocked(r.Event(), txlog.Position{Segment: id, Offset: r.Offset(), Size: r.RecordSize()})
+		e.records.Add(1)
+	}
+
+	err = r.Err()
+	if err != nil && !errors.Is(err, txlog.ErrTruncated) {
+		return false, fmt.Errorf("engine: read segment %d: %w", id, err)
+	}
+
+	return false, nil
+}
+
+// applyLocked makes the record ev stored at pos the state of its key. Must
+// be called with e.mu held.
+func (e *BitcaskEngine) applyLocked(ev txlog.Event, pos txlog.Position) {
+	switch ev.Op {
+	case txlog.OpSet:
+		e.keydir[ev.Key] = keydirEntry{
+			pos:       pos,
+			version:   ev.LSN,
+			expiresAt: ev.ExpiresAt,
+		}
+		e.index.Insert(ev.Key)
+	case txlog.OpDelete, txlog.OpExpire:
+		delete(e.keydir, ev.Key)
+		e.index.Remove(ev.Key)
+	}
+}
+
+// Log returns the log of the engine.
+func (e *BitcaskEngine) Log() txlog.Log {
+	return e.log
+}
+
+func (e *BitcaskEngine) Get(key string) (store.Entry, bool) {
+	e.mu.RLock()
+
+	entry, ok := e.keydir[key]
+	if !ok {
+		e.mu.RUnlock()
+		return store.Entry{}, false
+	}
+
+	if entry.expired(e.now()) {
+		e.mu.RUnlock()
+
+		_, err := e.expire(key)
+		if err != nil {
+			log := logger.L().With().Str("component", "bitcask").Logger()
+			log.Warn().Err(err).Str("key", key).Msg("failed to log expired key")
+		}
+		return store.Entry{}, false
+	}
+
+	value, err := e.readValue(key, entry.pos)
+	e.mu.RUnlock()
+
+	if err != nil {
+		log := logger.L().With().Str("component", "bitcask").Logger()
+		log.Error().Err(err).Str("key", key).Msg("failed to read value")
+		return store.Entry{}, false
+	}
+
+	return store.Entry{
+		Value:     value,
+		Version:   entry.version,
+		ExpiresAt: entry.expiresAt,
+	}, true
+}
+
+// readValue reads the value of key from pos. Must be called with e.mu held.
+func (e *BitcaskEngine) readValue(key string, pos txlog.Position) (string, error) {
+	file, ok := e.files[pos.Segment]
+	if !ok {
+		return "", fmt.Errorf("engine: segment %d is not open", pos.Segment)
+	}
+
+	ev, err := txlog.ReadRecordAt(file, pos)
+	if err != nil {
+		return "", err
+	}
+
+	if ev.Key != key {
+		return "", fmt.Errorf("engine: record at %+v belongs to key %q", pos, ev.Key)
+	}
+
+	return ev.Value, nil
+}
+
+func (e *BitcaskEngine) Set(key, value string, ttl time.Duration, cond store.Condition) (uint64, error) {
+	ev := txlog.Event{
+		Key:   key,
+		Value: value,
+		Op:    txlog.OpSet,
+	}
+	if ttl > 0 {
+		ev.ExpiresAt = e.now().Add(ttl)
+	}
+
+	return e.write(ev, cond)
+}
+
+func (e *BitcaskEngine) Delete(key string, cond store.Condition) (uint64, error) {
+	return e.write(txlog.Event{
+		Key: key,
+		Op:  txlog.OpDelete,
+	}, cond)
+}
+
+// write appends ev and applies it if cond holds for the current state of
+// the key.
+func (e *BitcaskEngine) write(ev txlog.Event, cond store.Condition) (uint64, error) {
+	e.writeMu.Lock()
+	defer e.writeMu.Unlock()
+
+	e.mu.RLock()
+	current, exists := e.keydir[ev.Key]
+	e.mu.RUnlock()
+
+	if exists && current.expired(e.now()) {
+		exists = false
+	}
+
+	if !cond.Holds(current.version, exists) {
+		return 0, store.ErrPreconditionFailed
+	}
+
+	return e.commit(ev)
+}
+
+// commit appends ev and applies it to the keydir. Must be called with
+// e.writeMu held. As in store.Store, a record that was written but not
+// synced is applied and reported with an error.
+func (e *BitcaskEngine) commit(ev txlog.Event) (uint64, error) {
+	lsn, pos, err := e.log.AppendPosition(ev)
+	if err != nil && lsn == 0 {
+		return 0, fmt.Errorf("engine: append %s event: %w", ev.Op, err)
+	}
+	ev.LSN = lsn
+
+	e.mu.Lock()
+	if _, ok := e.files[pos.Segment]; !ok {
+		// The log has rolled to a new segment.
+		file, openErr := os.Open(e.log.SegmentPath(pos.Segment))
+		if openErr != nil {
+			err = errors.Join(err, fmt.Errorf("engine: open segment %d: %w", pos.Segment, openErr))
+		} else {
+			e.files[pos.Segment] = file
+		}
+	}
+	e.applyLocked(ev, pos)
+	e.mu.Unlock()
+
+	e.records.Add(1)
+	e.maybeCompact()
+
+	if err != nil {
+		return 0, fmt.Errorf("engine: sync %s event: %w", ev.Op, err)
+	}
+	return lsn, nil
+}
+
+// Scan has the semantics of store.Store.Scan. Values are read from disk
+// while the keydir is locked, so a page reflects one point in the history
+// of writes.
+func (e *BitcaskEngine) Scan(start, end string, limit int) ([]store.Item, bool) {
+	now := e.now()
+
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	var items []store.Item
+	for node := e.index.Seek(start); node != nil; node = node.Next() {
+		if end != "" && node.Key >= end {
+			break
+		}
+
+		entry := e.keydir[node.Key]
+		if entry.expired(now) {
+			continue
+		}
+
+		if limit > 0 && len(items) == limit {
+			return items, true
+		}
+
+		value, err := e.readValue(node.Key, entry.pos)
+		if err != nil {
+			log := logger.L().With().Str("component", "bitcask").Logger()
+			log.Error().Err(err).Str("key", node.Key).Msg("failed to read value")
+			continue
+		}
+
+		items = append(items, store.Item{
+			Key: node.Key,
+			Entry: store.Entry{
+				Value:     value,
+				Version:   entry.version,
+				ExpiresAt: entry.expiresAt,
+			},
+		})
+	}
+
+	return items, false
+}
+
+func (e *BitcaskEngine) Stats() Stats {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	return Stats{
+		Keys:        len(e.keydir),
+		ExpiredKeys: e.expiredKeys.Load(),
+	}
+}
+
+func (e *BitcaskEngine) Sync() error {
+	return e.log.Sync()
+}
+
+func (e *BitcaskEngine) Close() error {
+	e.StopExpirySweeper()
+
+	e.mu.Lock()
+	var errs []error
+	for id, file := range e.files {
+		errs = append(errs, file.Close())
+		delete(e.files, id)
+	}
+	e.mu.Unlock()
+
+	errs = append(errs, e.log.Close())
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,223 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/alexey-y-a/go-txlog-microservices/libs/logger"
+	"github.com/alexey-y-a/go-txlog-microservices/libs/txlog"
+	"github.com/alexey-y-a/go-txlog-microservices/services/kv-service/internal/store"
+)
+
+// Compact merges every sealed segment, oldest first, keeping only the
+// records the keydir points to, and writes a hint file for each of them.
+// Deletes are dropped: by the time the segment of a delete is merged, the
+// older records of its key have already been dropped from earlier ones.
+func (e *BitcaskEngine) Compact() (txlog.CompactStats, error) {
+	var stats txlog.CompactStats
+
+	if !e.compacting.CompareAndSwap(false, true) {
+		return stats, store.ErrCompactionRunning
+	}
+	defer e.compacting.Store(false)
+
+	segments := e.log.Segments()
+	for _, id := range segments[:len(segments)-1] {
+		segmentStats, err := e.mergeSegment(id)
+		if err != nil {
+			return stats, err
+		}
+
+		stats.RecordsIn += segmentStats.RecordsIn
+		stats.RecordsOut += segmentStats.RecordsOut
+		stats.BytesIn += segmentStats.BytesIn
+		stats.BytesOut += segmentStats.BytesOut
+		stats.BytesReclaimed += segmentStats.BytesReclaimed
+	}
+
+	return stats, nil
+}
+
+type movedRecord struct {
+	key      string
+	from, to txlog.Position
+}
+
+func (e *BitcaskEngine) mergeSegment(id uint64) (txlog.CompactStats, error) {
+	path := e.log.SegmentPath(id)
+	hint := hintPath(path)
+
+	// The hint describes the segment that is about to be replaced.
+	err := os.Remove(hint)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return txlog.CompactStats{}, fmt.Errorf("engine: remove hint of segment %d: %w", id, err)
+	}
+
+	var moved []movedRecord
+	var hints []hintEntry
+
+	stats, err := e.log.RewriteSegment(id, func(ev txlog.Event, pos txlog.Position) bool {
+		if ev.Op != txlog.OpSet {
+			return false
+		}
+
+		e.mu.RLock()
+		entry, ok := e.keydir[ev.Key]
+		e.mu.RUnlock()
+
+		return ok && entry.pos == pos
+	}, func(ev txlog.Event, from, to txlog.Position) {
+		moved = append(moved, movedRecord{key: ev.Key, from: from, to: to})
+		hints = append(hints, hintEntry{key: ev.Key, pos: to, version: ev.LSN, expiresAt: ev.ExpiresAt})
+	})
+	if err != nil {
+		return stats, fmt.Errorf("engine: merge segment %d: %w", id, err)
+	}
+
+	var file *os.File
+	if stats.RecordsOut > 0 {
+		file, err = os.Open(path)
+		if err != nil {
+			return stats, fmt.Errorf("engine: reopen merged segment %d: %w", id, err)
+		}
+	}
+
+	// Keys written while the segment was merged already point to a newer
+	// segment and are left alone.
+	e.mu.Lock()
+	for _, m := range moved {
+		entry, ok := e.keydir[m.key]
+		if ok && entry.pos == m.from {
+			entry.pos = m.to
+			e.keydir[m.key] = entry
+		}
+	}
+
+	old := e.files[id]
+	if file != nil {
+		e.files[id] = file
+	} else {
+		delete(e.files, id)
+	}
+	e.mu.Unlock()
+
+	if old != nil {
+		old.Close()
+	}
+
+	e.records.Add(int64(stats.RecordsOut - stats.RecordsIn))
+
+	if file == nil {
+		return stats, nil
+	}
+
+	err = writeHint(hint, stats.BytesOut, hints)
+	if err != nil {
+		return stats, err
+	}
+
+	return stats, nil
+}
+
+// SetCompactionPolicy has the semantics of store.Store.SetCompactionPolicy.
+// It must be called before the engine is used.
+func (e *BitcaskEngine) SetCompactionPolicy(ratio float64, minRecords int64) {
+	e.compactRatio = ratio
+	e.compactMinRecords = minRecords
+}
+
+// DeadRatio estimates the share of log records that no longer back a key.
+func (e *BitcaskEngine) DeadRatio() float64 {
+	live := e.Stats().Keys
+
+	records := e.records.Load()
+	if records == 0 || int64(live) >= records {
+		return 0
+	}
+
+	return 1 - float64(live)/float64(records)
+}
+
+func (e *BitcaskEngine) maybeCompact() {
+	if e.compactRatio <= 0 || e.records.Load() < e.compactMinRecords || e.compacting.Load() {
+		return
+	}
+
+	if e.DeadRatio() < e.compactRatio {
+		return
+	}
+
+	go func() {
+		log := logger.L().With().Str("component", "bitcask").Logger()
+
+		deadRatio := e.DeadRatio()
+
+		stats, err := e.Compact()
+		if err != nil {
+			if !errors.Is(err, store.ErrCompactionRunning) {
+				log.Error().Err(err).Msg("automatic merge failed")
+			}
+			return
+		}
+
+		log.Info().
+			Float64("dead_ratio", deadRatio).
+			Int("records_in", stats.RecordsIn).
+			Int("records_out", stats.RecordsOut).
+			Int64("bytes_reclaimed", stats.BytesReclaimed).
+			Msg("automatic merge finished")
+	}()
+}
+
+// expire logs and applies the expiry of key if it is still expired. It
+// reports whether the key was removed.
+func (e *BitcaskEngine) expire(key string) (bool, error) {
+	e.writeMu.Lock()
+	defer e.writeMu.Unlock()
+
+	e.mu.RLock()
+	entry, ok := e.keydir[key]
+	e.mu.RUnlock()
+
+	if !ok || !entry.expired(e.now()) {
+		return false, nil
+	}
+
+	_, err := e.commit(txlog.Event{
+		Key: key,
+		Op:  txlog.OpExpire,
+	})
+	if err != nil {
+		return false, err
+	}
+
+	e.expiredKeys.Add(1)
+
+	return true, nil
+}
+
+// StartExpirySweeper removes expired keys every interval. Close stops it.
+func (e *BitcaskEngine) StartExpirySweeper(interval time.Duration) {
+	e.sweeper = store.StartSweeper(interval, "bitcask", e.sweep)
+}
+
+func (e *BitcaskEngine) StopExpirySweeper() {
+	e.sweeper.Stop()
+}
+
+func (e *BitcaskEngine) sweep() (int, error) {
+	now := e.now()
+
+	var keys []string
+	e.mu.RLock()
+	for key, entry := range e.keydir {
+		if entry.expired(now) {
+			keys = append(keys, key)
+		}
+	}
+	e.mu.RUnlock()
+
+	return store.ExpireKeys(keys, e.expire)
+}
@@ -0,0 +1,201 @@
+package engine
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/alexey-y-a/go-txlog-microservices/libs/txlog"
+	"github.com/alexey-y-a/go-txlog-microservices/services/kv-service/internal/store"
+)
+
+func openTestBitcask(t *testing.T, dir string) (*BitcaskEngine, LoadStats) {
+	t.Helper()
+
+	e, stats, err := OpenBitcask(dir, txlog.WithMaxSegmentSize(512))
+	require.NoError(t, err, "OpenBitcask should not return error")
+
+	return e, stats
+}
+
+func requireValue(t *testing.T, e *BitcaskEngine, key, value string) {
+	t.Helper()
+
+	entry, ok := e.Get(key)
+	require.True(t, ok, "key %q should exist", key)
+	require.Equal(t, value, entry.Value, "value of %q", key)
+}
+
+func TestBitcask_ReadWrite(t *testing.T) {
+	t.Helper()
+
+	dir := t.TempDir()
+	e, _ := openTestBitcask(t, dir)
+
+	for i := 0; i < 50; i++ {
+		_, err := e.Set(fmt.Sprintf("key%02d", i), fmt.Sprintf("v%d", i), 0, store.Condition{})
+		require.NoError(t, err)
+	}
+
+	version, err := e.Set("key00", "updated", 0, store.Condition{})
+	require.NoError(t, err)
+
+	_, err = e.Set("key00", "stale", 0, store.Condition{IfMatch: []uint64{version - 1}})
+	require.ErrorIs(t, err, store.ErrPreconditionFailed, "a stale version should be rejected")
+
+	_, err = e.Delete("key01", store.Condition{})
+	require.NoError(t, err)
+
+	_, err = e.Set("session", "s", time.Hour, store.Condition{})
+	require.NoError(t, err)
+
+	require.Greater(t, len(e.log.Segments()), 1, "the log should span several segments")
+
+	requireValue(t, e, "key00", "updated")
+	requireValue(t, e, "key49", "v49")
+	_, ok := e.Get("key01")
+	require.False(t, ok, "a deleted key should be missing")
+
+	items, more := e.Scan("key0", "key1", 3)
+	require.True(t, more)
+	require.Len(t, items, 3)
+	require.Equal(t, "key00", items[0].Key)
+	require.Equal(t, "updated", items[0].Value)
+	require.Equal(t, "key02", items[1].Key, "Scan should skip deleted keys")
+
+	entry, _ := e.Get("key00")
+	require.NoError(t, e.Close())
+
+	e, stats := openTestBitcask(t, dir)
+	defer e.Close()
+
+	require.Equal(t, 50, stats.Keys, "the keydir should be rebuilt from the log")
+	require.Zero(t, stats.HintSegments)
+
+	reopened, ok := e.Get("key00")
+	require.True(t, ok)
+	require.Equal(t, entry, reopened, "values and versions should survive a restart")
+
+	_, ok = e.Get("key01")
+	require.False(t, ok)
+
+	session, ok := e.Get("session")
+	require.True(t, ok)
+	require.False(t, session.ExpiresAt.IsZero(), "the expiry should survive a restart")
+}
+
+func TestBitcask_Expiry(t *testing.T) {
+	t.Helper()
+
+	e, _ := openTestBitcask(t, t.TempDir())
+	defer e.Close()
+
+	now := time.Now()
+	e.now = func() time.Time { return now }
+
+	_, err := e.Set("session", "s", time.Second, store.Condition{})
+	require.NoError(t, err)
+	requireValue(t, e, "session", "s")
+
+	now = now.Add(2 * time.Second)
+
+	_, ok := e.Get("session")
+	require.False(t, ok, "an expired key should be missing")
+	require.Equal(t, Stats{Keys: 0, ExpiredKeys: 1}, e.Stats())
+}
+
+func TestBitcask_Compact(t *testing.T) {
+	t.Helper()
+
+	dir := t.TempDir()
+	e, _ := openTestBitcask(t, dir)
+
+	want := make(map[string]string)
+	for round := 0; round < 5; round++ {
+		for i := 0; i < 20; i++ {
+			key := fmt.Sprintf("key%02d", i)
+			value := fmt.Sprintf("r%d-%d", round, i)
+
+			_, err := e.Set(key, value, 0, store.Condition{})
+			require.NoError(t, err)
+			want[key] = value
+		}
+	}
+
+	for i := 0; i < 20; i += 3 {
+		key := fmt.Sprintf("key%02d", i)
+
+		_, err := e.Delete(key, store.Condition{})
+		require.NoError(t, err)
+		delete(want, key)
+	}
+
+	segments := len(e.log.Segments())
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+
+			entry, ok := e.Get("key01")
+			if !ok || entry.Value != want["key01"] {
+				t.Errorf("Get during compaction returned %+v, %v", entry, ok)
+				return
+			}
+		}
+	}()
+
+	stats, err := e.Compact()
+	close(stop)
+	wg.Wait()
+
+	require.NoError(t, err)
+	require.Less(t, stats.RecordsOut, stats.RecordsIn, "superseded records should be dropped")
+	require.Less(t, len(e.log.Segments()), segments, "emptied segments should be removed")
+
+	for key, value := range want {
+		requireValue(t, e, key, value)
+	}
+
+	require.NoError(t, e.Close())
+
+	e, loaded := openTestBitcask(t, dir)
+	require.Positive(t, loaded.HintSegments, "merged segments should be loaded from hint files")
+	require.Equal(t, len(want), loaded.Keys)
+
+	for key, value := range want {
+		requireValue(t, e, key, value)
+	}
+	_, ok := e.Get("key00")
+	require.False(t, ok, "a deleted key should stay deleted after its tombstone is merged")
+
+	require.NoError(t, e.Close())
+
+	hints, err := filepath.Glob(filepath.Join(dir, "*"+hintSuffix))
+	require.NoError(t, err)
+	require.NotEmpty(t, hints)
+	for _, hint := range hints {
+		require.NoError(t, os.WriteFile(hint, []byte("garbage"), 0o644))
+	}
+
+	e, loaded = openTestBitcask(t, dir)
+	defer e.Close()
+
+	require.Zero(t, loaded.HintSegments, "corrupt hint files should be ignored")
+	for key, value := range want {
+		requireValue(t, e, key, value)
+	}
+}
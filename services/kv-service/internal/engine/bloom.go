@@ -0,0 +1,90 @@
+package engine
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/fnv"
+)
+
+const (
+	bloomBitsPerKey = 10
+	// bloomHashes is the number of probes per key, close to optimal for 10
+	// bits per key (about 1% false positives).
+	bloomHashes = 7
+)
+
+// bloom is a Bloom filter over the keys of an SSTable. Its probes are
+// derived from the two halves of a 64-bit FNV-1a hash.
+type bloom struct {
+	bits   []byte
+	hashes uint32
+}
+
+func bloomHash(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return h.Sum64()
+}
+
+// newBloom builds a filter over the keys with the given bloomHash values.
+func newBloom(keyHashes []uint64) bloom {
+	nbits := max(64, len(keyHashes)*bloomBitsPerKey)
+
+	b := bloom{
+		bits:   make([]byte, (nbits+7)/8),
+		hashes: bloomHashes,
+	}
+
+	for _, h := range keyHashes {
+		b.add(h)
+	}
+
+	return b
+}
+
+func (b bloom) add(h uint64) {
+	nbits := uint32(len(b.bits) * 8)
+	h1, h2 := uint32(h), uint32(h>>32)
+
+	for i := uint32(0); i < b.hashes; i++ {
+		bit := (h1 + i*h2) % nbits
+		b.bits[bit/8] |= 1 << (bit % 8)
+	}
+}
+
+// mayContain reports whether key may be in the set; false means it is not.
+func (b bloom) mayContain(key string) bool {
+	if len(b.bits) == 0 {
+		return true
+	}
+
+	nbits := uint32(len(b.bits) * 8)
+	h := bloomHash(key)
+	h1, h2 := uint32(h), uint32(h>>32)
+
+	for i := uint32(0); i < b.hashes; i++ {
+		bit := (h1 + i*h2) % nbits
+		if b.bits[bit/8]&(1<<(bit%8)) == 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (b bloom) encode() []byte {
+	buf := binary.AppendUvarint(nil, uint64(b.hashes))
+	return append(buf, b.bits...)
+}
+
+func decodeBloom(data []byte) (bloom, error) {
+	hashes, n := binary.Uvarint(data)
+	if n <= 0 || hashes == 0 || hashes > 32 || len(data) == n {
+		return bloom{}, errors.New("engine: invalid bloom filter")
+	}
+
+	return bloom{
+		bits:   data[n:],
+		hashes: uint32(hashes),
+	}, nil
+}
@@ -0,0 +1,97 @@
+package engine
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/alexey-y-a/go-txlog-microservices/libs/txlog"
+	"github.com/alexey-y-a/go-txlog-microservices/services/kv-service/internal/store"
+)
+
+// Engine stores the keys of one namespace. Versions returned by writes and
+// reported in entries are increasing, so they can be used as ETags.
+type Engine interface {
+	// Get returns the entry of a live key.
+	Get(key string) (store.Entry, bool)
+	// Set writes key if cond holds; a positive ttl makes the key expire.
+	// It fails with store.ErrPreconditionFailed if cond does not hold.
+	Set(key, value string, ttl time.Duration, cond store.Condition) (uint64, error)
+	// Delete removes key if cond holds.
+	Delete(key string, cond store.Condition) (uint64, error)
+	// Scan has the semantics of store.Store.Scan.
+	Scan(start, end string, limit int) ([]store.Item, bool)
+	Stats() Stats
+	// Close stops the background jobs of the engine and releases its files.
+	Close() error
+}
+
+type Stats struct {
+	Keys        int
+	ExpiredKeys uint64
+}
+
+// Batcher is implemented by engines that can apply a batch atomically.
+type Batcher interface {
+	Apply(batch store.Batch) (uint64, error)
+}
+
+// Compactor is implemented by engines whose log can be compacted on demand.
+type Compactor interface {
+	Compact() (txlog.CompactStats, error)
+}
+
+// Snapshotter is implemented by engines that can take snapshots on demand.
+type Snapshotter interface {
+	Snapshot() (store.SnapshotStats, error)
+}
+
+// Stamper is implemented by engines that order stamped writes; see
+// store.Store.SetStamped.
+type Stamper interface {
+	SetStamped(key, value string, ttl time.Duration, stamp uint64) (uint64, error)
+	DeleteStamped(key string, stamp uint64) (uint64, error)
+	// DeletedStamp returns the stamp of the stamped delete that removed
+	// key, if it still keeps a tombstone.
+	DeletedStamp(key string) (uint64, bool)
+}
+
+// Syncer is implemented by engines that can flush their writes to disk.
+type Syncer interface {
+	Sync() error
+}
+
+// Kind selects the engine kv-service stores its namespaces in.
+type Kind int
+
+const (
+	// KindTxlog keeps all keys in memory and persists every write to a
+	// txlog.Log.
+	KindTxlog Kind = iota
+	// KindBitcask keeps only the keys in memory and reads values from the
+	// segments of a txlog.SegmentedLog.
+	KindBitcask
+	// KindLSM is a log-structured merge tree: a memtable in front of sorted
+	// tables on disk, with a txlog.SegmentedLog as its write-ahead log.
+	KindLSM
+)
+
+func (k Kind) String() string {
+	switch k {
+	case KindTxlog:
+		return "txlog"
+	case KindBitcask:
+		return "bitcask"
+	case KindLSM:
+		return "lsm"
+	}
+	return fmt.Sprintf("Kind(%d)", int(k))
+}
+
+func ParseKind(s string) (Kind, error) {
+	for _, k := range []Kind{KindTxlog, KindBitcask, KindLSM} {
+		if k.String() == s {
+			return k, nil
+		}
+	}
+	return 0, fmt.Errorf("engine: unknown engine %q", s)
+}
@@ -0,0 +1,253 @@
+package engine
+
+import (
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/alexey-y-a/go-txlog-microservices/libs/txlog"
+	"github.com/alexey-y-a/go-txlog-microservices/services/kv-service/internal/store"
+)
+
+type testEngine struct {
+	name string
+	open func(t *testing.T, dir string) Engine
+}
+
+// testEngines are the engines the behavioural tests below run against; the
+// in-memory store is the reference.
+var testEngines = []testEngine{
+	{name: "txlog", open: func(t *testing.T, dir string) Engine {
+		t.Helper()
+
+		path := filepath.Join(dir, "kv.log")
+
+		log, err := txlog.NewFileLog(path)
+		require.NoError(t, err, "NewFileLog should not return error")
+
+		s, _, err := store.NewStoreFromLog(log, path)
+		require.NoError(t, err, "NewStoreFromLog should not return error")
+
+		return NewTxlogEngine(s, log)
+	}},
+	{name: "bitcask", open: func(t *testing.T, dir string) Engine {
+		t.Helper()
+
+		e, _ := openTestBitcask(t, dir)
+		return e
+	}},
+	{name: "lsm", open: func(t *testing.T, dir string) Engine {
+		t.Helper()
+
+		return openTestLSM(t, dir)
+	}},
+}
+
+func forEachEngine(t *testing.T, fn func(t *testing.T, open func(t *testing.T, dir string) Engine)) {
+	t.Helper()
+
+	for _, te := range testEngines {
+		t.Run(te.name, func(t *testing.T) {
+			fn(t, te.open)
+		})
+	}
+}
+
+func TestEngine_Conditions(t *testing.T) {
+	t.Helper()
+
+	forEachEngine(t, func(t *testing.T, open func(t *testing.T, dir string) Engine) {
+		e := open(t, t.TempDir())
+		defer e.Close()
+
+		_, err := e.Set("a", "1", 0, store.Condition{IfMatchAny: true})
+		require.ErrorIs(t, err, store.ErrPreconditionFailed, "IfMatchAny should fail for a missing key")
+
+		v1, err := e.Set("a", "1", 0, store.Condition{IfNoneMatchAny: true})
+		require.NoError(t, err)
+
+		entry, ok := e.Get("a")
+		require.True(t, ok)
+		require.Equal(t, store.Entry{Value: "1", Version: v1}, entry)
+
+		_, err = e.Set("a", "2", 0, store.Condition{IfNoneMatchAny: true})
+		require.ErrorIs(t, err, store.ErrPreconditionFailed, "IfNoneMatchAny should fail for an existing key")
+
+		v2, err := e.Set("a", "2", 0, store.Condition{IfMatch: []uint64{v1}})
+		require.NoError(t, err)
+		require.Greater(t, v2, v1, "versions should increase")
+
+		_, err = e.Delete("a", store.Condition{IfMatch: []uint64{v1}})
+		require.ErrorIs(t, err, store.ErrPreconditionFailed, "a stale version should be rejected")
+
+		_, err = e.Delete("a", store.Condition{IfMatch: []uint64{v2}})
+		require.NoError(t, err)
+
+		_, ok = e.Get("a")
+		require.False(t, ok, "a deleted key should be missing")
+
+		_, err = e.Set("a", "3", 0, store.Condition{IfNoneMatchAny: true})
+		require.NoError(t, err, "a deleted key should count as missing")
+	})
+}
+
+func TestEngine_Scan(t *testing.T) {
+	t.Helper()
+
+	forEachEngine(t, func(t *testing.T, open func(t *testing.T, dir string) Engine) {
+		e := open(t, t.TempDir())
+		defer e.Close()
+
+		for i := 0; i < 20; i++ {
+			_, err := e.Set(fmt.Sprintf("k%02d", i), fmt.Sprintf("v%d", i), 0, store.Condition{})
+			require.NoError(t, err)
+		}
+
+		for i := 0; i < 20; i += 4 {
+			_, err := e.Delete(fmt.Sprintf("k%02d", i), store.Condition{})
+			require.NoError(t, err)
+		}
+
+		items, more := e.Scan("k03", "k10", 0)
+		require.False(t, more)
+
+		var keys []string
+		for _, item := range items {
+			keys = append(keys, item.Key)
+		}
+		require.Equal(t, []string{"k03", "k05", "k06", "k07", "k09"}, keys)
+		require.Equal(t, "v5", items[1].Value)
+
+		items, more = e.Scan("", "", 3)
+		require.True(t, more, "a full page should report more keys")
+		require.Len(t, items, 3)
+		require.Equal(t, "k01", items[0].Key)
+
+		items, more = e.Scan("k19", "", 3)
+		require.False(t, more)
+		require.Len(t, items, 1)
+	})
+}
+
+func TestEngine_TTLSurvivesRestart(t *testing.T) {
+	t.Helper()
+
+	forEachEngine(t, func(t *testing.T, open func(t *testing.T, dir string) Engine) {
+		dir := t.TempDir()
+		e := open(t, dir)
+
+		_, err := e.Set("session", "s", time.Hour, store.Condition{})
+		require.NoError(t, err)
+
+		entry, ok := e.Get("session")
+		require.True(t, ok)
+		require.False(t, entry.ExpiresAt.IsZero(), "a key with a TTL should have an expiry")
+		require.NoError(t, e.Close())
+
+		e = open(t, dir)
+		defer e.Close()
+
+		reopened, ok := e.Get("session")
+		require.True(t, ok)
+		require.True(t, entry.ExpiresAt.Equal(reopened.ExpiresAt), "the expiry should survive a restart")
+	})
+}
+
+func TestEngine_ExpirySweeper(t *testing.T) {
+	t.Helper()
+
+	forEachEngine(t, func(t *testing.T, open func(t *testing.T, dir string) Engine) {
+		e := open(t, t.TempDir())
+		defer e.Close()
+
+		_, err := e.Set("session", "s", 10*time.Millisecond, store.Condition{})
+		require.NoError(t, err)
+		_, err = e.Set("user1", "Alice", 0, store.Condition{})
+		require.NoError(t, err)
+
+		switch sweeper := e.(type) {
+		case *TxlogEngine:
+			sweeper.Store().StartExpirySweeper(5 * time.Millisecond)
+		case interface{ StartExpirySweeper(time.Duration) }:
+			sweeper.StartExpirySweeper(5 * time.Millisecond)
+		}
+
+		require.Eventually(t, func() bool {
+			return e.Stats().ExpiredKeys == 1
+		}, 5*time.Second, 5*time.Millisecond, "the sweeper should remove the expired key")
+
+		_, ok := e.Get("user1")
+		require.True(t, ok, "keys without a TTL should stay")
+	})
+}
+
+// TestEngine_MatchesModel applies random writes and checks every engine
+// against a map, before and after a restart.
+func TestEngine_MatchesModel(t *testing.T) {
+	t.Helper()
+
+	forEachEngine(t, func(t *testing.T, open func(t *testing.T, dir string) Engine) {
+		dir := t.TempDir()
+		e := open(t, dir)
+
+		rng := rand.New(rand.NewSource(1))
+		model := make(map[string]store.Entry)
+
+		for i := 0; i < 3000; i++ {
+			key := fmt.Sprintf("key%03d", rng.Intn(200))
+
+			switch {
+			case rng.Intn(4) == 0:
+				_, err := e.Delete(key, store.Condition{})
+				require.NoError(t, err)
+				delete(model, key)
+			default:
+				value := fmt.Sprintf("value-%d-%s", i, key)
+				version, err := e.Set(key, value, 0, store.Condition{})
+				require.NoError(t, err)
+				model[key] = store.Entry{Value: value, Version: version}
+			}
+
+			if i == 1500 {
+				if c, ok := e.(Compactor); ok {
+					_, err := c.Compact()
+					require.NoError(t, err, "Compact should not return error")
+				}
+			}
+		}
+
+		requireMatchesModel(t, e, model)
+		require.NoError(t, e.Close())
+
+		e = open(t, dir)
+		defer e.Close()
+
+		requireMatchesModel(t, e, model)
+	})
+}
+
+func requireMatchesModel(t *testing.T, e Engine, model map[string]store.Entry) {
+	t.Helper()
+
+	for i := 0; i < 200; i++ {
+		key := fmt.Sprintf("key%03d", i)
+
+		entry, ok := e.Get(key)
+		want, exists := model[key]
+		require.Equal(t, exists, ok, "existence of %q", key)
+		require.Equal(t, want, entry, "entry of %q", key)
+	}
+
+	items, more := e.Scan("", "", 0)
+	require.False(t, more)
+	require.Len(t, items, len(model), "Scan should return every live key")
+	for _, item := range items {
+		require.Equal(t, model[item.Key], item.Entry, "scanned entry of %q", item.Key)
+	}
+
+	require.Equal(t, len(model), e.Stats().Keys, "Stats should count live keys")
+}
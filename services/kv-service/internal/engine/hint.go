@@ -0,0 +1,180 @@
+package engine
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/alexey-y-a/go-txlog-microservices/libs/txlog"
+)
+
+// A hint file lists the records of a merged segment, so that the keydir can
+// be rebuilt without reading the values. It is
+//
+//	magic version reserved[3] uvarint(segment size) entries... crc32c
+//
+// with one entry per record
+//
+//	uvarint(len(key)) key uvarint(offset) uvarint(size) uvarint(version) varint(expires)
+//
+// where expires is in Unix nanoseconds, 0 for keys without a TTL. The
+// segment size ties the hint to the segment it was written for.
+const (
+	hintSuffix  = ".hint"
+	hintVersion = 1
+)
+
+var (
+	hintMagic    = [4]byte{'K', 'V', 'H', 'T'}
+	hintCRCTable = crc32.MakeTable(crc32.Castagnoli)
+
+	errInvalidHint = errors.New("engine: invalid hint file")
+)
+
+type hintEntry struct {
+	key       string
+	pos       txlog.Position
+	version   uint64
+	expiresAt time.Time
+}
+
+// hintPath returns the path of the hint file of the segment at segmentPath.
+func hintPath(segmentPath string) string {
+	return strings.TrimSuffix(segmentPath, filepath.Ext(segmentPath)) + hintSuffix
+}
+
+func writeHint(path string, segmentSize int64, entries []hintEntry) error {
+	buf := append([]byte(nil), hintMagic[:]...)
+	buf = append(buf, hintVersion, 0, 0, 0)
+	buf = binary.AppendUvarint(buf, uint64(segmentSize))
+
+	for _, entry := range entries {
+		var expires int64
+		if !entry.expiresAt.IsZero() {
+			expires = entry.expiresAt.UnixNano()
+		}
+
+		buf = binary.AppendUvarint(buf, uint64(len(entry.key)))
+		buf = append(buf, entry.key...)
+		buf = binary.AppendUvarint(buf, uint64(entry.pos.Offset))
+		buf = binary.AppendUvarint(buf, uint64(entry.pos.Size))
+		buf = binary.AppendUvarint(buf, entry.version)
+		buf = binary.AppendVarint(buf, expires)
+	}
+
+	buf = binary.LittleEndian.AppendUint32(buf, crc32.Checksum(buf, hintCRCTable))
+
+	tmpPath := path + ".tmp"
+
+	f, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o644)
+	if err != nil {
+		return fmt.Errorf("engine: create hint file: %w", err)
+	}
+
+	_, err = f.Write(buf)
+	if err == nil {
+		err = f.Sync()
+	}
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("engine: write hint file: %w", err)
+	}
+
+	err = os.Rename(tmpPath, path)
+	if err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("engine: rename hint file: %w", err)
+	}
+
+	return syncDir(filepath.Dir(path))
+}
+
+// readHint reads the hint file at path written for segment id, which must
+// now be segmentSize bytes long.
+func readHint(path string, id uint64, segmentSize int64) ([]hintEntry, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) < len(hintMagic)+4+4 || !bytes.HasPrefix(data, hintMagic[:]) {
+		return nil, fmt.Errorf("%w: bad header", errInvalidHint)
+	}
+
+	body := data[:len(data)-4]
+	if binary.LittleEndian.Uint32(data[len(data)-4:]) != crc32.Checksum(body, hintCRCTable) {
+		return nil, fmt.Errorf("%w: checksum mismatch", errInvalidHint)
+	}
+
+	if body[4] != hintVersion {
+		return nil, fmt.Errorf("%w: unsupported version %d", errInvalidHint, body[4])
+	}
+
+	rd := bytes.NewReader(body[8:])
+
+	size, err := binary.ReadUvarint(rd)
+	if err != nil || int64(size) != segmentSize {
+		return nil, fmt.Errorf("%w: written for another version of the segment", errInvalidHint)
+	}
+
+	var entries []hintEntry
+	for rd.Len() > 0 {
+		keyLen, err := binary.ReadUvarint(rd)
+		if err != nil || keyLen > txlog.MaxKeySize || keyLen > uint64(rd.Len()) {
+			return nil, fmt.Errorf("%w: bad key", errInvalidHint)
+		}
+
+		key := make([]byte, keyLen)
+		rd.Read(key)
+
+		var fields [3]uint64
+		for i := range fields {
+			fields[i], err = binary.ReadUvarint(rd)
+			if err != nil {
+				return nil, fmt.Errorf("%w: bad entry", errInvalidHint)
+			}
+		}
+
+		expires, err := binary.ReadVarint(rd)
+		if err != nil {
+			return nil, fmt.Errorf("%w: bad entry", errInvalidHint)
+		}
+
+		entry := hintEntry{
+			key:     string(key),
+			pos:     txlog.Position{Segment: id, Offset: int64(fields[0]), Size: int64(fields[1])},
+			version: fields[2],
+		}
+		if expires != 0 {
+			entry.expiresAt = time.Unix(0, expires)
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("engine: open dir %q: %w", dir, err)
+	}
+	defer d.Close()
+
+	err = d.Sync()
+	if err != nil {
+		return fmt.Errorf("engine: sync dir %q: %w", dir, err)
+	}
+	return nil
+}
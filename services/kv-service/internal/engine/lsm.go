@@ -0,0 +1,744 @@
+package engine
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/alexey-y-a/go-txlog-microservices/libs/logger"
+	"github.com/alexey-y-a/go-txlog-microservices/libs/txlog"
+	"github.com/alexey-y-a/go-txlog-microservices/services/kv-service/internal/store"
+)
+
+// LSMEngine is the KindLSM engine, a log-structured merge tree. Writes go
+// to a txlog.SegmentedLog, the write-ahead log, and to the memtable. A full
+// memtable is frozen and flushed in the background to a level-0 SSTable,
+// after which the log segments it covers are truncated. Tables are merged
+// into deeper levels by leveled compaction: level 0 as a whole once it has
+// L0Tables tables, and one table of level i once the level outgrows
+// BaseLevelSize·10^(i-1). The tables of a level other than 0 do not overlap.
+//
+// The tables of every level are listed in the LEVELS file, which also
+// records the first log segment not yet flushed; on open the log is replayed
+// from there into the memtable.
+type LSMEngine struct {
+	dir  string
+	opts LSMOptions
+	wal  *txlog.SegmentedLog
+
+	// writeMu serializes writes, so that they become visible in the order
+	// of the log.
+	writeMu sync.Mutex
+
+	// mu guards the memtables, the levels and the fields below. Readers
+	// hold it while they read tables, so that a compaction cannot close
+	// them underneath.
+	mu  sync.RWMutex
+	mem *memtable
+	// imm is the memtable being flushed, if any, and immSegment the log
+	// segment the records after it start in.
+	imm        *memtable
+	immSegment uint64
+	immKeys    int
+	// flushed is signalled when imm has been flushed or the engine closed.
+	flushed   *sync.Cond
+	closed    bool
+	levels    [][]*table
+	nextTable uint64
+	// walSegment and flushedKeys describe the flushed state, as saved in
+	// the LEVELS file.
+	walSegment  uint64
+	flushedKeys int
+	keys        int
+	// cursors hold, per level, the largest key of the table compacted
+	// last, so that compactions rotate through the key space.
+	cursors []string
+
+	flushMu   sync.Mutex
+	compactMu sync.Mutex
+
+	now         func() time.Time
+	expiredKeys atomic.Uint64
+
+	work chan struct{}
+	stop chan struct{}
+	wg   sync.WaitGroup
+
+	sweeper *store.Sweeper
+}
+
+// LSMOptions configure an LSMEngine. Zero fields take their value from
+// DefaultLSMOptions.
+type LSMOptions struct {
+	// MemtableSize is the size the memtable is flushed at, in bytes.
+	MemtableSize int
+	// TableSize is the size compaction splits its output tables at.
+	TableSize int64
+	// BlockSize is the size of the data blocks of a table.
+	BlockSize int
+	// L0Tables is the number of level-0 tables that triggers their
+	// compaction into level 1.
+	L0Tables int
+	// BaseLevelSize is the size of level 1 that triggers its compaction;
+	// every deeper level may be ten times larger than the previous one.
+	BaseLevelSize int64
+	// WAL are the options of the write-ahead log.
+	WAL []txlog.SegmentOption
+}
+
+func DefaultLSMOptions() LSMOptions {
+	return LSMOptions{
+		MemtableSize:  4 << 20,
+		TableSize:     2 << 20,
+		BlockSize:     4 << 10,
+		L0Tables:      4,
+		BaseLevelSize: 10 << 20,
+	}
+}
+
+func (o LSMOptions) withDefaults() LSMOptions {
+	d := DefaultLSMOptions()
+
+	if o.MemtableSize <= 0 {
+		o.MemtableSize = d.MemtableSize
+	}
+	if o.TableSize <= 0 {
+		o.TableSize = d.TableSize
+	}
+	if o.BlockSize <= 0 {
+		o.BlockSize = d.BlockSize
+	}
+	if o.L0Tables <= 0 {
+		o.L0Tables = d.L0Tables
+	}
+	if o.BaseLevelSize <= 0 {
+		o.BaseLevelSize = d.BaseLevelSize
+	}
+
+	return o
+}
+
+const (
+	levelsFile = "LEVELS"
+	walDir     = "wal"
+)
+
+var errLSMClosed = errors.New("engine: lsm engine is closed")
+
+type levelsManifest struct {
+	Levels     [][]uint64 `json:"levels"`
+	NextTable  uint64     `json:"next_table"`
+	WALSegment uint64     `json:"wal_segment"`
+	Keys       int        `json:"keys"`
+}
+
+// LevelStats describe the tables of one level.
+type LevelStats struct {
+	Tables int
+	Bytes  int64
+}
+
+// OpenLSM opens the engine in dir, replaying the part of its write-ahead
+// log that has not been flushed yet.
+func OpenLSM(dir string, opts LSMOptions) (*LSMEngine, error) {
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return nil, fmt.Errorf("engine: create lsm dir %q: %w", dir, err)
+	}
+
+	m, err := readLevels(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	e := &LSMEngine{
+		dir:         dir,
+		opts:        opts.withDefaults(),
+		mem:         newMemtable(),
+		nextTable:   max(m.NextTable, 1),
+		walSegment:  m.WALSegment,
+		flushedKeys: m.Keys,
+		keys:        m.Keys,
+		now:         time.Now,
+		work:        make(chan struct{}, 1),
+		stop:        make(chan struct{}),
+	}
+	e.flushed = sync.NewCond(&e.mu)
+
+	err = e.openTables(m)
+	if err != nil {
+		e.closeTables()
+		return nil, err
+	}
+
+	e.wal, err = txlog.OpenSegmentedLog(filepath.Join(dir, walDir), e.opts.WAL...)
+	if err != nil {
+		e.closeTables()
+		return nil, err
+	}
+
+	_, err = txlog.ReadFileFrom(e.wal.Dir(), e.walSegment, func(ev txlog.Event) error {
+		rec, found, err := e.lookupLocked(ev.Key)
+		if err != nil {
+			return err
+		}
+
+		e.applyLocked(ev, found && !rec.deleted)
+		return nil
+	})
+	if err != nil {
+		e.closeTables()
+		e.wal.Close()
+		return nil, fmt.Errorf("engine: replay write-ahead log: %w", err)
+	}
+
+	e.wg.Add(1)
+	go e.runBackground()
+
+	if e.mem.size >= e.opts.MemtableSize {
+		err = e.rotate()
+		if err != nil {
+			e.Close()
+			return nil, err
+		}
+	}
+
+	return e, nil
+}
+
+func readLevels(dir string) (levelsManifest, error) {
+	var m levelsManifest
+
+	data, err := os.ReadFile(filepath.Join(dir, levelsFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return m, nil
+	}
+	if err != nil {
+		return m, fmt.Errorf("engine: read levels: %w", err)
+	}
+
+	err = json.Unmarshal(data, &m)
+	if err != nil {
+		return m, fmt.Errorf("engine: decode levels: %w", err)
+	}
+
+	return m, nil
+}
+
+// openTables opens the tables listed in m and removes the table files it
+// does not list, left by a flush or a compaction that did not finish.
+func (e *LSMEngine) openTables(m levelsManifest) error {
+	listed := make(map[string]bool)
+
+	for level, ids := range m.Levels {
+		e.levels = append(e.levels, nil)
+
+		for _, id := range ids {
+			name := tableFileName(id)
+			listed[name] = true
+
+			t, err := openTable(filepath.Join(e.dir, name), id)
+			if err != nil {
+				return err
+			}
+			e.levels[level] = append(e.levels[level], t)
+		}
+	}
+
+	if len(e.levels) == 0 {
+		e.levels = [][]*table{nil}
+	}
+	e.cursors = make([]string, len(e.levels))
+
+	entries, err := os.ReadDir(e.dir)
+	if err != nil {
+		return fmt.Errorf("engine: read lsm dir: %w", err)
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasSuffix(name, tableSuffix) || listed[name] {
+			continue
+		}
+
+		id, err := strconv.ParseUint(strings.TrimSuffix(name, tableSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+
+		err = os.Remove(filepath.Join(e.dir, name))
+		if err != nil {
+			return fmt.Errorf("engine: remove stray table %d: %w", id, err)
+		}
+	}
+
+	return nil
+}
+
+// writeLevelsLocked saves the levels and the flushed state to the LEVELS
+// file. Must be called with e.mu held.
+func (e *LSMEngine) writeLevelsLocked() error {
+	m := levelsManifest{
+		Levels:     make([][]uint64, len(e.levels)),
+		NextTable:  e.nextTable,
+		WALSegment: e.walSegment,
+		Keys:       e.flushedKeys,
+	}
+
+	for level, tables := range e.levels {
+		m.Levels[level] = []uint64{}
+		for _, t := range tables {
+			m.Levels[level] = append(m.Levels[level], t.id)
+		}
+	}
+
+	data, err := json.Marshal(m)
+	if err != nil {
+		return fmt.Errorf("engine: encode levels: %w", err)
+	}
+
+	path := filepath.Join(e.dir, levelsFile)
+	tmpPath := path + ".tmp"
+
+	f, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o644)
+	if err != nil {
+		return fmt.Errorf("engine: create levels file: %w", err)
+	}
+
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("engine: write levels file: %w", err)
+	}
+
+	err = os.Rename(tmpPath, path)
+	if err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("engine: rename levels file: %w", err)
+	}
+
+	return syncDir(e.dir)
+}
+
+// lookupLocked returns the newest record of key, which may be a tombstone.
+// Must be called with e.mu held.
+func (e *LSMEngine) lookupLocked(key string) (record, bool, error) {
+	if rec, ok := e.mem.records[key]; ok {
+		return rec, true, nil
+	}
+
+	if e.imm != nil {
+		if rec, ok := e.imm.records[key]; ok {
+			return rec, true, nil
+		}
+	}
+
+	level0 := e.levels[0]
+	for i := len(level0) - 1; i >= 0; i-- {
+		rec, ok, err := level0[i].get(key)
+		if err != nil || ok {
+			return rec, ok, err
+		}
+	}
+
+	for _, tables := range e.levels[1:] {
+		i := sort.Search(len(tables), func(i int) bool {
+			return tables[i].maxKey >= key
+		})
+		if i == len(tables) {
+			continue
+		}
+
+		rec, ok, err := tables[i].get(key)
+		if err != nil || ok {
+			return rec, ok, err
+		}
+	}
+
+	return record{}, false, nil
+}
+
+// applyLocked applies ev to the memtable; existed tells whether the key had
+// a value before. Must be called with e.mu held.
+func (e *LSMEngine) applyLocked(ev txlog.Event, existed bool) {
+	switch ev.Op {
+	case txlog.OpSet:
+		e.mem.put(ev.Key, record{
+			value:     ev.Value,
+			version:   ev.LSN,
+			expiresAt: ev.ExpiresAt,
+		})
+		if !existed {
+			e.keys++
+		}
+	case txlog.OpDelete, txlog.OpExpire:
+		e.mem.put(ev.Key, record{
+			version: ev.LSN,
+			deleted: true,
+		})
+		if existed {
+			e.keys--
+		}
+	}
+}
+
+// Log returns the write-ahead log of the engine.
+func (e *LSMEngine) Log() txlog.Log {
+	return e.wal
+}
+
+func (e *LSMEngine) Get(key string) (store.Entry, bool) {
+	e.mu.RLock()
+	rec, ok, err := e.lookupLocked(key)
+	e.mu.RUnlock()
+
+	if err != nil {
+		log := logger.L().With().Str("component", "lsm").Logger()
+		log.Error().Err(err).Str("key", key).Msg("failed to read value")
+		return store.Entry{}, false
+	}
+
+	if !ok || rec.deleted {
+		return store.Entry{}, false
+	}
+
+	if rec.expired(e.now()) {
+		_, err := e.expire(key)
+		if err != nil {
+			log := logger.L().With().Str("component", "lsm").Logger()
+			log.Warn().Err(err).Str("key", key).Msg("failed to log expired key")
+		}
+		return store.Entry{}, false
+	}
+
+	return store.Entry{
+		Value:     rec.value,
+		Version:   rec.version,
+		ExpiresAt: rec.expiresAt,
+	}, true
+}
+
+func (e *LSMEngine) Set(key, value string, ttl time.Duration, cond store.Condition) (uint64, error) {
+	ev := txlog.Event{
+		Key:   key,
+		Value: value,
+		Op:    txlog.OpSet,
+	}
+	if ttl > 0 {
+		ev.ExpiresAt = e.now().Add(ttl)
+	}
+
+	return e.write(ev, cond)
+}
+
+func (e *LSMEngine) Delete(key string, cond store.Condition) (uint64, error) {
+	return e.write(txlog.Event{
+		Key: key,
+		Op:  txlog.OpDelete,
+	}, cond)
+}
+
+// write appends ev and applies it if cond holds for the current state of
+// the key.
+func (e *LSMEngine) write(ev txlog.Event, cond store.Condition) (uint64, error) {
+	e.writeMu.Lock()
+	defer e.writeMu.Unlock()
+
+	e.mu.RLock()
+	current, found, err := e.lookupLocked(ev.Key)
+	e.mu.RUnlock()
+
+	if err != nil {
+		return 0, err
+	}
+
+	existed := found && !current.deleted
+	exists := existed && !current.expired(e.now())
+
+	if !cond.Holds(current.version, exists) {
+		return 0, store.ErrPreconditionFailed
+	}
+
+	return e.commit(ev, existed)
+}
+
+// commit appends ev to the write-ahead log and applies it to the memtable.
+// Must be called with e.writeMu held. As in store.Store, a record that was
+// written but not synced is applied and reported with an error.
+func (e *LSMEngine) commit(ev txlog.Event, existed bool) (uint64, error) {
+	lsn, err := e.wal.Append(ev)
+	if err != nil && lsn == 0 {
+		return 0, fmt.Errorf("engine: append %s event: %w", ev.Op, err)
+	}
+	ev.LSN = lsn
+
+	e.mu.Lock()
+	e.applyLocked(ev, existed)
+	full := e.mem.size >= e.opts.MemtableSize
+	e.mu.Unlock()
+
+	if full {
+		rotateErr := e.rotate()
+		if rotateErr != nil {
+			log := logger.L().With().Str("component", "lsm").Logger()
+			log.Error().Err(rotateErr).Msg("failed to freeze memtable")
+		}
+	}
+
+	if err != nil {
+		return 0, fmt.Errorf("engine: sync %s event: %w", ev.Op, err)
+	}
+	return lsn, nil
+}
+
+// rotate freezes the memtable and starts a new log segment for the writes
+// after it, then wakes the background flush. While an earlier memtable is
+// still being flushed, writes stall until it is done. Must be called with
+// e.writeMu held.
+func (e *LSMEngine) rotate() error {
+	e.mu.Lock()
+	for e.imm != nil && !e.closed {
+		e.wake()
+		e.flushed.Wait()
+	}
+	closed, empty := e.closed, len(e.mem.records) == 0
+	e.mu.Unlock()
+
+	if closed {
+		return errLSMClosed
+	}
+	if empty {
+		return nil
+	}
+
+	segment, err := e.wal.Checkpoint()
+	if err != nil {
+		return fmt.Errorf("engine: checkpoint write-ahead log: %w", err)
+	}
+
+	e.mu.Lock()
+	e.imm = e.mem
+	e.immSegment = segment
+	e.immKeys = e.keys
+	e.mem = newMemtable()
+	e.mu.Unlock()
+
+	e.wake()
+	return nil
+}
+
+// wake asks the background goroutine to flush and compact.
+func (e *LSMEngine) wake() {
+	select {
+	case e.work <- struct{}{}:
+	default:
+	}
+}
+
+// expire logs and applies the expiry of key if it is still expired. It
+// reports whether the key was removed.
+func (e *LSMEngine) expire(key string) (bool, error) {
+	e.writeMu.Lock()
+	defer e.writeMu.Unlock()
+
+	e.mu.RLock()
+	rec, ok, err := e.lookupLocked(key)
+	e.mu.RUnlock()
+
+	if err != nil {
+		return false, err
+	}
+
+	if !ok || rec.deleted || !rec.expired(e.now()) {
+		return false, nil
+	}
+
+	_, err = e.commit(txlog.Event{
+		Key: key,
+		Op:  txlog.OpExpire,
+	}, true)
+	if err != nil {
+		return false, err
+	}
+
+	e.expiredKeys.Add(1)
+
+	return true, nil
+}
+
+// iterLocked merges the memtables and all tables from start on. Must be
+// called with e.mu held.
+func (e *LSMEngine) iterLocked(start string) iterator {
+	sources := []iterator{e.mem.iter(start)}
+
+	if e.imm != nil {
+		sources = append(sources, e.imm.iter(start))
+	}
+
+	level0 := e.levels[0]
+	for i := len(level0) - 1; i >= 0; i-- {
+		sources = append(sources, level0[i].iter(start))
+	}
+
+	for _, tables := range e.levels[1:] {
+		for _, t := range tables {
+			if t.maxKey >= start {
+				sources = append(sources, t.iter(start))
+			}
+		}
+	}
+
+	return newMergeIter(sources)
+}
+
+// Scan has the semantics of store.Store.Scan. Tables are read while the
+// engine is locked, so a page reflects one point in the history of writes.
+func (e *LSMEngine) Scan(start, end string, limit int) ([]store.Item, bool) {
+	now := e.now()
+
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	var items []store.Item
+
+	it := e.iterLocked(start)
+	for ; it.valid(); it.next() {
+		if end != "" && it.key() >= end {
+			break
+		}
+
+		rec := it.record()
+		if rec.deleted || rec.expired(now) {
+			continue
+		}
+
+		if limit > 0 && len(items) == limit {
+			return items, true
+		}
+
+		items = append(items, store.Item{
+			Key: it.key(),
+			Entry: store.Entry{
+				Value:     rec.value,
+				Version:   rec.version,
+				ExpiresAt: rec.expiresAt,
+			},
+		})
+	}
+
+	err := it.err()
+	if err != nil {
+		log := logger.L().With().Str("component", "lsm").Logger()
+		log.Error().Err(err).Msg("failed to read table")
+	}
+
+	return items, false
+}
+
+func (e *LSMEngine) Stats() Stats {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	return Stats{
+		Keys:        e.keys,
+		ExpiredKeys: e.expiredKeys.Load(),
+	}
+}
+
+// Levels describes the tables of every level, level 0 first.
+func (e *LSMEngine) Levels() []LevelStats {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	levels := make([]LevelStats, len(e.levels))
+	for i, tables := range e.levels {
+		levels[i].Tables = len(tables)
+		for _, t := range tables {
+			levels[i].Bytes += t.size
+		}
+	}
+
+	return levels
+}
+
+func (e *LSMEngine) Sync() error {
+	return e.wal.Sync()
+}
+
+// Close stops the background jobs and closes the tables and the log. The
+// memtable is not flushed: it is rebuilt from the log on the next open.
+func (e *LSMEngine) Close() error {
+	e.StopExpirySweeper()
+
+	e.mu.Lock()
+	e.closed = true
+	e.flushed.Broadcast()
+	e.mu.Unlock()
+
+	close(e.stop)
+	e.wg.Wait()
+
+	err := e.closeTables()
+	return errors.Join(err, e.wal.Close())
+}
+
+func (e *LSMEngine) closeTables() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	var errs []error
+	for _, tables := range e.levels {
+		for _, t := range tables {
+			errs = append(errs, t.close())
+		}
+	}
+	e.levels = nil
+
+	return errors.Join(errs...)
+}
+
+// StartExpirySweeper removes expired keys every interval. Close stops it.
+func (e *LSMEngine) StartExpirySweeper(interval time.Duration) {
+	e.sweeper = store.StartSweeper(interval, "lsm", e.sweep)
+}
+
+func (e *LSMEngine) StopExpirySweeper() {
+	e.sweeper.Stop()
+}
+
+func (e *LSMEngine) sweep() (int, error) {
+	now := e.now()
+
+	var keys []string
+	e.mu.RLock()
+	it := e.iterLocked("")
+	for ; it.valid(); it.next() {
+		rec := it.record()
+		if !rec.deleted && rec.expired(now) {
+			keys = append(keys, it.key())
+		}
+	}
+	err := it.err()
+	e.mu.RUnlock()
+
+	if err != nil {
+		return 0, err
+	}
+
+	return store.ExpireKeys(keys, e.expire)
+}
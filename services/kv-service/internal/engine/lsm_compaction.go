@@ -0,0 +1,414 @@
+package engine
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/alexey-y-a/go-txlog-microservices/libs/logger"
+	"github.com/alexey-y-a/go-txlog-microservices/libs/txlog"
+)
+
+// flushRetryInterval is how long a failed flush waits before it is retried;
+// writes stall in the meantime.
+const flushRetryInterval = time.Second
+
+// runBackground flushes frozen memtables and runs the compactions they make
+// necessary, until Close.
+func (e *LSMEngine) runBackground() {
+	defer e.wg.Done()
+
+	log := logger.L().With().Str("component", "lsm").Logger()
+
+	for {
+		select {
+		case <-e.stop:
+			return
+		case <-e.work:
+		}
+
+		err := e.flush()
+		if err != nil {
+			log.Error().Err(err).Msg("memtable flush failed")
+
+			select {
+			case <-e.stop:
+				return
+			case <-time.After(flushRetryInterval):
+			}
+
+			e.wake()
+			continue
+		}
+
+		for {
+			select {
+			case <-e.stop:
+				return
+			default:
+			}
+
+			ran, err := e.compactStep()
+			if err != nil {
+				log.Error().Err(err).Msg("compaction failed")
+				break
+			}
+			if !ran {
+				break
+			}
+		}
+	}
+}
+
+// flush writes the frozen memtable to a new level-0 table and truncates the
+// log segments it covers.
+func (e *LSMEngine) flush() error {
+	e.flushMu.Lock()
+	defer e.flushMu.Unlock()
+
+	e.mu.RLock()
+	imm, segment, keys := e.imm, e.immSegment, e.immKeys
+	e.mu.RUnlock()
+
+	if imm == nil {
+		return nil
+	}
+
+	tables, err := e.writeTables(imm.iter(""), false, false)
+	if err != nil {
+		return err
+	}
+
+	e.mu.Lock()
+	level0 := e.levels[0]
+	walSegment, flushedKeys := e.walSegment, e.flushedKeys
+
+	e.levels[0] = append(level0[:len(level0):len(level0)], tables...)
+	e.walSegment, e.flushedKeys = segment, keys
+
+	err = e.writeLevelsLocked()
+	if err != nil {
+		e.levels[0] = level0
+		e.walSegment, e.flushedKeys = walSegment, flushedKeys
+		e.mu.Unlock()
+
+		removeTables(tables)
+		return err
+	}
+
+	e.imm = nil
+	e.flushed.Broadcast()
+	e.mu.Unlock()
+
+	err = e.wal.TruncateBefore(segment)
+	if err != nil {
+		return fmt.Errorf("engine: truncate write-ahead log: %w", err)
+	}
+
+	return nil
+}
+
+func (e *LSMEngine) allocTable() uint64 {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	id := e.nextTable
+	e.nextTable++
+	return id
+}
+
+// writeTables writes the records of it to new tables. With split set, a
+// table is finished once it reaches TableSize.
+func (e *LSMEngine) writeTables(it iterator, dropTombstones, split bool) ([]*table, error) {
+	var tables []*table
+	var w *tableWriter
+	var id uint64
+
+	fail := func(err error) ([]*table, error) {
+		if w != nil {
+			w.abort()
+		}
+		removeTables(tables)
+		return nil, err
+	}
+
+	for ; it.valid(); it.next() {
+		rec := it.record()
+		if rec.deleted && dropTombstones {
+			continue
+		}
+
+		if w == nil {
+			var err error
+
+			id = e.allocTable()
+			w, err = createTable(filepath.Join(e.dir, tableFileName(id)), e.opts.BlockSize)
+			if err != nil {
+				return fail(err)
+			}
+		}
+
+		err := w.add(it.key(), rec)
+		if err != nil {
+			return fail(err)
+		}
+
+		if split && w.size() >= e.opts.TableSize {
+			t, err := finishTable(w, id)
+			w = nil
+			if err != nil {
+				return fail(err)
+			}
+			tables = append(tables, t)
+		}
+	}
+
+	err := it.err()
+	if err != nil {
+		return fail(err)
+	}
+
+	if w != nil {
+		t, err := finishTable(w, id)
+		w = nil
+		if err != nil {
+			return fail(err)
+		}
+		tables = append(tables, t)
+	}
+
+	return tables, nil
+}
+
+func finishTable(w *tableWriter, id uint64) (*table, error) {
+	err := w.finish()
+	if err != nil {
+		os.Remove(w.path)
+		return nil, err
+	}
+
+	t, err := openTable(w.path, id)
+	if err != nil {
+		os.Remove(w.path)
+		return nil, err
+	}
+
+	return t, nil
+}
+
+// removeTables closes tables and deletes their files.
+func removeTables(tables []*table) {
+	for _, t := range tables {
+		t.close()
+		os.Remove(t.path)
+	}
+}
+
+// compactStep runs the compaction the levels need most, if any. It reports
+// whether one was run.
+func (e *LSMEngine) compactStep() (bool, error) {
+	e.compactMu.Lock()
+	defer e.compactMu.Unlock()
+
+	e.mu.Lock()
+	level, inputs := e.pickLocked()
+	e.mu.Unlock()
+
+	if inputs == nil {
+		return false, nil
+	}
+
+	_, err := e.compactTables(inputs, level+1)
+	return true, err
+}
+
+// pickLocked picks the next compaction: the level it compacts and its input
+// tables, newest first. Must be called with e.mu held.
+func (e *LSMEngine) pickLocked() (int, []*table) {
+	if len(e.levels[0]) >= e.opts.L0Tables {
+		var inputs []*table
+		for i := len(e.levels[0]) - 1; i >= 0; i-- {
+			inputs = append(inputs, e.levels[0][i])
+		}
+
+		minKey, maxKey := keyRange(inputs)
+		return 0, append(inputs, e.overlappingLocked(1, minKey, maxKey)...)
+	}
+
+	limit := e.opts.BaseLevelSize
+	for level := 1; level < len(e.levels); level++ {
+		if levelBytes(e.levels[level]) > limit {
+			t := e.nextInputLocked(level)
+			return level, append([]*table{t}, e.overlappingLocked(level+1, t.minKey, t.maxKey)...)
+		}
+		limit *= 10
+	}
+
+	return 0, nil
+}
+
+// nextInputLocked picks the table of level that follows the one compacted
+// last, wrapping around at the end of the key space.
+func (e *LSMEngine) nextInputLocked(level int) *table {
+	tables := e.levels[level]
+
+	i := sort.Search(len(tables), func(i int) bool {
+		return tables[i].minKey > e.cursors[level]
+	})
+	if i == len(tables) {
+		i = 0
+	}
+
+	e.cursors[level] = tables[i].maxKey
+	return tables[i]
+}
+
+func (e *LSMEngine) overlappingLocked(level int, minKey, maxKey string) []*table {
+	if level >= len(e.levels) {
+		return nil
+	}
+
+	var tables []*table
+	for _, t := range e.levels[level] {
+		if t.overlaps(minKey, maxKey) {
+			tables = append(tables, t)
+		}
+	}
+	return tables
+}
+
+func keyRange(tables []*table) (string, string) {
+	minKey, maxKey := tables[0].minKey, tables[0].maxKey
+	for _, t := range tables[1:] {
+		minKey = min(minKey, t.minKey)
+		maxKey = max(maxKey, t.maxKey)
+	}
+	return minKey, maxKey
+}
+
+func levelBytes(tables []*table) int64 {
+	var size int64
+	for _, t := range tables {
+		size += t.size
+	}
+	return size
+}
+
+// compactTables merges inputs, ordered newest first, into new tables of
+// level out. Tombstones are dropped when no deeper level holds tables they
+// could hide. Must be called with e.compactMu held.
+func (e *LSMEngine) compactTables(inputs []*table, out int) (txlog.CompactStats, error) {
+	var stats txlog.CompactStats
+
+	e.mu.RLock()
+	dropTombstones := true
+	for level := out + 1; level < len(e.levels); level++ {
+		if len(e.levels[level]) > 0 {
+			dropTombstones = false
+		}
+	}
+	e.mu.RUnlock()
+
+	// Inputs are only closed by compactions, so they can be read without
+	// holding e.mu.
+	sources := make([]iterator, len(inputs))
+	for i, t := range inputs {
+		sources[i] = t.iter("")
+		stats.RecordsIn += t.count
+		stats.BytesIn += t.size
+	}
+
+	tables, err := e.writeTables(newMergeIter(sources), dropTombstones, true)
+	if err != nil {
+		return stats, fmt.Errorf("engine: compact into level %d: %w", out, err)
+	}
+
+	for _, t := range tables {
+		stats.RecordsOut += t.count
+		stats.BytesOut += t.size
+	}
+	stats.BytesReclaimed = stats.BytesIn - stats.BytesOut
+
+	compacted := make(map[uint64]bool, len(inputs))
+	for _, t := range inputs {
+		compacted[t.id] = true
+	}
+
+	e.mu.Lock()
+	levels := e.levels
+
+	e.levels = make([][]*table, max(len(levels), out+1))
+	for level, tables := range levels {
+		for _, t := range tables {
+			if !compacted[t.id] {
+				e.levels[level] = append(e.levels[level], t)
+			}
+		}
+	}
+
+	e.levels[out] = append(e.levels[out], tables...)
+	sort.Slice(e.levels[out], func(i, j int) bool {
+		return e.levels[out][i].minKey < e.levels[out][j].minKey
+	})
+
+	for len(e.cursors) < len(e.levels) {
+		e.cursors = append(e.cursors, "")
+	}
+
+	err = e.writeLevelsLocked()
+	if err != nil {
+		e.levels = levels
+		e.mu.Unlock()
+
+		removeTables(tables)
+		return stats, err
+	}
+	e.mu.Unlock()
+
+	removeTables(inputs)
+
+	return stats, nil
+}
+
+// Compact flushes the memtable and merges every table into the deepest
+// level, dropping overwritten records and tombstones.
+func (e *LSMEngine) Compact() (txlog.CompactStats, error) {
+	err := e.flush()
+	if err != nil {
+		return txlog.CompactStats{}, err
+	}
+
+	e.writeMu.Lock()
+	err = e.rotate()
+	e.writeMu.Unlock()
+	if err != nil {
+		return txlog.CompactStats{}, err
+	}
+
+	err = e.flush()
+	if err != nil {
+		return txlog.CompactStats{}, err
+	}
+
+	e.compactMu.Lock()
+	defer e.compactMu.Unlock()
+
+	e.mu.RLock()
+	var inputs []*table
+	for i := len(e.levels[0]) - 1; i >= 0; i-- {
+		inputs = append(inputs, e.levels[0][i])
+	}
+	for _, tables := range e.levels[1:] {
+		inputs = append(inputs, tables...)
+	}
+	out := max(len(e.levels)-1, 1)
+	e.mu.RUnlock()
+
+	if len(inputs) == 0 {
+		return txlog.CompactStats{}, nil
+	}
+
+	return e.compactTables(inputs, out)
+}
@@ -0,0 +1,163 @@
+package engine
+
+import (
+	"github.com/alexey-y-a/go-txlog-microservices/services/kv-service/internal/index"
+)
+
+// iterator walks records in key order. It is positioned on its first record
+// when created.
+type iterator interface {
+	valid() bool
+	key() string
+	record() record
+	next()
+	err() error
+}
+
+// memtable holds the latest writes of the LSM engine in memory until they
+// are flushed to a level-0 table.
+type memtable struct {
+	records map[string]record
+	keys    *index.Skiplist
+	// size estimates the memory held by the records.
+	size int
+}
+
+// memtableRecordOverhead approximates the per-key cost of the map entry and
+// the skiplist node.
+const memtableRecordOverhead = 64
+
+func newMemtable() *memtable {
+	return &memtable{
+		records: make(map[string]record),
+		keys:    index.NewSkiplist(),
+	}
+}
+
+func (m *memtable) put(key string, rec record) {
+	old, ok := m.records[key]
+	if ok {
+		m.size -= len(old.value)
+	} else {
+		m.size += len(key) + memtableRecordOverhead
+		m.keys.Insert(key)
+	}
+
+	m.size += len(rec.value)
+	m.records[key] = rec
+}
+
+func (m *memtable) iter(start string) iterator {
+	return &memIter{
+		node:    m.keys.Seek(start),
+		records: m.records,
+	}
+}
+
+type memIter struct {
+	node    *index.Node
+	records map[string]record
+}
+
+func (it *memIter) valid() bool    { return it.node != nil }
+func (it *memIter) key() string    { return it.node.Key }
+func (it *memIter) record() record { return it.records[it.node.Key] }
+func (it *memIter) next()          { it.node = it.node.Next() }
+func (it *memIter) err() error     { return nil }
+
+type tableIter struct {
+	t     *table
+	block int
+	data  []byte
+
+	k       string
+	rec     record
+	ok      bool
+	readErr error
+}
+
+// iter returns an iterator over the records of t from start on.
+func (t *table) iter(start string) iterator {
+	it := &tableIter{
+		t:     t,
+		block: max(t.blockFor(start), 0) - 1,
+	}
+
+	it.next()
+	for it.ok && it.k < start {
+		it.next()
+	}
+
+	return it
+}
+
+func (it *tableIter) valid() bool    { return it.ok }
+func (it *tableIter) key() string    { return it.k }
+func (it *tableIter) record() record { return it.rec }
+func (it *tableIter) err() error     { return it.readErr }
+
+func (it *tableIter) next() {
+	it.ok = false
+
+	for len(it.data) == 0 {
+		if it.readErr != nil || it.block+1 >= len(it.t.blocks) {
+			return
+		}
+
+		it.block++
+		it.data, it.readErr = it.t.readBlock(it.block)
+	}
+
+	it.k, it.rec, it.data, it.readErr = decodeEntry(it.data)
+	it.ok = it.readErr == nil
+}
+
+// mergeIter merges iterators ordered from the newest to the oldest. Of the
+// records of a key only the one of the newest iterator is returned.
+type mergeIter struct {
+	sources []iterator
+
+	k   string
+	rec record
+	ok  bool
+}
+
+func newMergeIter(sources []iterator) *mergeIter {
+	m := &mergeIter{sources: sources}
+	m.next()
+	return m
+}
+
+func (m *mergeIter) valid() bool    { return m.ok }
+func (m *mergeIter) key() string    { return m.k }
+func (m *mergeIter) record() record { return m.rec }
+
+func (m *mergeIter) next() {
+	m.ok = false
+
+	for _, s := range m.sources {
+		if s.valid() && (!m.ok || s.key() < m.k) {
+			m.k, m.rec, m.ok = s.key(), s.record(), true
+		}
+	}
+
+	if !m.ok {
+		return
+	}
+
+	for _, s := range m.sources {
+		if s.valid() && s.key() == m.k {
+			s.next()
+		}
+	}
+}
+
+func (m *mergeIter) err() error {
+	for _, s := range m.sources {
+		err := s.err()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,495 @@
+package engine
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/alexey-y-a/go-txlog-microservices/services/kv-service/internal/store"
+)
+
+// An SSTable is an immutable file of records sorted by key:
+//
+//	data blocks | bloom filter | block index | footer
+//
+// A data block is a run of entries followed by crc32c(entries), with
+//
+//	uvarint(len(key)) key uvarint(len(value)) value uvarint(version) varint(expires) flags
+//
+// per entry. The bloom filter and the index also end with their crc32c;
+// the index lists the first key, offset and size of every block, then the
+// largest key and the number of entries of the table. The fixed-size footer
+// holds the offsets and sizes of the filter and the index.
+const (
+	tableSuffix  = ".sst"
+	tableVersion = 1
+	footerSize   = 4*8 + 8
+
+	flagDeleted = 1
+)
+
+var (
+	tableMagic    = [4]byte{'L', 'S', 'M', 'T'}
+	tableCRCTable = crc32.MakeTable(crc32.Castagnoli)
+
+	errCorruptTable = errors.New("engine: corrupt sstable")
+)
+
+// record is the state of a key in the LSM engine: a value or, if deleted is
+// set, a tombstone hiding older values of the key.
+type record struct {
+	value     string
+	version   uint64
+	expiresAt time.Time
+	deleted   bool
+}
+
+func (r record) expired(now time.Time) bool {
+	return store.Expired(r.expiresAt, now)
+}
+
+type blockHandle struct {
+	firstKey string
+	offset   int64
+	size     int64
+}
+
+// table is an open SSTable. Its index and bloom filter are kept in memory.
+type table struct {
+	id     uint64
+	path   string
+	file   *os.File
+	size   int64
+	blocks []blockHandle
+	bloom  bloom
+	minKey string
+	maxKey string
+	count  int
+}
+
+func tableFileName(id uint64) string {
+	return fmt.Sprintf("%020d%s", id, tableSuffix)
+}
+
+func appendEntry(buf []byte, key string, rec record) []byte {
+	var expires int64
+	if !rec.expiresAt.IsZero() {
+		expires = rec.expiresAt.UnixNano()
+	}
+
+	var flags byte
+	if rec.deleted {
+		flags |= flagDeleted
+	}
+
+	buf = binary.AppendUvarint(buf, uint64(len(key)))
+	buf = append(buf, key...)
+	buf = binary.AppendUvarint(buf, uint64(len(rec.value)))
+	buf = append(buf, rec.value...)
+	buf = binary.AppendUvarint(buf, rec.version)
+	buf = binary.AppendVarint(buf, expires)
+	return append(buf, flags)
+}
+
+func decodeEntry(data []byte) (string, record, []byte, error) {
+	var rec record
+
+	key, data, err := readTableChunk(data)
+	if err != nil {
+		return "", rec, nil, err
+	}
+
+	value, data, err := readTableChunk(data)
+	if err != nil {
+		return "", rec, nil, err
+	}
+
+	version, n := binary.Uvarint(data)
+	if n <= 0 {
+		return "", rec, nil, fmt.Errorf("%w: bad version", errCorruptTable)
+	}
+	data = data[n:]
+
+	expires, n := binary.Varint(data)
+	if n <= 0 || len(data) == n {
+		return "", rec, nil, fmt.Errorf("%w: bad entry", errCorruptTable)
+	}
+	flags := data[n]
+	data = data[n+1:]
+
+	rec.value = string(value)
+	rec.version = version
+	rec.deleted = flags&flagDeleted != 0
+	if expires != 0 {
+		rec.expiresAt = time.Unix(0, expires)
+	}
+
+	return string(key), rec, data, nil
+}
+
+func readTableChunk(data []byte) ([]byte, []byte, error) {
+	size, n := binary.Uvarint(data)
+	if n <= 0 || size > uint64(len(data)-n) {
+		return nil, nil, fmt.Errorf("%w: bad length", errCorruptTable)
+	}
+
+	end := n + int(size)
+	return data[n:end], data[end:], nil
+}
+
+// tableWriter writes an SSTable from records added in key order.
+type tableWriter struct {
+	file      *os.File
+	path      string
+	blockSize int
+
+	block      []byte
+	blockFirst string
+	offset     int64
+	blocks     []blockHandle
+	hashes     []uint64
+
+	minKey, maxKey string
+	count          int
+}
+
+func createTable(path string, blockSize int) (*tableWriter, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("engine: create sstable: %w", err)
+	}
+
+	return &tableWriter{
+		file:      file,
+		path:      path,
+		blockSize: blockSize,
+	}, nil
+}
+
+func (w *tableWriter) add(key string, rec record) error {
+	if w.count == 0 {
+		w.minKey = key
+	}
+	if len(w.block) == 0 {
+		w.blockFirst = key
+	}
+
+	w.block = appendEntry(w.block, key, rec)
+	w.hashes = append(w.hashes, bloomHash(key))
+	w.maxKey = key
+	w.count++
+
+	if len(w.block) >= w.blockSize {
+		return w.flushBlock()
+	}
+	return nil
+}
+
+// size returns the number of bytes written so far.
+func (w *tableWriter) size() int64 {
+	return w.offset + int64(len(w.block))
+}
+
+func (w *tableWriter) flushBlock() error {
+	if len(w.block) == 0 {
+		return nil
+	}
+
+	w.block = binary.LittleEndian.AppendUint32(w.block, crc32.Checksum(w.block, tableCRCTable))
+
+	err := w.writeSection(w.block)
+	if err != nil {
+		return err
+	}
+
+	w.blocks = append(w.blocks, blockHandle{
+		firstKey: w.blockFirst,
+		offset:   w.offset - int64(len(w.block)),
+		size:     int64(len(w.block)),
+	})
+	w.block = w.block[:0]
+
+	return nil
+}
+
+func (w *tableWriter) writeSection(data []byte) error {
+	_, err := w.file.Write(data)
+	if err != nil {
+		return fmt.Errorf("engine: write sstable: %w", err)
+	}
+	w.offset += int64(len(data))
+	return nil
+}
+
+// finish writes the filter, the index and the footer and syncs the file.
+func (w *tableWriter) finish() error {
+	err := w.flushBlock()
+	if err != nil {
+		return err
+	}
+
+	bloomData := newBloom(w.hashes).encode()
+	bloomData = binary.LittleEndian.AppendUint32(bloomData, crc32.Checksum(bloomData, tableCRCTable))
+	bloomOffset := w.offset
+
+	err = w.writeSection(bloomData)
+	if err != nil {
+		return err
+	}
+
+	indexData := binary.AppendUvarint(nil, uint64(len(w.blocks)))
+	for _, b := range w.blocks {
+		indexData = binary.AppendUvarint(indexData, uint64(len(b.firstKey)))
+		indexData = append(indexData, b.firstKey...)
+		indexData = binary.AppendUvarint(indexData, uint64(b.offset))
+		indexData = binary.AppendUvarint(indexData, uint64(b.size))
+	}
+	indexData = binary.AppendUvarint(indexData, uint64(len(w.maxKey)))
+	indexData = append(indexData, w.maxKey...)
+	indexData = binary.AppendUvarint(indexData, uint64(w.count))
+	indexData = binary.LittleEndian.AppendUint32(indexData, crc32.Checksum(indexData, tableCRCTable))
+	indexOffset := w.offset
+
+	err = w.writeSection(indexData)
+	if err != nil {
+		return err
+	}
+
+	footer := make([]byte, 0, footerSize)
+	footer = binary.LittleEndian.AppendUint64(footer, uint64(bloomOffset))
+	footer = binary.LittleEndian.AppendUint64(footer, uint64(len(bloomData)))
+	footer = binary.LittleEndian.AppendUint64(footer, uint64(indexOffset))
+	footer = binary.LittleEndian.AppendUint64(footer, uint64(len(indexData)))
+	footer = append(footer, tableMagic[:]...)
+	footer = append(footer, tableVersion, 0, 0, 0)
+
+	err = w.writeSection(footer)
+	if err != nil {
+		return err
+	}
+
+	err = w.file.Sync()
+	if err != nil {
+		return fmt.Errorf("engine: sync sstable: %w", err)
+	}
+
+	err = w.file.Close()
+	if err != nil {
+		return fmt.Errorf("engine: close sstable: %w", err)
+	}
+	return nil
+}
+
+// abort closes and removes a table that will not be finished.
+func (w *tableWriter) abort() {
+	w.file.Close()
+	os.Remove(w.path)
+}
+
+func openTable(path string, id uint64) (*table, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("engine: open sstable: %w", err)
+	}
+
+	t, err := readTable(file, path, id)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("engine: sstable %q: %w", path, err)
+	}
+
+	return t, nil
+}
+
+func readTable(file *os.File, path string, id uint64) (*table, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	if info.Size() < footerSize {
+		return nil, fmt.Errorf("%w: file too short", errCorruptTable)
+	}
+
+	footer := make([]byte, footerSize)
+	_, err = file.ReadAt(footer, info.Size()-footerSize)
+	if err != nil {
+		return nil, err
+	}
+
+	if !bytes.Equal(footer[32:36], tableMagic[:]) || footer[36] != tableVersion {
+		return nil, fmt.Errorf("%w: bad footer", errCorruptTable)
+	}
+
+	bloomData, err := readSection(file, footer[0:16], info.Size())
+	if err != nil {
+		return nil, err
+	}
+
+	indexData, err := readSection(file, footer[16:32], info.Size())
+	if err != nil {
+		return nil, err
+	}
+
+	t := &table{
+		id:   id,
+		path: path,
+		file: file,
+		size: info.Size(),
+	}
+
+	t.bloom, err = decodeBloom(bloomData)
+	if err != nil {
+		return nil, err
+	}
+
+	count, n := binary.Uvarint(indexData)
+	if n <= 0 || count > uint64(len(indexData)) {
+		return nil, fmt.Errorf("%w: bad index", errCorruptTable)
+	}
+	data := indexData[n:]
+
+	for i := uint64(0); i < count; i++ {
+		var firstKey []byte
+		firstKey, data, err = readTableChunk(data)
+		if err != nil {
+			return nil, err
+		}
+
+		offset, n := binary.Uvarint(data)
+		if n <= 0 {
+			return nil, fmt.Errorf("%w: bad index", errCorruptTable)
+		}
+		data = data[n:]
+
+		size, n := binary.Uvarint(data)
+		if n <= 0 {
+			return nil, fmt.Errorf("%w: bad index", errCorruptTable)
+		}
+		data = data[n:]
+
+		t.blocks = append(t.blocks, blockHandle{firstKey: string(firstKey), offset: int64(offset), size: int64(size)})
+	}
+
+	maxKey, data, err := readTableChunk(data)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, n := binary.Uvarint(data)
+	if n <= 0 {
+		return nil, fmt.Errorf("%w: bad index", errCorruptTable)
+	}
+
+	t.maxKey = string(maxKey)
+	t.count = int(entries)
+	if len(t.blocks) > 0 {
+		t.minKey = t.blocks[0].firstKey
+	}
+
+	return t, nil
+}
+
+// readSection reads the section whose offset and size are encoded in
+// handle and checks its trailing crc32c.
+func readSection(file *os.File, handle []byte, fileSize int64) ([]byte, error) {
+	offset := int64(binary.LittleEndian.Uint64(handle))
+	size := int64(binary.LittleEndian.Uint64(handle[8:]))
+
+	if offset < 0 || size < 4 || offset+size > fileSize-footerSize {
+		return nil, fmt.Errorf("%w: bad section", errCorruptTable)
+	}
+
+	data := make([]byte, size)
+	_, err := file.ReadAt(data, offset)
+	if err != nil {
+		return nil, err
+	}
+
+	body := data[:size-4]
+	if binary.LittleEndian.Uint32(data[size-4:]) != crc32.Checksum(body, tableCRCTable) {
+		return nil, fmt.Errorf("%w: checksum mismatch", errCorruptTable)
+	}
+
+	return body, nil
+}
+
+// readBlock returns the entries of block i.
+func (t *table) readBlock(i int) ([]byte, error) {
+	b := t.blocks[i]
+
+	data := make([]byte, b.size)
+	_, err := t.file.ReadAt(data, b.offset)
+	if err != nil {
+		return nil, fmt.Errorf("engine: read sstable block: %w", err)
+	}
+
+	if b.size < 4 {
+		return nil, fmt.Errorf("%w: short block", errCorruptTable)
+	}
+
+	body := data[:b.size-4]
+	if binary.LittleEndian.Uint32(data[b.size-4:]) != crc32.Checksum(body, tableCRCTable) {
+		return nil, fmt.Errorf("%w: block checksum mismatch in %q", errCorruptTable, t.path)
+	}
+
+	return body, nil
+}
+
+// blockFor returns the index of the only block that may hold key, -1 if
+// key is before the first block.
+func (t *table) blockFor(key string) int {
+	return sort.Search(len(t.blocks), func(i int) bool {
+		return t.blocks[i].firstKey > key
+	}) - 1
+}
+
+// get returns the record of key if the table has one.
+func (t *table) get(key string) (record, bool, error) {
+	if key < t.minKey || key > t.maxKey || !t.bloom.mayContain(key) {
+		return record{}, false, nil
+	}
+
+	i := t.blockFor(key)
+	if i < 0 {
+		return record{}, false, nil
+	}
+
+	data, err := t.readBlock(i)
+	if err != nil {
+		return record{}, false, err
+	}
+
+	for len(data) > 0 {
+		var k string
+		var rec record
+
+		k, rec, data, err = decodeEntry(data)
+		if err != nil {
+			return record{}, false, err
+		}
+
+		if k == key {
+			return rec, true, nil
+		}
+		if k > key {
+			break
+		}
+	}
+
+	return record{}, false, nil
+}
+
+// overlaps reports whether the table may hold keys in [minKey, maxKey].
+func (t *table) overlaps(minKey, maxKey string) bool {
+	return t.minKey <= maxKey && minKey <= t.maxKey
+}
+
+func (t *table) close() error {
+	return t.file.Close()
+}
@@ -0,0 +1,229 @@
+package engine
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/alexey-y-a/go-txlog-microservices/libs/txlog"
+	"github.com/alexey-y-a/go-txlog-microservices/services/kv-service/internal/store"
+)
+
+// openTestLSM opens an engine with tiny memtables and tables, so that a few
+// hundred writes go through flushes and compactions.
+func openTestLSM(t *testing.T, dir string) *LSMEngine {
+	t.Helper()
+
+	e, err := OpenLSM(dir, LSMOptions{
+		MemtableSize:  2048,
+		TableSize:     2048,
+		BlockSize:     256,
+		L0Tables:      2,
+		BaseLevelSize: 4096,
+		WAL:           []txlog.SegmentOption{txlog.WithMaxSegmentSize(4096)},
+	})
+	require.NoError(t, err, "OpenLSM should not return error")
+
+	return e
+}
+
+func TestLSM_Table(t *testing.T) {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), tableFileName(1))
+
+	w, err := createTable(path, 128)
+	require.NoError(t, err)
+
+	expiresAt := time.Unix(0, time.Now().UnixNano())
+	for i := 0; i < 100; i++ {
+		rec := record{value: fmt.Sprintf("v%d", i), version: uint64(i + 1)}
+		if i%10 == 0 {
+			rec = record{version: uint64(i + 1), deleted: true}
+		}
+		if i == 5 {
+			rec.expiresAt = expiresAt
+		}
+		require.NoError(t, w.add(fmt.Sprintf("key%03d", i), rec))
+	}
+	require.NoError(t, w.finish())
+
+	table, err := openTable(path, 1)
+	require.NoError(t, err, "openTable should not return error")
+	defer table.close()
+
+	require.Greater(t, len(table.blocks), 1, "the table should span several blocks")
+	require.Equal(t, 100, table.count)
+	require.Equal(t, "key000", table.minKey)
+	require.Equal(t, "key099", table.maxKey)
+
+	rec, ok, err := table.get("key042")
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, record{value: "v42", version: 43}, rec)
+
+	rec, ok, err = table.get("key005")
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.True(t, expiresAt.Equal(rec.expiresAt), "the expiry should be stored")
+
+	rec, ok, err = table.get("key010")
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.True(t, rec.deleted, "tombstones should be stored")
+
+	_, ok, err = table.get("key042x")
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	falsePositives := 0
+	for i := 0; i < 1000; i++ {
+		if table.bloom.mayContain(fmt.Sprintf("missing%d", i)) {
+			falsePositives++
+		}
+	}
+	require.Less(t, falsePositives, 50, "the bloom filter should reject most missing keys")
+
+	it := table.iter("key0505")
+	require.True(t, it.valid())
+	require.Equal(t, "key051", it.key())
+
+	n := 0
+	for ; it.valid(); it.next() {
+		n++
+	}
+	require.NoError(t, it.err())
+	require.Equal(t, 49, n)
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	data[table.blocks[1].offset] ^= 0xff
+	require.NoError(t, os.WriteFile(path, data, 0o644))
+
+	corrupt, err := openTable(path, 1)
+	require.NoError(t, err)
+	defer corrupt.close()
+
+	_, _, err = corrupt.get(table.blocks[1].firstKey)
+	require.ErrorIs(t, err, errCorruptTable, "a damaged block should be detected")
+}
+
+func TestLSM_FlushAndCompaction(t *testing.T) {
+	t.Helper()
+
+	dir := t.TempDir()
+	e := openTestLSM(t, dir)
+
+	_, err := e.Set("fixed", "value", 0, store.Condition{})
+	require.NoError(t, err)
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+
+			entry, ok := e.Get("fixed")
+			if !ok || entry.Value != "value" {
+				t.Errorf("Get during flushes returned %+v, %v", entry, ok)
+				return
+			}
+		}
+	}()
+
+	want := map[string]string{"fixed": "value"}
+	for round := 0; round < 4; round++ {
+		for i := 0; i < 150; i++ {
+			key := fmt.Sprintf("key%03d", i)
+			value := fmt.Sprintf("r%d-%d", round, i)
+
+			_, err := e.Set(key, value, 0, store.Condition{})
+			require.NoError(t, err)
+			want[key] = value
+		}
+	}
+
+	for i := 0; i < 150; i += 5 {
+		key := fmt.Sprintf("key%03d", i)
+
+		_, err := e.Delete(key, store.Condition{})
+		require.NoError(t, err)
+		delete(want, key)
+	}
+
+	require.Eventually(t, func() bool {
+		levels := e.Levels()
+		return len(levels) > 1 && levels[0].Tables < 2
+	}, 5*time.Second, 10*time.Millisecond, "level 0 should be compacted into deeper levels")
+
+	close(stop)
+	wg.Wait()
+
+	stats, err := e.Compact()
+	require.NoError(t, err)
+	require.Len(t, e.wal.Segments(), 1, "flushed log segments should be truncated")
+	require.Equal(t, len(want), stats.RecordsOut, "compaction should keep one record per live key")
+
+	levels := e.Levels()
+	for _, level := range levels[:len(levels)-1] {
+		require.Zero(t, level.Tables, "Compact should merge everything into the last level")
+	}
+
+	for key, value := range want {
+		entry, ok := e.Get(key)
+		require.True(t, ok, "key %q should exist", key)
+		require.Equal(t, value, entry.Value)
+	}
+	require.Equal(t, len(want), e.Stats().Keys)
+
+	require.NoError(t, e.Close())
+
+	stray := filepath.Join(dir, tableFileName(9999))
+	require.NoError(t, os.WriteFile(stray, []byte("unfinished"), 0o644))
+
+	e = openTestLSM(t, dir)
+	defer e.Close()
+
+	require.NoFileExists(t, stray, "tables missing from LEVELS should be removed")
+	require.Equal(t, len(want), e.Stats().Keys, "the key count should survive a restart")
+
+	_, ok := e.Get("key000")
+	require.False(t, ok, "a deleted key should stay deleted after compaction")
+}
+
+func TestLSM_Expiry(t *testing.T) {
+	t.Helper()
+
+	e := openTestLSM(t, t.TempDir())
+	defer e.Close()
+
+	now := time.Now()
+	e.now = func() time.Time { return now }
+
+	_, err := e.Set("session", "s", time.Second, store.Condition{})
+	require.NoError(t, err)
+
+	_, err = e.Compact()
+	require.NoError(t, err)
+
+	_, ok := e.Get("session")
+	require.True(t, ok, "a key should be readable from a table")
+
+	now = now.Add(2 * time.Second)
+
+	_, ok = e.Get("session")
+	require.False(t, ok, "an expired key should be missing")
+	require.Equal(t, Stats{Keys: 0, ExpiredKeys: 1}, e.Stats())
+}
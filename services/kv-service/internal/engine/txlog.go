@@ -0,0 +1,90 @@
+package engine
+
+import (
+	"time"
+
+	"github.com/alexey-y-a/go-txlog-microservices/libs/txlog"
+	"github.com/alexey-y-a/go-txlog-microservices/services/kv-service/internal/store"
+)
+
+// TxlogEngine is the KindTxlog engine: a store.Store together with the log
+// it writes to. The engine owns the log and closes it on Close.
+type TxlogEngine struct {
+	store *store.Store
+	log   txlog.Log
+}
+
+func NewTxlogEngine(s *store.Store, log txlog.Log) *TxlogEngine {
+	return &TxlogEngine{
+		store: s,
+		log:   log,
+	}
+}
+
+// Store returns the store of the engine.
+func (e *TxlogEngine) Store() *store.Store {
+	return e.store
+}
+
+// Log returns the log of the engine.
+func (e *TxlogEngine) Log() txlog.Log {
+	return e.log
+}
+
+func (e *TxlogEngine) Get(key string) (store.Entry, bool) {
+	return e.store.GetEntry(key)
+}
+
+func (e *TxlogEngine) Set(key, value string, ttl time.Duration, cond store.Condition) (uint64, error) {
+	return e.store.SetWithTTL(key, value, ttl, cond)
+}
+
+func (e *TxlogEngine) Delete(key string, cond store.Condition) (uint64, error) {
+	return e.store.DeleteIf(key, cond)
+}
+
+func (e *TxlogEngine) Scan(start, end string, limit int) ([]store.Item, bool) {
+	return e.store.Scan(start, end, limit)
+}
+
+func (e *TxlogEngine) Stats() Stats {
+	return Stats{
+		Keys:        e.store.Len(),
+		ExpiredKeys: e.store.ExpiredKeys(),
+	}
+}
+
+func (e *TxlogEngine) Apply(batch store.Batch) (uint64, error) {
+	return e.store.Apply(batch)
+}
+
+func (e *TxlogEngine) SetStamped(key, value string, ttl time.Duration, stamp uint64) (uint64, error) {
+	return e.store.SetStamped(key, value, ttl, stamp)
+}
+
+func (e *TxlogEngine) DeleteStamped(key string, stamp uint64) (uint64, error) {
+	return e.store.DeleteStamped(key, stamp)
+}
+
+func (e *TxlogEngine) DeletedStamp(key string) (uint64, bool) {
+	return e.store.DeletedStamp(key)
+}
+
+func (e *TxlogEngine) Compact() (txlog.CompactStats, error) {
+	return e.store.Compact()
+}
+
+func (e *TxlogEngine) Snapshot() (store.SnapshotStats, error) {
+	return e.store.Snapshot()
+}
+
+func (e *TxlogEngine) Sync() error {
+	return e.log.Sync()
+}
+
+func (e *TxlogEngine) Close() error {
+	e.store.StopExpirySweeper()
+	e.store.StopSnapshots()
+
+	return e.log.Close()
+}
@@ -1,22 +1,32 @@
 package http
 
 import (
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"net/http"
+	"strconv"
+	"sync/atomic"
 	"time"
 
 	"github.com/alexey-y-a/go-txlog-microservices/libs/logger"
 	"github.com/alexey-y-a/go-txlog-microservices/libs/txlog"
+	"github.com/alexey-y-a/go-txlog-microservices/services/kv-service/internal/engine"
+	"github.com/alexey-y-a/go-txlog-microservices/services/kv-service/internal/namespace"
+	"github.com/alexey-y-a/go-txlog-microservices/services/kv-service/internal/raft"
 	"github.com/alexey-y-a/go-txlog-microservices/services/kv-service/internal/store"
 )
 
 type Handler struct {
-    store *store.Store
+    namespaces *namespace.Registry
+    ready atomic.Bool
+    readOnly atomic.Bool
+    leader func() (string, bool)
 }
 
-func NewHandler(s *store.Store) *Handler {
+func NewHandler(namespaces *namespace.Registry) *Handler {
     return &Handler {
-        store: s,
+        namespaces: namespaces,
     }
 }
 
@@ -25,9 +35,63 @@ type healthResponse struct {
     Time string   `json:"time"`
 }
 
+func (h *Handler) SetReady(ready bool) {
+    h.ready.Store(ready)
+}
+
+// SetReadOnly makes the handler answer writes with 403, as a follower does.
+func (h *Handler) SetReadOnly(readOnly bool) {
+    h.readOnly.Store(readOnly)
+}
+
+// rejectWrite answers 403 itself if the handler is read-only.
+func (h *Handler) rejectWrite(w http.ResponseWriter) bool {
+    if !h.readOnly.Load() {
+        return false
+    }
+
+    writeJSON(w, http.StatusForbidden, commonResponse{
+        Status:  "error",
+        Message: "read-only follower",
+    })
+    return true
+}
+
+// SetLeader makes the handler redirect writes that the node cannot take, as
+// a Raft follower, to the address of the leader that leader returns.
+func (h *Handler) SetLeader(leader func() (string, bool)) {
+    h.leader = leader
+}
+
+// redirectWrite answers a write that failed because the node does not lead
+// its cluster: with 307 to the leader, or 503 while there is none.
+func (h *Handler) redirectWrite(w http.ResponseWriter, r *http.Request, err error) bool {
+    if h.leader == nil || !errors.Is(err, store.ErrReadOnly) && !errors.Is(err, raft.ErrNotLeader) {
+        return false
+    }
+
+    addr, ok := h.leader()
+    if !ok {
+        writeJSON(w, http.StatusServiceUnavailable, commonResponse{
+            Status:  "error",
+            Message: "no leader",
+        })
+        return true
+    }
+
+    w.Header().Set("Location", addr+r.URL.RequestURI())
+    writeJSON(w, http.StatusTemporaryRedirect, commonResponse{
+        Status:  "error",
+        Message: "not the leader",
+    })
+    return true
+}
+
 func (h *Handler) RegisterRoutes(mux *http.ServeMux) {
     mux.HandleFunc("/health", h.HealthHandler)
 
+    mux.HandleFunc("/ready", h.ReadyHandler)
+
     mux.HandleFunc("/kv/set", h.SetHandler)
 
     mux.HandleFunc("kv/get", h.GetHandler)
@@ -53,14 +117,59 @@ func (h *Handler) HealthHandler(w http.ResponseWriter, r *http.Request) {
     }
 }
 
+func (h *Handler) ReadyHandler(w http.ResponseWriter, r *http.Request) {
+    log := logger.L().With().Str("handler", "ready").Logger()
+
+    status := http.StatusOK
+    response := healthResponse{
+        Status: "ok",
+        Time:   time.Now().UTC().Format(time.RFC3339),
+    }
+
+    if !h.ready.Load() {
+        status = http.StatusServiceUnavailable
+        response.Status = "replaying"
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(status)
+
+    err := json.NewEncoder(w).Encode(response)
+    if err != nil {
+        log.Error().Err(err).Msg("failed to write ready response")
+    }
+}
+
+// RequireReady answers 503 in place of next until SetReady(true), so that
+// no request reaches the namespaces while their logs are replayed.
+func (h *Handler) RequireReady(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if !h.ready.Load() {
+            writeJSON(w, http.StatusServiceUnavailable, commonResponse{
+                Status:  "error",
+                Message: "replaying",
+            })
+            return
+        }
+
+        next.ServeHTTP(w, r)
+    })
+}
+
 type SetRequest struct {
     Key string `json:"key"`
     Value string `json:"value"`
+    // TTL is the lifetime of the key in seconds; zero means no expiry.
+    TTL int64 `json:"ttl,omitempty"`
+    // Stamp makes the write one ordered by store.Store.SetStamped; zero
+    // means an ordinary write.
+    Stamp uint64 `json:"stamp,omitempty"`
 }
 
 type commonResponse struct {
     Status string `json:"status"`
     Message string `json:"message,omitempty"`
+    LSN uint64 `json:"lsn,omitempty"`
 }
 
 func (h *Handler) SetHandler(w http.ResponseWriter, r *http.Request) {
@@ -71,6 +180,15 @@ func (h *Handler) SetHandler(w http.ResponseWriter, r *http.Request) {
         return
     }
 
+    if h.rejectWrite(w) {
+        return
+    }
+
+    kvEngine, ok := h.engineFor(w, r)
+    if !ok {
+        return
+    }
+
     var req SetRequest
     decoder := json.NewDecoder(r.Body)
     err := decoder.Decode(&req)
@@ -86,12 +204,39 @@ func (h *Handler) SetHandler(w http.ResponseWriter, r *http.Request) {
         return
     }
 
-    if len([]byte(req.Key)) > txlog.MaxKeySize || len([]byte(req.Value)) > txlog.MaxKeySize {
+    if len([]byte(req.Key)) > txlog.MaxKeySize || len([]byte(req.Value)) > txlog.MaxValueSize {
+        w.WriteHeader(http.StatusBadRequest)
+        return
+    }
+
+    if req.TTL < 0 {
         w.WriteHeader(http.StatusBadRequest)
         return
     }
 
-    err = h.store.Set(req.Key, req.Value)
+    ttl := time.Duration(req.TTL) * time.Second
+
+    var lsn uint64
+    if req.Stamp != 0 {
+        stamper, ok := stamperFor(w, r, kvEngine)
+        if !ok {
+            return
+        }
+        lsn, err = stamper.SetStamped(req.Key, req.Value, ttl, req.Stamp)
+    } else {
+        lsn, err = kvEngine.Set(req.Key, req.Value, ttl, parseCondition(r))
+    }
+    if errors.Is(err, store.ErrPreconditionFailed) {
+        w.WriteHeader(http.StatusPreconditionFailed)
+        return
+    }
+    if errors.Is(err, store.ErrStale) {
+        w.WriteHeader(http.StatusConflict)
+        return
+    }
+    if h.redirectWrite(w, r, err) {
+        return
+    }
     if err != nil {
         log.Error().Err(err).Str("key", req.Key).Msg("store set failed")
 
@@ -102,9 +247,11 @@ func (h *Handler) SetHandler(w http.ResponseWriter, r *http.Request) {
      response := commonResponse {
          Status: "ok",
          Message: "value set",
+         LSN: lsn,
      }
 
      w.Header().Set("Content-Type", "application/json")
+     w.Header().Set("ETag", etag(lsn))
      w.WriteHeader(http.StatusOK)
 
      err = json.NewEncoder(w).Encode(response)
@@ -115,7 +262,9 @@ func (h *Handler) SetHandler(w http.ResponseWriter, r *http.Request) {
 
 type getResponse struct {
     Status string `json:"status"`
-    Value string `json:"value, omitempty"`
+    Value string `json:"value,omitempty"`
+    ExpiresAt string `json:"expires_at,omitempty"`
+    Stamp uint64 `json:"stamp,omitempty"`
 }
 
 func (h *Handler) GetHandler(w http.ResponseWriter, r *http.Request) {
@@ -126,24 +275,35 @@ func (h *Handler) GetHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	kvEngine, ok := h.engineFor(w, r)
+	if !ok {
+		return
+	}
+
 	key := r.URL.Query().Get("key")
 	if key == "" {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
-	value, ok := h.store.Get(key)
+	entry, ok := kvEngine.Get(key)
 	if !ok {
-		w.WriteHeader(http.StatusNotFound)
+		writeNotFound(w, kvEngine, key)
 		return
 	}
 
 	response := getResponse{
 		Status: "ok",
-		Value:  value,
+		Value:  entry.Value,
+		Stamp:  entry.Stamp,
+	}
+
+	if !entry.ExpiresAt.IsZero() {
+		response.ExpiresAt = entry.ExpiresAt.UTC().Format(time.RFC3339Nano)
 	}
 
 	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", etag(entry.Version))
 	w.WriteHeader(http.StatusOK)
 
 	err := json.NewEncoder(w).Encode(response)
@@ -160,13 +320,48 @@ func (h *Handler) DeleteHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if h.rejectWrite(w) {
+		return
+	}
+
+	kvEngine, ok := h.engineFor(w, r)
+	if !ok {
+		return
+	}
+
 	key := r.URL.Query().Get("key")
 	if key == "" {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
-	err := h.store.Delete(key)
+	stamp, err := parseStamp(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	var lsn uint64
+	if stamp != 0 {
+		stamper, ok := stamperFor(w, r, kvEngine)
+		if !ok {
+			return
+		}
+		lsn, err = stamper.DeleteStamped(key, stamp)
+	} else {
+		lsn, err = kvEngine.Delete(key, parseCondition(r))
+	}
+	if errors.Is(err, store.ErrPreconditionFailed) {
+		w.WriteHeader(http.StatusPreconditionFailed)
+		return
+	}
+	if errors.Is(err, store.ErrStale) {
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+	if h.redirectWrite(w, r, err) {
+		return
+	}
 	if err != nil {
 		log.Error().Err(err).Str("key", key).Msg("store delete failed")
 
@@ -177,6 +372,7 @@ func (h *Handler) DeleteHandler(w http.ResponseWriter, r *http.Request) {
 	response := commonResponse{
 		Status:  "ok",
 		Message: "key deleted",
+		LSN:     lsn,
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -186,4 +382,300 @@ func (h *Handler) DeleteHandler(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		log.Error().Err(err).Msg("failed to write delete response")
 	}
-}
\ No newline at end of file
+}
+
+type compactResponse struct {
+	Status string             `json:"status"`
+	Stats  txlog.CompactStats `json:"stats"`
+}
+
+func (h *Handler) CompactHandler(w http.ResponseWriter, r *http.Request) {
+	log := logger.L().With().Str("handler", "admin_compact").Logger()
+
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	kvEngine, ok := h.engineFor(w, r)
+	if !ok {
+		return
+	}
+
+	compactor, ok := kvEngine.(engine.Compactor)
+	if !ok {
+		w.WriteHeader(http.StatusNotImplemented)
+		return
+	}
+
+	stats, err := compactor.Compact()
+	switch {
+	case errors.Is(err, store.ErrCompactionRunning):
+		w.WriteHeader(http.StatusConflict)
+		return
+	case errors.Is(err, store.ErrCompactionUnsupported):
+		w.WriteHeader(http.StatusNotImplemented)
+		return
+	case err != nil:
+		log.Error().Err(err).Msg("compaction failed")
+
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	response := compactResponse{
+		Status: "ok",
+		Stats:  stats,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	err = json.NewEncoder(w).Encode(response)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to write compact response")
+	}
+}
+
+type snapshotResponse struct {
+	Status string              `json:"status"`
+	Stats  store.SnapshotStats `json:"stats"`
+}
+
+func (h *Handler) SnapshotHandler(w http.ResponseWriter, r *http.Request) {
+	log := logger.L().With().Str("handler", "admin_snapshot").Logger()
+
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	kvEngine, ok := h.engineFor(w, r)
+	if !ok {
+		return
+	}
+
+	snapshotter, ok := kvEngine.(engine.Snapshotter)
+	if !ok {
+		w.WriteHeader(http.StatusNotImplemented)
+		return
+	}
+
+	stats, err := snapshotter.Snapshot()
+	switch {
+	case errors.Is(err, store.ErrSnapshotRunning):
+		w.WriteHeader(http.StatusConflict)
+		return
+	case errors.Is(err, store.ErrSnapshotUnsupported):
+		w.WriteHeader(http.StatusNotImplemented)
+		return
+	case err != nil:
+		log.Error().Err(err).Msg("snapshot failed")
+
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	response := snapshotResponse{
+		Status: "ok",
+		Stats:  stats,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	err = json.NewEncoder(w).Encode(response)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to write snapshot response")
+	}
+}
+
+type txnOp struct {
+	Op    string `json:"op"`
+	Key   string `json:"key"`
+	Value string `json:"value,omitempty"`
+}
+
+type TxnRequest struct {
+	Ops []txnOp `json:"ops"`
+}
+
+// TxnHandler applies all operations of the request atomically.
+func (h *Handler) TxnHandler(w http.ResponseWriter, r *http.Request) {
+	log := logger.L().With().Str("handler", "txn").Logger()
+
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	if h.rejectWrite(w) {
+		return
+	}
+
+	kvEngine, ok := h.engineFor(w, r)
+	if !ok {
+		return
+	}
+
+	batcher, ok := kvEngine.(engine.Batcher)
+	if !ok {
+		w.WriteHeader(http.StatusNotImplemented)
+		return
+	}
+
+	var req TxnRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to decode txn request")
+
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	batch := make(store.Batch, 0, len(req.Ops))
+	for _, op := range req.Ops {
+		if len(op.Key) > txlog.MaxKeySize || len(op.Value) > txlog.MaxValueSize {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		batch = append(batch, store.Op{
+			Type:  op.Op,
+			Key:   op.Key,
+			Value: op.Value,
+		})
+	}
+
+	lsn, err := batcher.Apply(batch)
+	switch {
+	case errors.Is(err, store.ErrInvalidBatch):
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	case errors.Is(err, store.ErrBatchUnsupported):
+		w.WriteHeader(http.StatusNotImplemented)
+		return
+	case h.redirectWrite(w, r, err):
+		return
+	case err != nil:
+		log.Error().Err(err).Int("ops", len(batch)).Msg("store apply failed")
+
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	response := commonResponse{
+		Status:  "ok",
+		Message: "transaction committed",
+		LSN:     lsn,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	err = json.NewEncoder(w).Encode(response)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to write txn response")
+	}
+}
+
+const (
+	defaultScanLimit = 100
+	maxScanLimit     = 1000
+)
+
+type scanItem struct {
+	Key     string `json:"key"`
+	Value   string `json:"value"`
+	Version uint64 `json:"version"`
+	// ExpiresAt is omitted for keys without a TTL.
+	ExpiresAt time.Time `json:"expires_at,omitzero"`
+	Stamp     uint64    `json:"stamp,omitempty"`
+}
+
+type scanResponse struct {
+	Status     string     `json:"status"`
+	Items      []scanItem `json:"items"`
+	NextCursor string     `json:"next_cursor,omitempty"`
+}
+
+// ScanHandler lists keys in order. The range is given by prefix and/or
+// start (inclusive) and end (exclusive); next_cursor in the response
+// continues the scan on the next page.
+func (h *Handler) ScanHandler(w http.ResponseWriter, r *http.Request) {
+	log := logger.L().With().Str("handler", "scan").Logger()
+
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	kvEngine, ok := h.engineFor(w, r)
+	if !ok {
+		return
+	}
+
+	query := r.URL.Query()
+
+	limit := defaultScanLimit
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > maxScanLimit {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	start, end := query.Get("start"), query.Get("end")
+
+	if prefix := query.Get("prefix"); prefix != "" {
+		if prefix > start {
+			start = prefix
+		}
+		if prefixEnd := store.PrefixEnd(prefix); prefixEnd != "" && (end == "" || prefixEnd < end) {
+			end = prefixEnd
+		}
+	}
+
+	if cursor := query.Get("cursor"); cursor != "" {
+		after, err := base64.RawURLEncoding.DecodeString(cursor)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if string(after) > start {
+			start = string(after)
+		}
+	}
+
+	items, more := kvEngine.Scan(start, end, limit)
+
+	response := scanResponse{
+		Status: "ok",
+		Items:  make([]scanItem, 0, len(items)),
+	}
+	for _, item := range items {
+		response.Items = append(response.Items, scanItem{
+			Key:       item.Key,
+			Value:     item.Value,
+			Version:   item.Version,
+			ExpiresAt: item.ExpiresAt,
+			Stamp:     item.Stamp,
+		})
+	}
+
+	if more {
+		// The cursor is the smallest key after the last one returned.
+		next := items[len(items)-1].Key + "\x00"
+		response.NextCursor = base64.RawURLEncoding.EncodeToString([]byte(next))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	err := json.NewEncoder(w).Encode(response)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to write scan response")
+	}
+}
@@ -0,0 +1,428 @@
+package http
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/alexey-y-a/go-txlog-microservices/libs/txlog"
+	"github.com/alexey-y-a/go-txlog-microservices/services/kv-service/internal/engine"
+	"github.com/alexey-y-a/go-txlog-microservices/services/kv-service/internal/namespace"
+	"github.com/alexey-y-a/go-txlog-microservices/services/kv-service/internal/raft"
+	"github.com/alexey-y-a/go-txlog-microservices/services/kv-service/internal/store"
+)
+
+// fakeEngine is an in-memory engine without a log. It supports none of the
+// optional engine interfaces.
+type fakeEngine struct {
+	mu      sync.Mutex
+	version uint64
+	data    map[string]store.Entry
+	// writeErr, if set, fails every write.
+	writeErr error
+}
+
+func newFakeEngine() *fakeEngine {
+	return &fakeEngine{
+		data: make(map[string]store.Entry),
+	}
+}
+
+func (e *fakeEngine) Get(key string) (store.Entry, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	entry, ok := e.data[key]
+	return entry, ok
+}
+
+func (e *fakeEngine) Set(key, value string, ttl time.Duration, cond store.Condition) (uint64, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.writeErr != nil {
+		return 0, e.writeErr
+	}
+
+	current, exists := e.data[key]
+	if !cond.Holds(current.Version, exists) {
+		return 0, store.ErrPreconditionFailed
+	}
+
+	e.version++
+	entry := store.Entry{Value: value, Version: e.version}
+	if ttl > 0 {
+		entry.ExpiresAt = time.Now().Add(ttl)
+	}
+	e.data[key] = entry
+
+	return e.version, nil
+}
+
+func (e *fakeEngine) Delete(key string, cond store.Condition) (uint64, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.writeErr != nil {
+		return 0, e.writeErr
+	}
+
+	current, exists := e.data[key]
+	if !cond.Holds(current.Version, exists) {
+		return 0, store.ErrPreconditionFailed
+	}
+
+	e.version++
+	delete(e.data, key)
+
+	return e.version, nil
+}
+
+func (e *fakeEngine) Scan(start, end string, limit int) ([]store.Item, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	var keys []string
+	for key := range e.data {
+		if key >= start && (end == "" || key < end) {
+			keys = append(keys, key)
+		}
+	}
+	slices.Sort(keys)
+
+	var items []store.Item
+	for _, key := range keys {
+		if limit > 0 && len(items) == limit {
+			return items, true
+		}
+		items = append(items, store.Item{Key: key, Entry: e.data[key]})
+	}
+
+	return items, false
+}
+
+func (e *fakeEngine) Stats() engine.Stats {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return engine.Stats{Keys: len(e.data)}
+}
+
+func (e *fakeEngine) Close() error {
+	return nil
+}
+
+func newTestMux(t *testing.T) (*http.ServeMux, *fakeEngine) {
+	t.Helper()
+
+	handler, defaultEngine := newTestHandler(t)
+
+	return testRoutes(handler), defaultEngine
+}
+
+func newTestHandler(t *testing.T) (*Handler, *fakeEngine) {
+	t.Helper()
+
+	defaultEngine := newFakeEngine()
+
+	namespaces := namespace.NewRegistry(t.TempDir(), func(name, dir string) (engine.Engine, error) {
+		return newFakeEngine(), nil
+	})
+	namespaces.SetDefault(defaultEngine)
+
+	return NewHandler(namespaces), defaultEngine
+}
+
+func testRoutes(handler *Handler) *http.ServeMux {
+	mux := http.NewServeMux()
+	for _, prefix := range []string{"/kv", "/kv/{ns}"} {
+		mux.HandleFunc(prefix+"/set", handler.SetHandler)
+		mux.HandleFunc(prefix+"/get", handler.GetHandler)
+		mux.HandleFunc(prefix+"/delete", handler.DeleteHandler)
+		mux.HandleFunc(prefix+"/txn", handler.TxnHandler)
+		mux.HandleFunc(prefix+"/scan", handler.ScanHandler)
+	}
+	mux.HandleFunc("/admin/compact", handler.CompactHandler)
+	mux.HandleFunc("/admin/snapshot", handler.SnapshotHandler)
+	mux.HandleFunc("/admin/namespaces", handler.NamespacesHandler)
+	mux.HandleFunc("/admin/namespaces/{ns}", handler.NamespaceHandler)
+
+	return mux
+}
+
+func serve(mux *http.ServeMux, method, target, body string, header http.Header) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	for name, values := range header {
+		req.Header[name] = values
+	}
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+
+	return rec
+}
+
+func TestHandler_SetGetDelete(t *testing.T) {
+	t.Helper()
+
+	mux, kvEngine := newTestMux(t)
+
+	rec := serve(mux, http.MethodPost, "/kv/set", `{"key":"user1","value":"Alice"}`, nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, `"1"`, rec.Header().Get("ETag"), "set should return the new version as ETag")
+
+	entry, ok := kvEngine.Get("user1")
+	require.True(t, ok, "set should write to the engine of the default namespace")
+	require.Equal(t, "Alice", entry.Value)
+
+	rec = serve(mux, http.MethodGet, "/kv/get?key=user1", "", nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, `"1"`, rec.Header().Get("ETag"))
+
+	var got getResponse
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&got))
+	require.Equal(t, "Alice", got.Value)
+
+	rec = serve(mux, http.MethodPost, "/kv/set", `{"key":"user1","value":"Bob"}`, http.Header{"If-Match": {`"7"`}})
+	require.Equal(t, http.StatusPreconditionFailed, rec.Code, "a stale If-Match should be rejected")
+
+	rec = serve(mux, http.MethodPost, "/kv/set", `{"key":"user1","value":"Bob"}`, http.Header{"If-Match": {`W/"1"`}})
+	require.Equal(t, http.StatusPreconditionFailed, rec.Code, "If-Match should not match a weak tag")
+
+	rec = serve(mux, http.MethodPost, "/kv/set", `{"key":"user1","value":"Bob"}`, http.Header{"If-None-Match": {`W/"1"`}})
+	require.Equal(t, http.StatusPreconditionFailed, rec.Code, "If-None-Match should match a weak tag")
+
+	rec = serve(mux, http.MethodPost, "/kv/set", `{"key":"user1","value":"Bob"}`, http.Header{"If-None-Match": {"*"}})
+	require.Equal(t, http.StatusPreconditionFailed, rec.Code, "If-None-Match: * should reject an existing key")
+
+	rec = serve(mux, http.MethodDelete, "/kv/delete?key=user1", "", http.Header{"If-Match": {`"1"`}})
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	rec = serve(mux, http.MethodGet, "/kv/get?key=user1", "", nil)
+	require.Equal(t, http.StatusNotFound, rec.Code, "a deleted key should not be found")
+
+	rec = serve(mux, http.MethodPost, "/kv/set", `{"key":"","value":"x"}`, nil)
+	require.Equal(t, http.StatusBadRequest, rec.Code, "an empty key should be rejected")
+
+	value := strings.Repeat("v", txlog.MaxKeySize+1)
+	rec = serve(mux, http.MethodPost, "/kv/set", `{"key":"big","value":"`+value+`"}`, nil)
+	require.Equal(t, http.StatusOK, rec.Code, "a value over MaxKeySize should be accepted")
+
+	value = strings.Repeat("v", txlog.MaxValueSize+1)
+	rec = serve(mux, http.MethodPost, "/kv/set", `{"key":"big","value":"`+value+`"}`, nil)
+	require.Equal(t, http.StatusBadRequest, rec.Code, "a value over MaxValueSize should be rejected")
+}
+
+func TestHandler_Scan(t *testing.T) {
+	t.Helper()
+
+	mux, kvEngine := newTestMux(t)
+
+	for _, key := range []string{"a", "user:1", "user:2", "user:3", "z"} {
+		_, err := kvEngine.Set(key, "v", 0, store.Condition{})
+		require.NoError(t, err)
+	}
+
+	var keys []string
+	cursor := ""
+	for {
+		target := "/kv/scan?prefix=user:&limit=2"
+		if cursor != "" {
+			target += "&cursor=" + url.QueryEscape(cursor)
+		}
+
+		rec := serve(mux, http.MethodGet, target, "", nil)
+		require.Equal(t, http.StatusOK, rec.Code)
+
+		var page scanResponse
+		require.NoError(t, json.NewDecoder(rec.Body).Decode(&page))
+
+		for _, item := range page.Items {
+			keys = append(keys, item.Key)
+		}
+
+		cursor = page.NextCursor
+		if cursor == "" {
+			break
+		}
+	}
+
+	require.Equal(t, []string{"user:1", "user:2", "user:3"}, keys, "pages should cover the prefix in order")
+
+	_, err := kvEngine.Set("session", "s", time.Hour, store.Condition{})
+	require.NoError(t, err)
+
+	rec := serve(mux, http.MethodGet, "/kv/scan?start=session&end=t", "", nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	var page scanResponse
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&page))
+	require.Len(t, page.Items, 1)
+	require.False(t, page.Items[0].ExpiresAt.IsZero(), "a scan should report the expiry of a key")
+
+	rec = serve(mux, http.MethodGet, "/kv/scan?limit=0", "", nil)
+	require.Equal(t, http.StatusBadRequest, rec.Code, "a non-positive limit should be rejected")
+}
+
+func TestHandler_Namespaces(t *testing.T) {
+	t.Helper()
+
+	mux, kvEngine := newTestMux(t)
+
+	rec := serve(mux, http.MethodGet, "/kv/team-a/get?key=user1", "", nil)
+	require.Equal(t, http.StatusNotFound, rec.Code, "an unknown namespace should be reported as missing")
+
+	rec = serve(mux, http.MethodPost, "/admin/namespaces", `{"name":"team-a"}`, nil)
+	require.Equal(t, http.StatusCreated, rec.Code)
+
+	rec = serve(mux, http.MethodPost, "/kv/team-a/set", `{"key":"user1","value":"Alice"}`, nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	_, ok := kvEngine.Get("user1")
+	require.False(t, ok, "a namespace should not write to the default engine")
+
+	rec = serve(mux, http.MethodGet, "/kv/team-a/get?key=user1", "", nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+}
+
+func TestHandler_UnsupportedOperations(t *testing.T) {
+	t.Helper()
+
+	mux, _ := newTestMux(t)
+
+	rec := serve(mux, http.MethodPost, "/kv/txn", `{"ops":[{"op":"set","key":"a","value":"1"}]}`, nil)
+	require.Equal(t, http.StatusNotImplemented, rec.Code, "txn should need an engine with batches")
+
+	rec = serve(mux, http.MethodPost, "/admin/compact", "", nil)
+	require.Equal(t, http.StatusNotImplemented, rec.Code, "compaction should need an engine that supports it")
+
+	rec = serve(mux, http.MethodPost, "/admin/snapshot", "", nil)
+	require.Equal(t, http.StatusNotImplemented, rec.Code, "snapshots should need an engine that supports them")
+
+	rec = serve(mux, http.MethodPost, "/kv/set", `{"key":"a","value":"1","stamp":5}`, nil)
+	require.Equal(t, http.StatusNotImplemented, rec.Code, "stamped writes should need an engine that orders them")
+}
+
+func TestHandler_Stamped(t *testing.T) {
+	t.Helper()
+
+	log, err := txlog.NewFileLog(t.TempDir() + "/kv.log")
+	require.NoError(t, err)
+
+	namespaces := namespace.NewRegistry(t.TempDir(), nil)
+	namespaces.SetDefault(engine.NewTxlogEngine(store.NewStore(log), log))
+	t.Cleanup(func() { log.Close() })
+
+	mux := testRoutes(NewHandler(namespaces))
+
+	rec := serve(mux, http.MethodPost, "/kv/set", `{"key":"a","value":"new","stamp":20}`, nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	rec = serve(mux, http.MethodPost, "/kv/set", `{"key":"a","value":"old","stamp":10}`, nil)
+	require.Equal(t, http.StatusConflict, rec.Code, "an older stamp should be rejected")
+
+	rec = serve(mux, http.MethodGet, "/kv/get?key=a", "", nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.JSONEq(t, `{"status":"ok","value":"new","stamp":20}`, rec.Body.String())
+
+	rec = serve(mux, http.MethodGet, "/kv/scan", "", nil)
+	require.Contains(t, rec.Body.String(), `"stamp":20`)
+
+	rec = serve(mux, http.MethodPost, "/kv/set", `{"key":"a","value":"x","stamp":30}`, http.Header{"If-Match": {`"1"`}})
+	require.Equal(t, http.StatusBadRequest, rec.Code, "a stamped write should not take preconditions")
+
+	rec = serve(mux, http.MethodDelete, "/kv/delete?key=a&stamp=abc", "", nil)
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+
+	rec = serve(mux, http.MethodDelete, "/kv/delete?key=a&stamp=15", "", nil)
+	require.Equal(t, http.StatusConflict, rec.Code, "an older delete should be rejected")
+
+	rec = serve(mux, http.MethodDelete, "/kv/delete?key=a&stamp=25", "", nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	rec = serve(mux, http.MethodGet, "/kv/get?key=a", "", nil)
+	require.Equal(t, http.StatusNotFound, rec.Code)
+	require.JSONEq(t, `{"status":"not found","stamp":25}`, rec.Body.String(), "a deleted key should keep the stamp of the delete")
+
+	rec = serve(mux, http.MethodGet, "/kv/get?key=b", "", nil)
+	require.Equal(t, http.StatusNotFound, rec.Code)
+	require.Empty(t, rec.Body.String())
+}
+
+func TestHandler_ReadOnly(t *testing.T) {
+	t.Helper()
+
+	handler, kvEngine := newTestHandler(t)
+	handler.SetReadOnly(true)
+
+	mux := testRoutes(handler)
+
+	_, err := kvEngine.Set("user1", "Alice", 0, store.Condition{})
+	require.NoError(t, err)
+
+	rec := serve(mux, http.MethodGet, "/kv/get?key=user1", "", nil)
+	require.Equal(t, http.StatusOK, rec.Code, "a follower should serve reads")
+
+	writes := []struct {
+		method, target, body string
+	}{
+		{http.MethodPost, "/kv/set", `{"key":"user1","value":"Bob"}`},
+		{http.MethodDelete, "/kv/delete?key=user1", ""},
+		{http.MethodPost, "/kv/txn", `{"ops":[{"op":"set","key":"a","value":"1"}]}`},
+		{http.MethodPost, "/admin/namespaces", `{"name":"team-a"}`},
+		{http.MethodDelete, "/admin/namespaces/team-a", ""},
+	}
+	for _, write := range writes {
+		rec = serve(mux, write.method, write.target, write.body, nil)
+		require.Equal(t, http.StatusForbidden, rec.Code, "%s %s should be rejected on a follower", write.method, write.target)
+	}
+
+	entry, ok := kvEngine.Get("user1")
+	require.True(t, ok)
+	require.Equal(t, "Alice", entry.Value, "a rejected write should not reach the engine")
+}
+
+func TestHandler_RedirectsToLeader(t *testing.T) {
+	t.Helper()
+
+	handler, kvEngine := newTestHandler(t)
+
+	var leaderAddr string
+	handler.SetLeader(func() (string, bool) {
+		return leaderAddr, leaderAddr != ""
+	})
+
+	mux := testRoutes(handler)
+
+	rec := serve(mux, http.MethodPost, "/kv/set", `{"key":"user1","value":"Alice"}`, nil)
+	require.Equal(t, http.StatusOK, rec.Code, "the leader should take writes")
+
+	kvEngine.writeErr = fmt.Errorf("store: append set event: %w", &raft.NotLeaderError{})
+
+	rec = serve(mux, http.MethodPost, "/kv/set", `{"key":"user1","value":"Bob"}`, nil)
+	require.Equal(t, http.StatusServiceUnavailable, rec.Code, "a write should fail while there is no leader")
+
+	leaderAddr = "http://kv-2:8081"
+
+	rec = serve(mux, http.MethodPost, "/kv/set?trace=1", `{"key":"user1","value":"Bob"}`, nil)
+	require.Equal(t, http.StatusTemporaryRedirect, rec.Code)
+	require.Equal(t, "http://kv-2:8081/kv/set?trace=1", rec.Header().Get("Location"))
+
+	kvEngine.writeErr = store.ErrReadOnly
+
+	rec = serve(mux, http.MethodDelete, "/kv/delete?key=user1", "", nil)
+	require.Equal(t, http.StatusTemporaryRedirect, rec.Code, "a follower should redirect deletes")
+	require.Equal(t, "http://kv-2:8081/kv/delete?key=user1", rec.Header().Get("Location"))
+
+	rec = serve(mux, http.MethodGet, "/kv/get?key=user1", "", nil)
+	require.Equal(t, http.StatusOK, rec.Code, "a follower should serve reads itself")
+}
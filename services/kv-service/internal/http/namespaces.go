@@ -0,0 +1,140 @@
+package http
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/alexey-y-a/go-txlog-microservices/libs/logger"
+	"github.com/alexey-y-a/go-txlog-microservices/services/kv-service/internal/engine"
+	kvmetrics "github.com/alexey-y-a/go-txlog-microservices/services/kv-service/internal/metrics"
+	"github.com/alexey-y-a/go-txlog-microservices/services/kv-service/internal/namespace"
+)
+
+// engineFor returns the engine of the namespace in the {ns} path segment,
+// or of the default namespace for routes without one. It answers 404 itself
+// if the namespace does not exist.
+func (h *Handler) engineFor(w http.ResponseWriter, r *http.Request) (engine.Engine, bool) {
+	name := r.PathValue("ns")
+	if name == "" {
+		name = namespace.Default
+	}
+
+	e, ok := h.namespaces.Engine(name)
+	if !ok {
+		writeJSON(w, http.StatusNotFound, commonResponse{
+			Status:  "error",
+			Message: "namespace not found",
+		})
+		return nil, false
+	}
+
+	kvmetrics.ObserveNamespaceRequest(name)
+
+	return e, true
+}
+
+type namespaceRequest struct {
+	Name string `json:"name"`
+}
+
+type namespacesResponse struct {
+	Status     string   `json:"status"`
+	Namespaces []string `json:"namespaces"`
+}
+
+// NamespacesHandler lists namespaces on GET and creates one on POST.
+func (h *Handler) NamespacesHandler(w http.ResponseWriter, r *http.Request) {
+	log := logger.L().With().Str("handler", "admin_namespaces").Logger()
+
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, namespacesResponse{
+			Status:     "ok",
+			Namespaces: h.namespaces.Names(),
+		})
+	case http.MethodPost:
+		if h.rejectWrite(w) {
+			return
+		}
+
+		var req namespaceRequest
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			log.Error().Err(err).Msg("failed to decode namespace request")
+
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		err = h.namespaces.Create(req.Name)
+		switch {
+		case errors.Is(err, namespace.ErrInvalidName):
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		case errors.Is(err, namespace.ErrExists):
+			w.WriteHeader(http.StatusConflict)
+			return
+		case err != nil:
+			log.Error().Err(err).Str("namespace", req.Name).Msg("namespace create failed")
+
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		writeJSON(w, http.StatusCreated, commonResponse{
+			Status:  "ok",
+			Message: "namespace created",
+		})
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// NamespaceHandler drops the namespace in the path on DELETE.
+func (h *Handler) NamespaceHandler(w http.ResponseWriter, r *http.Request) {
+	log := logger.L().With().Str("handler", "admin_namespace").Logger()
+
+	if r.Method != http.MethodDelete {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	if h.rejectWrite(w) {
+		return
+	}
+
+	name := r.PathValue("ns")
+
+	err := h.namespaces.Drop(name)
+	switch {
+	case errors.Is(err, namespace.ErrNotFound):
+		w.WriteHeader(http.StatusNotFound)
+		return
+	case errors.Is(err, namespace.ErrDefault):
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	case err != nil:
+		log.Error().Err(err).Str("namespace", name).Msg("namespace drop failed")
+
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, commonResponse{
+		Status:  "ok",
+		Message: "namespace dropped",
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	log := logger.L().With().Str("component", "http").Logger()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to write response")
+	}
+}
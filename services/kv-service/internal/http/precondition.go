@@ -0,0 +1,63 @@
+package http
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/alexey-y-a/go-txlog-microservices/services/kv-service/internal/store"
+)
+
+// etag formats a key version as a strong entity tag.
+func etag(version uint64) string {
+	return `"` + strconv.FormatUint(version, 10) + `"`
+}
+
+// parseCondition builds a store.Condition from the If-Match and If-None-Match
+// headers. Tags that are not versions issued by this service never match.
+// If-Match uses the strong comparison of RFC 7232, so weak tags never match
+// there.
+func parseCondition(r *http.Request) store.Condition {
+	var cond store.Condition
+
+	cond.IfMatch, cond.IfMatchAny = parseETags(r.Header.Values("If-Match"), false)
+	cond.IfNoneMatch, cond.IfNoneMatchAny = parseETags(r.Header.Values("If-None-Match"), true)
+
+	return cond
+}
+
+// parseETags returns the versions listed in the header values and whether
+// one of them is "*". Weak tags are skipped unless weak is set. A header
+// that is present but lists no valid version yields an empty non-nil
+// slice, so that it still acts as a condition.
+func parseETags(values []string, weak bool) ([]uint64, bool) {
+	if len(values) == 0 {
+		return nil, false
+	}
+
+	versions := []uint64{}
+	for _, value := range values {
+		for _, tag := range strings.Split(value, ",") {
+			tag = strings.TrimSpace(tag)
+			if tag == "*" {
+				return nil, true
+			}
+
+			if strings.HasPrefix(tag, "W/") {
+				if !weak {
+					continue
+				}
+				tag = strings.TrimPrefix(tag, "W/")
+			}
+			tag = strings.Trim(tag, `"`)
+
+			version, err := strconv.ParseUint(tag, 10, 64)
+			if err != nil {
+				continue
+			}
+			versions = append(versions, version)
+		}
+	}
+
+	return versions, false
+}
@@ -0,0 +1,58 @@
+package http
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/alexey-y-a/go-txlog-microservices/services/kv-service/internal/engine"
+)
+
+// parseStamp returns the stamp query parameter, zero if it is absent.
+func parseStamp(r *http.Request) (uint64, error) {
+	v := r.URL.Query().Get("stamp")
+	if v == "" {
+		return 0, nil
+	}
+
+	return strconv.ParseUint(v, 10, 64)
+}
+
+// stamperFor returns kvEngine for a stamped write. It answers 400 itself
+// if the write also has preconditions, which stamped writes do not check,
+// and 501 if the engine does not order stamped writes.
+func stamperFor(w http.ResponseWriter, r *http.Request, kvEngine engine.Engine) (engine.Stamper, bool) {
+	if r.Header.Get("If-Match") != "" || r.Header.Get("If-None-Match") != "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return nil, false
+	}
+
+	stamper, ok := kvEngine.(engine.Stamper)
+	if !ok {
+		w.WriteHeader(http.StatusNotImplemented)
+		return nil, false
+	}
+
+	return stamper, true
+}
+
+// writeNotFound answers 404 for a missing key, with the stamp of the delete
+// that removed it if the engine keeps one, so that a reader of several
+// replicas can tell a newer delete from an older write.
+func writeNotFound(w http.ResponseWriter, kvEngine engine.Engine, key string) {
+	stamper, ok := kvEngine.(engine.Stamper)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	stamp, ok := stamper.DeletedStamp(key)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	writeJSON(w, http.StatusNotFound, getResponse{
+		Status: "not found",
+		Stamp:  stamp,
+	})
+}
@@ -0,0 +1,121 @@
+// Package index provides the ordered key index shared by the storage
+// engines.
+package index
+
+import "math/rand/v2"
+
+const (
+	skiplistMaxLevel = 32
+	// skiplistP is the probability of a node reaching the next level.
+	skiplistP = 0.25
+)
+
+// Skiplist is an ordered set of keys. It is not safe for concurrent use;
+// engines guard it with the same lock as the data it indexes.
+type Skiplist struct {
+	head   *Node
+	level  int
+	length int
+}
+
+type Node struct {
+	Key  string
+	next []*Node
+}
+
+// Next returns the node with the next key, nil after the last one.
+func (n *Node) Next() *Node {
+	return n.next[0]
+}
+
+func NewSkiplist() *Skiplist {
+	return &Skiplist{
+		head:  &Node{next: make([]*Node, skiplistMaxLevel)},
+		level: 1,
+	}
+}
+
+// Len returns the number of keys.
+func (l *Skiplist) Len() int {
+	return l.length
+}
+
+// findPrev fills prev with the last node before key on every level and
+// returns the first node at or after key.
+func (l *Skiplist) findPrev(key string, prev *[skiplistMaxLevel]*Node) *Node {
+	x := l.head
+	for i := l.level - 1; i >= 0; i-- {
+		for x.next[i] != nil && x.next[i].Key < key {
+			x = x.next[i]
+		}
+		prev[i] = x
+	}
+	return x.next[0]
+}
+
+// Insert adds key and reports whether it was not present yet.
+func (l *Skiplist) Insert(key string) bool {
+	var prev [skiplistMaxLevel]*Node
+
+	x := l.findPrev(key, &prev)
+	if x != nil && x.Key == key {
+		return false
+	}
+
+	level := randomLevel()
+	if level > l.level {
+		for i := l.level; i < level; i++ {
+			prev[i] = l.head
+		}
+		l.level = level
+	}
+
+	node := &Node{Key: key, next: make([]*Node, level)}
+	for i := 0; i < level; i++ {
+		node.next[i] = prev[i].next[i]
+		prev[i].next[i] = node
+	}
+	l.length++
+
+	return true
+}
+
+// Remove deletes key and reports whether it was present.
+func (l *Skiplist) Remove(key string) bool {
+	var prev [skiplistMaxLevel]*Node
+
+	x := l.findPrev(key, &prev)
+	if x == nil || x.Key != key {
+		return false
+	}
+
+	for i := 0; i < len(x.next); i++ {
+		prev[i].next[i] = x.next[i]
+	}
+	for l.level > 1 && l.head.next[l.level-1] == nil {
+		l.level--
+	}
+	l.length--
+
+	return true
+}
+
+// Seek returns the first node with a key at or after key, nil if there is
+// none. Following Next visits the remaining keys in order.
+func (l *Skiplist) Seek(key string) *Node {
+	x := l.head
+	for i := l.level - 1; i >= 0; i-- {
+		for x.next[i] != nil && x.next[i].Key < key {
+			x = x.next[i]
+		}
+	}
+	return x.next[0]
+}
+
+func randomLevel() int {
+	level := 1
+	for level < skiplistMaxLevel && rand.Float64() < skiplistP {
+		level++
+	}
+	return level
+}
@@ -3,6 +3,7 @@ package metrics
 import (
 	"net/http"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -18,6 +19,137 @@ var httpRequestsTotal = promauto.NewCounterVec(
 	[]string{"handler", "method", "status"},
 )
 
+var (
+	replicationLag = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Subsystem: "replication",
+			Name:      "lag_records",
+			Help:      "Number of leader log records the follower has not applied yet.",
+		},
+	)
+	replicationConnected = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Subsystem: "replication",
+			Name:      "connected",
+			Help:      "Whether the follower is streaming the log of its leader (1) or not (0).",
+		},
+	)
+	replicationFollowers = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Subsystem: "replication",
+			Name:      "followers",
+			Help:      "Number of followers streaming the log of this instance.",
+		},
+	)
+)
+
+// SetReplicationLag reports how many records a follower is behind its
+// leader.
+func SetReplicationLag(records uint64) {
+	replicationLag.Set(float64(records))
+}
+
+// SetReplicationConnected reports whether a follower is connected to its
+// leader.
+func SetReplicationConnected(connected bool) {
+	if connected {
+		replicationConnected.Set(1)
+	} else {
+		replicationConnected.Set(0)
+	}
+}
+
+// AddReplicationFollowers changes the number of connected followers by
+// delta.
+func AddReplicationFollowers(delta int) {
+	replicationFollowers.Add(float64(delta))
+}
+
+var namespaceRequestsTotal = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Subsystem: "namespace",
+		Name:      "requests_total",
+		Help:      "Total number of requests served by each namespace.",
+	},
+	[]string{"namespace"},
+)
+
+// ObserveNamespaceRequest counts a request served by an existing namespace.
+func ObserveNamespaceRequest(name string) {
+	namespaceRequestsTotal.WithLabelValues(name).Inc()
+}
+
+// NamespaceStats are the per-namespace values exported as metrics.
+type NamespaceStats struct {
+	Keys        int
+	ExpiredKeys uint64
+
+	// Durability is the mode of the namespace's log and Fsyncs the number
+	// of fsyncs it issued; Durability is empty for an engine whose log does
+	// not report them.
+	Durability string
+	Fsyncs     uint64
+}
+
+var (
+	namespaceKeysDesc = prometheus.NewDesc(
+		"namespace_keys",
+		"Number of keys stored in the namespace.",
+		[]string{"namespace"}, nil,
+	)
+	expiredKeysDesc = prometheus.NewDesc(
+		"store_expired_keys_total",
+		"Total number of keys removed because their TTL passed.",
+		[]string{"namespace"}, nil,
+	)
+	durabilityModeDesc = prometheus.NewDesc(
+		"txlog_durability_mode",
+		"Durability mode of the transaction log of the namespace (1 for the active mode).",
+		[]string{"namespace", "mode"}, nil,
+	)
+	fsyncsDesc = prometheus.NewDesc(
+		"txlog_fsyncs_total",
+		"Total number of fsync calls issued by the transaction log of the namespace.",
+		[]string{"namespace"}, nil,
+	)
+)
+
+// namespaceCollector reads the stats of all namespaces on every scrape, so
+// namespaces that were created or dropped show up or disappear by
+// themselves.
+type namespaceCollector struct {
+	stats func() map[string]NamespaceStats
+}
+
+func (c namespaceCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- namespaceKeysDesc
+	ch <- expiredKeysDesc
+	ch <- durabilityModeDesc
+	ch <- fsyncsDesc
+}
+
+func (c namespaceCollector) Collect(ch chan<- prometheus.Metric) {
+	for name, stats := range c.stats() {
+		ch <- prometheus.MustNewConstMetric(namespaceKeysDesc, prometheus.GaugeValue, float64(stats.Keys), name)
+		ch <- prometheus.MustNewConstMetric(expiredKeysDesc, prometheus.CounterValue, float64(stats.ExpiredKeys), name)
+
+		if stats.Durability != "" {
+			ch <- prometheus.MustNewConstMetric(durabilityModeDesc, prometheus.GaugeValue, 1, name, stats.Durability)
+			ch <- prometheus.MustNewConstMetric(fsyncsDesc, prometheus.CounterValue, float64(stats.Fsyncs), name)
+		}
+	}
+}
+
+var registerNamespaces sync.Once
+
+// RegisterNamespaces exports the values returned by stats, keyed by
+// namespace name.
+func RegisterNamespaces(stats func() map[string]NamespaceStats) {
+	registerNamespaces.Do(func() {
+		prometheus.MustRegister(namespaceCollector{stats: stats})
+	})
+}
+
 func InstrumentHandler(handlerName string, next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		ww := &responseWriterWrapper{
@@ -45,3 +177,9 @@ func (w *responseWriterWrapper) WriteHeader(statusCode int) {
 	w.statusCode = statusCode
 	w.ResponseWriter.WriteHeader(statusCode)
 }
+
+// Unwrap lets http.ResponseController reach the underlying writer, so that
+// streaming handlers can flush.
+func (w *responseWriterWrapper) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
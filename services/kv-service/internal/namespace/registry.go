@@ -0,0 +1,214 @@
+package namespace
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sync"
+
+	"github.com/alexey-y-a/go-txlog-microservices/services/kv-service/internal/engine"
+)
+
+// Default is the namespace used by requests that do not name one. It is
+// backed by the configured log and cannot be dropped.
+const Default = "default"
+
+var (
+	ErrInvalidName = errors.New("namespace: invalid name")
+	ErrExists      = errors.New("namespace: already exists")
+	ErrNotFound    = errors.New("namespace: not found")
+	ErrDefault     = errors.New("namespace: the default namespace cannot be dropped")
+)
+
+var validName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]{0,63}$`)
+
+// OpenFunc opens the engine of a namespace whose data lives in dir. The
+// engine is expected to be ready for use, with its background jobs started.
+type OpenFunc func(name, dir string) (engine.Engine, error)
+
+type namespace struct {
+	engine engine.Engine
+	dir    string
+}
+
+// Registry holds the namespaces of a kv-service. Every namespace except
+// Default keeps its data in its own directory under root, so dropping one
+// is closing its engine and removing the directory.
+type Registry struct {
+	mu         sync.RWMutex
+	root       string
+	open       OpenFunc
+	namespaces map[string]*namespace
+}
+
+func NewRegistry(root string, open OpenFunc) *Registry {
+	return &Registry{
+		root:       root,
+		open:       open,
+		namespaces: make(map[string]*namespace),
+	}
+}
+
+// SetDefault registers the engine of the Default namespace.
+func (r *Registry) SetDefault(e engine.Engine) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.namespaces[Default] = &namespace{engine: e}
+}
+
+// Load opens every namespace found under root.
+func (r *Registry) Load() error {
+	entries, err := os.ReadDir(r.root)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return fmt.Errorf("namespace: list %q: %w", r.root, err)
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.IsDir() || name == Default || !validName.MatchString(name) {
+			continue
+		}
+
+		dir := filepath.Join(r.root, name)
+
+		e, err := r.open(name, dir)
+		if err != nil {
+			return fmt.Errorf("namespace: open %q: %w", name, err)
+		}
+
+		r.mu.Lock()
+		r.namespaces[name] = &namespace{engine: e, dir: dir}
+		r.mu.Unlock()
+	}
+
+	return nil
+}
+
+// Engine returns the engine of the namespace name.
+func (r *Registry) Engine(name string) (engine.Engine, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	ns, ok := r.namespaces[name]
+	if !ok {
+		return nil, false
+	}
+	return ns.engine, true
+}
+
+// Names returns the names of all namespaces in order.
+func (r *Registry) Names() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	names := make([]string, 0, len(r.namespaces))
+	for name := range r.namespaces {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	return names
+}
+
+// Create creates an empty namespace.
+func (r *Registry) Create(name string) error {
+	if !validName.MatchString(name) {
+		return fmt.Errorf("%w %q", ErrInvalidName, name)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.namespaces[name]; ok {
+		return fmt.Errorf("%w: %q", ErrExists, name)
+	}
+
+	err := os.MkdirAll(r.root, 0o755)
+	if err != nil {
+		return fmt.Errorf("namespace: create root %q: %w", r.root, err)
+	}
+
+	dir := filepath.Join(r.root, name)
+
+	err = os.Mkdir(dir, 0o755)
+	if err != nil {
+		if errors.Is(err, os.ErrExist) {
+			return fmt.Errorf("%w: %q", ErrExists, name)
+		}
+		return fmt.Errorf("namespace: create %q: %w", name, err)
+	}
+
+	e, err := r.open(name, dir)
+	if err != nil {
+		os.RemoveAll(dir)
+		return fmt.Errorf("namespace: open %q: %w", name, err)
+	}
+
+	r.namespaces[name] = &namespace{engine: e, dir: dir}
+
+	return nil
+}
+
+// Drop removes a namespace together with its data. Requests still running
+// against it may fail.
+func (r *Registry) Drop(name string) error {
+	if name == Default {
+		return ErrDefault
+	}
+
+	r.mu.Lock()
+	ns, ok := r.namespaces[name]
+	delete(r.namespaces, name)
+	r.mu.Unlock()
+
+	if !ok {
+		return fmt.Errorf("%w: %q", ErrNotFound, name)
+	}
+
+	err := ns.engine.Close()
+	if err != nil {
+		return fmt.Errorf("namespace: close engine of %q: %w", name, err)
+	}
+
+	err = os.RemoveAll(ns.dir)
+	if err != nil {
+		return fmt.Errorf("namespace: remove %q: %w", name, err)
+	}
+
+	return nil
+}
+
+// Sync flushes the engines of all namespaces that support it.
+func (r *Registry) Sync() error {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var errs []error
+	for _, ns := range r.namespaces {
+		if syncer, ok := ns.engine.(engine.Syncer); ok {
+			errs = append(errs, syncer.Sync())
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Close closes the engines of all namespaces.
+func (r *Registry) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var errs []error
+	for _, ns := range r.namespaces {
+		errs = append(errs, ns.engine.Close())
+	}
+	clear(r.namespaces)
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,80 @@
+package namespace
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/alexey-y-a/go-txlog-microservices/libs/txlog"
+	"github.com/alexey-y-a/go-txlog-microservices/services/kv-service/internal/engine"
+	"github.com/alexey-y-a/go-txlog-microservices/services/kv-service/internal/store"
+)
+
+func openFileEngine(name, dir string) (engine.Engine, error) {
+	path := filepath.Join(dir, "kv.log")
+
+	log, err := txlog.NewFileLog(path)
+	if err != nil {
+		return nil, err
+	}
+
+	s, _, err := store.NewStoreFromLog(log, path)
+	if err != nil {
+		log.Close()
+		return nil, err
+	}
+
+	return engine.NewTxlogEngine(s, log), nil
+}
+
+func TestRegistry(t *testing.T) {
+	t.Helper()
+
+	root := t.TempDir()
+
+	r := NewRegistry(root, openFileEngine)
+	require.NoError(t, r.Load(), "Load should accept a missing root")
+
+	require.NoError(t, r.Create("team-a"))
+	require.NoError(t, r.Create("team-b"))
+	require.ErrorIs(t, r.Create("team-a"), ErrExists)
+	require.ErrorIs(t, r.Create("../escape"), ErrInvalidName)
+	require.Equal(t, []string{"team-a", "team-b"}, r.Names())
+
+	a, ok := r.Engine("team-a")
+	require.True(t, ok)
+	b, ok := r.Engine("team-b")
+	require.True(t, ok)
+
+	_, err := a.Set("user1", "Alice", 0, store.Condition{})
+	require.NoError(t, err)
+	_, err = b.Set("user1", "Bob", 0, store.Condition{})
+	require.NoError(t, err)
+
+	entry, _ := a.Get("user1")
+	require.Equal(t, "Alice", entry.Value, "namespaces should not share keys")
+
+	require.NoError(t, r.Drop("team-b"))
+	require.ErrorIs(t, r.Drop("team-b"), ErrNotFound)
+	require.ErrorIs(t, r.Drop(Default), ErrDefault)
+
+	_, err = os.Stat(filepath.Join(root, "team-b"))
+	require.ErrorIs(t, err, os.ErrNotExist, "dropping a namespace should remove its log")
+
+	require.NoError(t, r.Close())
+
+	r = NewRegistry(root, openFileEngine)
+	require.NoError(t, r.Load())
+	defer r.Close()
+
+	require.Equal(t, []string{"team-a"}, r.Names(), "Load should find the remaining namespaces")
+
+	a, ok = r.Engine("team-a")
+	require.True(t, ok)
+
+	entry, ok = a.Get("user1")
+	require.True(t, ok)
+	require.Equal(t, "Alice", entry.Value, "namespace data should survive a restart")
+}
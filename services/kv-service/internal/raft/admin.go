@@ -0,0 +1,65 @@
+package raft
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+)
+
+const (
+	AdminStatusPath  = "/admin/raft"
+	AdminMembersPath = "/admin/raft/members"
+)
+
+// NewAdminHandler serves the status of n and changes to the membership of
+// its cluster. Membership changes sent to a follower are redirected to the
+// leader.
+func NewAdminHandler(n *Node) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET "+AdminStatusPath, func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, n.Status())
+	})
+
+	mux.HandleFunc("POST "+AdminMembersPath, func(w http.ResponseWriter, r *http.Request) {
+		var m Member
+		err := json.NewDecoder(r.Body).Decode(&m)
+		if err != nil || m.ID == "" || m.Addr == "" {
+			http.Error(w, "id and addr are required", http.StatusBadRequest)
+			return
+		}
+
+		writeChangeResult(w, r, n.AddMember(r.Context(), m))
+	})
+
+	mux.HandleFunc("DELETE "+AdminMembersPath+"/{id}", func(w http.ResponseWriter, r *http.Request) {
+		writeChangeResult(w, r, n.RemoveMember(r.Context(), r.PathValue("id")))
+	})
+
+	return mux
+}
+
+func writeChangeResult(w http.ResponseWriter, r *http.Request, err error) {
+	var notLeader *NotLeaderError
+
+	switch {
+	case err == nil:
+		w.WriteHeader(http.StatusNoContent)
+	case errors.As(err, &notLeader) && notLeader.Leader.Addr != "":
+		http.Redirect(w, r, notLeader.Leader.Addr+r.URL.RequestURI(), http.StatusTemporaryRedirect)
+	case errors.Is(err, ErrNotLeader):
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	case errors.Is(err, ErrUnknownMember):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, ErrConfigChangePending):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
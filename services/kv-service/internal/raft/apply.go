@@ -0,0 +1,331 @@
+package raft
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/alexey-y-a/go-txlog-microservices/libs/txlog"
+)
+
+type waitKind int
+
+const (
+	// waitWrite is a write of the state machine, which applies it itself
+	// once Append returns.
+	waitWrite waitKind = iota
+	// waitNoop and waitConfig are entries of the node, which the apply loop
+	// applies like those of other leaders.
+	waitNoop
+	waitConfig
+)
+
+// waiter is a proposal of the node waiting for its last entry to commit.
+type waiter struct {
+	kind waitKind
+	term uint64
+	done chan error
+}
+
+// Append proposes e to the cluster and returns its index once it is
+// committed; the caller then applies it. Only the leader accepts writes.
+func (n *Node) Append(e txlog.Event) (uint64, error) {
+	return n.propose([]txlog.Event{e})
+}
+
+// AppendBatch proposes events as one batch, see Append.
+func (n *Node) AppendBatch(events []txlog.Event) (uint64, error) {
+	if len(events) == 0 {
+		return 0, txlog.ErrEmptyBatch
+	}
+	return n.propose(events)
+}
+
+// Sync does nothing: Append returns once the entries are synced by a
+// quorum.
+func (n *Node) Sync() error {
+	return nil
+}
+
+func (n *Node) propose(events []txlog.Event) (uint64, error) {
+	n.mu.Lock()
+	if n.closed {
+		n.mu.Unlock()
+		return 0, ErrClosed
+	}
+	if n.role != leader || !n.ready {
+		err := n.notLeader()
+		n.mu.Unlock()
+		return 0, err
+	}
+
+	w, err := n.appendLocal(events, waitWrite)
+	last := n.entries.lastIndex()
+	n.mu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+
+	err = <-w.done
+	if err != nil {
+		return 0, err
+	}
+	return last, nil
+}
+
+// appendLocal appends events of the current term to the log as one batch,
+// replicates them and returns the waiter of their commit. Must be called
+// with n.mu held by a leader.
+func (n *Node) appendLocal(events []txlog.Event, kind waitKind) (*waiter, error) {
+	now := time.Now()
+	index := n.entries.lastIndex()
+
+	entries := make([]Entry, len(events))
+	for i, e := range events {
+		index++
+		e.LSN, e.Term = index, n.term
+		if e.Time.IsZero() {
+			e.Time = now
+		}
+		entries[i] = newEntry(e, i < len(events)-1)
+	}
+
+	err := n.entries.append(entries)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &waiter{kind: kind, term: n.term, done: make(chan error, 1)}
+	n.waiters[index] = w
+
+	n.notifyPeers()
+	n.advanceCommit()
+
+	return w, nil
+}
+
+// failWaiters fails the proposals whose last entry is after index.
+func (n *Node) failWaiters(index uint64, err error) {
+	for i, w := range n.waiters {
+		if i > index {
+			w.done <- err
+			delete(n.waiters, i)
+		}
+	}
+}
+
+// AddMember adds m to the cluster. The new node is started without being
+// bootstrapped and receives the log, or a snapshot, from the leader.
+func (n *Node) AddMember(ctx context.Context, m Member) error {
+	return n.changeMembers(ctx, func(members []Member) ([]Member, error) {
+		i := slices.IndexFunc(members, func(other Member) bool { return other.ID == m.ID })
+		if i >= 0 {
+			members[i] = m
+			return members, nil
+		}
+		return append(members, m), nil
+	})
+}
+
+// RemoveMember removes the member with id from the cluster. A leader that
+// removes itself steps down once the change is committed.
+func (n *Node) RemoveMember(ctx context.Context, id string) error {
+	return n.changeMembers(ctx, func(members []Member) ([]Member, error) {
+		i := slices.IndexFunc(members, func(m Member) bool { return m.ID == id })
+		if i < 0 {
+			return nil, fmt.Errorf("%w %q", ErrUnknownMember, id)
+		}
+		return slices.Delete(members, i, i+1), nil
+	})
+}
+
+// changeMembers appends the configuration that change returns and waits
+// for it to commit. The new configuration is in effect from the moment it
+// is appended; there is only one uncommitted change at a time.
+func (n *Node) changeMembers(ctx context.Context, change func([]Member) ([]Member, error)) error {
+	n.mu.Lock()
+	if n.role != leader || !n.ready {
+		err := n.notLeader()
+		n.mu.Unlock()
+		return err
+	}
+	if n.configIndex > n.commitIndex {
+		n.mu.Unlock()
+		return ErrConfigChangePending
+	}
+
+	members, err := change(slices.Clone(n.members))
+	if err != nil {
+		n.mu.Unlock()
+		return err
+	}
+
+	value, err := json.Marshal(members)
+	if err != nil {
+		n.mu.Unlock()
+		return fmt.Errorf("raft: encode members: %w", err)
+	}
+
+	w, err := n.appendLocal([]txlog.Event{{Op: txlog.OpConfig, Value: string(value)}}, waitConfig)
+	if err == nil {
+		n.log.Info().Any("members", members).Msg("changing members")
+		n.setMembers(members, n.entries.lastIndex())
+		n.advanceCommit()
+	}
+	n.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	select {
+	case err = <-w.done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (n *Node) signalApply() {
+	select {
+	case n.applyCh <- struct{}{}:
+	default:
+	}
+}
+
+// runApply applies committed entries in order. It is the only caller of the
+// state machine besides the writes that Append hands back.
+func (n *Node) runApply() {
+	defer n.wg.Done()
+
+	for {
+		select {
+		case <-n.stop:
+			return
+		case <-n.applyCh:
+		}
+
+		for n.applyNext() {
+			select {
+			case <-n.stop:
+				return
+			default:
+			}
+		}
+	}
+}
+
+// applyNext restores a pending snapshot or applies the next committed
+// batch, and reports whether it did either.
+func (n *Node) applyNext() bool {
+	n.mu.Lock()
+
+	if snap := n.restore; snap != nil {
+		n.restore = nil
+		n.mu.Unlock()
+
+		err := n.stateMachine.RestoreState(snap.Data, snap.Index)
+		if err != nil {
+			n.log.Error().Err(err).Uint64("index", snap.Index).Msg("failed to restore snapshot")
+			return false
+		}
+
+		n.mu.Lock()
+		n.lastApplied = max(n.lastApplied, snap.Index)
+		n.mu.Unlock()
+		return true
+	}
+
+	if n.lastApplied >= n.commitIndex {
+		n.mu.Unlock()
+		return false
+	}
+
+	first := n.lastApplied + 1
+	last := n.entries.groupEnd(first)
+	group := slices.Clone(n.entries.slice(first, last))
+
+	w, ok := n.waiters[last]
+	if ok && w.term == group[0].Term {
+		delete(n.waiters, last)
+	} else {
+		w = nil
+	}
+	n.mu.Unlock()
+
+	if w != nil && w.kind == waitWrite {
+		// The proposer applies the write once Append returns; the state
+		// machine orders it after the entries before it.
+		w.done <- nil
+	} else {
+		events := make([]txlog.Event, len(group))
+		for i, e := range group {
+			events[i] = e.event()
+		}
+		n.stateMachine.ApplyCommitted(events)
+
+		if w != nil {
+			w.done <- nil
+		}
+	}
+
+	n.mu.Lock()
+	n.lastApplied = last
+
+	if w != nil && w.kind == waitNoop && n.role == leader && n.term == w.term {
+		n.ready = true
+		n.stateMachine.SetReadOnly(false)
+		n.log.Info().Uint64("term", n.term).Msg("leader ready for writes")
+	}
+
+	due := last-n.entries.snapIndex >= n.snapshotThreshold
+	n.mu.Unlock()
+
+	if due {
+		err := n.takeSnapshot(last)
+		if err != nil {
+			n.log.Error().Err(err).Uint64("index", last).Msg("failed to take snapshot")
+		}
+	}
+
+	return true
+}
+
+// takeSnapshot writes the state at index to the snapshot file and discards
+// the log up to it. index must be the last applied entry.
+func (n *Node) takeSnapshot(index uint64) error {
+	data, err := n.stateMachine.SnapshotState(index)
+	if err != nil {
+		return err
+	}
+
+	n.snapMu.Lock()
+	defer n.snapMu.Unlock()
+
+	n.mu.Lock()
+	if index <= n.entries.snapIndex {
+		n.mu.Unlock()
+		return nil
+	}
+	term, _ := n.entries.term(index)
+	snap := &snapshot{Index: index, Term: term, Members: n.membersAt(index), Data: data}
+	n.mu.Unlock()
+
+	err = writeSnapshot(n.dir, snap)
+	if err != nil {
+		return err
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	err = n.entries.compact(index, term)
+	if err != nil {
+		return err
+	}
+	n.snapMembers = snap.Members
+
+	n.log.Info().Uint64("index", index).Int("bytes", len(data)).Msg("snapshot taken")
+	return nil
+}
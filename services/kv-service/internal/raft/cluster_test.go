@@ -0,0 +1,282 @@
+package raft
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/alexey-y-a/go-txlog-microservices/services/kv-service/internal/store"
+)
+
+var errUnreachable = errors.New("network: unreachable")
+
+// network connects the nodes of a test cluster in memory. A node can only
+// reach the nodes of its own side of a partition.
+type network struct {
+	mu    sync.Mutex
+	nodes map[string]*Node
+	side  map[string]int
+}
+
+func newNetwork() *network {
+	return &network{
+		nodes: make(map[string]*Node),
+		side:  make(map[string]int),
+	}
+}
+
+func (net *network) register(id string, n *Node) {
+	net.mu.Lock()
+	defer net.mu.Unlock()
+
+	net.nodes[id] = n
+}
+
+// partition splits the network so that the nodes of every group only reach
+// each other. Nodes not listed stay together.
+func (net *network) partition(groups ...[]string) {
+	net.mu.Lock()
+	defer net.mu.Unlock()
+
+	clear(net.side)
+	for i, group := range groups {
+		for _, id := range group {
+			net.side[id] = i + 1
+		}
+	}
+}
+
+func (net *network) heal() {
+	net.partition()
+}
+
+func (net *network) route(from, to string) (*Node, error) {
+	net.mu.Lock()
+	defer net.mu.Unlock()
+
+	n, ok := net.nodes[to]
+	if !ok || net.side[from] != net.side[to] {
+		return nil, errUnreachable
+	}
+	return n, nil
+}
+
+type memTransport struct {
+	net  *network
+	from string
+}
+
+func (t memTransport) RequestVote(_ context.Context, addr string, req *VoteRequest) (*VoteResponse, error) {
+	n, err := t.net.route(t.from, addr)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := n.HandleRequestVote(req)
+	return resp, t.reply(addr, err)
+}
+
+func (t memTransport) AppendEntries(_ context.Context, addr string, req *AppendRequest) (*AppendResponse, error) {
+	n, err := t.net.route(t.from, addr)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := n.HandleAppendEntries(req)
+	return resp, t.reply(addr, err)
+}
+
+func (t memTransport) InstallSnapshot(_ context.Context, addr string, req *SnapshotRequest) (*SnapshotResponse, error) {
+	n, err := t.net.route(t.from, addr)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := n.HandleInstallSnapshot(req)
+	return resp, t.reply(addr, err)
+}
+
+// reply loses the response if the network was split while the request was
+// handled.
+func (t memTransport) reply(addr string, err error) error {
+	if err != nil {
+		return err
+	}
+	_, err = t.net.route(addr, t.from)
+	return err
+}
+
+type testNode struct {
+	id    string
+	dir   string
+	node  *Node
+	store *store.Store
+}
+
+type testCluster struct {
+	t       *testing.T
+	net     *network
+	dir     string
+	opts    Config
+	members []Member
+	nodes   map[string]*testNode
+}
+
+// newTestCluster starts a bootstrapped cluster of size nodes, n1 to nN.
+func newTestCluster(t *testing.T, size int, opts Config) *testCluster {
+	t.Helper()
+
+	c := &testCluster{
+		t:     t,
+		net:   newNetwork(),
+		dir:   t.TempDir(),
+		opts:  opts,
+		nodes: make(map[string]*testNode),
+	}
+
+	for i := 1; i <= size; i++ {
+		id := fmt.Sprintf("n%d", i)
+		c.members = append(c.members, Member{ID: id, Addr: id})
+	}
+
+	for _, m := range c.members {
+		c.start(m.ID, c.members)
+	}
+
+	t.Cleanup(func() {
+		for id := range c.nodes {
+			c.stop(id)
+		}
+	})
+
+	return c
+}
+
+// start opens and starts the node id, bootstrapping it with members unless
+// they are nil.
+func (c *testCluster) start(id string, members []Member) *testNode {
+	c.t.Helper()
+
+	cfg := c.opts
+	cfg.ID = id
+	cfg.Dir = filepath.Join(c.dir, id)
+	cfg.Transport = memTransport{net: c.net, from: id}
+	if cfg.ElectionTimeout == 0 {
+		cfg.ElectionTimeout = 300 * time.Millisecond
+	}
+	if cfg.HeartbeatInterval == 0 {
+		cfg.HeartbeatInterval = 30 * time.Millisecond
+	}
+
+	n, err := Open(cfg)
+	require.NoError(c.t, err, "Open should not return error")
+
+	if members != nil {
+		require.NoError(c.t, n.Bootstrap(members))
+	}
+
+	s := store.NewStore(n)
+	c.net.register(id, n)
+	n.Start(s)
+
+	tn := &testNode{id: id, dir: cfg.Dir, node: n, store: s}
+	c.nodes[id] = tn
+	return tn
+}
+
+func (c *testCluster) stop(id string) {
+	c.t.Helper()
+
+	tn, ok := c.nodes[id]
+	if !ok {
+		return
+	}
+	delete(c.nodes, id)
+
+	require.NoError(c.t, tn.node.Close())
+}
+
+func (c *testCluster) restart(id string) *testNode {
+	c.t.Helper()
+
+	c.stop(id)
+	return c.start(id, nil)
+}
+
+// leader waits for exactly one of ids, all running nodes by default, to
+// lead and accept writes.
+func (c *testCluster) leader(ids ...string) *testNode {
+	c.t.Helper()
+
+	if len(ids) == 0 {
+		for id := range c.nodes {
+			ids = append(ids, id)
+		}
+	}
+
+	var found *testNode
+	require.Eventually(c.t, func() bool {
+		found = nil
+		for _, id := range ids {
+			tn := c.nodes[id]
+			if !tn.node.IsLeader() {
+				continue
+			}
+			if found != nil {
+				return false
+			}
+			found = tn
+		}
+		return found != nil
+	}, 5*time.Second, 5*time.Millisecond, "a leader should be elected among %v", ids)
+
+	return found
+}
+
+// requireConverged waits for ids, all running nodes by default, to apply
+// the same entries and hold the same keys.
+func (c *testCluster) requireConverged(ids ...string) {
+	c.t.Helper()
+
+	if len(ids) == 0 {
+		for id := range c.nodes {
+			ids = append(ids, id)
+		}
+	}
+
+	require.Eventually(c.t, func() bool {
+		applied := c.nodes[ids[0]].store.AppliedLSN()
+		for _, id := range ids {
+			tn := c.nodes[id]
+			if tn.store.AppliedLSN() != applied || tn.node.Status().CommitIndex != applied {
+				return false
+			}
+		}
+		return applied > 0
+	}, 5*time.Second, 5*time.Millisecond, "nodes %v should apply the same entries", ids)
+
+	want, _ := c.nodes[ids[0]].store.Scan("", "", 0)
+	for _, id := range ids[1:] {
+		got, _ := c.nodes[id].store.Scan("", "", 0)
+		require.Equal(c.t, len(want), len(got), "node %s should hold the same keys", id)
+
+		for i := range want {
+			require.Equal(c.t, want[i].Key, got[i].Key, "node %s", id)
+			require.Equal(c.t, want[i].Value, got[i].Value, "node %s, key %s", id, want[i].Key)
+			require.Equal(c.t, want[i].Version, got[i].Version, "node %s, key %s", id, want[i].Key)
+		}
+	}
+}
+
+func (c *testCluster) others(id string) []string {
+	var ids []string
+	for other := range c.nodes {
+		if other != id {
+			ids = append(ids, other)
+		}
+	}
+	return ids
+}
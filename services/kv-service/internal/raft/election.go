@@ -0,0 +1,199 @@
+package raft
+
+import (
+	"context"
+	"time"
+
+	"github.com/alexey-y-a/go-txlog-microservices/libs/txlog"
+)
+
+// campaign runs a pre-vote and, if a quorum would vote for the node, an
+// election. The pre-vote keeps a node that was cut off from the cluster
+// from raising the term of a leader that is doing fine when it rejoins.
+func (n *Node) campaign() {
+	defer n.wg.Done()
+	defer func() {
+		n.mu.Lock()
+		n.campaigning = false
+		n.mu.Unlock()
+	}()
+
+	n.mu.Lock()
+	if n.role == leader || n.closed {
+		n.mu.Unlock()
+		return
+	}
+	req := VoteRequest{
+		Term:         n.term + 1,
+		CandidateID:  n.id,
+		LastLogIndex: n.entries.lastIndex(),
+		LastLogTerm:  n.entries.lastTerm(),
+		PreVote:      true,
+	}
+	n.mu.Unlock()
+
+	if !n.poll(req) {
+		return
+	}
+
+	// A leader may have been elected while the pre-vote ran.
+	n.mu.Lock()
+	if n.role == leader || n.closed || n.term+1 != req.Term || n.hasLeader() {
+		n.mu.Unlock()
+		return
+	}
+
+	n.role = candidate
+	n.term++
+	n.votedFor = n.id
+	n.leaderID = ""
+	err := n.saveState()
+	if err != nil {
+		n.log.Error().Err(err).Msg("failed to save raft state")
+		n.mu.Unlock()
+		return
+	}
+	n.resetElectionTimer()
+	n.log.Info().Uint64("term", n.term).Msg("starting election")
+
+	req.PreVote = false
+	n.mu.Unlock()
+
+	if !n.poll(req) {
+		return
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.role == candidate && n.term == req.Term && !n.closed {
+		n.becomeLeader()
+	}
+}
+
+// poll asks the other members for their vote and reports whether a quorum,
+// the node included, granted it.
+func (n *Node) poll(req VoteRequest) bool {
+	n.mu.Lock()
+	members := n.members
+	quorum := n.quorum()
+	n.mu.Unlock()
+
+	granted := 1
+	if granted >= quorum {
+		return true
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), n.electionTimeout)
+	defer cancel()
+
+	votes := make(chan bool, len(members))
+	for _, m := range members {
+		if m.ID == n.id {
+			continue
+		}
+
+		go func(m Member) {
+			resp, err := n.transport.RequestVote(ctx, m.Addr, &req)
+			if err != nil {
+				votes <- false
+				return
+			}
+
+			n.mu.Lock()
+			if resp.Term > n.term && !resp.Granted {
+				n.becomeFollower(resp.Term, "")
+			}
+			n.mu.Unlock()
+
+			votes <- resp.Granted
+		}(m)
+	}
+
+	for range len(members) - 1 {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-n.stop:
+			return false
+		case ok := <-votes:
+			if ok {
+				granted++
+			}
+			if granted >= quorum {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// HandleRequestVote answers a vote or pre-vote request of a candidate.
+func (n *Node) HandleRequestVote(req *VoteRequest) (*VoteResponse, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.closed {
+		return nil, ErrClosed
+	}
+
+	resp := &VoteResponse{Term: n.term}
+	if req.Term < n.term {
+		return resp, nil
+	}
+
+	upToDate := req.LastLogTerm > n.entries.lastTerm() ||
+		req.LastLogTerm == n.entries.lastTerm() && req.LastLogIndex >= n.entries.lastIndex()
+
+	if req.PreVote {
+		resp.Granted = upToDate && !n.hasLeader()
+		return resp, nil
+	}
+
+	if req.Term > n.term {
+		n.becomeFollower(req.Term, "")
+		resp.Term = n.term
+	}
+
+	if n.votedFor != "" && n.votedFor != req.CandidateID || !upToDate {
+		return resp, nil
+	}
+
+	n.votedFor = req.CandidateID
+	err := n.saveState()
+	if err != nil {
+		return nil, err
+	}
+	n.resetElectionTimer()
+
+	resp.Granted = true
+	return resp, nil
+}
+
+// hasLeader reports whether the node leads or has heard from the leader
+// within the election timeout; such a node would not vote in an election.
+// Must be called with n.mu held.
+func (n *Node) hasLeader() bool {
+	return n.role == leader ||
+		n.leaderID != "" && time.Since(n.lastContact) < n.electionTimeout
+}
+
+// becomeLeader starts replicating to the other members and appends an
+// empty entry of the new term: entries of earlier terms are committed, and
+// the node accepts writes, only once it is. Must be called with n.mu held.
+func (n *Node) becomeLeader() {
+	n.log.Info().Uint64("term", n.term).Msg("elected leader")
+
+	n.role = leader
+	n.leaderID = n.id
+	n.ready = false
+	n.leaderSince = time.Now()
+	n.peers = make(map[string]*peer)
+	n.setMembers(n.members, n.configIndex)
+
+	_, err := n.appendLocal([]txlog.Event{{Op: txlog.OpNoop}}, waitNoop)
+	if err != nil {
+		n.log.Error().Err(err).Msg("failed to append leader entry")
+		n.becomeFollower(n.term, "")
+	}
+}
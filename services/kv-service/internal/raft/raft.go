@@ -0,0 +1,550 @@
+// Package raft replicates the log of a kv-service store to a cluster of
+// nodes with the Raft consensus algorithm.
+//
+// A Node is a txlog.Log: the store appends its writes to it on the leader,
+// and Append returns once a quorum of the cluster has stored the record and
+// it is committed. Records the node commits on behalf of other leaders are
+// applied to the store through StateMachine. The log is kept in a txlog
+// file whose LSNs are the Raft log indexes and whose records carry their
+// term; batches of the store are replicated and committed as a unit.
+//
+// Besides leader election with pre-vote and log replication with
+// truncation of conflicting suffixes, the node takes snapshots of the store
+// to discard the start of its log, installs the snapshot of the leader when
+// it lags behind the leader's log, and changes the membership of the
+// cluster one node at a time.
+package raft
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"github.com/alexey-y-a/go-txlog-microservices/libs/logger"
+	"github.com/alexey-y-a/go-txlog-microservices/libs/txlog"
+)
+
+const (
+	DefaultElectionTimeout   = time.Second
+	DefaultHeartbeatInterval = 100 * time.Millisecond
+	DefaultSnapshotThreshold = 8192
+)
+
+var (
+	ErrNotLeader           = errors.New("raft: node is not the leader")
+	ErrClosed              = errors.New("raft: node is closed")
+	ErrAlreadyBootstrapped = errors.New("raft: node already has state")
+	ErrConfigChangePending = errors.New("raft: a membership change is in progress")
+	ErrUnknownMember       = errors.New("raft: unknown member")
+)
+
+// NotLeaderError is returned for writes to a node that does not lead the
+// cluster. Leader is the current leader, if the node knows it.
+type NotLeaderError struct {
+	Leader Member
+}
+
+func (e *NotLeaderError) Error() string {
+	if e.Leader.ID == "" {
+		return "raft: node is not the leader, leader unknown"
+	}
+	return fmt.Sprintf("raft: node is not the leader, leader is %s at %s", e.Leader.ID, e.Leader.Addr)
+}
+
+func (e *NotLeaderError) Is(target error) bool {
+	return target == ErrNotLeader
+}
+
+// Member is a node of the cluster. Addr is what the Transport connects to.
+type Member struct {
+	ID   string `json:"id"`
+	Addr string `json:"addr"`
+}
+
+// StateMachine is what the node applies committed records to; it is
+// implemented by *store.Store.
+type StateMachine interface {
+	// ApplyCommitted applies the records of one batch, or a single record,
+	// in log order.
+	ApplyCommitted(events []txlog.Event)
+	// SnapshotState returns the state after the record at index has been
+	// applied, encoded for RestoreState.
+	SnapshotState(index uint64) ([]byte, error)
+	// RestoreState replaces the state with a snapshot taken at index.
+	RestoreState(snapshot []byte, index uint64) error
+	// SetReadOnly is called with false once the node leads the cluster and
+	// has applied every earlier record, and with true when it stops.
+	SetReadOnly(readOnly bool)
+}
+
+type Config struct {
+	// ID identifies the node within the cluster.
+	ID string
+	// Dir holds the log, the snapshot and the term and vote of the node.
+	Dir       string
+	Transport Transport
+
+	// ElectionTimeout is how long a follower waits to hear from a leader
+	// before it starts an election; the actual timeout is randomised
+	// between one and two times this. A leader that has not heard from a
+	// quorum for this long steps down.
+	ElectionTimeout   time.Duration
+	HeartbeatInterval time.Duration
+	// SnapshotThreshold is how many records are applied after a snapshot
+	// before the next one is taken and the log before it discarded.
+	SnapshotThreshold uint64
+
+	LogOptions []txlog.Option
+}
+
+type role int
+
+const (
+	follower role = iota
+	candidate
+	leader
+)
+
+func (r role) String() string {
+	switch r {
+	case candidate:
+		return "candidate"
+	case leader:
+		return "leader"
+	}
+	return "follower"
+}
+
+// Status describes the state of a node.
+type Status struct {
+	ID            string   `json:"id"`
+	Role          string   `json:"role"`
+	Term          uint64   `json:"term"`
+	Leader        string   `json:"leader,omitempty"`
+	LastIndex     uint64   `json:"last_index"`
+	CommitIndex   uint64   `json:"commit_index"`
+	AppliedIndex  uint64   `json:"applied_index"`
+	SnapshotIndex uint64   `json:"snapshot_index"`
+	Members       []Member `json:"members"`
+}
+
+// Node is one member of a Raft cluster.
+type Node struct {
+	id        string
+	dir       string
+	transport Transport
+	log       zerolog.Logger
+
+	electionTimeout   time.Duration
+	heartbeatInterval time.Duration
+	snapshotThreshold uint64
+
+	// snapMu serialises writing the snapshot file with discarding the log
+	// it covers. It is taken before mu.
+	snapMu sync.Mutex
+
+	mu       sync.Mutex
+	role     role
+	term     uint64
+	votedFor string
+	leaderID string
+	// ready is set on a leader once the entry it appended on election has
+	// been applied, and with it every entry of earlier terms.
+	ready bool
+
+	entries *entryLog
+
+	// members is the latest membership in the log, committed or not, as
+	// set by the entry at configIndex.
+	members      []Member
+	configIndex  uint64
+	snapMembers  []Member
+	commitIndex  uint64
+	lastApplied  uint64
+	restore      *snapshot
+	waiters      map[uint64]*waiter
+	peers        map[string]*peer
+	leaderSince  time.Time
+	lastContact  time.Time
+	electionDue  time.Time
+	campaigning  bool
+	stateMachine StateMachine
+
+	applyCh chan struct{}
+	stop    chan struct{}
+	wg      sync.WaitGroup
+	closed  bool
+}
+
+// Open opens the state of a node in cfg.Dir, creating it if needed. The
+// node does nothing until Start.
+func Open(cfg Config) (*Node, error) {
+	if cfg.ID == "" {
+		return nil, errors.New("raft: node ID is required")
+	}
+	if cfg.Transport == nil {
+		return nil, errors.New("raft: transport is required")
+	}
+
+	n := &Node{
+		id:                cfg.ID,
+		dir:               cfg.Dir,
+		transport:         cfg.Transport,
+		log:               logger.L().With().Str("component", "raft").Str("node", cfg.ID).Logger(),
+		electionTimeout:   cfg.ElectionTimeout,
+		heartbeatInterval: cfg.HeartbeatInterval,
+		snapshotThreshold: cfg.SnapshotThreshold,
+		waiters:           make(map[uint64]*waiter),
+		applyCh:           make(chan struct{}, 1),
+		stop:              make(chan struct{}),
+	}
+	if n.electionTimeout <= 0 {
+		n.electionTimeout = DefaultElectionTimeout
+	}
+	if n.heartbeatInterval <= 0 {
+		n.heartbeatInterval = DefaultHeartbeatInterval
+	}
+	if n.snapshotThreshold == 0 {
+		n.snapshotThreshold = DefaultSnapshotThreshold
+	}
+
+	err := os.MkdirAll(cfg.Dir, 0o755)
+	if err != nil {
+		return nil, fmt.Errorf("raft: create dir %q: %w", cfg.Dir, err)
+	}
+
+	state, err := readState(cfg.Dir)
+	if err != nil {
+		return nil, err
+	}
+	n.term, n.votedFor = state.Term, state.VotedFor
+
+	snap, err := readSnapshot(cfg.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	n.entries, err = openEntryLog(cfg.Dir, snap.Index, snap.Term, cfg.LogOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	if snap.Index > 0 {
+		n.snapMembers = snap.Members
+		n.commitIndex = snap.Index
+		n.restore = snap
+	}
+	n.loadConfig()
+
+	return n, nil
+}
+
+// Bootstrap makes members the initial cluster. Every node of a new cluster
+// is bootstrapped with the same members before it is started; nodes added
+// later with AddMember are not bootstrapped at all.
+func (n *Node) Bootstrap(members []Member) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.term > 0 || n.entries.lastIndex() > 0 {
+		return ErrAlreadyBootstrapped
+	}
+
+	value, err := json.Marshal(members)
+	if err != nil {
+		return fmt.Errorf("raft: encode members: %w", err)
+	}
+
+	n.term = 1
+	err = n.saveState()
+	if err != nil {
+		return err
+	}
+
+	err = n.entries.append([]Entry{{Index: 1, Term: 1, Op: txlog.OpConfig, Value: string(value), Time: time.Now()}})
+	if err != nil {
+		return err
+	}
+
+	n.loadConfig()
+	return nil
+}
+
+// Start restores the state machine from the snapshot of the node, if it has
+// one, and starts taking part in the cluster. The state machine starts out
+// read-only.
+func (n *Node) Start(sm StateMachine) {
+	n.mu.Lock()
+	n.stateMachine = sm
+	n.resetElectionTimer()
+	n.mu.Unlock()
+
+	sm.SetReadOnly(true)
+
+	n.wg.Add(2)
+	go n.run()
+	go n.runApply()
+
+	n.signalApply()
+}
+
+// Close stops the node. Pending writes fail with ErrClosed.
+func (n *Node) Close() error {
+	n.mu.Lock()
+	if n.closed {
+		n.mu.Unlock()
+		return nil
+	}
+	n.closed = true
+	n.stepDown()
+	n.failWaiters(0, ErrClosed)
+	close(n.stop)
+	n.mu.Unlock()
+
+	n.wg.Wait()
+
+	return n.entries.close()
+}
+
+// Status returns the current state of the node.
+func (n *Node) Status() Status {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	return Status{
+		ID:            n.id,
+		Role:          n.role.String(),
+		Term:          n.term,
+		Leader:        n.leaderID,
+		LastIndex:     n.entries.lastIndex(),
+		CommitIndex:   n.commitIndex,
+		AppliedIndex:  n.lastApplied,
+		SnapshotIndex: n.entries.snapIndex,
+		Members:       slices.Clone(n.members),
+	}
+}
+
+// Leader returns the leader of the cluster as far as the node knows.
+func (n *Node) Leader() (Member, bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	return n.member(n.leaderID)
+}
+
+// IsLeader reports whether the node leads the cluster and accepts writes.
+func (n *Node) IsLeader() bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	return n.role == leader && n.ready
+}
+
+func (n *Node) member(id string) (Member, bool) {
+	if id == "" {
+		return Member{}, false
+	}
+
+	i := slices.IndexFunc(n.members, func(m Member) bool { return m.ID == id })
+	if i < 0 {
+		return Member{ID: id}, false
+	}
+	return n.members[i], true
+}
+
+func (n *Node) notLeader() error {
+	leader, _ := n.member(n.leaderID)
+	return &NotLeaderError{Leader: leader}
+}
+
+// isVoter reports whether the node is a member of its latest configuration.
+func (n *Node) isVoter() bool {
+	return slices.ContainsFunc(n.members, func(m Member) bool { return m.ID == n.id })
+}
+
+func (n *Node) quorum() int {
+	return len(n.members)/2 + 1
+}
+
+// run drives elections and the leader's check that it still reaches a
+// quorum.
+func (n *Node) run() {
+	defer n.wg.Done()
+
+	ticker := time.NewTicker(n.heartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-n.stop:
+			return
+		case <-ticker.C:
+			n.tick()
+		}
+	}
+}
+
+func (n *Node) tick() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.closed {
+		return
+	}
+
+	now := time.Now()
+
+	if n.role == leader {
+		if now.Sub(n.leaderSince) > n.electionTimeout && !n.hasQuorumContact(now) {
+			n.log.Warn().Uint64("term", n.term).Msg("lost contact with a quorum, stepping down")
+			n.becomeFollower(n.term, "")
+		}
+		return
+	}
+
+	if now.Before(n.electionDue) || n.campaigning || !n.isVoter() {
+		return
+	}
+
+	n.resetElectionTimer()
+	n.campaigning = true
+	n.wg.Add(1)
+	go n.campaign()
+}
+
+func (n *Node) resetElectionTimer() {
+	timeout := n.electionTimeout + rand.N(n.electionTimeout)
+	n.electionDue = time.Now().Add(timeout)
+}
+
+// becomeFollower moves the node to term, which must not be lower than its
+// current term, following leader if known. Must be called with n.mu held.
+func (n *Node) becomeFollower(term uint64, leaderID string) {
+	if term > n.term {
+		n.term = term
+		n.votedFor = ""
+		err := n.saveState()
+		if err != nil {
+			n.log.Error().Err(err).Msg("failed to save raft state")
+		}
+	}
+
+	if n.role == leader {
+		n.stepDown()
+	}
+	n.role = follower
+
+	if leaderID != "" && leaderID != n.leaderID {
+		n.log.Info().Uint64("term", n.term).Str("leader", leaderID).Msg("following new leader")
+	}
+	n.leaderID = leaderID
+}
+
+// stepDown ends the leadership of the node, if it leads. Writes that have
+// not been committed yet fail; they may still be committed by the next
+// leader. Must be called with n.mu held.
+func (n *Node) stepDown() {
+	if n.role != leader {
+		return
+	}
+
+	for _, p := range n.peers {
+		close(p.stop)
+	}
+	n.peers = nil
+
+	if n.ready && n.stateMachine != nil {
+		n.stateMachine.SetReadOnly(true)
+	}
+	n.ready = false
+	n.role = follower
+	n.leaderID = ""
+
+	n.failWaiters(n.commitIndex, n.notLeader())
+}
+
+func (n *Node) saveState() error {
+	return writeState(n.dir, persistentState{Term: n.term, VotedFor: n.votedFor})
+}
+
+// loadConfig sets the membership from the latest configuration entry in the
+// log, or from the snapshot if the log has none. Must be called with n.mu
+// held or before the node is started.
+func (n *Node) loadConfig() {
+	members, index := n.snapMembers, n.entries.snapIndex
+
+	for i := len(n.entries.entries) - 1; i >= 0; i-- {
+		e := n.entries.entries[i]
+		if e.Op != txlog.OpConfig {
+			continue
+		}
+
+		var m []Member
+		err := json.Unmarshal([]byte(e.Value), &m)
+		if err != nil {
+			n.log.Error().Err(err).Uint64("index", e.Index).Msg("invalid membership entry")
+			continue
+		}
+		members, index = m, e.Index
+		break
+	}
+
+	n.setMembers(members, index)
+}
+
+// setMembers makes members the configuration of the node. A leader starts
+// and stops replicating to the nodes that were added or removed.
+func (n *Node) setMembers(members []Member, index uint64) {
+	n.members, n.configIndex = members, index
+
+	if n.role != leader {
+		return
+	}
+
+	for id, p := range n.peers {
+		if !slices.ContainsFunc(members, func(m Member) bool { return m.ID == id }) {
+			close(p.stop)
+			delete(n.peers, id)
+		}
+	}
+
+	for _, m := range members {
+		if m.ID == n.id {
+			continue
+		}
+		if p, ok := n.peers[m.ID]; ok {
+			p.member = m
+			continue
+		}
+		n.startPeer(m)
+	}
+}
+
+// membersAt returns the configuration in effect at index, which must not be
+// before the snapshot.
+func (n *Node) membersAt(index uint64) []Member {
+	members := n.snapMembers
+
+	for _, e := range n.entries.entries {
+		if e.Index > index {
+			break
+		}
+		if e.Op != txlog.OpConfig {
+			continue
+		}
+
+		var m []Member
+		if json.Unmarshal([]byte(e.Value), &m) == nil {
+			members = m
+		}
+	}
+
+	return members
+}
@@ -0,0 +1,266 @@
+package raft
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/alexey-y-a/go-txlog-microservices/libs/txlog"
+	"github.com/alexey-y-a/go-txlog-microservices/services/kv-service/internal/store"
+)
+
+func TestCluster_ReplicatesWrites(t *testing.T) {
+	t.Helper()
+
+	c := newTestCluster(t, 3, Config{})
+	leader := c.leader()
+
+	for i := 0; i < 30; i++ {
+		_, err := leader.store.Set("key"+strconv.Itoa(i%10), strconv.Itoa(i))
+		require.NoError(t, err)
+	}
+
+	lsn, err := leader.store.Apply(store.Batch{
+		{Type: txlog.OpSet, Key: "a", Value: "1"},
+		{Type: txlog.OpDelete, Key: "key3"},
+	})
+	require.NoError(t, err)
+
+	c.requireConverged()
+
+	for _, id := range c.others(leader.id) {
+		follower := c.nodes[id]
+
+		value, ok := follower.store.Get("a")
+		require.True(t, ok, "node %s should apply the batch", id)
+		require.Equal(t, "1", value)
+
+		entry, _ := follower.store.GetEntry("key9")
+		require.Equal(t, lsn-2, entry.Version, "versions should be the indexes of the leader's log")
+
+		_, err = follower.store.Set("a", "2")
+		require.ErrorIs(t, err, store.ErrReadOnly, "a follower should not accept writes")
+
+		_, err = follower.node.Append(txlog.Event{Op: txlog.OpSet, Key: "a", Value: "2"})
+		require.ErrorIs(t, err, ErrNotLeader)
+
+		var notLeader *NotLeaderError
+		require.ErrorAs(t, err, &notLeader)
+		require.Equal(t, leader.id, notLeader.Leader.ID, "a follower should know the leader")
+	}
+}
+
+func TestCluster_Failover(t *testing.T) {
+	t.Helper()
+
+	c := newTestCluster(t, 3, Config{})
+	old := c.leader()
+
+	_, err := old.store.Set("a", "1")
+	require.NoError(t, err)
+	c.requireConverged()
+
+	oldID := old.id
+	c.stop(oldID)
+
+	leader := c.leader()
+	require.NotEqual(t, oldID, leader.id)
+
+	_, err = leader.store.Set("b", "2")
+	require.NoError(t, err, "the remaining quorum should accept writes")
+
+	c.start(oldID, nil)
+	c.requireConverged()
+
+	value, ok := c.nodes[oldID].store.Get("b")
+	require.True(t, ok, "a restarted node should catch up")
+	require.Equal(t, "2", value)
+}
+
+func TestCluster_PartitionedLeader(t *testing.T) {
+	t.Helper()
+
+	c := newTestCluster(t, 5, Config{})
+	old := c.leader()
+
+	_, err := old.store.Set("a", "1")
+	require.NoError(t, err)
+	c.requireConverged()
+
+	// The old leader and one follower are cut off from the majority.
+	minority := []string{old.id, c.others(old.id)[0]}
+	majority := c.others(old.id)[1:]
+	c.net.partition(minority, majority)
+
+	lost := make(chan error, 1)
+	go func() {
+		_, err := old.store.Set("lost", "x")
+		lost <- err
+	}()
+
+	leader := c.leader(majority...)
+	_, err = leader.store.Set("a", "2")
+	require.NoError(t, err, "the majority should elect a leader and accept writes")
+
+	select {
+	case err = <-lost:
+		require.ErrorIs(t, err, ErrNotLeader, "a write to a leader without a quorum should fail")
+	case <-time.After(5 * time.Second):
+		t.Fatal("a write to a leader without a quorum should not hang")
+	}
+	require.False(t, old.node.IsLeader(), "a leader without a quorum should step down")
+
+	c.net.heal()
+	c.requireConverged()
+
+	for id, tn := range c.nodes {
+		_, ok := tn.store.Get("lost")
+		require.False(t, ok, "node %s should drop the uncommitted entry", id)
+
+		value, _ := tn.store.Get("a")
+		require.Equal(t, "2", value, "node %s", id)
+	}
+}
+
+func TestCluster_PreVote(t *testing.T) {
+	t.Helper()
+
+	c := newTestCluster(t, 3, Config{})
+	leader := c.leader()
+	term := leader.node.Status().Term
+
+	follower := c.others(leader.id)[0]
+	c.net.partition([]string{follower})
+	time.Sleep(5 * c.nodes[follower].node.electionTimeout)
+
+	require.Equal(t, term, c.nodes[follower].node.Status().Term, "a cut off node should not raise its term without a quorum")
+
+	c.net.heal()
+	_, err := leader.store.Set("a", "1")
+	require.NoError(t, err)
+	c.requireConverged()
+
+	require.True(t, leader.node.IsLeader(), "a rejoining node should not disrupt the leader")
+	require.Equal(t, term, leader.node.Status().Term)
+}
+
+func TestCluster_InstallSnapshot(t *testing.T) {
+	t.Helper()
+
+	c := newTestCluster(t, 3, Config{SnapshotThreshold: 16})
+	leader := c.leader()
+
+	lagging := c.others(leader.id)[0]
+	c.net.partition([]string{lagging})
+
+	for i := 0; i < 100; i++ {
+		_, err := leader.store.Set("key"+strconv.Itoa(i%20), strconv.Itoa(i))
+		require.NoError(t, err)
+	}
+	_, err := leader.store.Delete("key0")
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		return leader.node.Status().SnapshotIndex > 50
+	}, 5*time.Second, 5*time.Millisecond, "the leader should snapshot and discard its log")
+
+	c.net.heal()
+	c.requireConverged()
+
+	status := c.nodes[lagging].node.Status()
+	require.Greater(t, status.SnapshotIndex, uint64(50), "the lagging node should install the snapshot")
+
+	_, ok := c.nodes[lagging].store.Get("key0")
+	require.False(t, ok)
+
+	// The installed snapshot survives a restart.
+	tn := c.restart(lagging)
+	c.requireConverged()
+
+	value, ok := tn.store.Get("key19")
+	require.True(t, ok)
+	require.Equal(t, "99", value)
+}
+
+func TestCluster_MembershipChange(t *testing.T) {
+	t.Helper()
+
+	c := newTestCluster(t, 3, Config{SnapshotThreshold: 16})
+	leader := c.leader()
+
+	for i := 0; i < 40; i++ {
+		_, err := leader.store.Set("key"+strconv.Itoa(i), "v")
+		require.NoError(t, err)
+	}
+
+	c.start("n4", nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	require.NoError(t, leader.node.AddMember(ctx, Member{ID: "n4", Addr: "n4"}))
+	c.requireConverged()
+	require.Len(t, c.nodes["n4"].node.Status().Members, 4, "the new node should learn the membership")
+
+	// A leader that removes itself hands over to the others.
+	require.NoError(t, leader.node.RemoveMember(ctx, leader.id))
+
+	removed := leader.id
+	next := c.leader(c.others(removed)...)
+	require.False(t, c.nodes[removed].node.IsLeader())
+
+	_, err := next.store.Set("after", "1")
+	require.NoError(t, err, "the remaining members should accept writes")
+
+	err = next.node.RemoveMember(ctx, "n9")
+	require.ErrorIs(t, err, ErrUnknownMember)
+
+	c.stop(removed)
+	c.requireConverged()
+
+	for _, tn := range c.nodes {
+		require.Len(t, tn.node.Status().Members, 3)
+	}
+}
+
+func TestNode_Restart(t *testing.T) {
+	t.Helper()
+
+	c := newTestCluster(t, 1, Config{SnapshotThreshold: 8})
+	leader := c.leader()
+
+	for i := 0; i < 20; i++ {
+		_, err := leader.store.Set("key"+strconv.Itoa(i%5), strconv.Itoa(i))
+		require.NoError(t, err)
+	}
+	_, err := leader.store.Apply(store.Batch{
+		{Type: txlog.OpSet, Key: "x", Value: "1"},
+		{Type: txlog.OpSet, Key: "y", Value: "1"},
+	})
+	require.NoError(t, err)
+
+	before := leader.node.Status()
+	require.Positive(t, before.SnapshotIndex, "the node should have taken a snapshot")
+
+	tn := c.restart(leader.id)
+	c.leader()
+
+	require.Eventually(t, func() bool {
+		return tn.store.AppliedLSN() > before.LastIndex
+	}, 5*time.Second, 5*time.Millisecond, "the node should replay its log after the snapshot")
+
+	require.Equal(t, 7, tn.store.Len())
+	value, _ := tn.store.Get("key4")
+	require.Equal(t, "19", value)
+
+	status := tn.node.Status()
+	require.Greater(t, status.Term, before.Term, "a restarted node should start a new term")
+	require.GreaterOrEqual(t, status.SnapshotIndex, before.SnapshotIndex)
+
+	lsn, err := tn.store.Set("z", "1")
+	require.NoError(t, err)
+	require.Equal(t, status.LastIndex+1, lsn, "indexes should continue after the restart")
+}
@@ -0,0 +1,400 @@
+package raft
+
+import (
+	"context"
+	"slices"
+	"time"
+
+	"github.com/alexey-y-a/go-txlog-microservices/libs/txlog"
+)
+
+// maxAppendEntries bounds the entries of one AppendEntries request; it is
+// exceeded only to send a batch whole.
+const maxAppendEntries = 512
+
+// peer is the replication state of the leader for another member.
+type peer struct {
+	member     Member
+	nextIndex  uint64
+	matchIndex uint64
+	// lastAck is when the member last answered in the current term.
+	lastAck time.Time
+
+	notify chan struct{}
+	stop   chan struct{}
+}
+
+// startPeer starts replicating to m. Must be called with n.mu held by a
+// leader.
+func (n *Node) startPeer(m Member) {
+	p := &peer{
+		member:    m,
+		nextIndex: n.entries.lastIndex() + 1,
+		notify:    make(chan struct{}, 1),
+		stop:      make(chan struct{}),
+	}
+	n.peers[m.ID] = p
+
+	n.wg.Add(1)
+	go n.replicate(p, n.term)
+}
+
+// notifyPeers wakes the replicators up to send new entries. Must be called
+// with n.mu held.
+func (n *Node) notifyPeers() {
+	for _, p := range n.peers {
+		select {
+		case p.notify <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// replicate sends entries, or heartbeats while there are none, to p until
+// the node stops leading in term.
+func (n *Node) replicate(p *peer, term uint64) {
+	defer n.wg.Done()
+
+	ticker := time.NewTicker(n.heartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		more, ok := n.sendTo(p, term)
+		if !ok {
+			return
+		}
+		if more {
+			continue
+		}
+
+		select {
+		case <-p.stop:
+			return
+		case <-p.notify:
+		case <-ticker.C:
+		}
+	}
+}
+
+// sendTo sends p the entries it is missing, or the snapshot if the log no
+// longer has them. It reports whether there is more to send right away and
+// whether the node still leads in term.
+func (n *Node) sendTo(p *peer, term uint64) (more, ok bool) {
+	n.mu.Lock()
+	if n.role != leader || n.term != term {
+		n.mu.Unlock()
+		return false, false
+	}
+
+	if p.nextIndex <= n.entries.snapIndex {
+		n.mu.Unlock()
+		return n.sendSnapshot(p, term)
+	}
+
+	prev := p.nextIndex - 1
+	prevTerm, _ := n.entries.term(prev)
+	req := &AppendRequest{
+		Term:         term,
+		LeaderID:     n.id,
+		PrevLogIndex: prev,
+		PrevLogTerm:  prevTerm,
+		LeaderCommit: n.commitIndex,
+	}
+
+	if last := n.entries.lastIndex(); p.nextIndex <= last {
+		to := n.entries.groupEnd(min(last, prev+maxAppendEntries))
+		req.Entries = slices.Clone(n.entries.slice(p.nextIndex, to))
+	}
+	addr := p.member.Addr
+	n.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), n.electionTimeout)
+	resp, err := n.transport.AppendEntries(ctx, addr, req)
+	cancel()
+	if err != nil {
+		return false, true
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if resp.Term > n.term {
+		n.becomeFollower(resp.Term, "")
+		return false, false
+	}
+	if n.role != leader || n.term != term {
+		return false, false
+	}
+	p.lastAck = time.Now()
+
+	if resp.Success {
+		p.matchIndex = max(p.matchIndex, resp.MatchIndex)
+		p.nextIndex = p.matchIndex + 1
+		n.advanceCommit()
+		return p.nextIndex <= n.entries.lastIndex(), true
+	}
+
+	// Continue from the hint of the follower, at the start of a batch.
+	next := min(resp.ConflictIndex, prev, n.entries.lastIndex()+1)
+	next = max(next, p.matchIndex+1, 1)
+	if next > n.entries.snapIndex+1 {
+		next = n.entries.groupStart(next)
+	}
+	p.nextIndex = next
+
+	return true, true
+}
+
+func (n *Node) sendSnapshot(p *peer, term uint64) (more, ok bool) {
+	snap, err := readSnapshot(n.dir)
+	if err != nil {
+		n.log.Error().Err(err).Msg("failed to read snapshot to send")
+		return false, true
+	}
+
+	n.mu.Lock()
+	addr := p.member.Addr
+	req := &SnapshotRequest{
+		Term:     term,
+		LeaderID: n.id,
+		Index:    snap.Index,
+		LogTerm:  snap.Term,
+		Members:  snap.Members,
+		Data:     snap.Data,
+	}
+	n.mu.Unlock()
+
+	n.log.Info().Str("peer", p.member.ID).Uint64("index", snap.Index).Msg("sending snapshot")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*n.electionTimeout)
+	resp, err := n.transport.InstallSnapshot(ctx, addr, req)
+	cancel()
+	if err != nil {
+		return false, true
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if resp.Term > n.term {
+		n.becomeFollower(resp.Term, "")
+		return false, false
+	}
+	if n.role != leader || n.term != term {
+		return false, false
+	}
+
+	p.lastAck = time.Now()
+	p.matchIndex = max(p.matchIndex, snap.Index)
+	p.nextIndex = p.matchIndex + 1
+
+	n.advanceCommit()
+	return p.nextIndex <= n.entries.lastIndex(), true
+}
+
+// advanceCommit commits the entries a quorum has stored, once one of them
+// is from the current term. A leader that has committed its own removal
+// from the cluster steps down. Must be called with n.mu held by a leader.
+func (n *Node) advanceCommit() {
+	var matches []uint64
+	for _, m := range n.members {
+		if m.ID == n.id {
+			matches = append(matches, n.entries.lastIndex())
+		} else if p, ok := n.peers[m.ID]; ok {
+			matches = append(matches, p.matchIndex)
+		}
+	}
+
+	if len(matches) < n.quorum() {
+		return
+	}
+
+	slices.Sort(matches)
+	slices.Reverse(matches)
+	index := matches[n.quorum()-1]
+
+	if index > n.commitIndex {
+		term, _ := n.entries.term(index)
+		if term == n.term {
+			n.commitIndex = index
+			n.signalApply()
+		}
+	}
+
+	if n.configIndex <= n.commitIndex && !n.isVoter() {
+		n.log.Info().Msg("removed from the cluster, stepping down")
+		n.stepDown()
+	}
+}
+
+// hasQuorumContact reports whether a quorum of the members, the leader
+// included, has answered within the election timeout. Must be called with
+// n.mu held by a leader.
+func (n *Node) hasQuorumContact(now time.Time) bool {
+	count := 0
+	for _, m := range n.members {
+		if m.ID == n.id {
+			count++
+		} else if p, ok := n.peers[m.ID]; ok && now.Sub(p.lastAck) <= n.electionTimeout {
+			count++
+		}
+	}
+	return count >= n.quorum()
+}
+
+// HandleAppendEntries stores the entries a leader sends, after dropping any
+// entries of the node that conflict with them.
+func (n *Node) HandleAppendEntries(req *AppendRequest) (*AppendResponse, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.closed {
+		return nil, ErrClosed
+	}
+
+	resp := &AppendResponse{Term: n.term}
+	if req.Term < n.term {
+		return resp, nil
+	}
+
+	n.heardFromLeader(req.Term, req.LeaderID)
+	resp.Term = n.term
+
+	prev, prevTerm, entries := req.PrevLogIndex, req.PrevLogTerm, req.Entries
+
+	// Entries the snapshot covers are committed, so they match.
+	if snapIndex := n.entries.snapIndex; prev < snapIndex {
+		skip := min(snapIndex-prev, uint64(len(entries)))
+		entries = entries[skip:]
+		prev, prevTerm = snapIndex, n.entries.snapTerm
+	}
+
+	if prev > n.entries.lastIndex() {
+		resp.ConflictIndex = n.entries.lastIndex() + 1
+		return resp, nil
+	}
+
+	if term, _ := n.entries.term(prev); term != prevTerm {
+		index := prev
+		for index > n.entries.snapIndex+1 {
+			t, _ := n.entries.term(index - 1)
+			if t != term {
+				break
+			}
+			index--
+		}
+		resp.ConflictIndex = index
+		return resp, nil
+	}
+
+	for len(entries) > 0 && entries[0].Index <= n.entries.lastIndex() {
+		term, _ := n.entries.term(entries[0].Index)
+		if term != entries[0].Term {
+			err := n.truncateAfter(entries[0].Index - 1)
+			if err != nil {
+				return nil, err
+			}
+			break
+		}
+		entries = entries[1:]
+	}
+
+	if len(entries) > 0 {
+		err := n.entries.append(entries)
+		if err != nil {
+			return nil, err
+		}
+		if slices.ContainsFunc(entries, func(e Entry) bool { return e.Op == txlog.OpConfig }) {
+			n.loadConfig()
+		}
+	}
+
+	resp.Success = true
+	resp.MatchIndex = req.PrevLogIndex + uint64(len(req.Entries))
+
+	if req.LeaderCommit > n.commitIndex {
+		n.commitIndex = max(n.commitIndex, min(req.LeaderCommit, resp.MatchIndex))
+		n.signalApply()
+	}
+
+	return resp, nil
+}
+
+// truncateAfter drops the entries after index and the membership they set.
+// Must be called with n.mu held.
+func (n *Node) truncateAfter(index uint64) error {
+	n.log.Info().Uint64("index", index).Uint64("last_index", n.entries.lastIndex()).Msg("truncating conflicting log entries")
+
+	err := n.entries.truncateAfter(index)
+	if err != nil {
+		return err
+	}
+
+	if n.configIndex > index {
+		n.loadConfig()
+	}
+	return nil
+}
+
+// HandleInstallSnapshot replaces the state of the node with the snapshot of
+// the leader. The log after the snapshot is kept if it agrees with it.
+func (n *Node) HandleInstallSnapshot(req *SnapshotRequest) (*SnapshotResponse, error) {
+	n.snapMu.Lock()
+	defer n.snapMu.Unlock()
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.closed {
+		return nil, ErrClosed
+	}
+
+	resp := &SnapshotResponse{Term: n.term}
+	if req.Term < n.term {
+		return resp, nil
+	}
+
+	n.heardFromLeader(req.Term, req.LeaderID)
+	resp.Term = n.term
+
+	if req.Index <= n.commitIndex {
+		return resp, nil
+	}
+
+	n.log.Info().Uint64("index", req.Index).Str("leader", req.LeaderID).Msg("installing snapshot")
+
+	snap := &snapshot{Index: req.Index, Term: req.LogTerm, Members: req.Members, Data: req.Data}
+	err := writeSnapshot(n.dir, snap)
+	if err != nil {
+		return nil, err
+	}
+
+	if term, ok := n.entries.term(req.Index); ok && term == req.LogTerm {
+		err = n.entries.compact(req.Index, req.LogTerm)
+	} else {
+		err = n.entries.reset(req.Index, req.LogTerm)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	n.snapMembers = req.Members
+	n.loadConfig()
+
+	n.commitIndex = req.Index
+	n.restore = snap
+	n.signalApply()
+
+	return resp, nil
+}
+
+// heardFromLeader follows the leader of term, which is not lower than the
+// current term. Must be called with n.mu held.
+func (n *Node) heardFromLeader(term uint64, leaderID string) {
+	if term > n.term || n.role != follower || n.leaderID != leaderID {
+		n.becomeFollower(term, leaderID)
+	}
+
+	n.lastContact = time.Now()
+	n.resetElectionTimer()
+}
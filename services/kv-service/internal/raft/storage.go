@@ -0,0 +1,416 @@
+package raft
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+
+	"github.com/alexey-y-a/go-txlog-microservices/libs/txlog"
+)
+
+const (
+	logFile      = "raft.log"
+	stateFile    = "state.json"
+	snapshotFile = "snapshot"
+
+	snapshotVersion = 1
+)
+
+var (
+	snapshotMagic = [4]byte{'R', 'F', 'S', 'N'}
+	crcTable      = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// persistentState is what a node must remember across restarts besides its
+// log, so that it never votes twice in a term.
+type persistentState struct {
+	Term     uint64 `json:"term"`
+	VotedFor string `json:"voted_for,omitempty"`
+}
+
+func readState(dir string) (persistentState, error) {
+	var state persistentState
+
+	data, err := os.ReadFile(filepath.Join(dir, stateFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return state, nil
+	}
+	if err != nil {
+		return state, fmt.Errorf("raft: read state: %w", err)
+	}
+
+	err = json.Unmarshal(data, &state)
+	if err != nil {
+		return state, fmt.Errorf("raft: decode state: %w", err)
+	}
+	return state, nil
+}
+
+func writeState(dir string, state persistentState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("raft: encode state: %w", err)
+	}
+	return writeFileAtomic(dir, stateFile, data)
+}
+
+// snapshot is the state of the store at Index, the last entry it covers,
+// together with what is needed to continue the log after it.
+type snapshot struct {
+	Index   uint64
+	Term    uint64
+	Members []Member
+	Data    []byte
+}
+
+// encode lays out the snapshot as "RFSN", version byte, 3 reserved bytes,
+// uvarint index and term, the uvarint-length-prefixed members as JSON and
+// state machine data, then the CRC32C of everything before it.
+func (s *snapshot) encode() ([]byte, error) {
+	members, err := json.Marshal(s.Members)
+	if err != nil {
+		return nil, fmt.Errorf("raft: encode snapshot members: %w", err)
+	}
+
+	buf := append([]byte(nil), snapshotMagic[:]...)
+	buf = append(buf, snapshotVersion, 0, 0, 0)
+	buf = binary.AppendUvarint(buf, s.Index)
+	buf = binary.AppendUvarint(buf, s.Term)
+	buf = binary.AppendUvarint(buf, uint64(len(members)))
+	buf = append(buf, members...)
+	buf = binary.AppendUvarint(buf, uint64(len(s.Data)))
+	buf = append(buf, s.Data...)
+
+	return binary.LittleEndian.AppendUint32(buf, crc32.Checksum(buf, crcTable)), nil
+}
+
+func decodeSnapshot(buf []byte) (*snapshot, error) {
+	if len(buf) < len(snapshotMagic)+4+4 || !bytes.HasPrefix(buf, snapshotMagic[:]) {
+		return nil, errors.New("raft: not a snapshot file")
+	}
+
+	body, sum := buf[:len(buf)-4], binary.LittleEndian.Uint32(buf[len(buf)-4:])
+	if crc32.Checksum(body, crcTable) != sum {
+		return nil, errors.New("raft: snapshot checksum mismatch")
+	}
+
+	if body[4] != snapshotVersion {
+		return nil, fmt.Errorf("raft: unsupported snapshot version %d", body[4])
+	}
+
+	rd := bytes.NewReader(body[8:])
+
+	var (
+		s   snapshot
+		err error
+	)
+	s.Index, err = binary.ReadUvarint(rd)
+	if err == nil {
+		s.Term, err = binary.ReadUvarint(rd)
+	}
+	if err != nil {
+		return nil, errors.New("raft: invalid snapshot header")
+	}
+
+	members, err := readChunk(rd)
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(members, &s.Members)
+	if err != nil {
+		return nil, fmt.Errorf("raft: decode snapshot members: %w", err)
+	}
+
+	s.Data, err = readChunk(rd)
+	if err != nil {
+		return nil, err
+	}
+
+	if rd.Len() != 0 {
+		return nil, errors.New("raft: trailing data in snapshot")
+	}
+	return &s, nil
+}
+
+func readChunk(rd *bytes.Reader) ([]byte, error) {
+	n, err := binary.ReadUvarint(rd)
+	if err != nil || n > uint64(rd.Len()) {
+		return nil, errors.New("raft: invalid snapshot chunk")
+	}
+
+	b := make([]byte, n)
+	_, err = rd.Read(b)
+	if err != nil && n > 0 {
+		return nil, errors.New("raft: invalid snapshot chunk")
+	}
+	return b, nil
+}
+
+// readSnapshot returns the snapshot in dir, an empty one if there is none.
+func readSnapshot(dir string) (*snapshot, error) {
+	buf, err := os.ReadFile(filepath.Join(dir, snapshotFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return &snapshot{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("raft: read snapshot: %w", err)
+	}
+
+	return decodeSnapshot(buf)
+}
+
+func writeSnapshot(dir string, s *snapshot) error {
+	buf, err := s.encode()
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(dir, snapshotFile, buf)
+}
+
+func writeFileAtomic(dir, name string, data []byte) error {
+	path := filepath.Join(dir, name)
+	tmpPath := path + ".tmp"
+
+	f, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o644)
+	if err != nil {
+		return fmt.Errorf("raft: create %s: %w", name, err)
+	}
+
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("raft: write %s: %w", name, err)
+	}
+
+	err = os.Rename(tmpPath, path)
+	if err != nil {
+		return fmt.Errorf("raft: rename %s: %w", name, err)
+	}
+
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("raft: open dir %q: %w", dir, err)
+	}
+	defer d.Close()
+
+	err = d.Sync()
+	if err != nil {
+		return fmt.Errorf("raft: sync dir %q: %w", dir, err)
+	}
+	return nil
+}
+
+// entryLog is the Raft log: the entries after the snapshot, kept in memory
+// and in a txlog file whose LSNs are their indexes.
+type entryLog struct {
+	file      *txlog.FileLog
+	snapIndex uint64
+	snapTerm  uint64
+	entries   []Entry
+}
+
+// openEntryLog loads the log in dir that continues the snapshot at
+// snapIndex. Entries the snapshot covers are skipped; entries after it are
+// dropped if the log does not agree with the snapshot on the term of
+// snapIndex, as when a crash interrupted a snapshot install.
+func openEntryLog(dir string, snapIndex, snapTerm uint64, opts []txlog.Option) (*entryLog, error) {
+	path := filepath.Join(dir, logFile)
+
+	file, err := txlog.NewFileLog(path, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &entryLog{file: file, snapIndex: snapIndex, snapTerm: snapTerm}
+
+	err = l.load(path)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *entryLog) load(path string) error {
+	r, err := txlog.OpenReader(path)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	conflict := false
+	for r.Next() {
+		e := r.Event()
+
+		switch {
+		case e.LSN < l.snapIndex:
+			continue
+		case e.LSN == l.snapIndex:
+			conflict = e.Term != l.snapTerm
+			continue
+		case conflict:
+			continue
+		case e.LSN != l.lastIndex()+1:
+			return fmt.Errorf("raft: log entry %d follows %d", e.LSN, l.lastIndex())
+		}
+
+		l.entries = append(l.entries, newEntry(e, r.Continued()))
+	}
+
+	err = r.Err()
+	if err != nil {
+		return fmt.Errorf("raft: read log: %w", err)
+	}
+
+	if conflict {
+		return l.reset(l.snapIndex, l.snapTerm)
+	}
+	if l.file.LastLSN() < l.snapIndex {
+		return l.file.TruncateAfter(l.snapIndex)
+	}
+	return nil
+}
+
+func (l *entryLog) lastIndex() uint64 {
+	return l.snapIndex + uint64(len(l.entries))
+}
+
+func (l *entryLog) lastTerm() uint64 {
+	if len(l.entries) == 0 {
+		return l.snapTerm
+	}
+	return l.entries[len(l.entries)-1].Term
+}
+
+// term returns the term of the entry at index, if the log has it or it is
+// the last entry of the snapshot.
+func (l *entryLog) term(index uint64) (uint64, bool) {
+	if index == l.snapIndex {
+		return l.snapTerm, true
+	}
+	if index < l.snapIndex || index > l.lastIndex() {
+		return 0, false
+	}
+	return l.at(index).Term, true
+}
+
+// at returns the entry at index, which must be in the log.
+func (l *entryLog) at(index uint64) Entry {
+	return l.entries[index-l.snapIndex-1]
+}
+
+// slice returns the entries from index from to index to, both in the log.
+func (l *entryLog) slice(from, to uint64) []Entry {
+	return l.entries[from-l.snapIndex-1 : to-l.snapIndex]
+}
+
+// groupEnd returns the index of the last entry of the batch the entry at
+// index belongs to.
+func (l *entryLog) groupEnd(index uint64) uint64 {
+	for index < l.lastIndex() && l.at(index).Continued {
+		index++
+	}
+	return index
+}
+
+// groupStart returns the index of the first entry of the batch the entry at
+// index belongs to, not going back into the snapshot.
+func (l *entryLog) groupStart(index uint64) uint64 {
+	for index-1 > l.snapIndex && l.at(index-1).Continued {
+		index--
+	}
+	return index
+}
+
+// append writes entries, which hold the next indexes, to the file. Entries
+// of a batch are written together.
+func (l *entryLog) append(entries []Entry) error {
+	for len(entries) > 0 {
+		n := 1
+		for n < len(entries) && entries[n-1].Continued {
+			n++
+		}
+
+		group := entries[:n]
+		entries = entries[n:]
+
+		var (
+			last uint64
+			err  error
+		)
+		if len(group) == 1 {
+			last, err = l.file.Append(group[0].event())
+		} else {
+			events := make([]txlog.Event, len(group))
+			for i, e := range group {
+				events[i] = e.event()
+			}
+			last, err = l.file.AppendBatch(events)
+		}
+		if err != nil {
+			return fmt.Errorf("raft: append to log: %w", err)
+		}
+
+		if want := group[len(group)-1].Index; last != want {
+			return fmt.Errorf("raft: log assigned index %d to entry %d", last, want)
+		}
+		l.entries = append(l.entries, group...)
+	}
+
+	return nil
+}
+
+// truncateAfter removes the entries after index.
+func (l *entryLog) truncateAfter(index uint64) error {
+	err := l.file.TruncateAfter(index)
+	if err != nil {
+		return fmt.Errorf("raft: truncate log: %w", err)
+	}
+
+	l.entries = l.entries[:index-l.snapIndex]
+	return nil
+}
+
+// compact discards the entries up to index, which a snapshot now covers.
+func (l *entryLog) compact(index, term uint64) error {
+	err := l.file.DiscardBefore(index + 1)
+	if err != nil {
+		return fmt.Errorf("raft: discard log: %w", err)
+	}
+
+	l.entries = append([]Entry(nil), l.entries[index-l.snapIndex:]...)
+	l.snapIndex, l.snapTerm = index, term
+	return nil
+}
+
+// reset discards the whole log, which continues from a snapshot at index.
+func (l *entryLog) reset(index, term uint64) error {
+	err := l.file.DiscardBefore(l.file.LastLSN() + 1)
+	if err == nil {
+		err = l.file.TruncateAfter(index)
+	}
+	if err != nil {
+		return fmt.Errorf("raft: reset log: %w", err)
+	}
+
+	l.entries = nil
+	l.snapIndex, l.snapTerm = index, term
+	return nil
+}
+
+func (l *entryLog) close() error {
+	return l.file.Close()
+}
@@ -0,0 +1,211 @@
+package raft
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/alexey-y-a/go-txlog-microservices/libs/txlog"
+)
+
+// Paths of the endpoints NewHandler serves and HTTPTransport calls.
+const (
+	VotePath     = "/raft/vote"
+	AppendPath   = "/raft/append"
+	SnapshotPath = "/raft/snapshot"
+)
+
+// Entry is an entry of the Raft log: a record of the store, or a txlog.OpNoop
+// or txlog.OpConfig entry of the node itself.
+type Entry struct {
+	Index     uint64    `json:"index"`
+	Term      uint64    `json:"term"`
+	Op        string    `json:"op"`
+	Key       string    `json:"key,omitempty"`
+	Value     string    `json:"value,omitempty"`
+	Time      time.Time `json:"time,omitzero"`
+	ExpiresAt time.Time `json:"expires_at,omitzero"`
+	Stamp     uint64    `json:"stamp,omitempty"`
+	// Continued is set on every entry of a batch but the last.
+	Continued bool `json:"continued,omitempty"`
+}
+
+func newEntry(e txlog.Event, continued bool) Entry {
+	return Entry{
+		Index:     e.LSN,
+		Term:      e.Term,
+		Op:        e.Op,
+		Key:       e.Key,
+		Value:     e.Value,
+		Time:      e.Time,
+		ExpiresAt: e.ExpiresAt,
+		Stamp:     e.Stamp,
+		Continued: continued,
+	}
+}
+
+func (e Entry) event() txlog.Event {
+	return txlog.Event{
+		LSN:       e.Index,
+		Term:      e.Term,
+		Op:        e.Op,
+		Key:       e.Key,
+		Value:     e.Value,
+		Time:      e.Time,
+		ExpiresAt: e.ExpiresAt,
+		Stamp:     e.Stamp,
+	}
+}
+
+type VoteRequest struct {
+	Term         uint64 `json:"term"`
+	CandidateID  string `json:"candidate_id"`
+	LastLogIndex uint64 `json:"last_log_index"`
+	LastLogTerm  uint64 `json:"last_log_term"`
+	// PreVote asks whether the vote would be granted in Term, without the
+	// voter moving to it.
+	PreVote bool `json:"pre_vote,omitempty"`
+}
+
+type VoteResponse struct {
+	Term    uint64 `json:"term"`
+	Granted bool   `json:"granted"`
+}
+
+type AppendRequest struct {
+	Term         uint64  `json:"term"`
+	LeaderID     string  `json:"leader_id"`
+	PrevLogIndex uint64  `json:"prev_log_index"`
+	PrevLogTerm  uint64  `json:"prev_log_term"`
+	Entries      []Entry `json:"entries,omitempty"`
+	LeaderCommit uint64  `json:"leader_commit"`
+}
+
+type AppendResponse struct {
+	Term    uint64 `json:"term"`
+	Success bool   `json:"success"`
+	// MatchIndex is the last index known to match the leader on success.
+	MatchIndex uint64 `json:"match_index,omitempty"`
+	// ConflictIndex is where the leader should continue on failure: the
+	// first entry of the conflicting term, or the end of a short log.
+	ConflictIndex uint64 `json:"conflict_index,omitempty"`
+}
+
+type SnapshotRequest struct {
+	Term     uint64   `json:"term"`
+	LeaderID string   `json:"leader_id"`
+	Index    uint64   `json:"index"`
+	LogTerm  uint64   `json:"log_term"`
+	Members  []Member `json:"members"`
+	Data     []byte   `json:"data"`
+}
+
+type SnapshotResponse struct {
+	Term uint64 `json:"term"`
+}
+
+// Transport carries the RPCs of a node to the member at addr.
+type Transport interface {
+	RequestVote(ctx context.Context, addr string, req *VoteRequest) (*VoteResponse, error)
+	AppendEntries(ctx context.Context, addr string, req *AppendRequest) (*AppendResponse, error)
+	InstallSnapshot(ctx context.Context, addr string, req *SnapshotRequest) (*SnapshotResponse, error)
+}
+
+// HTTPTransport sends RPCs as JSON over HTTP to members whose Addr is the
+// base URL of their kv-service.
+type HTTPTransport struct {
+	client *http.Client
+}
+
+func NewHTTPTransport(client *http.Client) *HTTPTransport {
+	if client == nil {
+		client = &http.Client{}
+	}
+	return &HTTPTransport{client: client}
+}
+
+func (t *HTTPTransport) RequestVote(ctx context.Context, addr string, req *VoteRequest) (*VoteResponse, error) {
+	var resp VoteResponse
+	return &resp, t.call(ctx, addr+VotePath, req, &resp)
+}
+
+func (t *HTTPTransport) AppendEntries(ctx context.Context, addr string, req *AppendRequest) (*AppendResponse, error) {
+	var resp AppendResponse
+	return &resp, t.call(ctx, addr+AppendPath, req, &resp)
+}
+
+func (t *HTTPTransport) InstallSnapshot(ctx context.Context, addr string, req *SnapshotRequest) (*SnapshotResponse, error) {
+	var resp SnapshotResponse
+	return &resp, t.call(ctx, addr+SnapshotPath, req, &resp)
+}
+
+func (t *HTTPTransport) call(ctx context.Context, url string, req, resp any) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return fmt.Errorf("raft: encode request: %w", err)
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("raft: build request: %w", err)
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	httpResp, err := t.client.Do(httpReq)
+	if err != nil {
+		return fmt.Errorf("raft: send request: %w", err)
+	}
+	defer httpResp.Body.Close()
+
+	if httpResp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(httpResp.Body, 4096))
+		return fmt.Errorf("raft: %s responded %s: %s", url, httpResp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	err = json.NewDecoder(httpResp.Body).Decode(resp)
+	if err != nil {
+		return fmt.Errorf("raft: decode response: %w", err)
+	}
+	return nil
+}
+
+// NewHandler serves the RPCs of n for HTTPTransport.
+func NewHandler(n *Node) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("POST "+VotePath, func(w http.ResponseWriter, r *http.Request) {
+		serveRPC(w, r, n.HandleRequestVote)
+	})
+	mux.HandleFunc("POST "+AppendPath, func(w http.ResponseWriter, r *http.Request) {
+		serveRPC(w, r, n.HandleAppendEntries)
+	})
+	mux.HandleFunc("POST "+SnapshotPath, func(w http.ResponseWriter, r *http.Request) {
+		serveRPC(w, r, n.HandleInstallSnapshot)
+	})
+
+	return mux
+}
+
+func serveRPC[Req, Resp any](w http.ResponseWriter, r *http.Request, handle func(*Req) (*Resp, error)) {
+	var req Req
+
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	resp, err := handle(&req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
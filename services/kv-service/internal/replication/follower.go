@@ -0,0 +1,208 @@
+package replication
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/alexey-y-a/go-txlog-microservices/libs/logger"
+	"github.com/alexey-y-a/go-txlog-microservices/libs/txlog"
+	kvmetrics "github.com/alexey-y-a/go-txlog-microservices/services/kv-service/internal/metrics"
+	"github.com/alexey-y-a/go-txlog-microservices/services/kv-service/internal/store"
+)
+
+const (
+	defaultRetryInterval = time.Second
+
+	// defaultIdleTimeout is how long a follower waits for a message,
+	// heartbeats included, before it reconnects.
+	defaultIdleTimeout = 5 * defaultHeartbeat
+
+	// maxMessageSize bounds one line of the stream: a record with the
+	// largest key and value, escaped.
+	maxMessageSize = 1 << 20
+)
+
+// Follower copies the log of a leader into a store. The store keeps the
+// leader's LSNs, so a restarted follower resumes after the last record it
+// applied.
+type Follower struct {
+	leader string
+	store  *store.Store
+	client *http.Client
+
+	retryInterval time.Duration
+	idleTimeout   time.Duration
+
+	leaderLSN atomic.Uint64
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// NewFollower returns a Follower that streams the log of the leader at the
+// base URL leader into s.
+func NewFollower(leader string, s *store.Store) *Follower {
+	return &Follower{
+		leader:        strings.TrimSuffix(leader, "/"),
+		store:         s,
+		client:        &http.Client{},
+		retryInterval: defaultRetryInterval,
+		idleTimeout:   defaultIdleTimeout,
+	}
+}
+
+// Start connects to the leader in the background and reconnects whenever
+// the stream ends, until Stop.
+func (f *Follower) Start() {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	f.cancel = cancel
+	f.done = make(chan struct{})
+
+	go f.run(ctx)
+}
+
+// Stop disconnects from the leader and waits for the last record to be
+// applied.
+func (f *Follower) Stop() {
+	if f.cancel == nil {
+		return
+	}
+
+	f.cancel()
+	<-f.done
+}
+
+// Lag returns how many records of the leader the follower has not applied
+// yet, as of the last message from the leader.
+func (f *Follower) Lag() uint64 {
+	leader, applied := f.leaderLSN.Load(), f.store.AppliedLSN()
+	if leader <= applied {
+		return 0
+	}
+	return leader - applied
+}
+
+func (f *Follower) run(ctx context.Context) {
+	defer close(f.done)
+
+	log := logger.L().With().
+		Str("component", "replication").
+		Str("leader", f.leader).
+		Logger()
+
+	for {
+		err := f.follow(ctx)
+		kvmetrics.SetReplicationConnected(false)
+
+		if ctx.Err() != nil {
+			return
+		}
+
+		if errors.Is(err, ErrResyncRequired) {
+			log.Error().Err(err).
+				Uint64("applied_lsn", f.store.AppliedLSN()).
+				Msg("leader cannot resume replication; remove the follower data to copy the log again")
+		} else {
+			log.Warn().Err(err).Msg("replication stream ended")
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(f.retryInterval):
+		}
+	}
+}
+
+// follow streams the log of the leader from the last applied record until
+// the stream ends.
+func (f *Follower) follow(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// A leader that stops sending heartbeats is given up on.
+	idle := time.AfterFunc(f.idleTimeout, cancel)
+	defer idle.Stop()
+
+	from := f.store.AppliedLSN()
+	url := f.leader + StreamPath + "?from=" + strconv.FormatUint(from, 10)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return fmt.Errorf("replication: build request: %w", err)
+	}
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("replication: connect to leader: %w", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusGone:
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return leaderError(strings.TrimSpace(string(body)))
+	default:
+		return fmt.Errorf("replication: leader responded %s", resp.Status)
+	}
+
+	kvmetrics.SetReplicationConnected(true)
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), maxMessageSize)
+
+	// The records of a batch are held back until its last one arrives; a
+	// stream that ends in the middle of a batch leaves none of it applied.
+	var batch []txlog.Event
+
+	for scanner.Scan() {
+		idle.Reset(f.idleTimeout)
+
+		var m message
+		err = json.Unmarshal(scanner.Bytes(), &m)
+		if err != nil {
+			return fmt.Errorf("replication: decode message: %w", err)
+		}
+
+		if m.Error != "" {
+			return leaderError(m.Error)
+		}
+
+		if m.Event != nil {
+			batch = append(batch, m.Event.txlogEvent())
+			if m.Event.Continued {
+				continue
+			}
+
+			if len(batch) == 1 {
+				err = f.store.ApplyReplicated(batch[0])
+			} else {
+				err = f.store.ApplyReplicatedBatch(batch)
+			}
+			batch = batch[:0]
+			if err != nil {
+				return err
+			}
+		}
+
+		f.leaderLSN.Store(m.LeaderLSN)
+		kvmetrics.SetReplicationLag(f.Lag())
+	}
+
+	err = scanner.Err()
+	if err != nil {
+		return fmt.Errorf("replication: read stream: %w", err)
+	}
+	return io.ErrUnexpectedEOF
+}
@@ -0,0 +1,276 @@
+package replication
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/alexey-y-a/go-txlog-microservices/libs/logger"
+	"github.com/alexey-y-a/go-txlog-microservices/libs/txlog"
+	kvmetrics "github.com/alexey-y-a/go-txlog-microservices/services/kv-service/internal/metrics"
+	"github.com/alexey-y-a/go-txlog-microservices/services/kv-service/internal/store"
+)
+
+const (
+	// subscriptionBuffer is how many records a follower may lag behind the
+	// live writes before its stream is dropped.
+	subscriptionBuffer = 4096
+
+	defaultHeartbeat = time.Second
+)
+
+// Leader serves the log of a store to followers.
+type Leader struct {
+	store   *store.Store
+	logPath string
+
+	heartbeat time.Duration
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewLeader returns a Leader for s, whose log is the file or segment
+// directory at logPath.
+func NewLeader(s *store.Store, logPath string) *Leader {
+	return &Leader{
+		store:     s,
+		logPath:   logPath,
+		heartbeat: defaultHeartbeat,
+		done:      make(chan struct{}),
+	}
+}
+
+// Close ends the open streams. It is meant for http.Server.RegisterOnShutdown,
+// since Shutdown does not wait for streaming handlers on its own.
+func (l *Leader) Close() {
+	l.closeOnce.Do(func() {
+		close(l.done)
+	})
+}
+
+// ServeHTTP streams the log from the from query parameter onwards, or only
+// the records applied from now on if it is FromLatest.
+func (l *Leader) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	var from uint64
+	latest := false
+	if v := r.URL.Query().Get("from"); v == FromLatest {
+		latest = true
+	} else if v != "" {
+		var err error
+		from, err = strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			http.Error(w, "invalid from", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Subscribing before the log is opened makes the records written in
+	// between show up in both, rather than in neither.
+	sub := l.store.Subscribe(subscriptionBuffer)
+	defer sub.Close()
+
+	// Records are applied before they are handed to subscriptions, so the
+	// ones applied before this point are all visible in the store already.
+	if latest {
+		from = l.store.AppliedLSN()
+	}
+
+	log := logger.L().With().
+		Str("component", "replication").
+		Str("follower", r.RemoteAddr).
+		Uint64("from", from).
+		Logger()
+
+	// A follower ahead of the leader has records the leader never wrote.
+	if applied := l.store.AppliedLSN(); from > applied {
+		http.Error(w, fmt.Sprintf("%v: leader is at %d", ErrResyncRequired, applied), http.StatusGone)
+		return
+	}
+
+	var reader *txlog.Reader
+	if !latest {
+		var err error
+		reader, err = l.openLog(from)
+		if errors.Is(err, txlog.ErrLogTruncated) {
+			http.Error(w, err.Error(), http.StatusGone)
+			return
+		}
+		if err != nil {
+			log.Error().Err(err).Msg("failed to open log for replication")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		defer reader.Close()
+	}
+
+	kvmetrics.AddReplicationFollowers(1)
+	defer kvmetrics.AddReplicationFollowers(-1)
+
+	log.Info().Msg("follower connected")
+
+	s := stream{
+		rc:    http.NewResponseController(w),
+		enc:   json.NewEncoder(w),
+		store: l.store,
+		last:  from,
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+
+	// A stream from the latest record starts with a heartbeat, which tells
+	// the follower where it starts.
+	var err error
+	if latest {
+		err = s.send(message{})
+		if err == nil {
+			err = s.rc.Flush()
+		}
+	} else {
+		err = s.catchUp(reader, from > 0)
+	}
+	if err == nil {
+		err = s.follow(r, sub, l.heartbeat, l.done)
+	}
+
+	if errors.Is(err, ErrResyncRequired) {
+		s.send(message{Error: err.Error()})
+	}
+	log.Info().Err(err).Uint64("last_lsn", s.last).Msg("follower disconnected")
+}
+
+// openLog opens the log for a follower at from. A follower copying the log
+// from the start needs all of it, so a segmented log must not have been
+// truncated.
+func (l *Leader) openLog(from uint64) (*txlog.Reader, error) {
+	info, err := os.Stat(l.logPath)
+	if err != nil {
+		return nil, err
+	}
+
+	if info.IsDir() && from == 0 {
+		return txlog.OpenReaderFrom(l.logPath, 0)
+	}
+	return txlog.OpenReader(l.logPath)
+}
+
+// stream writes messages to one follower.
+type stream struct {
+	rc    *http.ResponseController
+	enc   *json.Encoder
+	store *store.Store
+
+	// last is the LSN of the last record sent.
+	last uint64
+}
+
+func (s *stream) send(m message) error {
+	m.LeaderLSN = s.store.AppliedLSN()
+	return s.enc.Encode(m)
+}
+
+func (s *stream) sendEvent(e txlog.Event, continued bool) error {
+	err := s.send(message{Event: newEvent(e, continued)})
+	if err != nil {
+		return err
+	}
+
+	s.last = e.LSN
+	return nil
+}
+
+// catchUp sends the records of the log after s.last in LSN order. A log
+// compacted in key order has them out of order, so they are collected and
+// sorted before the first is sent. When resuming, the first of them must
+// directly follow s.last, or records the follower has not seen are gone.
+func (s *stream) catchUp(reader *txlog.Reader, resume bool) error {
+	var records []store.Record
+	for reader.Next() {
+		e := reader.Event()
+		if e.LSN > s.last {
+			records = append(records, store.Record{Event: e, Continued: reader.Continued()})
+		}
+	}
+
+	// The tail of the log may be a record that is still being written; it
+	// arrives through the subscription.
+	err := reader.Err()
+	if err != nil && !errors.Is(err, txlog.ErrTruncated) {
+		return err
+	}
+
+	// The records of a batch have consecutive LSNs, so sorting keeps them
+	// together.
+	slices.SortFunc(records, func(a, b store.Record) int {
+		return cmp.Compare(a.LSN, b.LSN)
+	})
+
+	for _, rec := range records {
+		if resume && rec.LSN != s.last+1 {
+			return fmt.Errorf("%w: next record is %d after %d", ErrResyncRequired, rec.LSN, s.last)
+		}
+
+		err := s.sendEvent(rec.Event, rec.Continued)
+		if err != nil {
+			return err
+		}
+	}
+
+	return s.rc.Flush()
+}
+
+// follow sends the records the store applies until the follower goes away,
+// the subscription is dropped or done is closed.
+func (s *stream) follow(r *http.Request, sub *store.Subscription, heartbeat time.Duration, done <-chan struct{}) error {
+	ticker := time.NewTicker(heartbeat)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return r.Context().Err()
+		case <-done:
+			return nil
+		case <-ticker.C:
+			err := s.send(message{})
+			if err == nil {
+				err = s.rc.Flush()
+			}
+			if err != nil {
+				return err
+			}
+		case e, ok := <-sub.Events():
+			if !ok {
+				return sub.Err()
+			}
+			if e.LSN <= s.last {
+				continue
+			}
+
+			err := s.sendEvent(e.Event, e.Continued)
+			if err != nil {
+				return err
+			}
+
+			if !e.Continued && len(sub.Events()) == 0 {
+				err = s.rc.Flush()
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,94 @@
+// Package replication streams the transaction log of a leader kv-service to
+// its followers.
+//
+// A follower requests GET StreamPath?from=N, where N is the LSN of the last
+// record it applied, and reads a chunked response of newline-delimited JSON
+// messages: first the records of the leader's log after N, then every record
+// the leader applies from then on. Every record of a batch but the last is
+// marked as continued, and a follower applies a batch only once it has all
+// of it. Heartbeats carry the leader's position
+// while no records are written, so the follower can report its lag.
+//
+// With from=latest the stream skips the log and carries only the records
+// applied after the request, starting with a heartbeat. It is meant for
+// consumers that copy the data by other means, such as the resharding of
+// api-gateway, rather than for followers.
+package replication
+
+import (
+	"errors"
+	"time"
+
+	"github.com/alexey-y-a/go-txlog-microservices/libs/txlog"
+)
+
+// StreamPath is the leader endpoint that serves the log to followers.
+const StreamPath = "/replication/stream"
+
+// FromLatest is the from parameter that starts the stream at the current
+// position of the leader.
+const FromLatest = "latest"
+
+// ErrResyncRequired is returned when the leader no longer has the records a
+// follower needs to resume: they were compacted or truncated away. The
+// follower's data must be removed so that it copies the log from the start.
+var ErrResyncRequired = errors.New("replication: leader log no longer covers the follower position")
+
+// message is one line of the stream.
+type message struct {
+	// LeaderLSN is the LSN of the last record applied on the leader when
+	// the message was sent.
+	LeaderLSN uint64 `json:"leader_lsn"`
+	Event     *event `json:"event,omitempty"`
+	// Error ends the stream with the reason the follower must resync.
+	Error string `json:"error,omitempty"`
+}
+
+type event struct {
+	LSN       uint64    `json:"lsn"`
+	Op        string    `json:"op"`
+	Key       string    `json:"key"`
+	Value     string    `json:"value,omitempty"`
+	Time      time.Time `json:"time,omitzero"`
+	ExpiresAt time.Time `json:"expires_at,omitzero"`
+	Stamp     uint64    `json:"stamp,omitempty"`
+	// Continued is set on every record of a batch but the last.
+	Continued bool `json:"continued,omitempty"`
+}
+
+func newEvent(e txlog.Event, continued bool) *event {
+	return &event{
+		LSN:       e.LSN,
+		Op:        e.Op,
+		Key:       e.Key,
+		Value:     e.Value,
+		Time:      e.Time,
+		ExpiresAt: e.ExpiresAt,
+		Stamp:     e.Stamp,
+		Continued: continued,
+	}
+}
+
+func (e *event) txlogEvent() txlog.Event {
+	return txlog.Event{
+		LSN:       e.LSN,
+		Op:        e.Op,
+		Key:       e.Key,
+		Value:     e.Value,
+		Time:      e.Time,
+		ExpiresAt: e.ExpiresAt,
+		Stamp:     e.Stamp,
+	}
+}
+
+// leaderError is a reason the leader gave for not serving a follower. The
+// leader only gives up on followers that must resync.
+type leaderError string
+
+func (e leaderError) Error() string {
+	return string(e)
+}
+
+func (e leaderError) Is(target error) bool {
+	return target == ErrResyncRequired
+}
@@ -0,0 +1,356 @@
+package replication
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/alexey-y-a/go-txlog-microservices/libs/txlog"
+	"github.com/alexey-y-a/go-txlog-microservices/services/kv-service/internal/store"
+)
+
+type testNode struct {
+	store *store.Store
+	log   *txlog.FileLog
+	path  string
+}
+
+func openTestNode(t *testing.T, path string, opts ...txlog.Option) *testNode {
+	t.Helper()
+
+	log, err := txlog.NewFileLog(path, opts...)
+	require.NoError(t, err, "NewFileLog should not return error")
+
+	s, _, err := store.NewStoreFromLog(log, path)
+	require.NoError(t, err, "NewStoreFromLog should not return error")
+
+	return &testNode{store: s, log: log, path: path}
+}
+
+// startLeader serves the log of a new node in dir.
+func startLeader(t *testing.T, dir string, opts ...txlog.Option) (*testNode, *httptest.Server) {
+	t.Helper()
+
+	node := openTestNode(t, filepath.Join(dir, "leader.log"), opts...)
+
+	leader := NewLeader(node.store, node.path)
+	leader.heartbeat = 20 * time.Millisecond
+
+	srv := httptest.NewServer(leader)
+	t.Cleanup(func() {
+		leader.Close()
+		srv.Close()
+		node.log.Close()
+	})
+
+	return node, srv
+}
+
+func startFollower(t *testing.T, url string, node *testNode) *Follower {
+	t.Helper()
+
+	node.store.SetReadOnly(true)
+
+	f := NewFollower(url, node.store)
+	f.retryInterval = 10 * time.Millisecond
+	f.Start()
+
+	return f
+}
+
+func requireReplicated(t *testing.T, leader, follower *testNode) {
+	t.Helper()
+
+	require.Eventually(t, func() bool {
+		return follower.store.AppliedLSN() == leader.store.AppliedLSN()
+	}, 5*time.Second, 5*time.Millisecond, "the follower should catch up with the leader")
+
+	want, _ := leader.store.Scan("", "", 0)
+	got, _ := follower.store.Scan("", "", 0)
+	require.Len(t, got, len(want), "the follower should hold the keys of the leader")
+
+	for i := range want {
+		require.Equal(t, want[i].Key, got[i].Key)
+		require.Equal(t, want[i].Value, got[i].Value, "key %s", want[i].Key)
+		require.Equal(t, want[i].Version, got[i].Version, "key %s", want[i].Key)
+		require.True(t, want[i].ExpiresAt.Equal(got[i].ExpiresAt), "key %s", want[i].Key)
+	}
+}
+
+func TestReplication_CatchUpAndStream(t *testing.T) {
+	t.Helper()
+
+	dir := t.TempDir()
+	leader, srv := startLeader(t, dir)
+
+	for i := 0; i < 50; i++ {
+		_, err := leader.store.Set("key"+strconv.Itoa(i%10), strconv.Itoa(i))
+		require.NoError(t, err)
+	}
+	_, err := leader.store.Delete("key3")
+	require.NoError(t, err)
+
+	follower := openTestNode(t, filepath.Join(dir, "follower.log"))
+	defer follower.log.Close()
+
+	f := startFollower(t, srv.URL, follower)
+	defer f.Stop()
+
+	requireReplicated(t, leader, follower)
+
+	// Live writes, including a batch, arrive through the open stream.
+	_, err = leader.store.Apply(store.Batch{
+		{Type: txlog.OpSet, Key: "a", Value: "1"},
+		{Type: txlog.OpDelete, Key: "key4"},
+	})
+	require.NoError(t, err)
+	_, err = leader.store.SetWithTTL("session", "s", time.Hour, store.Condition{})
+	require.NoError(t, err)
+
+	requireReplicated(t, leader, follower)
+
+	entry, ok := follower.store.GetEntry("session")
+	require.True(t, ok)
+	require.False(t, entry.ExpiresAt.IsZero(), "the TTL should be replicated")
+	require.Equal(t, uint64(0), f.Lag())
+
+	_, err = follower.store.Set("a", "2")
+	require.ErrorIs(t, err, store.ErrReadOnly, "a follower should serve reads only")
+}
+
+func TestReplication_ResumesAfterRestart(t *testing.T) {
+	t.Helper()
+
+	dir := t.TempDir()
+	leader, srv := startLeader(t, dir)
+
+	for i := 0; i < 20; i++ {
+		_, err := leader.store.Set("key"+strconv.Itoa(i), "v1")
+		require.NoError(t, err)
+	}
+
+	path := filepath.Join(dir, "follower.log")
+	follower := openTestNode(t, path)
+	f := startFollower(t, srv.URL, follower)
+
+	requireReplicated(t, leader, follower)
+	f.Stop()
+	require.NoError(t, follower.log.Close())
+
+	for i := 0; i < 20; i += 2 {
+		_, err := leader.store.Set("key"+strconv.Itoa(i), "v2")
+		require.NoError(t, err)
+	}
+
+	follower = openTestNode(t, path)
+	defer follower.log.Close()
+	require.Equal(t, uint64(20), follower.store.AppliedLSN(), "the follower should restore its position")
+
+	f = startFollower(t, srv.URL, follower)
+	defer f.Stop()
+
+	requireReplicated(t, leader, follower)
+
+	var lsns []uint64
+	_, err := txlog.ReadFile(path, func(e txlog.Event) error {
+		lsns = append(lsns, e.LSN)
+		return nil
+	})
+	require.NoError(t, err)
+	require.Len(t, lsns, 30, "the follower should only fetch the records it missed")
+	require.Equal(t, uint64(30), lsns[len(lsns)-1])
+}
+
+func TestReplication_ResyncRequired(t *testing.T) {
+	t.Helper()
+
+	dir := t.TempDir()
+	leader, srv := startLeader(t, dir)
+
+	for _, kv := range [][2]string{{"a", "1"}, {"a", "2"}, {"b", "1"}, {"a", "3"}} {
+		_, err := leader.store.Set(kv[0], kv[1])
+		require.NoError(t, err)
+	}
+
+	resp, err := http.Get(srv.URL + StreamPath + "?from=10")
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusGone, resp.StatusCode, "a follower ahead of the leader cannot resume")
+
+	// Compaction leaves only LSNs 3 and 4.
+	_, err = leader.store.Compact()
+	require.NoError(t, err)
+
+	follower := openTestNode(t, filepath.Join(dir, "follower.log"))
+	defer follower.log.Close()
+
+	_, err = follower.store.Set("a", "1")
+	require.NoError(t, err)
+
+	f := NewFollower(srv.URL, follower.store)
+	err = f.follow(context.Background())
+	require.ErrorIs(t, err, ErrResyncRequired, "records the follower missed were compacted away")
+	require.Equal(t, uint64(1), follower.store.AppliedLSN())
+
+	// A new follower copies the compacted log.
+	fresh := openTestNode(t, filepath.Join(dir, "fresh.log"))
+	defer fresh.log.Close()
+
+	f = startFollower(t, srv.URL, fresh)
+	defer f.Stop()
+
+	requireReplicated(t, leader, fresh)
+}
+
+func TestReplication_KeyOrderedLog(t *testing.T) {
+	t.Helper()
+
+	dir := t.TempDir()
+	leader, srv := startLeader(t, dir, txlog.WithCompactOrder(txlog.CompactKeyOrder))
+
+	for _, kv := range [][2]string{{"a", "1"}, {"b", "1"}, {"a", "2"}} {
+		_, err := leader.store.Set(kv[0], kv[1])
+		require.NoError(t, err)
+	}
+
+	// Compaction leaves LSN 3 for a before LSN 2 for b.
+	_, err := leader.store.Compact()
+	require.NoError(t, err)
+
+	var lsns []uint64
+	_, err = txlog.ReadFile(leader.path, func(e txlog.Event) error {
+		lsns = append(lsns, e.LSN)
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, []uint64{3, 2}, lsns)
+
+	// A follower at LSN 1 resumes with both records it misses.
+	follower := openTestNode(t, filepath.Join(dir, "follower.log"))
+	defer follower.log.Close()
+
+	_, err = follower.store.Set("a", "1")
+	require.NoError(t, err)
+
+	f := startFollower(t, srv.URL, follower)
+	defer f.Stop()
+
+	requireReplicated(t, leader, follower)
+
+	// A new follower copies the whole log.
+	fresh := openTestNode(t, filepath.Join(dir, "fresh.log"))
+	defer fresh.log.Close()
+
+	f = startFollower(t, srv.URL, fresh)
+	defer f.Stop()
+
+	requireReplicated(t, leader, fresh)
+}
+
+func TestReplication_AppliesWholeBatches(t *testing.T) {
+	t.Helper()
+
+	batch := []*event{
+		{LSN: 2, Op: txlog.OpSet, Key: "b", Value: "1", Continued: true},
+		{LSN: 3, Op: txlog.OpSet, Key: "c", Value: "1", Continued: true},
+		{LSN: 4, Op: txlog.OpDelete, Key: "a"},
+	}
+
+	// The first stream breaks off in the middle of the batch.
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		events := batch
+		if r.URL.Query().Get("from") == "0" {
+			events = append([]*event{{LSN: 1, Op: txlog.OpSet, Key: "a", Value: "1"}}, batch[:2]...)
+		}
+
+		enc := json.NewEncoder(w)
+		for _, e := range events {
+			enc.Encode(message{LeaderLSN: 4, Event: e})
+		}
+	}))
+	defer srv.Close()
+
+	path := filepath.Join(t.TempDir(), "follower.log")
+	follower := openTestNode(t, path)
+	defer follower.log.Close()
+	follower.store.SetReadOnly(true)
+
+	f := NewFollower(srv.URL, follower.store)
+
+	require.Error(t, f.follow(context.Background()))
+	require.Equal(t, uint64(1), follower.store.AppliedLSN(), "a batch cut off by the stream should not be applied")
+	_, ok := follower.store.GetEntry("b")
+	require.False(t, ok)
+
+	require.Error(t, f.follow(context.Background()))
+	require.Equal(t, uint64(4), follower.store.AppliedLSN(), "the batch should be applied once it is complete")
+	_, ok = follower.store.GetEntry("a")
+	require.False(t, ok)
+
+	r, err := txlog.OpenReader(path)
+	require.NoError(t, err)
+	defer r.Close()
+
+	var continued []bool
+	for r.Next() {
+		continued = append(continued, r.Continued())
+	}
+	require.NoError(t, r.Err())
+	require.Equal(t, []bool{false, true, true, false}, continued, "the follower should log the batch as one")
+}
+
+func TestReplication_StreamFromLatest(t *testing.T) {
+	t.Helper()
+
+	leader, srv := startLeader(t, t.TempDir())
+
+	for i := 0; i < 3; i++ {
+		_, err := leader.store.Set("key"+strconv.Itoa(i), "v")
+		require.NoError(t, err)
+	}
+
+	resp, err := http.Get(srv.URL + StreamPath + "?from=" + FromLatest)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	dec := json.NewDecoder(resp.Body)
+
+	var m message
+	require.NoError(t, dec.Decode(&m))
+	require.Nil(t, m.Event, "the stream should skip the records written before it")
+	require.Equal(t, uint64(3), m.LeaderLSN, "the first heartbeat should tell where the stream starts")
+
+	_, err = leader.store.Set("key9", "live")
+	require.NoError(t, err)
+
+	for m.Event == nil {
+		require.NoError(t, dec.Decode(&m))
+	}
+	require.Equal(t, uint64(4), m.Event.LSN)
+	require.Equal(t, "key9", m.Event.Key)
+	require.False(t, m.Event.Continued)
+
+	_, err = leader.store.Apply(store.Batch{
+		{Type: txlog.OpSet, Key: "a", Value: "1"},
+		{Type: txlog.OpSet, Key: "b", Value: "1"},
+	})
+	require.NoError(t, err)
+
+	var continued []bool
+	for len(continued) < 2 {
+		m = message{}
+		require.NoError(t, dec.Decode(&m))
+		if m.Event != nil {
+			continued = append(continued, m.Event.Continued)
+		}
+	}
+	require.Equal(t, []bool{true, false}, continued, "the stream should mark the records of a batch")
+}
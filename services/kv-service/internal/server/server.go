@@ -1,46 +1,458 @@
 package server
 
 import (
+	"errors"
+	"fmt"
 	"net/http"
+	"path/filepath"
 
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/rs/zerolog"
 
 	"github.com/alexey-y-a/go-txlog-microservices/libs/logger"
 	"github.com/alexey-y-a/go-txlog-microservices/libs/txlog"
+	"github.com/alexey-y-a/go-txlog-microservices/services/kv-service/internal/config"
+	"github.com/alexey-y-a/go-txlog-microservices/services/kv-service/internal/engine"
 	kvhttp "github.com/alexey-y-a/go-txlog-microservices/services/kv-service/internal/http"
 	kvmetrics "github.com/alexey-y-a/go-txlog-microservices/services/kv-service/internal/metrics"
+	"github.com/alexey-y-a/go-txlog-microservices/services/kv-service/internal/namespace"
+	"github.com/alexey-y-a/go-txlog-microservices/services/kv-service/internal/raft"
+	"github.com/alexey-y-a/go-txlog-microservices/services/kv-service/internal/replication"
 	"github.com/alexey-y-a/go-txlog-microservices/services/kv-service/internal/store"
 )
 
-func NewServer() (*http.Server, *txlog.FileLog, error) {
+// NewServer returns the HTTP server of kv-service, the registry of its
+// namespaces and open, which opens the default namespace from the
+// configured log and every other namespace found in cfg.NamespaceDir, all
+// with the engine selected by cfg.Engine. open is meant to run while the
+// server already listens: until it returns, /ready and the data endpoints
+// answer 503. The registry owns the engines and must be closed after the
+// server is shut down and open has returned.
+func NewServer(cfg config.Config) (*http.Server, *namespace.Registry, func() error) {
 	logger.Init()
 	log := logger.L().With().Str("service", "kv-service").Logger()
 
-	logFile, err := txlog.NewFileLog("kv.log")
-	if err != nil {
-		return nil, nil, err
-	}
+	namespaces := namespace.NewRegistry(cfg.NamespaceDir, func(name, dir string) (engine.Engine, error) {
+		nsLog := log.With().Str("namespace", name).Logger()
+
+		if cfg.LogDir != "" {
+			return openEngine(cfg, filepath.Join(dir, "log"), filepath.Join(dir, "snapshots"), nsLog)
+		}
+		return openEngine(cfg, filepath.Join(dir, "kv.log"), "", nsLog)
+	})
 
-	kvStore := store.NewStore(logFile)
+	kvmetrics.RegisterNamespaces(func() map[string]kvmetrics.NamespaceStats {
+		stats := make(map[string]kvmetrics.NamespaceStats)
+		for _, name := range namespaces.Names() {
+			e, ok := namespaces.Engine(name)
+			if !ok {
+				continue
+			}
+			engineStats := e.Stats()
+			nsStats := kvmetrics.NamespaceStats{
+				Keys:        engineStats.Keys,
+				ExpiredKeys: engineStats.ExpiredKeys,
+			}
+			if withLog, ok := e.(interface{ Log() txlog.Log }); ok {
+				if logFile, ok := withLog.Log().(durableLog); ok {
+					nsStats.Durability = logFile.Durability().String()
+					nsStats.Fsyncs = logFile.SyncCount()
+				}
+			}
+			stats[name] = nsStats
+		}
+		return stats
+	})
 
 	mux := http.NewServeMux()
 
-	handler := kvhttp.NewHandler(kvStore)
+	handler := kvhttp.NewHandler(namespaces)
+
+	// The data endpoints wait for the namespaces to be opened.
+	route := func(pattern, name string, h http.HandlerFunc) {
+		mux.Handle(pattern, kvmetrics.InstrumentHandler(name, handler.RequireReady(h)))
+	}
 
 	mux.Handle("/health", kvmetrics.InstrumentHandler("health", http.HandlerFunc(handler.HealthHandler)))
-	mux.Handle("/kv/set", kvmetrics.InstrumentHandler("kv_set", http.HandlerFunc(handler.SetHandler)))
-	mux.Handle("/kv/get", kvmetrics.InstrumentHandler("kv_get", http.HandlerFunc(handler.GetHandler)))
-	mux.Handle("/kv/delete", kvmetrics.InstrumentHandler("kv_delete", http.HandlerFunc(handler.DeleteHandler)))
+	mux.Handle("/ready", kvmetrics.InstrumentHandler("ready", http.HandlerFunc(handler.ReadyHandler)))
+
+	for _, prefix := range []string{"/kv", "/kv/{ns}"} {
+		route(prefix+"/set", "kv_set", handler.SetHandler)
+		route(prefix+"/get", "kv_get", handler.GetHandler)
+		route(prefix+"/delete", "kv_delete", handler.DeleteHandler)
+		route(prefix+"/txn", "kv_txn", handler.TxnHandler)
+		route(prefix+"/scan", "kv_scan", handler.ScanHandler)
+	}
+
+	for _, prefix := range []string{"/admin", "/admin/namespaces/{ns}"} {
+		route(prefix+"/compact", "admin_compact", handler.CompactHandler)
+		route(prefix+"/snapshot", "admin_snapshot", handler.SnapshotHandler)
+	}
+
+	route("/admin/namespaces", "admin_namespaces", handler.NamespacesHandler)
+	route("/admin/namespaces/{ns}", "admin_namespace", handler.NamespaceHandler)
 
 	mux.Handle("/metrics", promhttp.Handler())
 
-	addr := ":8081"
+	addr := cfg.Addr
 	srv := &http.Server{
 		Addr:    addr,
 		Handler: mux,
 	}
 
+	open := func() error {
+		err := openNamespaces(cfg, srv, mux, handler, namespaces, log)
+		if err != nil {
+			return err
+		}
+
+		handler.SetReady(true)
+
+		log.Info().
+			Str("addr", addr).
+			Str("engine", cfg.Engine.String()).
+			Strs("namespaces", namespaces.Names()).
+			Msg("kv-service ready")
+
+		return nil
+	}
+
 	log.Info().Str("addr", addr).Msg("kv-service http server created")
 
-	return srv, logFile, nil
+	return srv, namespaces, open
+}
+
+// openNamespaces opens the namespaces into the registry and sets up what
+// depends on the default one: replication, Raft and their routes.
+func openNamespaces(cfg config.Config, srv *http.Server, mux *http.ServeMux, handler *kvhttp.Handler, namespaces *namespace.Registry, log zerolog.Logger) error {
+	snapshotDir := cfg.SnapshotDir
+	logPath := cfg.LogPath
+	if cfg.LogDir != "" {
+		logPath = cfg.LogDir
+		if snapshotDir == "" {
+			snapshotDir = filepath.Join(cfg.LogDir, "snapshots")
+		}
+	}
+
+	// A Raft node keeps the log of the default namespace in cfg.RaftDir
+	// instead of the configured log.
+	var node *raft.Node
+	var defaultEngine engine.Engine
+	var err error
+	if cfg.RaftID != "" {
+		node, defaultEngine, err = openRaft(cfg, log)
+	} else {
+		defaultEngine, err = openEngine(cfg, logPath, snapshotDir, log)
+	}
+	if err != nil {
+		return err
+	}
+
+	// Followers stream the log of the default namespace. A follower serves
+	// its copy of the log in turn, so followers can be chained.
+	var leader *replication.Leader
+	var follower *replication.Follower
+	if txlogEngine, ok := defaultEngine.(*engine.TxlogEngine); ok && node == nil {
+		leader = replication.NewLeader(txlogEngine.Store(), logPath)
+
+		if cfg.ReplicateFrom != "" {
+			txlogEngine.Store().SetReadOnly(true)
+			follower = replication.NewFollower(cfg.ReplicateFrom, txlogEngine.Store())
+			defaultEngine = followerEngine{TxlogEngine: txlogEngine, follower: follower}
+		}
+	}
+
+	namespaces.SetDefault(defaultEngine)
+
+	err = namespaces.Load()
+	if err != nil {
+		namespaces.Close()
+		return err
+	}
+
+	handler.SetReadOnly(follower != nil)
+
+	if node != nil {
+		handler.SetLeader(func() (string, bool) {
+			m, ok := node.Leader()
+			if !ok || m.ID == cfg.RaftID {
+				return "", false
+			}
+			return m.Addr, true
+		})
+	}
+
+	if leader != nil {
+		mux.Handle(replication.StreamPath, kvmetrics.InstrumentHandler("replication_stream", leader))
+		srv.RegisterOnShutdown(leader.Close)
+	}
+
+	if node != nil {
+		mux.Handle("/raft/", kvmetrics.InstrumentHandler("raft", raft.NewHandler(node)))
+
+		adminHandler := kvmetrics.InstrumentHandler("admin_raft", raft.NewAdminHandler(node))
+		mux.Handle(raft.AdminStatusPath, adminHandler)
+		mux.Handle(raft.AdminMembersPath+"/", adminHandler)
+		mux.Handle(raft.AdminMembersPath, adminHandler)
+	}
+
+	if follower != nil {
+		follower.Start()
+		log.Info().Str("leader", cfg.ReplicateFrom).Msg("replicating from leader")
+	}
+
+	return nil
+}
+
+// openRaft opens the Raft node of cfg.RaftID, bootstrapping it with
+// cfg.RaftPeers if it is new, and starts it with a store over its log.
+func openRaft(cfg config.Config, log zerolog.Logger) (*raft.Node, engine.Engine, error) {
+	node, err := raft.Open(raft.Config{
+		ID:                cfg.RaftID,
+		Dir:               cfg.RaftDir,
+		Transport:         raft.NewHTTPTransport(nil),
+		ElectionTimeout:   cfg.RaftElectionTimeout,
+		HeartbeatInterval: cfg.RaftHeartbeatInterval,
+		SnapshotThreshold: cfg.RaftSnapshotThreshold,
+		LogOptions:        fileOptions(cfg),
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if len(cfg.RaftPeers) > 0 {
+		err = node.Bootstrap(cfg.RaftPeers)
+		switch {
+		case err == nil:
+			log.Info().Any("members", cfg.RaftPeers).Msg("raft cluster bootstrapped")
+		case !errors.Is(err, raft.ErrAlreadyBootstrapped):
+			node.Close()
+			return nil, nil, err
+		}
+	}
+
+	kvStore := store.NewStore(node)
+	node.Start(kvStore)
+
+	if cfg.ExpiryInterval > 0 {
+		kvStore.StartExpirySweeper(cfg.ExpiryInterval)
+	}
+
+	status := node.Status()
+	log.Info().
+		Str("id", cfg.RaftID).
+		Str("dir", cfg.RaftDir).
+		Uint64("term", status.Term).
+		Uint64("last_index", status.LastIndex).
+		Uint64("snapshot_index", status.SnapshotIndex).
+		Msg("raft node started")
+
+	return node, engine.NewTxlogEngine(kvStore, node), nil
+}
+
+// followerEngine is the default engine of a follower. Close stops the
+// replication before the log it writes to is closed.
+type followerEngine struct {
+	*engine.TxlogEngine
+	follower *replication.Follower
+}
+
+func (e followerEngine) Close() error {
+	e.follower.Stop()
+	return e.TxlogEngine.Close()
+}
+
+// openEngine opens the engine selected by cfg.Engine with its data at
+// logPath and snapshotDir.
+func openEngine(cfg config.Config, logPath, snapshotDir string, log zerolog.Logger) (engine.Engine, error) {
+	switch cfg.Engine {
+	case engine.KindTxlog:
+		kvStore, logFile, err := openStore(cfg, logPath, snapshotDir, log)
+		if err != nil {
+			return nil, err
+		}
+		return engine.NewTxlogEngine(kvStore, logFile), nil
+	case engine.KindBitcask:
+		return openBitcask(cfg, logPath, log)
+	case engine.KindLSM:
+		return openLSM(cfg, logPath, log)
+	}
+
+	return nil, fmt.Errorf("server: unsupported engine %s", cfg.Engine)
+}
+
+// openStore opens the log at logPath, a segment directory if cfg.LogDir is
+// set and a single file otherwise, restores the store from it and starts
+// the store's background jobs.
+func openStore(cfg config.Config, logPath, snapshotDir string, log zerolog.Logger) (*store.Store, durableLog, error) {
+	logFile, err := openLog(cfg, logPath, log)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var kvStore *store.Store
+	var stats store.ReplayStats
+
+	if cfg.LogDir != "" {
+		kvStore, stats, err = store.NewStoreFromSnapshot(logFile, logPath, snapshotDir)
+	} else {
+		kvStore, stats, err = store.NewStoreFromLog(logFile, logPath)
+	}
+	if err != nil {
+		logFile.Close()
+		return nil, nil, err
+	}
+
+	kvStore.SetCompactionPolicy(cfg.CompactRatio, cfg.CompactMinRecords)
+
+	if stats.CorruptSnapshots > 0 {
+		log.Warn().
+			Str("dir", snapshotDir).
+			Int("corrupt_snapshots", stats.CorruptSnapshots).
+			Msg("skipped unusable snapshots")
+	}
+
+	log.Info().
+		Str("path", logPath).
+		Uint64("snapshot_segment", stats.Snapshot).
+		Int("snapshot_keys", stats.SnapshotKeys).
+		Int("events_applied", stats.Applied).
+		Int("skipped_lines", stats.Skipped).
+		Dur("duration", stats.Duration).
+		Msg("transaction log replayed")
+
+	if cfg.LogDir != "" && cfg.SnapshotInterval > 0 {
+		kvStore.StartSnapshots(cfg.SnapshotInterval)
+	}
+
+	if cfg.ExpiryInterval > 0 {
+		kvStore.StartExpirySweeper(cfg.ExpiryInterval)
+	}
+
+	return kvStore, logFile, nil
+}
+
+// openBitcask opens a bitcask engine over the segmented log in dir.
+func openBitcask(cfg config.Config, dir string, log zerolog.Logger) (engine.Engine, error) {
+	bitcask, stats, err := engine.OpenBitcask(dir, segmentOptions(cfg)...)
+	if err != nil {
+		return nil, err
+	}
+
+	bitcask.SetCompactionPolicy(cfg.CompactRatio, cfg.CompactMinRecords)
+
+	log.Info().
+		Str("dir", dir).
+		Int("keys", stats.Keys).
+		Int("hint_segments", stats.HintSegments).
+		Int("scanned_segments", stats.ScannedSegments).
+		Dur("duration", stats.Duration).
+		Msg("bitcask keydir loaded")
+
+	if cfg.ExpiryInterval > 0 {
+		bitcask.StartExpirySweeper(cfg.ExpiryInterval)
+	}
+
+	return bitcask, nil
+}
+
+// openLSM opens an lsm engine in dir.
+func openLSM(cfg config.Config, dir string, log zerolog.Logger) (engine.Engine, error) {
+	opts := engine.DefaultLSMOptions()
+	opts.MemtableSize = cfg.MemtableSize
+	opts.WAL = segmentOptions(cfg)
+
+	lsm, err := engine.OpenLSM(dir, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	tables := 0
+	for _, level := range lsm.Levels() {
+		tables += level.Tables
+	}
+
+	log.Info().
+		Str("dir", dir).
+		Int("keys", lsm.Stats().Keys).
+		Int("levels", len(lsm.Levels())).
+		Int("tables", tables).
+		Msg("lsm engine opened")
+
+	if cfg.ExpiryInterval > 0 {
+		lsm.StartExpirySweeper(cfg.ExpiryInterval)
+	}
+
+	return lsm, nil
+}
+
+type durableLog interface {
+	txlog.Log
+	Durability() txlog.Durability
+	SyncCount() uint64
+}
+
+func fileOptions(cfg config.Config) []txlog.Option {
+	return []txlog.Option{
+		txlog.WithDurability(cfg.Durability),
+		txlog.WithSyncInterval(cfg.SyncInterval),
+		txlog.WithCompactOrder(cfg.CompactOrder),
+	}
+}
+
+func segmentOptions(cfg config.Config) []txlog.SegmentOption {
+	return []txlog.SegmentOption{
+		txlog.WithMaxSegmentSize(cfg.SegmentSize),
+		txlog.WithMaxSegmentAge(cfg.SegmentMaxAge),
+		txlog.WithFileOptions(fileOptions(cfg)...),
+	}
+}
+
+func openLog(cfg config.Config, logPath string, log zerolog.Logger) (durableLog, error) {
+	var logFile durableLog
+
+	if cfg.LogDir != "" {
+		segmented, err := txlog.OpenSegmentedLog(logPath, segmentOptions(cfg)...)
+		if err != nil {
+			return nil, err
+		}
+
+		log.Info().
+			Str("dir", logPath).
+			Int("segments", len(segmented.Segments())).
+			Int64("segment_size", cfg.SegmentSize).
+			Msg("segmented transaction log opened")
+
+		logFile = segmented
+	} else {
+		migrated, err := txlog.MigrateFile(logPath)
+		if err != nil {
+			return nil, err
+		}
+
+		if migrated {
+			log.Info().Str("path", logPath).Msg("transaction log migrated to v2 format")
+		}
+
+		file, err := txlog.NewFileLog(logPath, fileOptions(cfg)...)
+		if err != nil {
+			return nil, err
+		}
+
+		if file.TruncatedBytes() > 0 {
+			log.Warn().
+				Str("path", logPath).
+				Int64("truncated_bytes", file.TruncatedBytes()).
+				Msg("torn tail truncated from transaction log")
+		}
+
+		logFile = file
+	}
+
+	log.Info().
+		Str("durability", cfg.Durability.String()).
+		Dur("sync_interval", cfg.SyncInterval).
+		Msg("transaction log opened")
+
+	return logFile, nil
 }
@@ -0,0 +1,85 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/alexey-y-a/go-txlog-microservices/libs/txlog"
+	"github.com/alexey-y-a/go-txlog-microservices/services/kv-service/internal/config"
+)
+
+func TestNewServer_ReadyAfterReplay(t *testing.T) {
+	t.Helper()
+
+	dir := t.TempDir()
+	logPath := filepath.Join(dir, "kv.log")
+
+	logFile, err := txlog.NewFileLog(logPath)
+	require.NoError(t, err)
+	_, err = logFile.Append(txlog.Event{Key: "user1", Value: "Alice", Op: txlog.OpSet})
+	require.NoError(t, err)
+	require.NoError(t, logFile.Close())
+
+	cfg := config.Default()
+	cfg.LogPath = logPath
+	cfg.NamespaceDir = filepath.Join(dir, "namespaces")
+	cfg.ExpiryInterval = 0
+
+	srv, namespaces, open := NewServer(cfg)
+
+	ts := httptest.NewServer(srv.Handler)
+	defer ts.Close()
+
+	get := func(path string) (int, map[string]any) {
+		resp, err := http.Get(ts.URL + path)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+
+		var body map[string]any
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+		return resp.StatusCode, body
+	}
+
+	// The server answers before the log is replayed.
+	status, body := get("/ready")
+	require.Equal(t, http.StatusServiceUnavailable, status)
+	require.Equal(t, "replaying", body["status"])
+
+	status, _ = get("/health")
+	require.Equal(t, http.StatusOK, status, "a replaying server should be alive")
+
+	status, _ = get("/kv/get?key=user1")
+	require.Equal(t, http.StatusServiceUnavailable, status, "reads should wait for the replay")
+
+	require.NoError(t, open())
+	defer namespaces.Close()
+
+	status, body = get("/ready")
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, "ok", body["status"])
+
+	status, body = get("/kv/get?key=user1")
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, "Alice", body["value"], "the replayed key should be served")
+
+	// Every namespace reports the fsyncs of its own log.
+	require.NoError(t, namespaces.Create("orders"))
+
+	resp, err := http.Get(ts.URL + "/metrics")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	metrics, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	for _, ns := range []string{"default", "orders"} {
+		require.Contains(t, string(metrics), `txlog_durability_mode{mode="group",namespace="`+ns+`"} 1`)
+		require.Contains(t, string(metrics), `txlog_fsyncs_total{namespace="`+ns+`"}`)
+	}
+}
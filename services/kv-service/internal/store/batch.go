@@ -0,0 +1,108 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/alexey-y-a/go-txlog-microservices/libs/txlog"
+)
+
+var (
+	ErrBatchUnsupported = errors.New("store: log does not support batches")
+	ErrInvalidBatch     = errors.New("store: invalid batch")
+)
+
+// Op is a single write of a Batch. Type is txlog.OpSet or txlog.OpDelete.
+type Op struct {
+	Type  string
+	Key   string
+	Value string
+}
+
+type Batch []Op
+
+// Apply writes all operations of batch to the log as one atomic unit and
+// then applies them in order. It returns the LSN of the last operation.
+func (s *Store) Apply(batch Batch) (uint64, error) {
+	if s.readOnly.Load() {
+		return 0, ErrReadOnly
+	}
+
+	batcher, ok := s.log.(txlog.Batcher)
+	if !ok {
+		return 0, ErrBatchUnsupported
+	}
+
+	if len(batch) == 0 {
+		return 0, fmt.Errorf("%w: no operations", ErrInvalidBatch)
+	}
+
+	events := make([]txlog.Event, 0, len(batch))
+	keys := make([]string, 0, len(batch))
+	for i, op := range batch {
+		if op.Key == "" {
+			return 0, fmt.Errorf("%w: operation %d: empty key", ErrInvalidBatch, i)
+		}
+
+		switch op.Type {
+		case txlog.OpSet:
+		case txlog.OpDelete:
+			op.Value = ""
+		default:
+			return 0, fmt.Errorf("%w: operation %d: unknown type %q", ErrInvalidBatch, i, op.Type)
+		}
+
+		events = append(events, txlog.Event{
+			Key:   op.Key,
+			Value: op.Value,
+			Op:    op.Type,
+		})
+		keys = append(keys, op.Key)
+	}
+
+	unlock := s.lockKeys(keys...)
+	defer unlock()
+
+	s.writeMu.RLock()
+	defer s.writeMu.RUnlock()
+
+	lsn, err := batcher.AppendBatch(events)
+	if err != nil && lsn == 0 {
+		return 0, fmt.Errorf("store: append batch: %w", err)
+	}
+
+	if lsn != 0 {
+		first := lsn - uint64(len(events)-1)
+		for i := range events {
+			events[i].LSN = first + uint64(i)
+		}
+	}
+
+	s.publish(events, func() {
+		s.applyBatch(keys, events)
+	})
+
+	s.records.Add(int64(len(events)))
+	s.dirty.Store(true)
+	s.maybeCompact()
+
+	if err != nil {
+		return 0, fmt.Errorf("store: sync batch: %w", err)
+	}
+	return lsn, nil
+}
+
+// applyBatch applies events, which write keys. All shards of the batch are
+// locked while it is applied, so that a Scan sees either none or all of it.
+func (s *Store) applyBatch(keys []string, events []txlog.Event) {
+	shards := s.shardIndexes(keys)
+	for _, i := range shards {
+		s.shards[i].mu.Lock()
+	}
+	for _, e := range events {
+		s.applyLocked(s.shardFor(e.Key), e)
+	}
+	for _, i := range shards {
+		s.shards[i].mu.Unlock()
+	}
+}
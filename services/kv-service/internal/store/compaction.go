@@ -0,0 +1,98 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/alexey-y-a/go-txlog-microservices/libs/logger"
+	"github.com/alexey-y-a/go-txlog-microservices/libs/txlog"
+)
+
+var (
+	ErrCompactionUnsupported = errors.New("store: log does not support compaction")
+	ErrCompactionRunning     = errors.New("store: compaction already running")
+)
+
+// SetCompactionPolicy enables automatic compaction once at least minRecords
+// records are in the log and the share of records that no longer back a live
+// key exceeds ratio. A zero ratio disables it.
+func (s *Store) SetCompactionPolicy(ratio float64, minRecords int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.compactRatio = ratio
+	s.compactMinRecords = minRecords
+}
+
+// DeadRatio estimates the share of log records that are superseded or
+// deleted.
+func (s *Store) DeadRatio() float64 {
+	live := s.Len()
+
+	records := s.records.Load()
+	if records == 0 || int64(live) >= records {
+		return 0
+	}
+
+	return 1 - float64(live)/float64(records)
+}
+
+// Compact compacts the underlying log while the store keeps serving writes.
+// Tombstones older than txlog.TombstoneGrace are dropped with their delete
+// records.
+func (s *Store) Compact() (txlog.CompactStats, error) {
+	compactor, ok := s.log.(txlog.Compactor)
+	if !ok {
+		return txlog.CompactStats{}, ErrCompactionUnsupported
+	}
+
+	if !s.compacting.CompareAndSwap(false, true) {
+		return txlog.CompactStats{}, ErrCompactionRunning
+	}
+	defer s.compacting.Store(false)
+
+	stats, err := compactor.Compact()
+	if err != nil {
+		return stats, fmt.Errorf("store: compact log: %w", err)
+	}
+
+	s.records.Add(int64(stats.RecordsOut - stats.RecordsIn))
+	s.dropTombstones()
+
+	return stats, nil
+}
+
+func (s *Store) maybeCompact() {
+	s.mu.RLock()
+	ratio, minRecords := s.compactRatio, s.compactMinRecords
+	s.mu.RUnlock()
+
+	if ratio <= 0 || s.records.Load() < minRecords || s.compacting.Load() {
+		return
+	}
+
+	if s.DeadRatio() < ratio {
+		return
+	}
+
+	go func() {
+		log := logger.L().With().Str("component", "store").Logger()
+
+		deadRatio := s.DeadRatio()
+
+		stats, err := s.Compact()
+		if err != nil {
+			if !errors.Is(err, ErrCompactionRunning) {
+				log.Error().Err(err).Msg("automatic compaction failed")
+			}
+			return
+		}
+
+		log.Info().
+			Float64("dead_ratio", deadRatio).
+			Int("records_in", stats.RecordsIn).
+			Int("records_out", stats.RecordsOut).
+			Int64("bytes_reclaimed", stats.BytesReclaimed).
+			Msg("automatic compaction finished")
+	}()
+}
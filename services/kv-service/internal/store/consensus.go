@@ -0,0 +1,113 @@
+package store
+
+import (
+	"fmt"
+
+	"github.com/alexey-y-a/go-txlog-microservices/libs/txlog"
+	"github.com/alexey-y-a/go-txlog-microservices/services/kv-service/internal/index"
+)
+
+// The methods below let a consensus log drive the store. Such a log is the
+// log of the store: writes of the store append to it on the leader, and the
+// log applies the records it commits from other nodes itself.
+
+// ApplyCommitted applies events, the records of one batch that the log of
+// the store has committed, in LSN order. The records are not appended: the
+// log already holds them. Records that change no key, such as txlog.OpNoop,
+// only advance AppliedLSN.
+func (s *Store) ApplyCommitted(events []txlog.Event) {
+	var (
+		keys []string
+		data []txlog.Event
+	)
+	for _, e := range events {
+		switch e.Op {
+		case txlog.OpSet, txlog.OpDelete, txlog.OpExpire:
+			keys = append(keys, e.Key)
+			data = append(data, e)
+		}
+	}
+
+	if len(keys) > 0 {
+		unlock := s.lockKeys(keys...)
+		defer unlock()
+	}
+
+	s.writeMu.RLock()
+	defer s.writeMu.RUnlock()
+
+	s.publish(events, func() {
+		if len(data) > 0 {
+			s.applyBatch(keys, data)
+		}
+	})
+
+	for _, e := range data {
+		if e.Op == txlog.OpExpire {
+			s.expiredKeys.Add(1)
+		}
+	}
+
+	s.records.Add(int64(len(data)))
+	s.dirty.Store(true)
+}
+
+// SnapshotState waits until every record up to lsn has been applied and
+// returns the contents of the store encoded as a snapshot at lsn. The
+// caller must make sure no later record is applied meanwhile.
+func (s *Store) SnapshotState(lsn uint64) ([]byte, error) {
+	s.seq.wait(lsn + 1)
+
+	if applied := s.seq.last(); applied != lsn {
+		return nil, fmt.Errorf("store: snapshot at %d requested, store is at %d", lsn, applied)
+	}
+
+	return encodeSnapshot(lsn, s.clone(), s.cloneTombstones()), nil
+}
+
+// RestoreState replaces the contents of the store with a snapshot returned
+// by SnapshotState, possibly on another node, and makes lsn the last
+// applied LSN.
+func (s *Store) RestoreState(snapshot []byte, lsn uint64) error {
+	stored, data, tombs, err := decodeSnapshot(snapshot)
+	if err != nil {
+		return err
+	}
+
+	if stored != lsn {
+		return fmt.Errorf("store: snapshot is at %d, not %d", stored, lsn)
+	}
+
+	for i := range s.shards {
+		s.shards[i].writer.Lock()
+		s.shards[i].mu.Lock()
+	}
+	s.indexMu.Lock()
+
+	keys := index.NewSkiplist()
+	for i := range s.shards {
+		s.shards[i].data = make(map[string]Entry)
+		s.shards[i].tombs = make(map[string]tombstone)
+	}
+	for key, entry := range data {
+		s.shardFor(key).data[key] = entry
+		keys.Insert(key)
+	}
+	for key, tomb := range tombs {
+		s.shardFor(key).tombs[key] = tomb
+	}
+
+	s.index = keys
+	s.keys.Store(int64(len(data)))
+
+	s.indexMu.Unlock()
+	for i := range s.shards {
+		s.shards[i].mu.Unlock()
+		s.shards[i].writer.Unlock()
+	}
+
+	s.seq.done(lsn)
+	s.dirty.Store(true)
+
+	return nil
+}
@@ -0,0 +1,89 @@
+package store
+
+import (
+	"time"
+
+	"github.com/alexey-y-a/go-txlog-microservices/libs/txlog"
+)
+
+// SetWithTTL is SetIf for a key that expires after ttl. A ttl of zero means
+// the key never expires.
+func (s *Store) SetWithTTL(key, value string, ttl time.Duration, cond Condition) (uint64, error) {
+	e := txlog.Event{
+		Key:   key,
+		Value: value,
+		Op:    txlog.OpSet,
+	}
+	if ttl > 0 {
+		e.ExpiresAt = s.now().Add(ttl)
+	}
+
+	return s.write(e, cond)
+}
+
+// ExpiredKeys returns how many keys have expired since the store was
+// created, either lazily on read or by the sweeper.
+func (s *Store) ExpiredKeys() uint64 {
+	return s.expiredKeys.Load()
+}
+
+// expire logs and applies the expiry of key if it is still expired. It
+// reports whether the key was removed. A read-only store leaves expiries to
+// its leader.
+func (s *Store) expire(key string) (bool, error) {
+	if s.readOnly.Load() {
+		return false, nil
+	}
+
+	unlock := s.lockKeys(key)
+	defer unlock()
+
+	current, exists := s.get(key)
+
+	if !exists || !current.expired(s.now()) {
+		return false, nil
+	}
+
+	_, err := s.commit(txlog.Event{
+		Key: key,
+		Op:  txlog.OpExpire,
+	})
+	if err != nil {
+		return false, err
+	}
+
+	s.expiredKeys.Add(1)
+
+	return true, nil
+}
+
+// StartExpirySweeper removes expired keys every interval, so that keys that
+// are never read again do not stay in memory. StopExpirySweeper stops it.
+func (s *Store) StartExpirySweeper(interval time.Duration) {
+	s.sweeper = StartSweeper(interval, "store", s.sweep)
+}
+
+func (s *Store) StopExpirySweeper() {
+	s.sweeper.Stop()
+}
+
+// sweep expires every key whose expiry time has passed and returns how
+// many were removed.
+func (s *Store) sweep() (int, error) {
+	now := s.now()
+
+	var keys []string
+	for i := range s.shards {
+		sh := &s.shards[i]
+
+		sh.mu.RLock()
+		for key, entry := range sh.data {
+			if entry.expired(now) {
+				keys = append(keys, key)
+			}
+		}
+		sh.mu.RUnlock()
+	}
+
+	return ExpireKeys(keys, s.expire)
+}
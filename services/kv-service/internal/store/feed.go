@@ -0,0 +1,107 @@
+package store
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/alexey-y-a/go-txlog-microservices/libs/txlog"
+)
+
+// ErrSubscriberBehind ends a subscription whose reader did not keep up with
+// the writes to the store.
+var ErrSubscriberBehind = errors.New("store: subscriber fell behind")
+
+// feed hands the events applied to a store to its subscriptions.
+type feed struct {
+	mu   sync.Mutex
+	subs map[*Subscription]struct{}
+}
+
+// Record is an event handed to subscriptions. Continued is set on every
+// event of a batch but the last, as by txlog.Reader.
+type Record struct {
+	txlog.Event
+	Continued bool
+}
+
+// Subscription receives the events applied to a store, in LSN order, from
+// the moment it was created.
+type Subscription struct {
+	feed   *feed
+	events chan Record
+	err    error
+}
+
+// Subscribe starts a subscription that buffers up to buffer events. A
+// subscriber that lets the buffer fill up is dropped with
+// ErrSubscriberBehind rather than slowing down writes.
+func (s *Store) Subscribe(buffer int) *Subscription {
+	sub := &Subscription{
+		feed:   &s.feed,
+		events: make(chan Record, buffer),
+	}
+
+	s.feed.mu.Lock()
+	if s.feed.subs == nil {
+		s.feed.subs = make(map[*Subscription]struct{})
+	}
+	s.feed.subs[sub] = struct{}{}
+	s.feed.mu.Unlock()
+
+	return sub
+}
+
+// Events returns the channel of events. It is closed when the subscription
+// ends; Err tells why. A subscription dropped in the middle of a batch may
+// have received only part of it.
+func (sub *Subscription) Events() <-chan Record {
+	return sub.events
+}
+
+// Err returns ErrSubscriberBehind if the subscription was dropped, nil
+// otherwise.
+func (sub *Subscription) Err() error {
+	sub.feed.mu.Lock()
+	defer sub.feed.mu.Unlock()
+
+	return sub.err
+}
+
+func (sub *Subscription) Close() {
+	sub.feed.mu.Lock()
+	defer sub.feed.mu.Unlock()
+
+	sub.feed.endLocked(sub, nil)
+}
+
+// endLocked removes sub and closes its channel. Must be called with f.mu
+// held.
+func (f *feed) endLocked(sub *Subscription, err error) {
+	if _, ok := f.subs[sub]; !ok {
+		return
+	}
+
+	delete(f.subs, sub)
+	sub.err = err
+	close(sub.events)
+}
+
+// broadcast hands events, the records of one write, to the subscriptions.
+func (f *feed) broadcast(events []txlog.Event) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for sub := range f.subs {
+		for i, e := range events {
+			select {
+			case sub.events <- Record{Event: e, Continued: i < len(events)-1}:
+			default:
+				f.endLocked(sub, ErrSubscriberBehind)
+			}
+
+			if sub.err != nil {
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/alexey-y-a/go-txlog-microservices/libs/txlog"
+)
+
+var (
+	ErrReadOnly               = errors.New("store: store is read-only")
+	ErrReplicationUnsupported = errors.New("store: log does not support replication")
+)
+
+// SetReadOnly makes the store reject writes, as on a follower that only
+// applies the records of its leader. Expired keys are then hidden from
+// reads but not removed: the expiry comes from the leader.
+func (s *Store) SetReadOnly(readOnly bool) {
+	s.readOnly.Store(readOnly)
+}
+
+// ApplyReplicated appends e, a record read from the log of a leader, to the
+// log of the store with its LSN and applies it. Records must be applied in
+// rising LSN order. Gaps are allowed, since a compacted leader log has
+// them; a log compacted in key order also has its records out of LSN order,
+// and the leader sorts them before it sends them.
+//
+// As with writes, a record that was written but not synced is applied and
+// reported with an error.
+func (s *Store) ApplyReplicated(e txlog.Event) error {
+	replica, ok := s.log.(txlog.Replica)
+	if !ok {
+		return ErrReplicationUnsupported
+	}
+
+	unlock := s.lockKeys(e.Key)
+	defer unlock()
+
+	s.writeMu.RLock()
+	defer s.writeMu.RUnlock()
+
+	lsn, err := replica.AppendReplicated(e)
+	if err != nil && lsn == 0 {
+		return fmt.Errorf("store: append replicated %s event: %w", e.Op, err)
+	}
+
+	s.apply(e)
+	s.feed.broadcast([]txlog.Event{e})
+	s.seq.done(e.LSN)
+
+	if e.Op == txlog.OpExpire {
+		s.expiredKeys.Add(1)
+	}
+
+	s.records.Add(1)
+	s.dirty.Store(true)
+	s.maybeCompact()
+
+	if err != nil {
+		return fmt.Errorf("store: sync replicated %s event: %w", e.Op, err)
+	}
+	return nil
+}
+
+// ApplyReplicatedBatch appends events, the records of one batch of the
+// leader, to the log of the store as a batch and applies them together, so
+// that neither the log nor a Scan holds only part of it.
+func (s *Store) ApplyReplicatedBatch(events []txlog.Event) error {
+	replica, ok := s.log.(txlog.Replica)
+	if !ok {
+		return ErrReplicationUnsupported
+	}
+
+	keys := make([]string, len(events))
+	for i, e := range events {
+		keys[i] = e.Key
+	}
+
+	unlock := s.lockKeys(keys...)
+	defer unlock()
+
+	s.writeMu.RLock()
+	defer s.writeMu.RUnlock()
+
+	lsn, err := replica.AppendReplicatedBatch(events)
+	if err != nil && lsn == 0 {
+		return fmt.Errorf("store: append replicated batch: %w", err)
+	}
+
+	s.applyBatch(keys, events)
+	s.feed.broadcast(events)
+	s.seq.done(lsn)
+
+	for _, e := range events {
+		if e.Op == txlog.OpExpire {
+			s.expiredKeys.Add(1)
+		}
+	}
+
+	s.records.Add(int64(len(events)))
+	s.dirty.Store(true)
+	s.maybeCompact()
+
+	if err != nil {
+		return fmt.Errorf("store: sync replicated batch: %w", err)
+	}
+	return nil
+}
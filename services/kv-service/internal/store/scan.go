@@ -0,0 +1,54 @@
+package store
+
+// Item is a key with its entry, as returned by Scan.
+type Item struct {
+	Key string
+	Entry
+}
+
+// Scan returns live keys k with start <= k < end in key order, at most limit
+// of them if limit is positive. An empty end means no upper bound. The
+// second result reports whether more keys follow in the range.
+//
+// A page is read under a single lock, so it reflects one point in the
+// history of writes; separate calls may observe different points.
+func (s *Store) Scan(start, end string, limit int) ([]Item, bool) {
+	now := s.now()
+
+	unlock := s.rlockAll()
+	defer unlock()
+
+	var items []Item
+	for node := s.index.Seek(start); node != nil; node = node.Next() {
+		if end != "" && node.Key >= end {
+			break
+		}
+
+		entry := s.shardFor(node.Key).data[node.Key]
+		if entry.expired(now) {
+			continue
+		}
+
+		if limit > 0 && len(items) == limit {
+			return items, true
+		}
+
+		items = append(items, Item{Key: node.Key, Entry: entry})
+	}
+
+	return items, false
+}
+
+// PrefixEnd returns the smallest key greater than every key starting with
+// prefix, or "" if there is none, so that [prefix, PrefixEnd(prefix)) is
+// the range of keys with that prefix.
+func PrefixEnd(prefix string) string {
+	b := []byte(prefix)
+	for i := len(b) - 1; i >= 0; i-- {
+		if b[i] < 0xff {
+			b[i]++
+			return string(b[:i+1])
+		}
+	}
+	return ""
+}
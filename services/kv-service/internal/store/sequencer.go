@@ -0,0 +1,84 @@
+package store
+
+import (
+	"sync"
+
+	"github.com/alexey-y-a/go-txlog-microservices/libs/txlog"
+)
+
+// sequencer makes log records visible in LSN order. Writers append to the
+// log concurrently and may finish in any order; each one waits until every
+// record with a smaller LSN has been applied before applying its own, so
+// that the order in which writes become visible is the order of the log.
+type sequencer struct {
+	mu      sync.Mutex
+	applied uint64
+	// waiting holds the channel of the writer that follows each LSN.
+	waiting map[uint64]chan struct{}
+}
+
+func newSequencer(applied uint64) *sequencer {
+	return &sequencer{
+		applied: applied,
+		waiting: make(map[uint64]chan struct{}),
+	}
+}
+
+// wait blocks until all records before first have been applied.
+func (q *sequencer) wait(first uint64) {
+	q.mu.Lock()
+	if q.applied >= first-1 {
+		q.mu.Unlock()
+		return
+	}
+
+	ch := make(chan struct{})
+	q.waiting[first-1] = ch
+	q.mu.Unlock()
+
+	<-ch
+}
+
+// done records that all records up to last have been applied and wakes the
+// writer of the next one.
+func (q *sequencer) done(last uint64) {
+	q.mu.Lock()
+	q.applied = last
+	ch, ok := q.waiting[last]
+	delete(q.waiting, last)
+	q.mu.Unlock()
+
+	if ok {
+		close(ch)
+	}
+}
+
+// last returns the LSN of the last applied record.
+func (q *sequencer) last() uint64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.applied
+}
+
+// publish runs apply for events, which hold consecutive LSNs, once every
+// earlier record is visible, and then hands them to the subscribers. Logs
+// that do not assign LSNs report 0 and are not ordered.
+func (s *Store) publish(events []txlog.Event, apply func()) {
+	first, last := events[0].LSN, events[len(events)-1].LSN
+	if last == 0 {
+		apply()
+		s.feed.broadcast(events)
+		return
+	}
+
+	s.seq.wait(first)
+	apply()
+	s.feed.broadcast(events)
+	s.seq.done(last)
+}
+
+// AppliedLSN returns the LSN of the last record applied to the store.
+func (s *Store) AppliedLSN() uint64 {
+	return s.seq.last()
+}
@@ -0,0 +1,196 @@
+package store
+
+import (
+	"maps"
+	"slices"
+	"sync"
+
+	"github.com/alexey-y-a/go-txlog-microservices/libs/txlog"
+	"github.com/alexey-y-a/go-txlog-microservices/services/kv-service/internal/index"
+)
+
+// defaultShards is the number of shards of a store. Writers and readers of
+// keys in different shards do not contend on any lock except around Append.
+const defaultShards = 64
+
+// shard holds the keys whose hash maps to it.
+//
+// writer serialises the writers of the shard's keys from the precondition
+// check until the event is applied, so that they are applied in the order
+// they were logged. mu guards data and tombs and is held only for map
+// access.
+type shard struct {
+	writer sync.Mutex
+	mu     sync.RWMutex
+	data   map[string]Entry
+	// tombs holds the stamped deletes of keys missing from data.
+	tombs map[string]tombstone
+}
+
+func newShards(n int) []shard {
+	shards := make([]shard, n)
+	for i := range shards {
+		shards[i].data = make(map[string]Entry)
+		shards[i].tombs = make(map[string]tombstone)
+	}
+	return shards
+}
+
+// shardIndex hashes key with 32-bit FNV-1a, inlined to avoid allocating on
+// every access.
+func (s *Store) shardIndex(key string) int {
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	return int(h % uint32(len(s.shards)))
+}
+
+func (s *Store) shardFor(key string) *shard {
+	return &s.shards[s.shardIndex(key)]
+}
+
+// shardIndexes returns the distinct shards of keys in ascending order, the
+// order in which multiple shards are always locked.
+func (s *Store) shardIndexes(keys []string) []int {
+	idx := make([]int, 0, len(keys))
+	for _, key := range keys {
+		idx = append(idx, s.shardIndex(key))
+	}
+
+	slices.Sort(idx)
+	return slices.Compact(idx)
+}
+
+func (s *Store) get(key string) (Entry, bool) {
+	sh := s.shardFor(key)
+
+	sh.mu.RLock()
+	entry, ok := sh.data[key]
+	sh.mu.RUnlock()
+
+	return entry, ok
+}
+
+// lockKeys locks the writers of the shards of keys and returns a function
+// that unlocks them.
+func (s *Store) lockKeys(keys ...string) func() {
+	if len(keys) == 1 {
+		sh := s.shardFor(keys[0])
+		sh.writer.Lock()
+		return sh.writer.Unlock
+	}
+
+	idx := s.shardIndexes(keys)
+
+	for _, i := range idx {
+		s.shards[i].writer.Lock()
+	}
+
+	return func() {
+		for _, i := range idx {
+			s.shards[i].writer.Unlock()
+		}
+	}
+}
+
+// rlockAll read-locks every shard and the index, giving a view of the store
+// that no write is halfway through, and returns a function that unlocks
+// them.
+func (s *Store) rlockAll() func() {
+	for i := range s.shards {
+		s.shards[i].mu.RLock()
+	}
+	s.indexMu.RLock()
+
+	return func() {
+		s.indexMu.RUnlock()
+		for i := range s.shards {
+			s.shards[i].mu.RUnlock()
+		}
+	}
+}
+
+func (s *Store) apply(e txlog.Event) {
+	sh := s.shardFor(e.Key)
+
+	sh.mu.Lock()
+	s.applyLocked(sh, e)
+	sh.mu.Unlock()
+}
+
+// applyLocked applies e to sh, which must be the shard of e.Key and locked.
+// The index is only touched when a key appears or disappears.
+func (s *Store) applyLocked(sh *shard, e txlog.Event) {
+	_, exists := sh.data[e.Key]
+
+	switch e.Op {
+	case txlog.OpSet:
+		sh.data[e.Key] = Entry{Value: e.Value, Version: e.LSN, ExpiresAt: e.ExpiresAt, Stamp: e.Stamp}
+		delete(sh.tombs, e.Key)
+		if exists {
+			return
+		}
+
+		s.indexMu.Lock()
+		s.index.Insert(e.Key)
+		s.indexMu.Unlock()
+		s.keys.Add(1)
+	case txlog.OpDelete, txlog.OpExpire:
+		if e.Op == txlog.OpDelete && e.Stamp != 0 {
+			sh.tombs[e.Key] = newTombstone(e, s.now())
+		}
+		if !exists {
+			return
+		}
+		delete(sh.data, e.Key)
+
+		s.indexMu.Lock()
+		s.index.Remove(e.Key)
+		s.indexMu.Unlock()
+		s.keys.Add(-1)
+	}
+}
+
+// load replaces the contents of the store with data and tombs.
+func (s *Store) load(data map[string]Entry, tombs map[string]tombstone) {
+	shards := newShards(len(s.shards))
+	keys := index.NewSkiplist()
+
+	for key, entry := range data {
+		shards[s.shardIndex(key)].data[key] = entry
+		keys.Insert(key)
+	}
+	for key, tomb := range tombs {
+		shards[s.shardIndex(key)].tombs[key] = tomb
+	}
+
+	s.shards = shards
+	s.index = keys
+	s.keys.Store(int64(len(data)))
+}
+
+// clone returns a copy of all entries.
+func (s *Store) clone() map[string]Entry {
+	unlock := s.rlockAll()
+	defer unlock()
+
+	data := make(map[string]Entry, s.keys.Load())
+	for i := range s.shards {
+		maps.Copy(data, s.shards[i].data)
+	}
+	return data
+}
+
+// cloneTombstones returns a copy of all tombstones.
+func (s *Store) cloneTombstones() map[string]tombstone {
+	unlock := s.rlockAll()
+	defer unlock()
+
+	tombs := make(map[string]tombstone)
+	for i := range s.shards {
+		maps.Copy(tombs, s.shards[i].tombs)
+	}
+	return tombs
+}
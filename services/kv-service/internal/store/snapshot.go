@@ -0,0 +1,511 @@
+package store
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alexey-y-a/go-txlog-microservices/libs/logger"
+	"github.com/alexey-y-a/go-txlog-microservices/libs/txlog"
+)
+
+var (
+	ErrSnapshotUnsupported = errors.New("store: snapshots are not configured")
+	ErrSnapshotRunning     = errors.New("store: snapshot already running")
+)
+
+const (
+	snapshotSuffix  = ".snap"
+	snapshotVersion = 5
+
+	// keepSnapshots is how many snapshots are kept on disk. The log is
+	// truncated only up to the oldest of them, so a corrupt newest snapshot
+	// can be replaced by the previous one.
+	keepSnapshots = 2
+)
+
+var (
+	snapshotMagic    = [4]byte{'K', 'V', 'S', 'N'}
+	snapshotCRCTable = crc32.MakeTable(crc32.Castagnoli)
+)
+
+type SnapshotStats struct {
+	Segment  uint64        `json:"segment"`
+	Keys     int           `json:"keys"`
+	Bytes    int64         `json:"bytes"`
+	Duration time.Duration `json:"duration"`
+}
+
+// SetSnapshotDir sets the directory snapshots are written to. Snapshots also
+// require a log implementing txlog.Checkpointer.
+func (s *Store) SetSnapshotDir(dir string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.snapshotDir = dir
+}
+
+// NewStoreFromSnapshot restores a store from the newest valid snapshot in
+// dir and replays only the part of the SegmentedLog at path written after
+// it. Corrupt snapshots are skipped in favour of older ones; without any
+// usable snapshot the whole log is replayed.
+func NewStoreFromSnapshot(log txlog.Log, path, dir string) (*Store, ReplayStats, error) {
+	s := NewStore(log)
+	s.snapshotDir = dir
+
+	var stats ReplayStats
+	start := time.Now()
+
+	segments, err := listSnapshots(dir)
+	if err != nil {
+		return nil, stats, err
+	}
+
+	var from uint64
+	for _, segment := range segments {
+		data, tombs, err := readSnapshot(snapshotPath(dir, segment), segment)
+		if err != nil {
+			stats.CorruptSnapshots++
+			continue
+		}
+
+		s.load(data, tombs)
+		from = segment
+		stats.SnapshotKeys = len(data)
+		break
+	}
+
+	readStats, err := txlog.ReadFileFrom(path, from, func(e txlog.Event) error {
+		s.apply(e)
+		return nil
+	})
+
+	s.records.Store(int64(readStats.Events))
+
+	stats.Applied = readStats.Events
+	stats.Skipped = readStats.Skipped
+	stats.Snapshot = from
+	stats.Duration = time.Since(start)
+
+	if err != nil {
+		return nil, stats, fmt.Errorf("store: replay log %q from segment %d: %w", path, from, err)
+	}
+
+	return s, stats, nil
+}
+
+// Snapshot writes the current state to a snapshot file and discards the log
+// segments no snapshot depends on any more. Writes are paused only while
+// the log is checkpointed and the state is copied.
+func (s *Store) Snapshot() (SnapshotStats, error) {
+	var stats SnapshotStats
+
+	s.mu.RLock()
+	dir := s.snapshotDir
+	s.mu.RUnlock()
+
+	checkpointer, ok := s.log.(txlog.Checkpointer)
+	if !ok || dir == "" {
+		return stats, ErrSnapshotUnsupported
+	}
+
+	if !s.snapshotting.CompareAndSwap(false, true) {
+		return stats, ErrSnapshotRunning
+	}
+	defer s.snapshotting.Store(false)
+
+	start := time.Now()
+
+	s.writeMu.Lock()
+	segment, err := checkpointer.Checkpoint()
+	if err != nil {
+		s.writeMu.Unlock()
+		return stats, fmt.Errorf("store: checkpoint log: %w", err)
+	}
+
+	data, tombs := s.clone(), s.cloneTombstones()
+	s.dirty.Store(false)
+	s.writeMu.Unlock()
+
+	size, err := writeSnapshot(dir, segment, data, tombs)
+	if err != nil {
+		return stats, err
+	}
+
+	err = pruneSnapshots(dir, checkpointer)
+	if err != nil {
+		return stats, err
+	}
+
+	stats = SnapshotStats{
+		Segment:  segment,
+		Keys:     len(data),
+		Bytes:    size,
+		Duration: time.Since(start),
+	}
+
+	return stats, nil
+}
+
+// StartSnapshots takes a snapshot every interval as long as the store has
+// been written to since the previous one. StopSnapshots stops it.
+func (s *Store) StartSnapshots(interval time.Duration) {
+	s.stopSnapshots = make(chan struct{})
+	s.snapshotsDone = make(chan struct{})
+
+	go s.runSnapshots(interval)
+}
+
+func (s *Store) StopSnapshots() {
+	if s.stopSnapshots == nil {
+		return
+	}
+
+	close(s.stopSnapshots)
+	<-s.snapshotsDone
+}
+
+func (s *Store) runSnapshots(interval time.Duration) {
+	defer close(s.snapshotsDone)
+
+	log := logger.L().With().Str("component", "store").Logger()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stopSnapshots:
+			return
+		case <-ticker.C:
+			if !s.dirty.Load() {
+				continue
+			}
+
+			stats, err := s.Snapshot()
+			if err != nil {
+				if !errors.Is(err, ErrSnapshotRunning) {
+					log.Error().Err(err).Msg("periodic snapshot failed")
+				}
+				continue
+			}
+
+			log.Info().
+				Uint64("segment", stats.Segment).
+				Int("keys", stats.Keys).
+				Int64("bytes", stats.Bytes).
+				Dur("duration", stats.Duration).
+				Msg("snapshot written")
+		}
+	}
+}
+
+// pruneSnapshots removes all but the newest keepSnapshots snapshots and
+// truncates the log before the oldest one that is kept.
+func pruneSnapshots(dir string, checkpointer txlog.Checkpointer) error {
+	segments, err := listSnapshots(dir)
+	if err != nil {
+		return err
+	}
+
+	if len(segments) < keepSnapshots {
+		return nil
+	}
+
+	for _, segment := range segments[keepSnapshots:] {
+		err = os.Remove(snapshotPath(dir, segment))
+		if err != nil {
+			return fmt.Errorf("store: remove snapshot %d: %w", segment, err)
+		}
+	}
+
+	err = checkpointer.TruncateBefore(segments[keepSnapshots-1])
+	if err != nil {
+		return fmt.Errorf("store: truncate log: %w", err)
+	}
+	return nil
+}
+
+func snapshotPath(dir string, segment uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("%020d%s", segment, snapshotSuffix))
+}
+
+// listSnapshots returns the segments of the snapshots in dir, newest first.
+func listSnapshots(dir string) ([]uint64, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("store: list snapshots: %w", err)
+	}
+
+	var segments []uint64
+	for _, entry := range entries {
+		name, ok := strings.CutSuffix(entry.Name(), snapshotSuffix)
+		if !ok {
+			continue
+		}
+
+		segment, err := strconv.ParseUint(name, 10, 64)
+		if err != nil {
+			continue
+		}
+		segments = append(segments, segment)
+	}
+
+	slices.Sort(segments)
+	slices.Reverse(segments)
+
+	return segments, nil
+}
+
+// writeSnapshot atomically writes data and tombs as the snapshot for
+// segment.
+func writeSnapshot(dir string, segment uint64, data map[string]Entry, tombs map[string]tombstone) (int64, error) {
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return 0, fmt.Errorf("store: create snapshot dir %q: %w", dir, err)
+	}
+
+	buf := encodeSnapshot(segment, data, tombs)
+
+	path := snapshotPath(dir, segment)
+	tmpPath := path + ".tmp"
+
+	f, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o644)
+	if err != nil {
+		return 0, fmt.Errorf("store: create snapshot: %w", err)
+	}
+
+	_, err = f.Write(buf)
+	if err == nil {
+		err = f.Sync()
+	}
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return 0, fmt.Errorf("store: write snapshot: %w", err)
+	}
+
+	err = os.Rename(tmpPath, path)
+	if err != nil {
+		return 0, fmt.Errorf("store: rename snapshot: %w", err)
+	}
+
+	err = syncDir(dir)
+	if err != nil {
+		return 0, err
+	}
+
+	return int64(len(buf)), nil
+}
+
+// encodeSnapshot encodes data and tombs as the snapshot for segment.
+//
+// Layout: "KVSN", version byte, 3 reserved bytes, uvarint segment, uvarint
+// key count, then uvarint-length-prefixed key and value and the uvarint key
+// version, varint expiry time in Unix nanoseconds (0 for none) and uvarint
+// stamp for every key in sorted order, then uvarint tombstone count and the
+// uvarint-length-prefixed key, uvarint stamp and version and varint delete
+// time of every tombstone in sorted order, then the CRC32C of everything
+// before it. Version 1 snapshots have no key versions, version 2 no expiry
+// times, version 3 no stamps, version 4 no tombstones.
+func encodeSnapshot(segment uint64, data map[string]Entry, tombs map[string]tombstone) []byte {
+	buf := append([]byte(nil), snapshotMagic[:]...)
+	buf = append(buf, snapshotVersion, 0, 0, 0)
+	buf = binary.AppendUvarint(buf, segment)
+	buf = binary.AppendUvarint(buf, uint64(len(data)))
+
+	for _, key := range slices.Sorted(maps.Keys(data)) {
+		buf = binary.AppendUvarint(buf, uint64(len(key)))
+		buf = append(buf, key...)
+		buf = binary.AppendUvarint(buf, uint64(len(data[key].Value)))
+		buf = append(buf, data[key].Value...)
+		buf = binary.AppendUvarint(buf, data[key].Version)
+
+		var expiresAt int64
+		if !data[key].ExpiresAt.IsZero() {
+			expiresAt = data[key].ExpiresAt.UnixNano()
+		}
+		buf = binary.AppendVarint(buf, expiresAt)
+		buf = binary.AppendUvarint(buf, data[key].Stamp)
+	}
+
+	buf = binary.AppendUvarint(buf, uint64(len(tombs)))
+	for _, key := range slices.Sorted(maps.Keys(tombs)) {
+		buf = binary.AppendUvarint(buf, uint64(len(key)))
+		buf = append(buf, key...)
+		buf = binary.AppendUvarint(buf, tombs[key].Stamp)
+		buf = binary.AppendUvarint(buf, tombs[key].Version)
+		buf = binary.AppendVarint(buf, tombs[key].DeletedAt.UnixNano())
+	}
+
+	return binary.LittleEndian.AppendUint32(buf, crc32.Checksum(buf, snapshotCRCTable))
+}
+
+func readSnapshot(path string, segment uint64) (map[string]Entry, map[string]tombstone, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("store: read snapshot: %w", err)
+	}
+
+	stored, data, tombs, err := decodeSnapshot(buf)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if stored != segment {
+		return nil, nil, fmt.Errorf("store: snapshot segment does not match file name %d", segment)
+	}
+
+	return data, tombs, nil
+}
+
+// decodeSnapshot decodes a snapshot encoded by encodeSnapshot and returns
+// its segment, data and tombstones.
+func decodeSnapshot(buf []byte) (uint64, map[string]Entry, map[string]tombstone, error) {
+	if len(buf) < len(snapshotMagic)+4+4 || !bytes.HasPrefix(buf, snapshotMagic[:]) {
+		return 0, nil, nil, errors.New("store: not a snapshot file")
+	}
+
+	body, sum := buf[:len(buf)-4], binary.LittleEndian.Uint32(buf[len(buf)-4:])
+	if crc32.Checksum(body, snapshotCRCTable) != sum {
+		return 0, nil, nil, errors.New("store: snapshot checksum mismatch")
+	}
+
+	version := body[4]
+	if version < 1 || version > snapshotVersion {
+		return 0, nil, nil, fmt.Errorf("store: unsupported snapshot version %d", version)
+	}
+
+	rd := bytes.NewReader(body[8:])
+
+	segment, err := binary.ReadUvarint(rd)
+	if err != nil {
+		return 0, nil, nil, errors.New("store: invalid snapshot segment")
+	}
+
+	count, err := binary.ReadUvarint(rd)
+	if err != nil || count > uint64(rd.Len()) {
+		return 0, nil, nil, errors.New("store: invalid snapshot key count")
+	}
+
+	data := make(map[string]Entry, count)
+	for i := uint64(0); i < count; i++ {
+		key, err := readSnapshotString(rd)
+		if err != nil {
+			return 0, nil, nil, err
+		}
+
+		var entry Entry
+		entry.Value, err = readSnapshotString(rd)
+		if err != nil {
+			return 0, nil, nil, err
+		}
+
+		if version >= 2 {
+			entry.Version, err = binary.ReadUvarint(rd)
+			if err != nil {
+				return 0, nil, nil, errors.New("store: invalid snapshot entry version")
+			}
+		}
+
+		if version >= 3 {
+			expiresAt, err := binary.ReadVarint(rd)
+			if err != nil {
+				return 0, nil, nil, errors.New("store: invalid snapshot entry expiry")
+			}
+			if expiresAt != 0 {
+				entry.ExpiresAt = time.Unix(0, expiresAt)
+			}
+		}
+
+		if version >= 4 {
+			entry.Stamp, err = binary.ReadUvarint(rd)
+			if err != nil {
+				return 0, nil, nil, errors.New("store: invalid snapshot entry stamp")
+			}
+		}
+
+		data[key] = entry
+	}
+
+	tombs := make(map[string]tombstone)
+	if version >= 5 {
+		count, err := binary.ReadUvarint(rd)
+		if err != nil || count > uint64(rd.Len()) {
+			return 0, nil, nil, errors.New("store: invalid snapshot tombstone count")
+		}
+
+		for i := uint64(0); i < count; i++ {
+			key, err := readSnapshotString(rd)
+			if err != nil {
+				return 0, nil, nil, err
+			}
+
+			var tomb tombstone
+			tomb.Stamp, err = binary.ReadUvarint(rd)
+			if err == nil {
+				tomb.Version, err = binary.ReadUvarint(rd)
+			}
+			var deletedAt int64
+			if err == nil {
+				deletedAt, err = binary.ReadVarint(rd)
+			}
+			if err != nil {
+				return 0, nil, nil, errors.New("store: invalid snapshot tombstone")
+			}
+			tomb.DeletedAt = time.Unix(0, deletedAt)
+
+			tombs[key] = tomb
+		}
+	}
+
+	if rd.Len() != 0 {
+		return 0, nil, nil, errors.New("store: trailing data in snapshot")
+	}
+
+	return segment, data, tombs, nil
+}
+
+func readSnapshotString(rd *bytes.Reader) (string, error) {
+	n, err := binary.ReadUvarint(rd)
+	if err != nil || n > uint64(rd.Len()) {
+		return "", errors.New("store: invalid snapshot entry")
+	}
+
+	b := make([]byte, n)
+	_, err = rd.Read(b)
+	if err != nil && n > 0 {
+		return "", errors.New("store: invalid snapshot entry")
+	}
+
+	return string(b), nil
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("store: open dir %q: %w", dir, err)
+	}
+	defer d.Close()
+
+	err = d.Sync()
+	if err != nil {
+		return fmt.Errorf("store: sync dir %q: %w", dir, err)
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package store
+
+import (
+	"errors"
+	"time"
+
+	"github.com/alexey-y-a/go-txlog-microservices/libs/txlog"
+)
+
+// ErrStale is returned for a stamped write to a key that already holds a
+// write with the same or a later stamp.
+var ErrStale = errors.New("store: stale write")
+
+// SetStamped is SetWithTTL for a write stamped by a client that writes the
+// key to several stores. The write is rejected with ErrStale if the key
+// holds a write with a stamp of at least stamp, so the stores end up with
+// the newest value whatever order the writes arrive in. A stamp of zero
+// makes it an unstamped write.
+func (s *Store) SetStamped(key, value string, ttl time.Duration, stamp uint64) (uint64, error) {
+	e := txlog.Event{
+		Key:   key,
+		Value: value,
+		Op:    txlog.OpSet,
+		Stamp: stamp,
+	}
+	if ttl > 0 {
+		e.ExpiresAt = s.now().Add(ttl)
+	}
+
+	return s.write(e, Condition{})
+}
+
+// DeleteStamped is Delete rejected with ErrStale like SetStamped. The key
+// keeps a tombstone with the stamp, so a delayed older write does not bring
+// it back, until a compaction after txlog.TombstoneGrace drops it. The
+// delete is logged even if the key is missing.
+func (s *Store) DeleteStamped(key string, stamp uint64) (uint64, error) {
+	return s.write(txlog.Event{
+		Key:   key,
+		Op:    txlog.OpDelete,
+		Stamp: stamp,
+	}, Condition{})
+}
+
+// DeletedStamp returns the stamp of the delete that removed key, if key is
+// missing and was last removed by DeleteStamped.
+func (s *Store) DeletedStamp(key string) (uint64, bool) {
+	sh := s.shardFor(key)
+
+	sh.mu.RLock()
+	tomb, ok := sh.tombs[key]
+	sh.mu.RUnlock()
+
+	return tomb.Stamp, ok
+}
+
+// tombstone is what a stamped delete leaves of a key: the stamp a stamped
+// write has to exceed to bring the key back.
+type tombstone struct {
+	Stamp   uint64
+	Version uint64
+	// DeletedAt is the time of the delete record; the tombstone is dropped
+	// TombstoneGrace after it.
+	DeletedAt time.Time
+}
+
+func newTombstone(e txlog.Event, now time.Time) tombstone {
+	if e.Time.IsZero() {
+		e.Time = now
+	}
+	return tombstone{Stamp: e.Stamp, Version: e.LSN, DeletedAt: e.Time}
+}
+
+// dropTombstones removes the tombstones older than txlog.TombstoneGrace,
+// as compaction does with their delete records.
+func (s *Store) dropTombstones() {
+	now := s.now()
+
+	for i := range s.shards {
+		sh := &s.shards[i]
+
+		sh.mu.Lock()
+		for key, tomb := range sh.tombs {
+			if now.Sub(tomb.DeletedAt) >= txlog.TombstoneGrace {
+				delete(sh.tombs, key)
+			}
+		}
+		sh.mu.Unlock()
+	}
+}
@@ -3,66 +3,192 @@ package store
 import (
 	"fmt"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/alexey-y-a/go-txlog-microservices/libs/txlog"
+	"github.com/alexey-y-a/go-txlog-microservices/services/kv-service/internal/index"
 )
 
 type Store struct{
+    // mu guards the configuration of the store; the data lives in shards.
     mu sync.RWMutex
-    data map[string]string
+    shards []shard
+    keys atomic.Int64
     log txlog.Log
+
+    // index holds all keys in order, for Scan. indexMu is taken after the
+    // lock of a shard, never before.
+    indexMu sync.RWMutex
+    index *index.Skiplist
+
+    // seq applies writes in the order of their LSNs.
+    seq *sequencer
+    feed feed
+    // readOnly is set on followers, whose log is only written by
+    // ApplyReplicated.
+    readOnly atomic.Bool
+
+    records atomic.Int64
+    compacting atomic.Bool
+    compactRatio float64
+    compactMinRecords int64
+
+    // writeMu is held shared by writers from Append until the event is
+    // applied, and exclusively by Snapshot to see a state that matches the
+    // log exactly.
+    writeMu sync.RWMutex
+    dirty atomic.Bool
+    snapshotDir string
+    snapshotting atomic.Bool
+    stopSnapshots chan struct{}
+    snapshotsDone chan struct{}
+
+    now func() time.Time
+    expiredKeys atomic.Uint64
+    sweeper *Sweeper
 }
 
 func NewStore(log txlog.Log) *Store {
+    return newStore(log, defaultShards)
+}
+
+func newStore(log txlog.Log, shards int) *Store {
+    // Writes continue the log, so the sequence starts at its last LSN.
+    var lastLSN uint64
+    if l, ok := log.(interface{ LastLSN() uint64 }); ok {
+        lastLSN = l.LastLSN()
+    }
+
     return &Store {
-        data: make(map[string]string),
+        shards: newShards(shards),
+        index: index.NewSkiplist(),
+        seq: newSequencer(lastLSN),
         log: log,
+        now: time.Now,
     }
 }
 
-func (s *Store) Set(key, value string) error {
-    event := txlog.Event {
-        Key: key,
-        Value: value,
-        Op: "set",
+type ReplayStats struct {
+    Applied  int
+    Skipped  int
+    Duration time.Duration
+
+    // Snapshot is the segment of the snapshot the store was restored from,
+    // zero if the whole log was replayed.
+    Snapshot         uint64
+    SnapshotKeys     int
+    CorruptSnapshots int
+}
+
+func NewStoreFromLog(log txlog.Log, path string) (*Store, ReplayStats, error) {
+    s := NewStore(log)
+
+    start := time.Now()
+
+    readStats, err := txlog.ReadFile(path, func(e txlog.Event) error {
+        s.apply(e)
+        return nil
+    })
+
+    s.records.Store(int64(readStats.Events))
+
+    stats := ReplayStats{
+        Applied:  readStats.Events,
+        Skipped:  readStats.Skipped,
+        Duration: time.Since(start),
     }
 
-    err := s.log.Append(event)
     if err != nil {
-        return fmt.Errorf("store: append set event: %w", err)
+        return nil, stats, fmt.Errorf("store: replay log %q: %w", path, err)
     }
 
-    s.mu.Lock()
-    s.data[key] = value
-    s.mu.Unlock()
+    return s, stats, nil
+}
+
+// Len returns the number of keys in the store, including expired keys that
+// have not been removed yet.
+func (s *Store) Len() int {
+    return int(s.keys.Load())
+}
 
-    return nil
+// Set stores value under key and returns the LSN of the log record, which is
+// also the new version of the key.
+func (s *Store) Set(key, value string) (uint64, error) {
+    return s.SetIf(key, value, Condition{})
 }
 
 func (s *Store) Get(key string) (string, bool) {
-    s.mu.RLock()
-    value, ok :=  s.data[key]
-    s.mu.RUnlock()
+    entry, ok := s.GetEntry(key)
+    return entry.Value, ok
+}
 
-    return value, ok
+// Delete removes key and returns the LSN of the log record.
+func (s *Store) Delete(key string) (uint64, error) {
+    return s.DeleteIf(key, Condition{})
 }
 
-func (s *Store) Delete(key string) error {
-    event := txlog.Event {
-        Key: key,
-        Value: "",
-        Op: "delete",
+// write appends e and applies it if cond holds for the current state of the
+// key and e is newer than it; see SetStamped.
+func (s *Store) write(e txlog.Event, cond Condition) (uint64, error) {
+    if s.readOnly.Load() {
+        return 0, ErrReadOnly
     }
 
-    err := s.log.Append(event)
-    if err != nil {
-        return fmt.Errorf("store: append delete event: %w", err)
+    unlock := s.lockKeys(e.Key)
+    defer unlock()
+
+    current, exists := s.get(e.Key)
+
+    if exists && !current.ExpiresAt.IsZero() && current.expired(s.now()) {
+        exists = false
+    }
+
+    if !cond.Holds(current.Version, exists) {
+        return 0, ErrPreconditionFailed
+    }
+
+    if e.Stamp != 0 && exists && current.Stamp >= e.Stamp {
+        return 0, ErrStale
     }
 
-    s.mu.Lock()
-    delete(s.data, key)
-    s.mu.Unlock()
+    if e.Stamp != 0 && !exists {
+        deleted, ok := s.DeletedStamp(e.Key)
+        if ok && deleted >= e.Stamp {
+            return 0, ErrStale
+        }
+    }
 
-    return nil
+    return s.commit(e)
 }
 
+// commit appends e and applies it in log order. Must be called with the
+// key of e locked.
+//
+// A log that wrote the record but failed to sync it returns its LSN along
+// with the error. The record will be replayed after a restart, so it is
+// applied anyway and the caller gets an error meaning the outcome is
+// unknown.
+func (s *Store) commit(e txlog.Event) (uint64, error) {
+    s.writeMu.RLock()
+    defer s.writeMu.RUnlock()
+
+    lsn, err := s.log.Append(e)
+    if err != nil && lsn == 0 {
+        return 0, fmt.Errorf("store: append %s event: %w", e.Op, err)
+    }
+    e.LSN = lsn
+
+    s.publish([]txlog.Event{e}, func() {
+        s.apply(e)
+    })
+
+    s.records.Add(1)
+    s.dirty.Store(true)
+    s.maybeCompact()
+
+    if err != nil {
+        return 0, fmt.Errorf("store: sync %s event: %w", e.Op, err)
+    }
+    return lsn, nil
+}
@@ -1,7 +1,17 @@
 package store
 
 import (
+	"errors"
+	"fmt"
+	"maps"
+	"math/rand/v2"
+	"os"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/alexey-y-a/go-txlog-microservices/libs/txlog"
 	"github.com/stretchr/testify/require"
@@ -12,9 +22,10 @@ type fakeLog struct {
     events []txlog.Event
 }
 
-func (f *fakeLog) Append(e txlog.Event) error {
+func (f *fakeLog) Append(e txlog.Event) (uint64, error) {
+    e.LSN = uint64(len(f.events) + 1)
     f.events = append(f.events, e)
-    return nil
+    return e.LSN, nil
 }
 
 func (f *fakeLog) Sync() error {
@@ -31,8 +42,9 @@ func TestStore_SetAndGet(t *testing.T) {
     flog := &fakeLog{}
     s := NewStore(flog)
 
-    err := s.Set("user42", "Alice")
+    lsn, err := s.Set("user42", "Alice")
     require.NoError(t, err, "Set should not return error")
+    require.Equal(t, uint64(1), lsn, "Set should return the LSN assigned by the log")
 
     value, ok := s.Get("user42")
     require.True(t, ok, "Get should return correct value")
@@ -50,15 +62,16 @@ func TestStore_Delete(t *testing.T) {
     flog := &fakeLog{}
     s := NewStore(flog)
 
-    err := s.Set("user1", "Bob")
+    _, err := s.Set("user1", "Bob")
     require.NoError(t, err, "Set should not return error")
 
     value, ok := s.Get("user1")
     require.True(t, ok, "Get should report that key exist before delete")
     require.Equal(t, "Bob", value, "Get should return correct value before delete")
 
-    err = s.Delete("user1")
+    lsn, err := s.Delete("user1")
     require.NoError(t, err, "Delete should not return error")
+    require.Equal(t, uint64(2), lsn, "Delete should return the LSN assigned by the log")
 
     _, ok = s.Get("user1")
     require.False(t, ok, "Get should report that key does not exist after delete")
@@ -68,4 +81,907 @@ func TestStore_Delete(t *testing.T) {
     deleteEvent := flog.events[1]
     require.Equal(t, "delete", deleteEvent.Op, "second event Op should be 'delete'")
     require.Equal(t, "user1", deleteEvent.Key, "second event Key should match")
-}
\ No newline at end of file
+}
+
+func TestNewStoreFromLog(t *testing.T) {
+    t.Helper()
+
+    logPath := t.TempDir() + "/kv.log"
+
+    logFile, err := txlog.NewFileLog(logPath)
+    require.NoError(t, err)
+
+    s := NewStore(logFile)
+    _, err = s.Set("user1", "Alice")
+    require.NoError(t, err)
+    _, err = s.Set("user2", "Bob")
+    require.NoError(t, err)
+    _, err = s.Set("user1", "Carol")
+    require.NoError(t, err)
+    _, err = s.Delete("user2")
+    require.NoError(t, err)
+    require.NoError(t, logFile.Close())
+
+    logFile, err = txlog.NewFileLog(logPath)
+    require.NoError(t, err)
+    defer logFile.Close()
+
+    restored, stats, err := NewStoreFromLog(logFile, logPath)
+    require.NoError(t, err, "NewStoreFromLog should not return error")
+    require.Equal(t, 4, stats.Applied, "all events should be applied")
+    require.Zero(t, stats.Skipped, "no lines should be skipped")
+
+    value, ok := restored.Get("user1")
+    require.True(t, ok, "user1 should exist after replay")
+    require.Equal(t, "Carol", value, "user1 should have the last written value")
+
+    _, ok = restored.Get("user2")
+    require.False(t, ok, "user2 should be deleted after replay")
+}
+
+
+func TestStore_CompactUnsupported(t *testing.T) {
+    t.Helper()
+
+    s := NewStore(&fakeLog{})
+
+    _, err := s.Compact()
+    require.ErrorIs(t, err, ErrCompactionUnsupported, "fakeLog cannot be compacted")
+}
+
+func TestStore_AutoCompact(t *testing.T) {
+    t.Helper()
+
+    logPath := t.TempDir() + "/kv.log"
+
+    logFile, err := txlog.NewFileLog(logPath)
+    require.NoError(t, err)
+
+    s := NewStore(logFile)
+    s.SetCompactionPolicy(0.5, 20)
+
+    for i := 0; i < 19; i++ {
+        _, err = s.Set("counter", fmt.Sprint(i))
+    require.NoError(t, err)
+    }
+    require.InDelta(t, 1-1.0/19, s.DeadRatio(), 0.001, "DeadRatio should count superseded records")
+
+    _, err = s.Set("counter", "last")
+    require.NoError(t, err)
+    _, err = s.Set("other", "value")
+    require.NoError(t, err)
+
+    require.Eventually(t, func() bool {
+        return s.DeadRatio() < 0.5 && !s.compacting.Load()
+    }, 2*time.Second, 10*time.Millisecond, "automatic compaction should run")
+
+    require.NoError(t, logFile.Close())
+
+    logFile, err = txlog.NewFileLog(logPath)
+    require.NoError(t, err)
+    defer logFile.Close()
+
+    restored, stats, err := NewStoreFromLog(logFile, logPath)
+    require.NoError(t, err)
+    require.Less(t, stats.Applied, 21, "compacted log should contain fewer records")
+
+    value, ok := restored.Get("counter")
+    require.True(t, ok)
+    require.Equal(t, "last", value)
+
+    value, ok = restored.Get("other")
+    require.True(t, ok)
+    require.Equal(t, "value", value)
+}
+
+func TestStore_SnapshotUnsupported(t *testing.T) {
+    t.Helper()
+
+    s := NewStore(&fakeLog{})
+    s.SetSnapshotDir(t.TempDir())
+
+    _, err := s.Snapshot()
+    require.ErrorIs(t, err, ErrSnapshotUnsupported, "fakeLog cannot be checkpointed")
+}
+
+func TestNewStoreFromSnapshot(t *testing.T) {
+    t.Helper()
+
+    logDir := t.TempDir()
+    snapshotDir := t.TempDir()
+
+    logFile, err := txlog.OpenSegmentedLog(logDir)
+    require.NoError(t, err)
+
+    s := NewStore(logFile)
+    s.SetSnapshotDir(snapshotDir)
+
+    _, err = s.Set("user1", "Alice")
+    require.NoError(t, err)
+    _, err = s.Set("user2", "Bob")
+    require.NoError(t, err)
+
+    first, err := s.Snapshot()
+    require.NoError(t, err, "Snapshot should not return error")
+    require.Equal(t, 2, first.Keys)
+
+    _, err = s.Delete("user2")
+    require.NoError(t, err)
+    _, err = s.Set("user3", "Carol")
+    require.NoError(t, err)
+
+    second, err := s.Snapshot()
+    require.NoError(t, err)
+    require.Greater(t, second.Segment, first.Segment)
+
+    _, err = s.Set("user1", "Dave")
+    require.NoError(t, err)
+
+    third, err := s.Snapshot()
+    require.NoError(t, err)
+
+    _, err = s.Set("user4", "Eve")
+    require.NoError(t, err)
+    require.NoError(t, logFile.Close())
+
+    snapshots, err := listSnapshots(snapshotDir)
+    require.NoError(t, err)
+    require.Equal(t, []uint64{third.Segment, second.Segment}, snapshots, "only the two newest snapshots should be kept")
+
+    _, err = txlog.OpenReaderFrom(logDir, first.Segment)
+    require.ErrorIs(t, err, txlog.ErrLogTruncated, "log before the oldest kept snapshot should be discarded")
+
+    want := map[string]string{"user1": "Dave", "user3": "Carol", "user4": "Eve"}
+
+    restore := func() (*Store, ReplayStats) {
+        logFile, err := txlog.OpenSegmentedLog(logDir)
+        require.NoError(t, err)
+        t.Cleanup(func() { logFile.Close() })
+
+        restored, stats, err := NewStoreFromSnapshot(logFile, logDir, snapshotDir)
+        require.NoError(t, err, "NewStoreFromSnapshot should not return error")
+
+        for key, value := range want {
+            got, ok := restored.Get(key)
+            require.True(t, ok, "%s should exist after restore", key)
+            require.Equal(t, value, got, "%s should have the last written value", key)
+        }
+        _, ok := restored.Get("user2")
+        require.False(t, ok, "user2 should stay deleted after restore")
+
+        return restored, stats
+    }
+
+    _, stats := restore()
+    require.Equal(t, third.Segment, stats.Snapshot, "newest snapshot should be used")
+    require.Equal(t, 1, stats.Applied, "only the tail after the snapshot should be replayed")
+
+    path := snapshotPath(snapshotDir, third.Segment)
+    data, err := os.ReadFile(path)
+    require.NoError(t, err)
+    data[len(data)/2] ^= 0xff
+    require.NoError(t, os.WriteFile(path, data, 0o644))
+
+    _, stats = restore()
+    require.Equal(t, 1, stats.CorruptSnapshots, "corrupt snapshot should be reported")
+    require.Equal(t, second.Segment, stats.Snapshot, "previous snapshot should be used as fallback")
+    require.Equal(t, 2, stats.Applied)
+}
+
+func TestStore_Apply(t *testing.T) {
+    t.Helper()
+
+    logPath := t.TempDir() + "/kv.log"
+
+    logFile, err := txlog.NewFileLog(logPath)
+    require.NoError(t, err)
+
+    s := NewStore(logFile)
+    _, err = s.Set("from", "100")
+    require.NoError(t, err)
+
+    lsn, err := s.Apply(Batch{
+        {Type: txlog.OpSet, Key: "from", Value: "70"},
+        {Type: txlog.OpSet, Key: "to", Value: "30"},
+        {Type: txlog.OpDelete, Key: "pending"},
+    })
+    require.NoError(t, err, "Apply should not return error")
+    require.Equal(t, uint64(4), lsn, "Apply should return the LSN of the last operation")
+
+    _, err = s.Apply(Batch{{Type: txlog.OpSet, Key: "to", Value: "0"}, {Type: "put", Key: "from"}})
+    require.ErrorIs(t, err, ErrInvalidBatch)
+
+    value, _ := s.Get("to")
+    require.Equal(t, "30", value, "a rejected batch should not change the store")
+    require.NoError(t, logFile.Close())
+
+    logFile, err = txlog.NewFileLog(logPath)
+    require.NoError(t, err)
+    defer logFile.Close()
+
+    restored, stats, err := NewStoreFromLog(logFile, logPath)
+    require.NoError(t, err)
+    require.Equal(t, 4, stats.Applied)
+
+    value, _ = restored.Get("from")
+    require.Equal(t, "70", value)
+    value, _ = restored.Get("to")
+    require.Equal(t, "30", value)
+
+    _, err = NewStore(&fakeLog{}).Apply(Batch{{Type: txlog.OpSet, Key: "k", Value: "v"}})
+    require.ErrorIs(t, err, ErrBatchUnsupported, "fakeLog cannot write batches")
+}
+
+func TestStore_SetIf(t *testing.T) {
+    t.Helper()
+
+    s := NewStore(&fakeLog{})
+
+    v1, err := s.Set("user1", "Alice")
+    require.NoError(t, err)
+
+    entry, ok := s.GetEntry("user1")
+    require.True(t, ok)
+    require.Equal(t, Entry{Value: "Alice", Version: v1}, entry, "version should be the LSN of the write")
+
+    v2, err := s.SetIf("user1", "Bob", Condition{IfMatch: []uint64{v1}})
+    require.NoError(t, err, "SetIf with the current version should succeed")
+    require.Greater(t, v2, v1)
+
+    _, err = s.SetIf("user1", "Carol", Condition{IfMatch: []uint64{v1}})
+    require.ErrorIs(t, err, ErrPreconditionFailed, "SetIf with a stale version should fail")
+
+    _, err = s.SetIf("user1", "Carol", Condition{IfNoneMatchAny: true})
+    require.ErrorIs(t, err, ErrPreconditionFailed, "If-None-Match: * should fail for an existing key")
+
+    _, err = s.SetIf("user2", "Dave", Condition{IfNoneMatchAny: true})
+    require.NoError(t, err, "If-None-Match: * should succeed for a new key")
+
+    _, err = s.DeleteIf("missing", Condition{IfMatchAny: true})
+    require.ErrorIs(t, err, ErrPreconditionFailed, "If-Match: * should fail for a missing key")
+
+    _, err = s.DeleteIf("user1", Condition{IfMatch: []uint64{v2}})
+    require.NoError(t, err)
+
+    _, ok = s.Get("user1")
+    require.False(t, ok)
+}
+
+func TestStore_SetStamped(t *testing.T) {
+    t.Helper()
+
+    logPath := t.TempDir() + "/kv.log"
+
+    logFile, err := txlog.NewFileLog(logPath)
+    require.NoError(t, err)
+
+    s := NewStore(logFile)
+
+    _, err = s.SetStamped("user1", "Bob", 0, 20)
+    require.NoError(t, err)
+
+    _, err = s.SetStamped("user1", "Alice", 0, 10)
+    require.ErrorIs(t, err, ErrStale, "an older stamp should be rejected")
+    _, err = s.SetStamped("user1", "Alice", 0, 20)
+    require.ErrorIs(t, err, ErrStale, "the same stamp should be rejected")
+    _, err = s.DeleteStamped("user1", 15)
+    require.ErrorIs(t, err, ErrStale, "an older delete should be rejected")
+
+    entry, ok := s.GetEntry("user1")
+    require.True(t, ok)
+    require.Equal(t, "Bob", entry.Value)
+    require.Equal(t, uint64(20), entry.Stamp)
+
+    _, err = s.SetStamped("user1", "Carol", time.Hour, 30)
+    require.NoError(t, err, "a newer stamp should be accepted")
+
+    _, err = s.Set("user2", "Dave")
+    require.NoError(t, err)
+    _, err = s.SetStamped("user2", "Eve", 0, 5)
+    require.NoError(t, err, "a stamped write should replace an unstamped one")
+
+    _, err = s.DeleteStamped("user2", 6)
+    require.NoError(t, err)
+    _, ok = s.Get("user2")
+    require.False(t, ok)
+
+    _, err = s.SetStamped("user2", "Frank", 0, 1)
+    require.ErrorIs(t, err, ErrStale, "the tombstone should reject an older write")
+    stamp, ok := s.DeletedStamp("user2")
+    require.True(t, ok)
+    require.Equal(t, uint64(6), stamp)
+
+    _, err = s.DeleteStamped("user3", 8)
+    require.NoError(t, err, "a missing key should get a tombstone too")
+    _, err = s.SetStamped("user3", "Grace", 0, 9)
+    require.NoError(t, err, "a newer write should replace the tombstone")
+    _, ok = s.DeletedStamp("user3")
+    require.False(t, ok)
+    require.NoError(t, logFile.Close())
+
+    logFile, err = txlog.NewFileLog(logPath)
+    require.NoError(t, err)
+    defer logFile.Close()
+
+    restored, _, err := NewStoreFromLog(logFile, logPath)
+    require.NoError(t, err)
+
+    entry, ok = restored.GetEntry("user1")
+    require.True(t, ok)
+    require.Equal(t, uint64(30), entry.Stamp, "the stamp should be replayed from the log")
+    require.False(t, entry.ExpiresAt.IsZero())
+
+    stamp, ok = restored.DeletedStamp("user2")
+    require.True(t, ok, "the tombstone should be replayed from the log")
+    require.Equal(t, uint64(6), stamp)
+
+    _, data, tombs, err := decodeSnapshot(encodeSnapshot(1, restored.clone(), restored.cloneTombstones()))
+    require.NoError(t, err)
+    require.Equal(t, entry, data["user1"], "the stamp should survive a snapshot")
+    require.Equal(t, restored.cloneTombstones(), tombs, "tombstones should survive a snapshot")
+    require.NotContains(t, data, "user2")
+
+    // The tombstone outlives a compaction until the grace period is over.
+    _, err = restored.Compact()
+    require.NoError(t, err)
+    _, ok = restored.DeletedStamp("user2")
+    require.True(t, ok)
+
+    restored.now = func() time.Time { return time.Now().Add(txlog.TombstoneGrace) }
+    _, err = restored.Compact()
+    require.NoError(t, err)
+    _, ok = restored.DeletedStamp("user2")
+    require.False(t, ok, "compaction after the grace period should drop the tombstone")
+}
+
+func TestStore_CompareAndSetConcurrent(t *testing.T) {
+    t.Helper()
+
+    logFile, err := txlog.NewFileLog(t.TempDir()+"/kv.log", txlog.WithDurability(txlog.DurabilityGroupCommit))
+    require.NoError(t, err)
+    defer logFile.Close()
+
+    s := NewStore(logFile)
+    _, err = s.Set("counter", "0")
+    require.NoError(t, err)
+
+    const workers, increments = 8, 25
+
+    errs := make(chan error, workers)
+    var wg sync.WaitGroup
+    for w := 0; w < workers; w++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+
+            for i := 0; i < increments; {
+                entry, _ := s.GetEntry("counter")
+                n, _ := strconv.Atoi(entry.Value)
+
+                _, err := s.SetIf("counter", strconv.Itoa(n+1), Condition{IfMatch: []uint64{entry.Version}})
+                if errors.Is(err, ErrPreconditionFailed) {
+                    continue
+                }
+                if err != nil {
+                    errs <- err
+                    return
+                }
+                i++
+            }
+        }()
+    }
+    wg.Wait()
+
+    close(errs)
+    for err := range errs {
+        require.NoError(t, err)
+    }
+
+    value, _ := s.Get("counter")
+    require.Equal(t, strconv.Itoa(workers*increments), value, "no increment should be lost")
+}
+
+func TestStore_Expiry(t *testing.T) {
+    t.Helper()
+
+    logPath := t.TempDir() + "/kv.log"
+
+    logFile, err := txlog.NewFileLog(logPath)
+    require.NoError(t, err)
+
+    now := time.Unix(1700000000, 0)
+    clock := func() time.Time { return now }
+
+    s := NewStore(logFile)
+    s.now = clock
+
+    _, err = s.SetWithTTL("session", "token", time.Minute, Condition{})
+    require.NoError(t, err)
+    _, err = s.SetWithTTL("cache", "page", time.Minute, Condition{})
+    require.NoError(t, err)
+    _, err = s.SetWithTTL("token", "abc", time.Hour, Condition{})
+    require.NoError(t, err)
+    _, err = s.Set("user1", "Alice")
+    require.NoError(t, err)
+
+    value, ok := s.Get("session")
+    require.True(t, ok, "key should exist before its TTL passes")
+    require.Equal(t, "token", value)
+
+    now = now.Add(2 * time.Minute)
+
+    _, ok = s.Get("session")
+    require.False(t, ok, "key should be expired lazily on Get")
+    require.Equal(t, uint64(1), s.ExpiredKeys())
+
+    _, err = s.SetIf("cache", "page2", Condition{IfNoneMatchAny: true})
+    require.NoError(t, err, "an expired key should count as missing for preconditions")
+
+    _, err = s.SetWithTTL("tmp", "1", time.Second, Condition{})
+    require.NoError(t, err)
+    now = now.Add(time.Minute)
+
+    removed, err := s.sweep()
+    require.NoError(t, err)
+    require.Equal(t, 1, removed, "sweeper should remove the expired key")
+    require.Equal(t, uint64(2), s.ExpiredKeys())
+    require.NoError(t, logFile.Close())
+
+    var expired []string
+    _, err = txlog.ReadFile(logPath, func(e txlog.Event) error {
+        if e.Op == txlog.OpExpire {
+            expired = append(expired, e.Key)
+        }
+        return nil
+    })
+    require.NoError(t, err)
+    require.Equal(t, []string{"session", "tmp"}, expired, "expirations should be logged")
+
+    logFile, err = txlog.NewFileLog(logPath)
+    require.NoError(t, err)
+    defer logFile.Close()
+
+    restored, _, err := NewStoreFromLog(logFile, logPath)
+    require.NoError(t, err)
+    restored.now = clock
+
+    _, ok = restored.Get("session")
+    require.False(t, ok)
+
+    entry, ok := restored.GetEntry("token")
+    require.True(t, ok)
+    require.True(t, entry.ExpiresAt.Equal(time.Unix(1700000000, 0).Add(time.Hour)), "expiry time should survive replay")
+
+    now = now.Add(time.Hour)
+    _, ok = restored.Get("token")
+    require.False(t, ok, "replayed TTL should still expire the key")
+}
+
+func TestStore_Scan(t *testing.T) {
+    t.Helper()
+
+    s := NewStore(&fakeLog{})
+
+    for _, key := range []string{"user/3", "user/1", "order/1", "user/2", "userx", "user/4"} {
+        _, err := s.Set(key, "v-"+key)
+        require.NoError(t, err)
+    }
+    _, err := s.Delete("user/4")
+    require.NoError(t, err)
+
+    keys := func(items []Item) []string {
+        var out []string
+        for _, item := range items {
+            out = append(out, item.Key)
+        }
+        return out
+    }
+
+    items, more := s.Scan("", "", 0)
+    require.Equal(t, []string{"order/1", "user/1", "user/2", "user/3", "userx"}, keys(items), "Scan should return all live keys in order")
+    require.False(t, more)
+    require.Equal(t, "v-user/1", items[1].Value)
+
+    items, more = s.Scan("user/", PrefixEnd("user/"), 2)
+    require.Equal(t, []string{"user/1", "user/2"}, keys(items), "Scan should stop at the limit")
+    require.True(t, more, "Scan should report that more keys follow")
+
+    items, more = s.Scan(items[1].Key+"\x00", PrefixEnd("user/"), 2)
+    require.Equal(t, []string{"user/3"}, keys(items), "next page should start after the last key")
+    require.False(t, more)
+
+    require.Equal(t, "", PrefixEnd("\xff\xff"))
+    require.Equal(t, "b", PrefixEnd("a\xff"))
+}
+
+func TestStore_ScanMatchesMap(t *testing.T) {
+    t.Helper()
+
+    s := NewStore(&fakeLog{})
+    want := make(map[string]bool)
+
+    rnd := rand.New(rand.NewPCG(1, 2))
+    for i := 0; i < 5000; i++ {
+        key := fmt.Sprintf("k%03d", rnd.IntN(500))
+        if rnd.IntN(3) == 0 {
+            _, err := s.Delete(key)
+            require.NoError(t, err)
+            delete(want, key)
+            continue
+        }
+
+        _, err := s.Set(key, "v")
+        require.NoError(t, err)
+        want[key] = true
+    }
+
+    var got []string
+    items, _ := s.Scan("", "", 0)
+    for _, item := range items {
+        got = append(got, item.Key)
+    }
+    require.Equal(t, slices.Sorted(maps.Keys(want)), got, "index should match the map after random writes")
+}
+
+func TestStore_ScanConsistentWithBatches(t *testing.T) {
+    t.Helper()
+
+    logFile, err := txlog.NewFileLog(t.TempDir() + "/kv.log")
+    require.NoError(t, err)
+    defer logFile.Close()
+
+    s := NewStore(logFile)
+
+    done := make(chan struct{})
+    var writeErr error
+    var wg sync.WaitGroup
+    wg.Add(1)
+    go func() {
+        defer wg.Done()
+
+        for i := 0; ; i++ {
+            select {
+            case <-done:
+                return
+            default:
+            }
+
+            value := strconv.Itoa(i)
+            _, err := s.Apply(Batch{
+                {Type: txlog.OpSet, Key: "pair/a", Value: value},
+                {Type: txlog.OpSet, Key: "pair/b", Value: value},
+            })
+            if err != nil {
+                writeErr = err
+                return
+            }
+        }
+    }()
+
+    for i := 0; i < 1000; i++ {
+        items, _ := s.Scan("pair/", PrefixEnd("pair/"), 0)
+        if len(items) == 2 {
+            require.Equal(t, items[0].Value, items[1].Value, "a page should never show half of a batch")
+        }
+    }
+
+    close(done)
+    wg.Wait()
+
+    require.NoError(t, writeErr)
+}
+
+// nopLog is a log that is safe for concurrent use and does no I/O, so that
+// benchmarks measure the store itself.
+type nopLog struct {
+    lsn atomic.Uint64
+}
+
+func (l *nopLog) Append(e txlog.Event) (uint64, error) {
+    return l.lsn.Add(1), nil
+}
+
+func (l *nopLog) Sync() error {
+    return nil
+}
+
+func (l *nopLog) Close() error {
+    return nil
+}
+
+func benchmarkKeys(n int) []string {
+    keys := make([]string, n)
+    for i := range keys {
+        keys[i] = fmt.Sprintf("user/%05d", i)
+    }
+    return keys
+}
+
+// BenchmarkStore_SetParallel compares a single shard, which behaves like a
+// store behind one lock, with the default number of shards.
+func BenchmarkStore_SetParallel(b *testing.B) {
+    keys := benchmarkKeys(4096)
+
+    for _, shards := range []int{1, defaultShards} {
+        b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+            s := newStore(&nopLog{}, shards)
+
+            var seed atomic.Uint64
+            b.RunParallel(func(pb *testing.PB) {
+                rnd := rand.New(rand.NewPCG(seed.Add(1), 0))
+                for pb.Next() {
+                    _, err := s.Set(keys[rnd.IntN(len(keys))], "value")
+                    if err != nil {
+                        b.Fatal(err)
+                    }
+                }
+            })
+        })
+    }
+}
+
+// BenchmarkStore_MixedParallel runs 90% reads and 10% writes.
+func BenchmarkStore_MixedParallel(b *testing.B) {
+    keys := benchmarkKeys(4096)
+
+    for _, shards := range []int{1, defaultShards} {
+        b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+            s := newStore(&nopLog{}, shards)
+            for _, key := range keys {
+                _, err := s.Set(key, "value")
+                if err != nil {
+                    b.Fatal(err)
+                }
+            }
+
+            var seed atomic.Uint64
+            b.RunParallel(func(pb *testing.PB) {
+                rnd := rand.New(rand.NewPCG(seed.Add(1), 0))
+                for pb.Next() {
+                    key := keys[rnd.IntN(len(keys))]
+                    if rnd.IntN(10) == 0 {
+                        _, err := s.Set(key, "value")
+                        if err != nil {
+                            b.Fatal(err)
+                        }
+                        continue
+                    }
+                    s.Get(key)
+                }
+            })
+        })
+    }
+}
+
+func TestStore_ReplayMatchesLiveState(t *testing.T) {
+    t.Helper()
+
+    logPath := t.TempDir() + "/kv.log"
+
+    logFile, err := txlog.NewFileLog(logPath, txlog.WithDurability(txlog.DurabilityGroupCommit))
+    require.NoError(t, err)
+
+    s := NewStore(logFile)
+
+    const workers, ops, keys = 8, 300, 8
+
+    errs := make(chan error, workers)
+    var wg sync.WaitGroup
+    for w := 0; w < workers; w++ {
+        wg.Add(1)
+        go func(w int) {
+            defer wg.Done()
+
+            rnd := rand.New(rand.NewPCG(uint64(w), 1))
+            for i := 0; i < ops; i++ {
+                key := fmt.Sprintf("key%d", rnd.IntN(keys))
+                value := fmt.Sprintf("w%d-%d", w, i)
+
+                var err error
+                switch rnd.IntN(4) {
+                case 0:
+                    _, err = s.Delete(key)
+                case 1:
+                    entry, _ := s.GetEntry(key)
+                    _, err = s.SetIf(key, value, Condition{IfMatch: []uint64{entry.Version}})
+                    if errors.Is(err, ErrPreconditionFailed) {
+                        err = nil
+                    }
+                case 2:
+                    _, err = s.Apply(Batch{
+                        {Type: txlog.OpSet, Key: key, Value: value},
+                        {Type: txlog.OpSet, Key: fmt.Sprintf("key%d", rnd.IntN(keys)), Value: value},
+                    })
+                default:
+                    _, err = s.Set(key, value)
+                }
+                if err != nil {
+                    errs <- err
+                    return
+                }
+            }
+        }(w)
+    }
+    wg.Wait()
+
+    close(errs)
+    for err := range errs {
+        require.NoError(t, err)
+    }
+
+    live := s.clone()
+    require.NoError(t, logFile.Close())
+
+    logFile, err = txlog.NewFileLog(logPath)
+    require.NoError(t, err)
+    defer logFile.Close()
+
+    restored, _, err := NewStoreFromLog(logFile, logPath)
+    require.NoError(t, err)
+    require.Equal(t, live, restored.clone(), "replaying the log should rebuild exactly the state that was served")
+}
+
+func TestStore_VisibilityFollowsLogOrder(t *testing.T) {
+    t.Helper()
+
+    logFile, err := txlog.NewFileLog(t.TempDir()+"/kv.log", txlog.WithDurability(txlog.DurabilityGroupCommit))
+    require.NoError(t, err)
+    defer logFile.Close()
+
+    s := NewStore(logFile)
+
+    const workers, ops = 8, 200
+
+    errs := make(chan error, workers)
+    var wg sync.WaitGroup
+    for w := 0; w < workers; w++ {
+        wg.Add(1)
+        go func(w int) {
+            defer wg.Done()
+
+            for i := 0; i < ops; i++ {
+                _, err := s.Set(fmt.Sprintf("w%d/%04d", w, i), "v")
+                if err != nil {
+                    errs <- err
+                    return
+                }
+            }
+        }(w)
+    }
+
+    done := make(chan struct{})
+    go func() {
+        wg.Wait()
+        close(done)
+    }()
+
+    // Every record sets a new key, so the versions visible at any moment
+    // must be exactly 1..n: a gap would mean a record became visible
+    // before an earlier one.
+    for finished := false; !finished; {
+        select {
+        case <-done:
+            finished = true
+        default:
+        }
+
+        items, _ := s.Scan("", "", 0)
+
+        versions := make([]uint64, 0, len(items))
+        for _, item := range items {
+            versions = append(versions, item.Version)
+        }
+        slices.Sort(versions)
+
+        for i, version := range versions {
+            require.Equal(t, uint64(i+1), version, "visible writes should form a prefix of the log")
+        }
+    }
+
+    close(errs)
+    for err := range errs {
+        require.NoError(t, err)
+    }
+    require.Equal(t, workers*ops, s.Len())
+}
+
+func TestStore_Subscribe(t *testing.T) {
+    t.Helper()
+
+    logFile, err := txlog.NewFileLog(t.TempDir() + "/kv.log")
+    require.NoError(t, err)
+    defer logFile.Close()
+
+    s := NewStore(logFile)
+
+    sub := s.Subscribe(10)
+
+    _, err = s.Set("a", "1")
+    require.NoError(t, err)
+    _, err = s.Apply(Batch{{Type: txlog.OpSet, Key: "b", Value: "2"}, {Type: txlog.OpDelete, Key: "a"}})
+    require.NoError(t, err)
+
+    var lsns []uint64
+    for i := 0; i < 3; i++ {
+        e := <-sub.Events()
+        lsns = append(lsns, e.LSN)
+    }
+    require.Equal(t, []uint64{1, 2, 3}, lsns, "events should arrive in LSN order")
+    require.Equal(t, uint64(3), s.AppliedLSN())
+
+    sub.Close()
+    _, ok := <-sub.Events()
+    require.False(t, ok, "Close should close the channel")
+    require.NoError(t, sub.Err())
+
+    slow := s.Subscribe(2)
+    for i := 0; i < 3; i++ {
+        _, err = s.Set("c", strconv.Itoa(i))
+        require.NoError(t, err)
+    }
+
+    <-slow.Events()
+    <-slow.Events()
+    _, ok = <-slow.Events()
+    require.False(t, ok, "a full subscription should be dropped")
+    require.ErrorIs(t, slow.Err(), ErrSubscriberBehind)
+}
+
+func TestStore_ApplyReplicated(t *testing.T) {
+    t.Helper()
+
+    logPath := t.TempDir() + "/replica.log"
+
+    logFile, err := txlog.NewFileLog(logPath)
+    require.NoError(t, err)
+
+    s := NewStore(logFile)
+    s.SetReadOnly(true)
+
+    now := time.Now()
+    s.now = func() time.Time { return now }
+
+    _, err = s.Set("a", "1")
+    require.ErrorIs(t, err, ErrReadOnly, "a read-only store should reject writes")
+    _, err = s.Apply(Batch{{Type: txlog.OpSet, Key: "a", Value: "1"}})
+    require.ErrorIs(t, err, ErrReadOnly)
+
+    // A compacted leader log has gaps between LSNs.
+    events := []txlog.Event{
+        {Key: "a", Value: "1", Op: txlog.OpSet, LSN: 3},
+        {Key: "b", Value: "2", Op: txlog.OpSet, LSN: 7},
+        {Key: "session", Value: "s", Op: txlog.OpSet, LSN: 8, ExpiresAt: now.Add(time.Second)},
+        {Key: "a", Op: txlog.OpDelete, LSN: 9},
+    }
+    for _, e := range events {
+        require.NoError(t, s.ApplyReplicated(e))
+    }
+
+    err = s.ApplyReplicated(txlog.Event{Key: "c", Value: "3", Op: txlog.OpSet, LSN: 9})
+    require.ErrorIs(t, err, txlog.ErrLSNOutOfOrder, "records must come in LSN order")
+
+    entry, ok := s.GetEntry("b")
+    require.True(t, ok)
+    require.Equal(t, uint64(7), entry.Version, "versions should be the leader's LSNs")
+    _, ok = s.GetEntry("a")
+    require.False(t, ok)
+    require.Equal(t, uint64(9), s.AppliedLSN())
+
+    now = now.Add(2 * time.Second)
+    _, ok = s.GetEntry("session")
+    require.False(t, ok, "an expired key should be hidden")
+    require.Equal(t, 2, s.Len(), "a follower should leave the expiry to the leader")
+
+    require.NoError(t, s.ApplyReplicated(txlog.Event{Key: "session", Op: txlog.OpExpire, LSN: 10}))
+    require.Equal(t, uint64(1), s.ExpiredKeys())
+    require.NoError(t, logFile.Close())
+
+    logFile, err = txlog.NewFileLog(logPath)
+    require.NoError(t, err)
+    defer logFile.Close()
+
+    restored, _, err := NewStoreFromLog(logFile, logPath)
+    require.NoError(t, err)
+    require.Equal(t, uint64(10), restored.AppliedLSN(), "a restarted follower should resume after its last record")
+    require.Equal(t, s.clone(), restored.clone())
+}
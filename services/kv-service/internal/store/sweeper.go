@@ -0,0 +1,89 @@
+package store
+
+import (
+	"sync"
+	"time"
+
+	"github.com/alexey-y-a/go-txlog-microservices/libs/logger"
+)
+
+// Expired reports whether a key that expires at expiresAt has expired at
+// now. A zero expiresAt never expires.
+func Expired(expiresAt, now time.Time) bool {
+	return !expiresAt.IsZero() && !now.Before(expiresAt)
+}
+
+// ExpireKeys calls expire for every key found expired by a sweep and returns
+// how many of them it removed. It stops at the first error.
+func ExpireKeys(keys []string, expire func(key string) (bool, error)) (int, error) {
+	removed := 0
+	for _, key := range keys {
+		ok, err := expire(key)
+		if err != nil {
+			return removed, err
+		}
+		if ok {
+			removed++
+		}
+	}
+
+	return removed, nil
+}
+
+// Sweeper runs the expiry sweep of a store or an engine in the background,
+// so that keys that are never read again do not stay around.
+type Sweeper struct {
+	stop     chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+// StartSweeper calls sweep every interval until Stop, logging its errors
+// and the keys it removed under component.
+func StartSweeper(interval time.Duration, component string, sweep func() (int, error)) *Sweeper {
+	s := &Sweeper{
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+
+	go s.run(interval, component, sweep)
+
+	return s
+}
+
+// Stop stops the sweeper and waits for a running sweep to finish. It does
+// nothing on a nil or already stopped Sweeper.
+func (s *Sweeper) Stop() {
+	if s == nil {
+		return
+	}
+
+	s.stopOnce.Do(func() {
+		close(s.stop)
+	})
+	<-s.done
+}
+
+func (s *Sweeper) run(interval time.Duration, component string, sweep func() (int, error)) {
+	defer close(s.done)
+
+	log := logger.L().With().Str("component", component).Logger()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			n, err := sweep()
+			if err != nil {
+				log.Error().Err(err).Msg("expiry sweep failed")
+			}
+			if n > 0 {
+				log.Debug().Int("keys", n).Msg("expired keys removed")
+			}
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package store
+
+import (
+	"errors"
+	"slices"
+	"time"
+
+	"github.com/alexey-y-a/go-txlog-microservices/libs/logger"
+	"github.com/alexey-y-a/go-txlog-microservices/libs/txlog"
+)
+
+var ErrPreconditionFailed = errors.New("store: precondition failed")
+
+// Entry is a stored value with its version: the LSN of the log record that
+// wrote it.
+type Entry struct {
+	Value   string
+	Version uint64
+	// ExpiresAt is zero for keys without a TTL.
+	ExpiresAt time.Time
+	// Stamp is the stamp of the write, zero for writes without one.
+	Stamp uint64
+}
+
+func (e Entry) expired(now time.Time) bool {
+	return Expired(e.ExpiresAt, now)
+}
+
+// Condition is a precondition on the current state of a key, checked
+// atomically with a write. The zero Condition always holds.
+type Condition struct {
+	// IfMatch requires the key to exist with one of the versions, or with
+	// any version if IfMatchAny is set. A non-nil empty IfMatch never holds.
+	IfMatch    []uint64
+	IfMatchAny bool
+	// IfNoneMatch requires the key not to have any of the versions, or not
+	// to exist at all if IfNoneMatchAny is set.
+	IfNoneMatch    []uint64
+	IfNoneMatchAny bool
+}
+
+// Holds reports whether c holds for a key with the given version, or for a
+// missing key if exists is false.
+func (c Condition) Holds(version uint64, exists bool) bool {
+	if c.IfMatchAny || c.IfMatch != nil {
+		if !exists || (!c.IfMatchAny && !slices.Contains(c.IfMatch, version)) {
+			return false
+		}
+	}
+
+	if exists && (c.IfNoneMatchAny || slices.Contains(c.IfNoneMatch, version)) {
+		return false
+	}
+
+	return true
+}
+
+// GetEntry returns the entry of key. An expired key is reported as missing
+// and its expiry is logged right away.
+func (s *Store) GetEntry(key string) (Entry, bool) {
+	entry, ok := s.get(key)
+
+	if ok && !entry.ExpiresAt.IsZero() && entry.expired(s.now()) {
+		_, err := s.expire(key)
+		if err != nil {
+			log := logger.L().With().Str("component", "store").Logger()
+			log.Warn().Err(err).Str("key", key).Msg("failed to log expired key")
+		}
+		return Entry{}, false
+	}
+
+	return entry, ok
+}
+
+// SetIf is Set guarded by cond; it fails with ErrPreconditionFailed if cond
+// does not hold.
+func (s *Store) SetIf(key, value string, cond Condition) (uint64, error) {
+	return s.SetWithTTL(key, value, 0, cond)
+}
+
+// DeleteIf is Delete guarded by cond.
+func (s *Store) DeleteIf(key string, cond Condition) (uint64, error) {
+	return s.write(txlog.Event{
+		Key: key,
+		Op:  txlog.OpDelete,
+	}, cond)
+}